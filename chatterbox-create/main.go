@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"path/filepath"
 
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/proto"
@@ -10,6 +12,79 @@ import (
 
 var root = flag.String("root", "", "chatterbox root directory")
 var subject = flag.String("subject", "", "used to refer to the conversation")
+var deliveryReceipts = flag.Bool("delivery-receipts", true, "tell the other participants when their messages have been received")
+var readReceipts = flag.Bool("read-receipts", false, "tell the other participants when their messages have been read")
+var retention = flag.Duration("retention", 0, "delete the messages of the conversation once they are older than this; 0 uses the setting of the account")
+var keep = flag.Bool("keep", false, "never delete the messages of the conversation because of their age")
+var disappear = flag.Duration("disappear", 0, "make the messages we send in the conversation disappear this long after each participant has received them; 0 turns it off")
+var add = flag.String("add", "", "add this user to the existing conversation")
+var remove = flag.String("remove", "", "remove this user from the existing conversation")
+
+// existingConversation returns the directory of the conversation that
+// metadata describes if it is in the conversations directory already, or ""
+// otherwise. We are a participant of it, but not on the command line.
+func existingConversation(p *persistence.Paths, metadata *proto.ConversationMetadata) (string, error) {
+	convs, err := p.ListConversations()
+	if err != nil {
+		return "", err
+	}
+	participants := make(map[string]bool)
+	for _, name := range metadata.Participants {
+		participants[name] = true
+	}
+	for _, conv := range convs {
+		if conv.Subject != metadata.Subject {
+			continue
+		}
+		others := 0
+		for _, name := range conv.Participants {
+			if !participants[name] {
+				others++
+			}
+		}
+		if others <= 1 && len(conv.Participants)-others == len(participants) {
+			convName, err := p.ConversationDirName(conv)
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(p.ConversationDir(), convName), nil
+		}
+	}
+	return "", nil
+}
+
+// applySettings sets the settings that were given on the command line in
+// metadata and tells whether there were any
+func applySettings(metadata *proto.ConversationMetadata) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "delivery-receipts":
+			metadata.DeliveryReceipts = deliveryReceipts
+		case "read-receipts":
+			metadata.ReadReceipts = readReceipts
+		case "retention":
+			metadata.Retention = int64(*retention)
+		case "keep":
+			metadata.Keep = *keep
+		case "disappear":
+			metadata.MessageLifetime = int64(*disappear)
+		default:
+			return
+		}
+		set = true
+	})
+	return set
+}
+
+// createConversation creates the outbox directory of a new conversation and
+// prints its path, where the messages to send in it go
+func createConversation(p *persistence.Paths, metadata *proto.ConversationMetadata) {
+	if err := p.ConversationToOutbox(metadata); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(filepath.Join(p.OutboxDir(), persistence.OutboxName(metadata)))
+}
 
 func main() {
 	flag.Parse()
@@ -26,8 +101,46 @@ func main() {
 		Participants: flag.Args(),
 		Subject:      *subject,
 	}
+	if *add != "" || *remove != "" {
+		dir, err := existingConversation(p, metadata)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dir == "" {
+			log.Fatal("no such conversation")
+		}
+		if *add != "" {
+			if err := p.ChangeMembership(filepath.Base(dir), *add, persistence.MembershipAdd); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *remove != "" {
+			if err := p.ChangeMembership(filepath.Base(dir), *remove, persistence.MembershipRemove); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	if !applySettings(metadata) {
+		createConversation(p, metadata)
+		return
+	}
 
-	if err := p.ConversationToOutbox(metadata); err != nil {
+	// change the settings of the conversation if it exists already
+	dir, err := existingConversation(p, metadata)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dir == "" {
+		createConversation(p, metadata)
+		return
+	}
+	existing, err := persistence.ReadConversationMetadata(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	applySettings(existing)
+	if err := p.WriteConversationMetadata(dir, existing); err != nil {
 		log.Fatal(err)
 	}
 }
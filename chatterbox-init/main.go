@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/andres-erbsen/chatterbox/client"
 	"github.com/andres-erbsen/chatterbox/client/daemon"
 )
 
@@ -35,7 +36,10 @@ func main() {
 	}
 	flag.Var((*hex32Byte)(&serverTransportPubkey), "server-pubkey", "The TCP port which the server listens on. Note that people sending you mesages expct to be able to reach your home server at port 1984.")
 	serverAddress := flag.String("server-host", "chatterbox.xvm.mit.edu", "The IP address or hostname on which your (prospective) home server server can be reached")
+	serverOnion := flag.String("server-onion", "", "The onion service address of your home server, if it has one. Clients that use Tor will connect to it instead of server-host.")
 	serverPort := flag.Int("server-port", 1984, "The TCP port which the server listens on.")
+	torAddr := flag.String("tor", client.DefaultTorAddress, "Address of the Tor SOCKS5 proxy.")
+	noTor := flag.Bool("dangerous-no-tor", false, "Connect to the server directly, revealing your IP address to it.")
 	dir := flag.String("account-directory", "", "Dedicated directory for the account.")
 	flag.Parse()
 
@@ -47,7 +51,11 @@ func main() {
 		*dir = filepath.Join(os.Getenv("HOME"), ".chatterbox", *dename)
 	}
 
-	if err := daemon.Init(*dir, *dename, *serverAddress, *serverPort, &serverTransportPubkey); err != nil {
+	var dialer client.Dialer = client.NewTorDialer(*torAddr, client.IsolateConnection)
+	if *noTor {
+		dialer = client.DirectDialer{}
+	}
+	if err := daemon.Init(*dir, *dename, *serverAddress, *serverOnion, *serverPort, &serverTransportPubkey, dialer); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("Account initialization done.\n"+
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/andres-erbsen/chatterbox/client/daemon"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+)
+
+func main() {
+	passphraseFd := flag.Int("passphrase-fd", -1, "Read the current passphrase (if there is one) and then the new one twice, one per line, from this file descriptor instead of prompting for them.")
+	encryptConversations := flag.Bool("encrypt-conversations", false, "Instead of changing the passphrase, encrypt the messages in the conversations directory with it, now and in the future.")
+	decryptConversations := flag.Bool("decrypt-conversations", false, "Instead of changing the passphrase, store the messages in the conversations directory in plaintext again.")
+	flag.Parse()
+	if flag.NArg() != 1 || *encryptConversations && *decryptConversations {
+		log.Fatalf("USAGE: %s [flags] <account-directory>\n"+
+			"Sets, changes or (given an empty new passphrase) removes the passphrase that protects the keys of the account. "+
+			"chatterboxd must not be running.", os.Args[0])
+	}
+	dir := flag.Arg(0)
+
+	var oldPassphrase []byte
+	hasPassphrase, err := (&persistence.Paths{RootDir: dir}).HasPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := persistence.PassphraseReader(*passphraseFd)
+	if hasPassphrase {
+		if oldPassphrase, err = persistence.ReadPassphrase(r, "Current passphrase: "); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *encryptConversations || *decryptConversations {
+		if err := daemon.EncryptConversations(dir, oldPassphrase, *encryptConversations); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	newPassphrase, err := persistence.ReadPassphrase(r, "New passphrase: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	confirmation, err := persistence.ReadPassphrase(r, "Repeat new passphrase: ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !bytes.Equal(newPassphrase, confirmation) {
+		log.Fatal("the passphrases do not match")
+	}
+	if err := daemon.ChangePassphrase(dir, oldPassphrase, newPassphrase); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,27 +3,35 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
 	"gopkg.in/fsnotify.v1"
 	"gopkg.in/qml.v1"
 )
 
 var root = flag.String("root", "", "chatterbox root directory")
+var passphraseFd = flag.Int("passphrase-fd", -1, "Read the passphrase of the account from this file descriptor instead of prompting for it.")
 
 type gui struct {
 	persistence.Paths
 	engine *qml.Engine
 
 	conversations        []*proto.ConversationMetadata
+	conversationNames    []string
 	conversationsIndex   map[string]int
 	conversationsDisplay qml.Object
 
@@ -31,6 +39,10 @@ type gui struct {
 
 	openConversations map[string]*qml.Window
 
+	// decrypted copies of attachments, shredded when the gui exits
+	plaintextCopies   []string
+	plaintextCopiesMu sync.Mutex
+
 	stop chan struct{}
 }
 
@@ -51,13 +63,27 @@ func main() {
 			Application: "qmlgui",
 		},
 	}
-	var err error
+	hasPassphrase, err := g.HasPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hasPassphrase {
+		passphrase, err := persistence.ReadPassphrase(persistence.PassphraseReader(*passphraseFd), "Passphrase: ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := g.Unlock(passphrase); err != nil {
+			log.Fatal(err)
+		}
+	}
 	g.watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
 	}
 	go g.watch()
-	if err := qml.Run(g.run); err != nil {
+	err = qml.Run(g.run)
+	g.shredPlaintextCopies()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(2)
 	}
@@ -94,7 +120,7 @@ func (g *gui) newConversation() error {
 		if err := g.ConversationToOutbox(conv); err != nil {
 			log.Printf("failed to create conversation (maybe already sent?): %s", err)
 		}
-		if err := g.MessageToOutbox(persistence.ConversationName(conv), message); err != nil {
+		if err := g.MessageToOutbox(persistence.OutboxName(conv), message); err != nil {
 			log.Printf("failed to send message (maybe already sent?): %s", err)
 		}
 		window.Call("closeWindow") //overriding native "close" b/c of weird errors
@@ -105,7 +131,7 @@ func (g *gui) newConversation() error {
 
 func (g *gui) handleMessage(path string) {
 	convName := filepath.Base(filepath.Dir(path))
-	msg, err := persistence.ReadMessageFromFile(path)
+	msg, err := g.ReadMessageFromFile(path)
 	if err != nil {
 		log.Printf("error reading message %s: %s\n", path, err)
 		return
@@ -121,15 +147,176 @@ func (g *gui) handleMessage(path string) {
 	g.displayMessage(win, msg)
 }
 
+// displayedMessage is a message in the conversation view
+type displayedMessage struct {
+	persistence.Message
+	Status  string
+	Expires string
+	// for attachments, the name the sender gave the file, and for images a
+	// URL that the view can load them from
+	Filename    string
+	ImageSource string
+	// hex-encoded ids of the message and of the message it replies to, if
+	// they are known
+	Id        string
+	InReplyTo string
+	// "edited" or "deleted" if it has been, see persistence.RevisedPath
+	Revision string
+	// whether we sent it, and can edit or delete it
+	Ours bool
+}
+
+// plaintextFile returns the path of a file with the contents of the message at
+// path that other programs can read: the message itself, or if it has been
+// sealed, a decrypted copy in the temporary directory
+func (g *gui) plaintextFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	contents, sealed := persistence.OpenAllowingPlaintext(contents, g.StorageKey)
+	if !sealed {
+		return path, nil
+	}
+	dir, err := g.MkdirInTemp()
+	if err != nil {
+		return "", err
+	}
+	g.plaintextCopiesMu.Lock()
+	g.plaintextCopies = append(g.plaintextCopies, dir)
+	g.plaintextCopiesMu.Unlock()
+	copyPath := filepath.Join(dir, filepath.Base(path))
+	return copyPath, ioutil.WriteFile(copyPath, contents, 0600)
+}
+
+func (g *gui) shredPlaintextCopies() {
+	g.plaintextCopiesMu.Lock()
+	defer g.plaintextCopiesMu.Unlock()
+	for _, dir := range g.plaintextCopies {
+		shred.RemoveAll(dir)
+	}
+	g.plaintextCopies = nil
+}
+
+// openAttachment opens the attachment at path with the default application
+// for its type
+func (g *gui) openAttachment(path string) {
+	plaintext, err := g.plaintextFile(path)
+	if err != nil {
+		log.Printf("error opening %s: %s\n", path, err)
+		return
+	}
+	if err := exec.Command("xdg-open", plaintext).Start(); err != nil {
+		log.Printf("error opening %s: %s\n", path, err)
+	}
+}
+
+// expiry tells when the message at path in a conversation directory is going
+// to disappear, if it is
+func (g *gui) expiry(path string) string {
+	expiry, err := persistence.ReadExpiry(g.ExpiryPath(filepath.Base(filepath.Dir(path)), filepath.Base(path)))
+	if err != nil {
+		return ""
+	}
+	return "disappears " + expiry.Local().Format("Jan 2 15:04")
+}
+
+// messageId reads the hex-encoded id of a message from path, or returns "" if
+// it has none
+func messageId(path string) string {
+	id, err := persistence.ReadId(path)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// deliveryStatus summarizes the delivery status of the message at path in a
+// conversation directory for the conversation view
+func (g *gui) deliveryStatus(path string) string {
+	convName, msgName := filepath.Base(filepath.Dir(path)), filepath.Base(path)
+	statuses, err := persistence.ReadDeliveryStatus(g.StatusPath(convName, msgName))
+	if err != nil {
+		return "" // not sent by us, or not yet seen by the daemon
+	}
+	chunks := make(map[string]string)
+	if progress, err := persistence.ReadProgress(g.ProgressPath(convName, msgName)); err == nil {
+		for _, p := range progress {
+			chunks[p.Name] = fmt.Sprintf(" %d/%d", p.Done, p.Total)
+		}
+	}
+	summary := make([]string, 0, len(statuses))
+	for _, s := range statuses {
+		if s.Reason != "" {
+			summary = append(summary, fmt.Sprintf("%s: %s%s (%s)", s.Recipient, s.Status, chunks[s.Recipient], s.Reason))
+		} else {
+			summary = append(summary, s.Recipient+": "+s.Status+chunks[s.Recipient])
+		}
+	}
+	return strings.Join(summary, ", ")
+}
+
+func (g *gui) handleStatus(path string) {
+	convName := filepath.Base(filepath.Dir(path))
+	msgPath := filepath.Join(g.ConversationDir(), convName, filepath.Base(path))
+	status := g.deliveryStatus(msgPath)
+
+	qml.Lock()
+	defer qml.Unlock()
+	if win, ok := g.openConversations[convName]; ok {
+		win.ObjectByName("messageModel").Call("setStatus", msgPath, status)
+	}
+}
+
+// handleRemoved takes a message that has been deleted, for example because it
+// has disappeared, out of its conversation view
+func (g *gui) handleRemoved(path string) {
+	qml.Lock()
+	defer qml.Unlock()
+	if win, ok := g.openConversations[filepath.Base(filepath.Dir(path))]; ok {
+		win.ObjectByName("messageModel").Call("removeItem", path)
+	}
+}
+
 func (g *gui) displayMessage(window *qml.Window, msg *persistence.Message) {
-	window.ObjectByName("messageModel").Call("addItem", toJson(
-		&persistence.Message{
-			Path:    msg.Path,
-			Content: strings.TrimSpace(msg.Content),
-			Sender:  msg.Sender,
-		}))
+	displayed := &displayedMessage{
+		Message: persistence.Message{
+			Path:        msg.Path,
+			Content:     strings.TrimSpace(msg.Content),
+			Sender:      msg.Sender,
+			ContentType: msg.ContentType,
+			Clock:       msg.Clock,
+		},
+		Status:    g.deliveryStatus(msg.Path),
+		Expires:   g.expiry(msg.Path),
+		Id:        messageId(g.IdPath(filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path))),
+		InReplyTo: messageId(g.ReplyPath(filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path))),
+	}
+	convName, msgName := filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path)
+	displayed.Revision, _, _ = persistence.ReadRevision(g.RevisedPath(convName, msgName))
+	if _, err := os.Stat(g.StatusPath(convName, msgName)); err == nil {
+		displayed.Ours = true
+	}
+	if msg.ContentType != "" && displayed.Revision != persistence.RevisionDeleted {
+		displayed.Content = ""
+		displayed.Filename, _ = g.ReadFilename(filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path))
+		if displayed.Filename == "" {
+			displayed.Filename = filepath.Base(msg.Path)
+		}
+		if strings.HasPrefix(msg.ContentType, "image/") {
+			if plaintext, err := g.plaintextFile(msg.Path); err == nil {
+				displayed.ImageSource = (&url.URL{Scheme: "file", Path: plaintext}).String()
+			}
+		}
+	}
+	window.ObjectByName("messageModel").Call("addItem", toJson(displayed))
 	// TODO: only do this if the view was at the end before adding the new item
 	window.ObjectByName("messageView").Call("positionViewAtEnd")
+	if msg.Sender != persistence.NoticeSender {
+		if err := g.MarkRead(filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path)); err != nil {
+			log.Printf("marking %s read: %s\n", msg.Path, err)
+		}
+	}
 }
 
 func (g *gui) openConversation(idx int) error {
@@ -140,11 +327,12 @@ func (g *gui) openConversation(idx int) error {
 	window := controls.CreateWindow(nil)
 
 	conv := g.conversations[idx]
+	convName := g.conversationNames[idx]
 
 	//TODO: if an open conversation is selected again, focus that window
 
 	qml.Lock()
-	g.openConversations[persistence.ConversationName(conv)] = window
+	g.openConversations[convName] = window
 	qml.Unlock()
 
 	msgs, err := g.LoadMessages(conv)
@@ -157,15 +345,63 @@ func (g *gui) openConversation(idx int) error {
 	window.ObjectByName("messageView").Call("positionViewAtEnd")
 
 	window.On("sendMessage", func(message string) {
-		err := g.MessageToOutbox(persistence.ConversationName(conv), message)
+		err := g.MessageToOutbox(convName, message)
 		if err != nil {
 			log.Fatal(err)
 		}
 	})
 
+	window.On("sendReply", func(message, inReplyTo string) {
+		id, err := hex.DecodeString(inReplyTo)
+		if err != nil {
+			log.Printf("not replying to %q: %s\n", inReplyTo, err)
+			return
+		}
+		if err := g.ReplyToOutbox(convName, message, id); err != nil {
+			log.Fatal(err)
+		}
+	})
+
+	window.On("editMessage", func(path, contents string) {
+		if err := g.EditMessage(convName, filepath.Base(path), contents); err != nil {
+			log.Printf("failed to edit %s: %s\n", path, err)
+		}
+	})
+
+	window.On("deleteMessage", func(path string) {
+		if err := g.DeleteMessage(convName, filepath.Base(path)); err != nil {
+			log.Printf("failed to delete %s: %s\n", path, err)
+		}
+	})
+
+	window.On("sendFile", func(fileURL string) {
+		u, err := url.Parse(fileURL)
+		if err != nil {
+			log.Printf("not sending %s: %s\n", fileURL, err)
+			return
+		}
+		if err := g.FileToOutbox(convName, u.Path); err != nil {
+			log.Printf("failed to send %s: %s\n", u.Path, err)
+		}
+	})
+
+	window.On("openAttachment", g.openAttachment)
+
+	window.On("addParticipant", func(name string) {
+		if err := g.ChangeMembership(convName, strings.TrimSpace(name), persistence.MembershipAdd); err != nil {
+			log.Printf("failed to add %s: %s\n", name, err)
+		}
+	})
+
+	window.On("removeParticipant", func(name string) {
+		if err := g.ChangeMembership(convName, strings.TrimSpace(name), persistence.MembershipRemove); err != nil {
+			log.Printf("failed to remove %s: %s\n", name, err)
+		}
+	})
+
 	window.On("closing", func() {
 		qml.Lock()
-		delete(g.openConversations, persistence.ConversationName(conv))
+		delete(g.openConversations, convName)
 		qml.Unlock()
 	})
 
@@ -182,12 +418,16 @@ func (g *gui) run() error {
 
 	window := controls.CreateWindow(nil)
 	g.conversationsDisplay = window.ObjectByName("listModel")
-	convs, err := g.ListConversations()
+	convDirs, err := ioutil.ReadDir(g.ConversationDir())
 	if err != nil {
 		return err
 	}
-	for _, con := range convs {
-		g.handleConversation(con)
+	for _, fi := range convDirs {
+		con, err := persistence.ReadConversationMetadata(filepath.Join(g.ConversationDir(), fi.Name()))
+		if err != nil {
+			return err
+		}
+		g.handleConversation(fi.Name(), con)
 	}
 
 	window.ObjectByName("table").On("activated", g.openConversation)
@@ -198,21 +438,23 @@ func (g *gui) run() error {
 	return nil
 }
 
-func (g *gui) handleConversation(con *proto.ConversationMetadata) {
-	if _, already := g.conversationsIndex[persistence.ConversationName(con)]; already {
+// handleConversation lists the conversation in the directory convName
+func (g *gui) handleConversation(convName string, con *proto.ConversationMetadata) {
+	if _, already := g.conversationsIndex[convName]; already {
 		return
 	}
 
-	err := g.watcher.Add(filepath.Join(g.ConversationDir(), persistence.ConversationName(con)))
+	err := g.watcher.Add(filepath.Join(g.ConversationDir(), convName))
 	if err != nil {
-		log.Printf("error watching conversation %s: %s\n", persistence.ConversationName(con), err)
+		log.Printf("error watching conversation %s: %s\n", convName, err)
 		// continue after error
 	}
 
 	qml.Lock()
 	defer qml.Unlock()
-	g.conversationsIndex[persistence.ConversationName(con)] = len(g.conversations)
+	g.conversationsIndex[convName] = len(g.conversations)
 	g.conversations = append(g.conversations, con)
+	g.conversationNames = append(g.conversationNames, convName)
 	g.conversationsDisplay.Call("addItem", toJson(con))
 }
 
@@ -222,6 +464,26 @@ func (g *gui) watch() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the status and progress files of messages are kept in a directory per
+	// conversation
+	statusDirs := []string{g.StatusDir(), g.ProgressDir()}
+	for _, dir := range statusDirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		if err := g.watcher.Add(dir); err != nil {
+			log.Fatal(err)
+		}
+		convDirs, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, fi := range convDirs {
+			if err := g.watcher.Add(filepath.Join(dir, fi.Name())); err != nil {
+				log.Printf("error watching status of %s: %s\n", fi.Name(), err)
+			}
+		}
+	}
 	for {
 		select {
 		case <-g.stop:
@@ -229,14 +491,40 @@ func (g *gui) watch() {
 		case err := <-g.watcher.Errors:
 			fmt.Println("error:", err)
 		case e := <-g.watcher.Events:
-			rpath, err := filepath.Rel(g.ConversationDir(), e.Name)
-			if err != nil {
-				panic(err)
+			if e.Op == fsnotify.Remove {
+				if rpath, err := filepath.Rel(g.ConversationDir(), e.Name); err == nil {
+					if match, _ := filepath.Match("*/*", rpath); match {
+						g.handleRemoved(e.Name)
+					}
+				}
+				continue
 			}
 			if !(e.Op == fsnotify.Create || e.Op == fsnotify.Rename) {
 				// TODO: handle move, delete
 				continue
 			}
+			handled := false
+			for _, dir := range statusDirs {
+				if rpath, err := filepath.Rel(dir, e.Name); err == nil && !strings.HasPrefix(rpath, "..") {
+					// status and progress files are replaced atomically, so
+					// they are created
+					if match, _ := filepath.Match("*", rpath); match {
+						if err := g.watcher.Add(e.Name); err != nil {
+							log.Printf("error watching status of %s: %s\n", rpath, err)
+						}
+					} else {
+						g.handleStatus(e.Name)
+					}
+					handled = true
+				}
+			}
+			if handled {
+				continue
+			}
+			rpath, err := filepath.Rel(g.ConversationDir(), e.Name)
+			if err != nil {
+				panic(err)
+			}
 			if match, _ := filepath.Match("*", rpath); match {
 				// when a conversation is created it MUST have a metadata file when
 				// it is moved to the conversations directory
@@ -245,7 +533,7 @@ func (g *gui) watch() {
 					log.Printf("error reading metadata of %s: %s\n", rpath, err)
 					continue
 				}
-				g.handleConversation(c)
+				g.handleConversation(rpath, c)
 			} else if match, _ := filepath.Match("*/*", rpath); match {
 				g.handleMessage(e.Name)
 
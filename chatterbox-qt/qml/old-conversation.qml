@@ -1,11 +1,19 @@
 import QtQuick 2.2
 import QtQuick.Controls 1.1
 import QtQuick.Layouts 1.1
+import QtQuick.Dialogs 1.1
 
 
 ApplicationWindow {
 	id: conversationWindow
 	signal sendMessage(string message)
+	signal sendReply(string message, string inReplyTo)
+	signal editMessage(string path, string contents)
+	signal deleteMessage(string path)
+	signal sendFile(string fileURL)
+	signal openAttachment(string path)
+	signal addParticipant(string name)
+	signal removeParticipant(string name)
 
     visible: true
     title: "Conversation"
@@ -14,14 +22,60 @@ ApplicationWindow {
     height: mainLayout.implicitHeight + 2 * margin
     minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin
     minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin
+	// the id of the message that the next one replies to, if any
+	property string replyTo: ""
+	property string replyQuote: ""
+	// the path of the message that is being edited, if any
+	property string editing: ""
 
 	Action {
 		id: sendMessage
 		text: "Send &Message"
 		shortcut: "Ctrl+Return"
 		onTriggered: {
-			conversationWindow.sendMessage(messageArea.text);
+			if (editing !== "") {
+				conversationWindow.editMessage(editing, messageArea.text);
+			} else if (replyTo !== "") {
+				conversationWindow.sendReply(messageArea.text, replyTo);
+			} else {
+				conversationWindow.sendMessage(messageArea.text);
+			}
 			messageArea.remove(0, messageArea.length);
+			replyTo = "";
+			editing = "";
+		}
+	}
+
+	FileDialog {
+		id: attachDialog
+		title: "Send a file"
+		onAccepted: conversationWindow.sendFile(attachDialog.fileUrl.toString())
+	}
+
+	Action {
+		id: attachFile
+		text: "Send &File..."
+		shortcut: "Ctrl+O"
+		onTriggered: attachDialog.open()
+	}
+
+	Action {
+		id: addParticipant
+		text: "&Add"
+		enabled: participantField.text !== ""
+		onTriggered: {
+			conversationWindow.addParticipant(participantField.text);
+			participantField.text = "";
+		}
+	}
+
+	Action {
+		id: removeParticipant
+		text: "&Remove"
+		enabled: participantField.text !== ""
+		onTriggered: {
+			conversationWindow.removeParticipant(participantField.text);
+			participantField.text = "";
 		}
 	}
 
@@ -29,7 +83,55 @@ ApplicationWindow {
 		id: messageModel
 		objectName: 'messageModel'
 
-		function addItem(json) { append(JSON.parse(json)); }
+		// addItem puts a message in its place in the order of the
+		// conversation, see persistence.SortMessages
+		function addItem(json) {
+			var item = JSON.parse(json);
+			item.Quote = quoteOf(item.InReplyTo);
+			// an edited or deleted message replaces what was shown
+			removeItem(item.Path);
+			var i = count;
+			while (i > 0 && before(item, get(i - 1))) {
+				i--;
+			}
+			insert(i, item);
+		}
+		function before(a, b) {
+			if (a.Clock !== b.Clock) {
+				return a.Clock < b.Clock;
+			}
+			if (a.Clock !== 0 && a.Sender !== b.Sender) {
+				return a.Sender < b.Sender;
+			}
+			return a.Path < b.Path;
+		}
+		// quoteOf describes the message with the given id in one line
+		function quoteOf(id) {
+			if (id === "") {
+				return "";
+			}
+			for (var i = 0; i < count; i++) {
+				var m = get(i);
+				if (m.Id === id) {
+					return m.Sender + ": " + (m.ContentType === "" ? m.Content.split("\n")[0] : m.Filename);
+				}
+			}
+			return "(message not available)";
+		}
+		function removeItem(path) {
+			for (var i = count - 1; i >= 0; i--) {
+				if (get(i).Path === path) {
+					remove(i);
+				}
+			}
+		}
+		function setStatus(path, status) {
+			for (var i = 0; i < count; i++) {
+				if (get(i).Path === path) {
+					setProperty(i, "Status", status);
+				}
+			}
+		}
     }
 
     ColumnLayout {
@@ -46,23 +148,123 @@ ApplicationWindow {
 				objectName: "messageView"
 
 				model: messageModel
-				delegate: RowLayout {
-					Text{ 
-						anchors.top: parent.top
-						text: Sender + ": "
+				delegate: ColumnLayout {
+					Text{
+						Layout.leftMargin: 4 * margin
+						text: "> " + Quote
 						textFormat: Text.PlainText
-						font.bold:true
+						color: "gray"
+						visible: InReplyTo !== ""
 					}
-					Text{ 
-						anchors.top: parent.top
-						text: Content
-						textFormat: Text.PlainText
+					RowLayout {
+						Layout.leftMargin: InReplyTo !== "" ? 2 * margin : 0
+						Text{ 
+							anchors.top: parent.top
+							text: Sender + ": "
+							textFormat: Text.PlainText
+							font.bold:true
+						}
+						Text{ 
+							anchors.top: parent.top
+							text: Revision === "deleted" ? "(deleted)" : Content
+							textFormat: Text.PlainText
+							font.italic: Revision === "deleted"
+							visible: ContentType === "" || Revision === "deleted"
+						}
+						Image{
+							anchors.top: parent.top
+							source: ImageSource
+							visible: ImageSource !== ""
+							fillMode: Image.PreserveAspectFit
+							sourceSize.height: 200
+						}
+						Button{
+							anchors.top: parent.top
+							text: Filename
+							tooltip: "Open " + ContentType + " attachment"
+							visible: ContentType !== "" && Revision !== "deleted"
+							onClicked: conversationWindow.openAttachment(Path)
+						}
+						Text{
+							anchors.top: parent.top
+							text: Status
+							textFormat: Text.PlainText
+							color: "gray"
+						}
+						Text{
+							anchors.top: parent.top
+							text: Expires
+							textFormat: Text.PlainText
+							color: "gray"
+						}
+						Text{
+							anchors.top: parent.top
+							text: "(edited)"
+							color: "gray"
+							visible: Revision === "edited"
+						}
+						Button{
+							anchors.top: parent.top
+							text: "Reply"
+							visible: Id !== ""
+							onClicked: {
+								conversationWindow.replyTo = Id;
+								conversationWindow.replyQuote = messageModel.quoteOf(Id);
+								messageArea.forceActiveFocus();
+							}
+						}
+						Button{
+							anchors.top: parent.top
+							text: "Edit"
+							visible: Ours && Id !== "" && ContentType === "" && Revision !== "deleted"
+							onClicked: {
+								conversationWindow.editing = Path;
+								messageArea.text = Content;
+								messageArea.forceActiveFocus();
+							}
+						}
+						Button{
+							anchors.top: parent.top
+							text: "Delete"
+							visible: Ours && Id !== "" && Revision !== "deleted"
+							onClicked: conversationWindow.deleteMessage(Path)
+						}
 					}
+				}
+			}
+		}
 
+		RowLayout {
+			visible: editing !== ""
+			Text {
+				text: "Editing a message"
+				color: "gray"
+				Layout.fillWidth: true
+			}
+			Button {
+				text: "Cancel"
+				onClicked: {
+					editing = "";
+					messageArea.remove(0, messageArea.length);
 				}
 			}
 		}
 
+		RowLayout {
+			visible: replyTo !== ""
+			Text {
+				text: "Replying to " + replyQuote
+				textFormat: Text.PlainText
+				color: "gray"
+				elide: Text.ElideRight
+				Layout.fillWidth: true
+			}
+			Button {
+				text: "Cancel"
+				onClicked: replyTo = ""
+			}
+		}
+
 		TextArea {
 			id: messageArea 
 			objectName: "messageArea"
@@ -78,5 +280,22 @@ ApplicationWindow {
 				messageArea.selectAll()
 			}
 		}
+
+		RowLayout {
+			Button {
+				action: attachFile
+			}
+			TextField {
+				id: participantField
+				placeholderText: "Participant"
+				Layout.fillWidth: true
+			}
+			Button {
+				action: addParticipant
+			}
+			Button {
+				action: removeParticipant
+			}
+		}
     }
 }
@@ -55,4 +55,4 @@ func qrcRepackResources() error {
 }
 
 var qrcResourcesRepacked []byte
-var qrcResourcesData = "qres\x00\x00\x00\x01\x00\x00\x13\u007f\x00\x00\x00\x14\x00\x00\x12\xfb\x00\x00\x06\x9eimport QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\n\n\nApplicationWindow {\n\tid: conversationWindow\n\tsignal sendMessage(string message)\n\n    visible: true\n    title: \"Conversation\"\n    property int margin: 10\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\n\tAction {\n\t\tid: sendMessage\n\t\ttext: \"Send &Message\"\n\t\tshortcut: \"Ctrl+Return\"\n\t\tonTriggered: {\n\t\t\tconversationWindow.sendMessage(messageArea.text);\n\t\t\tmessageArea.remove(0, messageArea.length);\n\t\t}\n\t}\n\n\tListModel {\n\t\tid: messageModel\n\t\tobjectName: 'messageModel'\n\n\t\tfunction addItem(json) { append(JSON.parse(json)); }\n    }\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\n\t\tScrollView {\n\t\t\t// TODO: handle pageup, pagedown\n\t\t\tLayout.fillHeight: true\n\t\t\tLayout.fillWidth: true\n\t\t\tListView {\n\t\t\t\tid: messageView\n\t\t\t\tobjectName: \"messageView\"\n\n\t\t\t\tmodel: messageModel\n\t\t\t\tdelegate: RowLayout {\n\t\t\t\t\tText{ \n\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\ttext: Sender + \": \"\n\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\tfont.bold:true\n\t\t\t\t\t}\n\t\t\t\t\tText{ \n\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\ttext: Content\n\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t}\n\n\t\t\t\t}\n\t\t\t}\n\t\t}\n\n\t\tTextArea {\n\t\t\tid: messageArea \n\t\t\tobjectName: \"messageArea\"\n\t\t\ttext: \"Ctrl + Enter to send a message.\"\n\t\t\tLayout.fillWidth: true\n\t\t\tLayout.minimumHeight: 12\n\t\t\tLayout.preferredHeight: 36\n\t\t\ttextFormat: TextEdit.PlainText\n\t\t\twrapMode: TextEdit.Wrap\n\n\t\t\tfocus: true\n\t\t\tComponent.onCompleted: {\n\t\t\t\tmessageArea.selectAll()\n\t\t\t}\n\t\t}\n    }\n}\n\x00\x00\x06wimport QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\n\nApplicationWindow {\n\tid: historyWindow\n\n    visible: true\n    title: \"History\"\n    property int margin: 5\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\n\tListModel {\n\t    id: sourceModel\n\t\tobjectName: \"listModel\"\n\n\t\tfunction addItem(json) {\n\t\t\tvar parsed = JSON.parse(json);\n\t\t\t// TODO represents participants using some QML-(color?)-delimited thing, comma-separated encoding is not reversible\n\t\t\tappend({Subject: parsed.Subject, Participants:parsed.Participants.toString()});\n\t\t}\n\t}\n\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\n\t    TableView {\n\t        id: tableView\n\t        objectName: \"table\"\n\n\t        focus:true\n\t        frameVisible: true\n\t        sortIndicatorVisible: false\n\n\t        model: sourceModel\n\t\t\tLayout.fillHeight: true\n\t\t\tLayout.fillWidth: true\n\n\t        TableViewColumn {\n\t            id: usersColumn\n\t            title: \"Participants\"\n\t            role: \"Participants\"\n\t            movable: false\n\t        }\n\n\t        TableViewColumn {\n\t            id: subjectColumn\n\t            title: \"Subject\"\n\t            role: \"Subject\"\n\t            movable: false\n\t        }\n\t    }\n\n\t\tButton {\n\t\t\tid: newConversationButton\n\t        objectName: \"newConversationButton\"\n\t\t\taction: newConversation\n\t\t}\n    }\n\n\tAction {\n\t\tid: newConversation\n\t\tobjectName: \"newConversation\"\n\t\ttext: \"&New Conversation\"\n\t\tshortcut: \"Ctrl+N\"\n\t}\n}\n\x00\x00\x05\xc6import QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\n\n\nApplicationWindow {\n\tid: newConversationWindow\n    visible: true\n    title: \"New Conversation\"\n    property int margin: 5\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\n    function closeWindow() {\n    \tnewConversationWindow.close();\n    }\n\n\tAction {\n\t\tid: sendMessage\n\t\tobjectName: \"sendMessage\"\n\t\ttext: \"Send &Message\"\n\t\tshortcut: \"Ctrl+Return\"\n\t}\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\t\tRowLayout {\n\t\t\tText {text: \"To:\"}\n\t\t\t\tTextField {\n\t\t\t\t\tid: toField\n\t\t\t\t\tobjectName: \"toField\"\n\t\t\t\t\tfocus: true\n\t\t\t\t\tplaceholderText: \"dename names, comma-separated\"\n\t\t\t\t\tLayout.fillWidth: true\n\t\t\t\t\tonAccepted: {subjectField.focus = true}\n\t\t\t\t}\n\t\t}\n\n\t\tRowLayout {\n\t\t\tText {text: \"Subject:\"}\n\t\t\t\tTextField {\n\t\t\t\t\tid: subjectField\n\t\t\t\t\tobjectName: \"subjectField\"\n\t\t\t\t\tLayout.fillWidth: true\n\t\t\t\t\tonAccepted: {messageArea.focus = true}\n\t\t\t\t}\n\t\t}\n\n\n\t\tTextArea {\n\t\t\tid: messageArea \n\t\t\tobjectName: \"messageArea\"\n\t\t\ttext: \"Ctrl + Enter to send a message.\"\n\t\t\tLayout.minimumHeight: 10\n\t\t\tLayout.fillWidth: true\n\t\t\tLayout.fillHeight: true\n\t\t\ttextFormat: TextEdit.PlainText\n\t\t\twrapMode: TextEdit.Wrap\n\t\t\tComponent.onCompleted: {\n\t\t\t\tmessageArea.selectAll()\n\t\t\t}\n\t\t}\n    }\n}\n\x00\x03\x00\x00x<\x00q\x00m\x00l\x00\x14\x00<\xd7|\x00o\x00l\x00d\x00-\x00c\x00o\x00n\x00v\x00e\x00r\x00s\x00a\x00t\x00i\x00o\x00n\x00.\x00q\x00m\x00l\x00\v\x06FE\\\x00h\x00i\x00s\x00t\x00o\x00r\x00y\x00.\x00q\x00m\x00l\x00\x14\a|\xd6|\x00n\x00e\x00w\x00-\x00c\x00o\x00n\x00v\x00e\x00r\x00s\x00a\x00t\x00i\x00o\x00n\x00.\x00q\x00m\x00l\x00\x00\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x02\x00\x00\x00\f\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00:\x00\x00\x00\x00\x00\x01\x00\x00\x06\xa2\x00\x00\x00V\x00\x00\x00\x00\x00\x01\x00\x00\r\x1d"
+var qrcResourcesData = "qres\x00\x00\x00\x01\x00\x00(\x8f\x00\x00\x00\x14\x00\x00(\v\x00\x00\x1b\xaeimport QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\nimport QtQuick.Dialogs 1.1\n\n\nApplicationWindow {\n\tid: conversationWindow\n\tsignal sendMessage(string message)\n\tsignal sendReply(string message, string inReplyTo)\n\tsignal editMessage(string path, string contents)\n\tsignal deleteMessage(string path)\n\tsignal sendFile(string fileURL)\n\tsignal openAttachment(string path)\n\tsignal addParticipant(string name)\n\tsignal removeParticipant(string name)\n\n    visible: true\n    title: \"Conversation\"\n    property int margin: 10\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\t// the id of the message that the next one replies to, if any\n\tproperty string replyTo: \"\"\n\tproperty string replyQuote: \"\"\n\t// the path of the message that is being edited, if any\n\tproperty string editing: \"\"\n\n\tAction {\n\t\tid: sendMessage\n\t\ttext: \"Send &Message\"\n\t\tshortcut: \"Ctrl+Return\"\n\t\tonTriggered: {\n\t\t\tif (editing !== \"\") {\n\t\t\t\tconversationWindow.editMessage(editing, messageArea.text);\n\t\t\t} else if (replyTo !== \"\") {\n\t\t\t\tconversationWindow.sendReply(messageArea.text, replyTo);\n\t\t\t} else {\n\t\t\t\tconversationWindow.sendMessage(messageArea.text);\n\t\t\t}\n\t\t\tmessageArea.remove(0, messageArea.length);\n\t\t\treplyTo = \"\";\n\t\t\tediting = \"\";\n\t\t}\n\t}\n\n\tFileDialog {\n\t\tid: attachDialog\n\t\ttitle: \"Send a file\"\n\t\tonAccepted: conversationWindow.sendFile(attachDialog.fileUrl.toString())\n\t}\n\n\tAction {\n\t\tid: attachFile\n\t\ttext: \"Send &File...\"\n\t\tshortcut: \"Ctrl+O\"\n\t\tonTriggered: attachDialog.open()\n\t}\n\n\tAction {\n\t\tid: addParticipant\n\t\ttext: \"&Add\"\n\t\tenabled: participantField.text !== \"\"\n\t\tonTriggered: {\n\t\t\tconversationWindow.addParticipant(participantField.text);\n\t\t\tparticipantField.text = \"\";\n\t\t}\n\t}\n\n\tAction {\n\t\tid: removeParticipant\n\t\ttext: \"&Remove\"\n\t\tenabled: participantField.text !== \"\"\n\t\tonTriggered: {\n\t\t\tconversationWindow.removeParticipant(participantField.text);\n\t\t\tparticipantField.text = \"\";\n\t\t}\n\t}\n\n\tListModel {\n\t\tid: messageModel\n\t\tobjectName: 'messageModel'\n\n\t\t// addItem puts a message in its place in the order of the\n\t\t// conversation, see persistence.SortMessages\n\t\tfunction addItem(json) {\n\t\t\tvar item = JSON.parse(json);\n\t\t\titem.Quote = quoteOf(item.InReplyTo);\n\t\t\t// an edited or deleted message replaces what was shown\n\t\t\tremoveItem(item.Path);\n\t\t\tvar i = count;\n\t\t\twhile (i > 0 && before(item, get(i - 1))) {\n\t\t\t\ti--;\n\t\t\t}\n\t\t\tinsert(i, item);\n\t\t}\n\t\tfunction before(a, b) {\n\t\t\tif (a.Clock !== b.Clock) {\n\t\t\t\treturn a.Clock < b.Clock;\n\t\t\t}\n\t\t\tif (a.Clock !== 0 && a.Sender !== b.Sender) {\n\t\t\t\treturn a.Sender < b.Sender;\n\t\t\t}\n\t\t\treturn a.Path < b.Path;\n\t\t}\n\t\t// quoteOf describes the message with the given id in one line\n\t\tfunction quoteOf(id) {\n\t\t\tif (id === \"\") {\n\t\t\t\treturn \"\";\n\t\t\t}\n\t\t\tfor (var i = 0; i < count; i++) {\n\t\t\t\tvar m = get(i);\n\t\t\t\tif (m.Id === id) {\n\t\t\t\t\treturn m.Sender + \": \" + (m.ContentType === \"\" ? m.Content.split(\"\\n\")[0] : m.Filename);\n\t\t\t\t}\n\t\t\t}\n\t\t\treturn \"(message not available)\";\n\t\t}\n\t\tfunction removeItem(path) {\n\t\t\tfor (var i = count - 1; i >= 0; i--) {\n\t\t\t\tif (get(i).Path === path) {\n\t\t\t\t\tremove(i);\n\t\t\t\t}\n\t\t\t}\n\t\t}\n\t\tfunction setStatus(path, status) {\n\t\t\tfor (var i = 0; i < count; i++) {\n\t\t\t\tif (get(i).Path === path) {\n\t\t\t\t\tsetProperty(i, \"Status\", status);\n\t\t\t\t}\n\t\t\t}\n\t\t}\n    }\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\n\t\tScrollView {\n\t\t\t// TODO: handle pageup, pagedown\n\t\t\tLayout.fillHeight: true\n\t\t\tLayout.fillWidth: true\n\t\t\tListView {\n\t\t\t\tid: messageView\n\t\t\t\tobjectName: \"messageView\"\n\n\t\t\t\tmodel: messageModel\n\t\t\t\tdelegate: ColumnLayout {\n\t\t\t\t\tText{\n\t\t\t\t\t\tLayout.leftMargin: 4 * margin\n\t\t\t\t\t\ttext: \"> \" + Quote\n\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\tcolor: \"gray\"\n\t\t\t\t\t\tvisible: InReplyTo !== \"\"\n\t\t\t\t\t}\n\t\t\t\t\tRowLayout {\n\t\t\t\t\t\tLayout.leftMargin: InReplyTo !== \"\" ? 2 * margin : 0\n\t\t\t\t\t\tText{ \n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: Sender + \": \"\n\t\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\t\tfont.bold:true\n\t\t\t\t\t\t}\n\t\t\t\t\t\tText{ \n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: Revision === \"deleted\" ? \"(deleted)\" : Content\n\t\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\t\tfont.italic: Revision === \"deleted\"\n\t\t\t\t\t\t\tvisible: ContentType === \"\" || Revision === \"deleted\"\n\t\t\t\t\t\t}\n\t\t\t\t\t\tImage{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\tsource: ImageSource\n\t\t\t\t\t\t\tvisible: ImageSource !== \"\"\n\t\t\t\t\t\t\tfillMode: Image.PreserveAspectFit\n\t\t\t\t\t\t\tsourceSize.height: 200\n\t\t\t\t\t\t}\n\t\t\t\t\t\tButton{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: Filename\n\t\t\t\t\t\t\ttooltip: \"Open \" + ContentType + \" attachment\"\n\t\t\t\t\t\t\tvisible: ContentType !== \"\" && Revision !== \"deleted\"\n\t\t\t\t\t\t\tonClicked: conversationWindow.openAttachment(Path)\n\t\t\t\t\t\t}\n\t\t\t\t\t\tText{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: Status\n\t\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\t\tcolor: \"gray\"\n\t\t\t\t\t\t}\n\t\t\t\t\t\tText{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: Expires\n\t\t\t\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\t\t\t\tcolor: \"gray\"\n\t\t\t\t\t\t}\n\t\t\t\t\t\tText{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: \"(edited)\"\n\t\t\t\t\t\t\tcolor: \"gray\"\n\t\t\t\t\t\t\tvisible: Revision === \"edited\"\n\t\t\t\t\t\t}\n\t\t\t\t\t\tButton{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: \"Reply\"\n\t\t\t\t\t\t\tvisible: Id !== \"\"\n\t\t\t\t\t\t\tonClicked: {\n\t\t\t\t\t\t\t\tconversationWindow.replyTo = Id;\n\t\t\t\t\t\t\t\tconversationWindow.replyQuote = messageModel.quoteOf(Id);\n\t\t\t\t\t\t\t\tmessageArea.forceActiveFocus();\n\t\t\t\t\t\t\t}\n\t\t\t\t\t\t}\n\t\t\t\t\t\tButton{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: \"Edit\"\n\t\t\t\t\t\t\tvisible: Ours && Id !== \"\" && ContentType === \"\" && Revision !== \"deleted\"\n\t\t\t\t\t\t\tonClicked: {\n\t\t\t\t\t\t\t\tconversationWindow.editing = Path;\n\t\t\t\t\t\t\t\tmessageArea.text = Content;\n\t\t\t\t\t\t\t\tmessageArea.forceActiveFocus();\n\t\t\t\t\t\t\t}\n\t\t\t\t\t\t}\n\t\t\t\t\t\tButton{\n\t\t\t\t\t\t\tanchors.top: parent.top\n\t\t\t\t\t\t\ttext: \"Delete\"\n\t\t\t\t\t\t\tvisible: Ours && Id !== \"\" && Revision !== \"deleted\"\n\t\t\t\t\t\t\tonClicked: conversationWindow.deleteMessage(Path)\n\t\t\t\t\t\t}\n\t\t\t\t\t}\n\t\t\t\t}\n\t\t\t}\n\t\t}\n\n\t\tRowLayout {\n\t\t\tvisible: editing !== \"\"\n\t\t\tText {\n\t\t\t\ttext: \"Editing a message\"\n\t\t\t\tcolor: \"gray\"\n\t\t\t\tLayout.fillWidth: true\n\t\t\t}\n\t\t\tButton {\n\t\t\t\ttext: \"Cancel\"\n\t\t\t\tonClicked: {\n\t\t\t\t\tediting = \"\";\n\t\t\t\t\tmessageArea.remove(0, messageArea.length);\n\t\t\t\t}\n\t\t\t}\n\t\t}\n\n\t\tRowLayout {\n\t\t\tvisible: replyTo !== \"\"\n\t\t\tText {\n\t\t\t\ttext: \"Replying to \" + replyQuote\n\t\t\t\ttextFormat: Text.PlainText\n\t\t\t\tcolor: \"gray\"\n\t\t\t\telide: Text.ElideRight\n\t\t\t\tLayout.fillWidth: true\n\t\t\t}\n\t\t\tButton {\n\t\t\t\ttext: \"Cancel\"\n\t\t\t\tonClicked: replyTo = \"\"\n\t\t\t}\n\t\t}\n\n\t\tTextArea {\n\t\t\tid: messageArea \n\t\t\tobjectName: \"messageArea\"\n\t\t\ttext: \"Ctrl + Enter to send a message.\"\n\t\t\tLayout.fillWidth: true\n\t\t\tLayout.minimumHeight: 12\n\t\t\tLayout.preferredHeight: 36\n\t\t\ttextFormat: TextEdit.PlainText\n\t\t\twrapMode: TextEdit.Wrap\n\n\t\t\tfocus: true\n\t\t\tComponent.onCompleted: {\n\t\t\t\tmessageArea.selectAll()\n\t\t\t}\n\t\t}\n\n\t\tRowLayout {\n\t\t\tButton {\n\t\t\t\taction: attachFile\n\t\t\t}\n\t\t\tTextField {\n\t\t\t\tid: participantField\n\t\t\t\tplaceholderText: \"Participant\"\n\t\t\t\tLayout.fillWidth: true\n\t\t\t}\n\t\t\tButton {\n\t\t\t\taction: addParticipant\n\t\t\t}\n\t\t\tButton {\n\t\t\t\taction: removeParticipant\n\t\t\t}\n\t\t}\n    }\n}\n\x00\x00\x06wimport QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\n\nApplicationWindow {\n\tid: historyWindow\n\n    visible: true\n    title: \"History\"\n    property int margin: 5\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\n\tListModel {\n\t    id: sourceModel\n\t\tobjectName: \"listModel\"\n\n\t\tfunction addItem(json) {\n\t\t\tvar parsed = JSON.parse(json);\n\t\t\t// TODO represents participants using some QML-(color?)-delimited thing, comma-separated encoding is not reversible\n\t\t\tappend({Subject: parsed.Subject, Participants:parsed.Participants.toString()});\n\t\t}\n\t}\n\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\n\t    TableView {\n\t        id: tableView\n\t        objectName: \"table\"\n\n\t        focus:true\n\t        frameVisible: true\n\t        sortIndicatorVisible: false\n\n\t        model: sourceModel\n\t\t\tLayout.fillHeight: true\n\t\t\tLayout.fillWidth: true\n\n\t        TableViewColumn {\n\t            id: usersColumn\n\t            title: \"Participants\"\n\t            role: \"Participants\"\n\t            movable: false\n\t        }\n\n\t        TableViewColumn {\n\t            id: subjectColumn\n\t            title: \"Subject\"\n\t            role: \"Subject\"\n\t            movable: false\n\t        }\n\t    }\n\n\t\tButton {\n\t\t\tid: newConversationButton\n\t        objectName: \"newConversationButton\"\n\t\t\taction: newConversation\n\t\t}\n    }\n\n\tAction {\n\t\tid: newConversation\n\t\tobjectName: \"newConversation\"\n\t\ttext: \"&New Conversation\"\n\t\tshortcut: \"Ctrl+N\"\n\t}\n}\n\x00\x00\x05\xc6import QtQuick 2.2\nimport QtQuick.Controls 1.1\nimport QtQuick.Layouts 1.1\n\n\nApplicationWindow {\n\tid: newConversationWindow\n    visible: true\n    title: \"New Conversation\"\n    property int margin: 5\n    width: mainLayout.implicitWidth + 2 * margin\n    height: mainLayout.implicitHeight + 2 * margin\n    minimumWidth: mainLayout.Layout.minimumWidth + 40 * margin\n    minimumHeight: mainLayout.Layout.minimumHeight + 12 * margin\n\n    function closeWindow() {\n    \tnewConversationWindow.close();\n    }\n\n\tAction {\n\t\tid: sendMessage\n\t\tobjectName: \"sendMessage\"\n\t\ttext: \"Send &Message\"\n\t\tshortcut: \"Ctrl+Return\"\n\t}\n\n    ColumnLayout {\n        id: mainLayout\n        anchors.fill: parent\n        anchors.margins: margin\n\t\tRowLayout {\n\t\t\tText {text: \"To:\"}\n\t\t\t\tTextField {\n\t\t\t\t\tid: toField\n\t\t\t\t\tobjectName: \"toField\"\n\t\t\t\t\tfocus: true\n\t\t\t\t\tplaceholderText: \"dename names, comma-separated\"\n\t\t\t\t\tLayout.fillWidth: true\n\t\t\t\t\tonAccepted: {subjectField.focus = true}\n\t\t\t\t}\n\t\t}\n\n\t\tRowLayout {\n\t\t\tText {text: \"Subject:\"}\n\t\t\t\tTextField {\n\t\t\t\t\tid: subjectField\n\t\t\t\t\tobjectName: \"subjectField\"\n\t\t\t\t\tLayout.fillWidth: true\n\t\t\t\t\tonAccepted: {messageArea.focus = true}\n\t\t\t\t}\n\t\t}\n\n\n\t\tTextArea {\n\t\t\tid: messageArea \n\t\t\tobjectName: \"messageArea\"\n\t\t\ttext: \"Ctrl + Enter to send a message.\"\n\t\t\tLayout.minimumHeight: 10\n\t\t\tLayout.fillWidth: true\n\t\t\tLayout.fillHeight: true\n\t\t\ttextFormat: TextEdit.PlainText\n\t\t\twrapMode: TextEdit.Wrap\n\t\t\tComponent.onCompleted: {\n\t\t\t\tmessageArea.selectAll()\n\t\t\t}\n\t\t}\n    }\n}\n\x00\x03\x00\x00x<\x00q\x00m\x00l\x00\x14\x00<\xd7|\x00o\x00l\x00d\x00-\x00c\x00o\x00n\x00v\x00e\x00r\x00s\x00a\x00t\x00i\x00o\x00n\x00.\x00q\x00m\x00l\x00\v\x06FE\\\x00h\x00i\x00s\x00t\x00o\x00r\x00y\x00.\x00q\x00m\x00l\x00\x14\a|\xd6|\x00n\x00e\x00w\x00-\x00c\x00o\x00n\x00v\x00e\x00r\x00s\x00a\x00t\x00i\x00o\x00n\x00.\x00q\x00m\x00l\x00\x00\x00\x00\x00\x02\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x02\x00\x00\x00\f\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00:\x00\x00\x00\x00\x00\x01\x00\x00\x1b\xb2\x00\x00\x00V\x00\x00\x00\x00\x00\x01\x00\x00\"-"
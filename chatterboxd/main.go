@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
+	"github.com/andres-erbsen/chatterbox/client"
 	"github.com/andres-erbsen/chatterbox/client/daemon"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"log"
 	"os"
 	"os/signal"
@@ -10,18 +13,70 @@ import (
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	if len(os.Args) != 2 {
-		log.Fatalf("USAGE: %s <account-directory>", os.Args[0])
+	torAddr := flag.String("tor", client.DefaultTorAddress, "Address of the Tor SOCKS5 proxy.")
+	isolation := flag.String("isolation", "connection", "Which connections may share a Tor circuit: connection (none may), destination (those to the same server) or none (any).")
+	noTor := flag.Bool("dangerous-no-tor", false, "Connect to servers directly, revealing your IP address to them.")
+	passphraseFd := flag.Int("passphrase-fd", -1, "Read the passphrase of the account from this file descriptor instead of prompting for it.")
+	retention := flag.Duration("message-retention", 0, "Delete messages that are older than this, unless their conversation says otherwise (see chatterbox-create). 0 keeps them forever. The setting is saved in the account.")
+	cover := flag.Duration("cover-traffic", 0, "Send a frame to our server this often, a dummy one if there is nothing to send, so that an observer cannot tell when we receive or send messages. Connections to the servers of recipients are not covered. 0 turns it off. The setting is saved in the account.")
+	coverPoisson := flag.Bool("cover-traffic-poisson", false, "Space the frames of -cover-traffic at random, exponentially distributed with the given mean. The setting is saved in the account.")
+	maxTransfer := flag.Int64("max-transfer-size", 0, "Discard received messages that are larger than this many bytes. 0 means 64 MiB. The setting is saved in the account.")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatalf("USAGE: %s [flags] <account-directory>", os.Args[0])
 	}
-	daemon, err := daemon.Load(os.Args[1])
+
+	var dialer client.Dialer = client.DirectDialer{}
+	if !*noTor {
+		policy, err := client.ParseIsolationPolicy(*isolation)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialer = client.NewTorDialer(*torAddr, policy)
+	}
+
+	var passphrase []byte
+	hasPassphrase, err := (&persistence.Paths{RootDir: flag.Arg(0)}).HasPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hasPassphrase {
+		if passphrase, err = persistence.ReadPassphrase(persistence.PassphraseReader(*passphraseFd), "Passphrase: "); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	daemon, err := daemon.Load(flag.Arg(0), passphrase, dialer)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
+	retentionSet, coverSet, maxTransferSet := false, false, false
+	flag.Visit(func(f *flag.Flag) {
+		retentionSet = retentionSet || f.Name == "message-retention"
+		maxTransferSet = maxTransferSet || f.Name == "max-transfer-size"
+		coverSet = coverSet || f.Name == "cover-traffic" || f.Name == "cover-traffic-poisson"
+	})
+	if retentionSet {
+		if err := daemon.SetMessageRetention(*retention); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if coverSet {
+		if err := daemon.SetCoverTraffic(*cover, *coverPoisson); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if maxTransferSet {
+		if err := daemon.SetMaxTransferSize(*maxTransfer); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	daemon.Start()
 
-	s := make(chan os.Signal)
+	s := make(chan os.Signal, 1)
 	signal.Notify(s, os.Kill, os.Interrupt, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGQUIT)
 	<-s
 	daemon.Stop()
@@ -6,6 +6,7 @@ import (
 	protobuf "code.google.com/p/gogoprotobuf/proto"
 	"crypto/rand"
 	"fmt"
+	"github.com/agl/ed25519"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/ratchet"
 	"github.com/andres-erbsen/dename/client"
@@ -128,3 +129,34 @@ func createNewUser(name string, t *testing.T, config *client.Config) (*[32]byte,
 
 	return skAuth, newClient
 }
+
+func TestVerifySignedKey(t *testing.T) {
+	pkSig, skSig, err := ed25519.GenerateKey(rand.Reader)
+	handleError(err, t)
+	pk, _, err := box.GenerateKey(rand.Reader)
+	handleError(err, t)
+	now := time.Now()
+	signedKey := SignKeys([]*[32]byte{pk}, now.Add(time.Hour), skSig)[0]
+
+	key, err := VerifySignedKey(signedKey, pkSig, now)
+	handleError(err, t)
+	if key == nil || *key != *pk {
+		t.Errorf("got key %v, expected %v", key, pk)
+	}
+	if _, err := VerifySignedKey(signedKey, pkSig, now.Add(2*time.Hour)); err == nil {
+		t.Error("expired key accepted")
+	}
+	otherPkSig, _, err := ed25519.GenerateKey(rand.Reader)
+	handleError(err, t)
+	if _, err := VerifySignedKey(signedKey, otherPkSig, now); err == nil {
+		t.Error("key signed by someone else accepted")
+	}
+	extended := append([]byte{}, signedKey...)
+	extended[39]++
+	if _, err := VerifySignedKey(extended, pkSig, now); err == nil {
+		t.Error("key with a tampered expiry accepted")
+	}
+	if _, err := VerifySignedKey(signedKey[:32+64], pkSig, now); err == nil {
+		t.Error("key without an expiry accepted")
+	}
+}
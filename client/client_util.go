@@ -5,9 +5,10 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
+	"math/big"
 	"time"
 
 	"code.google.com/p/go.crypto/curve25519"
@@ -19,7 +20,6 @@ import (
 	"github.com/andres-erbsen/chatterbox/transport"
 	"github.com/andres-erbsen/dename/client"
 	dename "github.com/andres-erbsen/dename/protocol"
-	"golang.org/x/net/proxy"
 )
 
 const PROFILE_FIELD_ID = 1984
@@ -28,6 +28,15 @@ const ENCRYPT_FIRST_ADDED_LEN = 200
 
 type ProfileRatchet func(string, *dename.ClientReply) (*dename.Profile, error)
 
+// RandomFloat reads a number from rnd that is uniformly distributed in [0, 1)
+func RandomFloat(rnd io.Reader) (float64, error) {
+	n, err := rand.Int(rnd, big.NewInt(1<<53))
+	if err != nil {
+		return 0, err
+	}
+	return float64(n.Int64()) / (1 << 53), nil
+}
+
 func ReceiveReply(connToServer *ConnectionToServer) (*proto.ServerToClient, error) {
 	response := <-connToServer.ReadReply //TODO: Timeout
 	return response, nil
@@ -52,7 +61,7 @@ func ListUserMessages(connToServer *ConnectionToServer) ([][32]byte, error) {
 	listMessages := &proto.ClientToServer{
 		ListMessages: protobuf.Bool(true),
 	}
-	if err := WriteProtobuf(connToServer.Conn, listMessages); err != nil {
+	if err := connToServer.WriteProtobuf(listMessages); err != nil {
 		return nil, err
 	}
 
@@ -68,35 +77,44 @@ func RequestMessage(connToServer *ConnectionToServer, messageHash *[32]byte) err
 	getEnvelope := &proto.ClientToServer{
 		DownloadEnvelope: (*proto.Byte32)(messageHash),
 	}
-	if err := WriteProtobuf(connToServer.Conn, getEnvelope); err != nil {
+	if err := connToServer.WriteProtobuf(getEnvelope); err != nil {
 		return err
 	}
 	return nil
 }
 
-func SignKeys(keys []*[32]byte, sk *[64]byte) [][]byte {
+// SignKeys signs prekeys that expire at expiry, see proto.SIGNED_PREKEY_SIZE
+func SignKeys(keys []*[32]byte, expiry time.Time, sk *[64]byte) [][]byte {
 
 	pkList := make([][]byte, 0)
 	for _, key := range keys {
-		signature := ed25519.Sign(sk, key[:])
-		pkList = append(pkList, append(append([]byte{}, key[:]...), signature[:]...))
+		signedKey := make([]byte, 40, proto.SIGNED_PREKEY_SIZE)
+		copy(signedKey, key[:])
+		binary.BigEndian.PutUint64(signedKey[32:40], uint64(expiry.Unix()))
+		signature := ed25519.Sign(sk, signedKey)
+		pkList = append(pkList, append(signedKey, signature[:]...))
 	}
 	return pkList
 }
 
-func TorAnon(addr string) proxy.Dialer {
-	var identity [16]byte
-	if _, err := rand.Read(identity[:]); err != nil {
-		panic(err)
+// VerifySignedKey returns the prekey in signedKey if it has been signed with
+// pkSig and has not expired at time now
+func VerifySignedKey(signedKey []byte, pkSig *[32]byte, now time.Time) (*[32]byte, error) {
+	expiry, ok := proto.SignedPrekeyExpiry(signedKey)
+	if !ok {
+		return nil, errors.New("Malformed signed key returned")
 	}
-	dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{
-		User:     fmt.Sprintf("%x", identity[:8]),
-		Password: fmt.Sprintf("%x", identity[8:]),
-	}, proxy.Direct)
-	if err != nil {
-		panic(err)
+	var sig [64]byte
+	copy(sig[:], signedKey[40:])
+	if !ed25519.Verify(pkSig, signedKey[:40], &sig) {
+		return nil, errors.New("Improperly signed key returned")
 	}
-	return dialer
+	if !now.Before(expiry) {
+		return nil, errors.New("Expired key returned")
+	}
+	var userKey [32]byte
+	copy(userKey[:], signedKey[:32])
+	return &userKey, nil
 }
 
 func EncryptAuthFirst(message []byte, skAuth *[32]byte, userKey *[32]byte, prt ProfileRatchet) ([]byte, *ratchet.Ratchet, error) {
@@ -156,7 +174,7 @@ func DeleteMessages(connToServer *ConnectionToServer, messageList [][32]byte) er
 	deleteMessages := &proto.ClientToServer{
 		DeleteMessages: proto.ToProtoByte32List(messageList),
 	}
-	if err := WriteProtobuf(connToServer.Conn, deleteMessages); err != nil {
+	if err := connToServer.WriteProtobuf(deleteMessages); err != nil {
 		return err
 	}
 
@@ -168,7 +186,7 @@ func UploadKeys(connToServer *ConnectionToServer, keyList [][]byte) error {
 	uploadKeys := &proto.ClientToServer{
 		UploadSignedKeys: keyList,
 	}
-	if err := WriteProtobuf(connToServer.Conn, uploadKeys); err != nil {
+	if err := connToServer.WriteProtobuf(uploadKeys); err != nil {
 		return err
 	}
 
@@ -189,24 +207,14 @@ func GetKey(conn *transport.Conn, inBuf []byte, pk *[32]byte, dename string, pkS
 		return nil, err
 	}
 
-	var userKey [32]byte
-	copy(userKey[:], response.SignedKey[:32])
-
-	var sig [64]byte
-	copy(sig[:], response.SignedKey[32:(32+64)])
-
-	if !ed25519.Verify(pkSig, userKey[:], &sig) {
-		return nil, errors.New("Improperly signed key returned")
-	}
-
-	return &userKey, nil
+	return VerifySignedKey(response.SignedKey, pkSig, time.Now())
 }
 
 func GetNumKeys(connToServer *ConnectionToServer) (int64, error) {
 	getNumKeys := &proto.ClientToServer{
 		GetNumKeys: protobuf.Bool(true),
 	}
-	if err := WriteProtobuf(connToServer.Conn, getNumKeys); err != nil {
+	if err := connToServer.WriteProtobuf(getNumKeys); err != nil {
 		return 0, err
 	}
 
@@ -222,7 +230,7 @@ func EnablePush(connToServer *ConnectionToServer) error {
 	command := &proto.ClientToServer{
 		ReceiveEnvelopes: &true_,
 	}
-	if err := WriteProtobuf(connToServer.Conn, command); err != nil {
+	if err := connToServer.WriteProtobuf(command); err != nil {
 		return err
 	}
 	_, err := ReceiveReply(connToServer)
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	protobuf "code.google.com/p/gogoprotobuf/proto"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+)
+
+var errCoverStopped = errors.New("cover traffic stopped")
+
+type coverFrame struct {
+	frame []byte
+	done  chan error
+}
+
+// CoverTraffic writes exactly one frame to a connection per tick. If a real
+// frame has been queued using WriteFrame, it is sent in place of the dummy
+// frame that would otherwise go out, so an observer of the connection learns
+// nothing from the timing or the number of frames. Ticks are spaced Interval
+// apart, or exponentially distributed with mean Interval if Poisson is set.
+// Every write to the connection MUST go through CoverTraffic while it is
+// running.
+//
+// The daemon only covers its connection to our own server. The connections it
+// opens to the servers of recipients to deliver messages (see
+// ConnectionCache) carry no cover traffic, so an observer of our network
+// connection, or one of those servers, can tell when we send to them.
+type CoverTraffic struct {
+	conn     *transport.Conn
+	interval time.Duration
+	poisson  bool
+	rand     io.Reader
+
+	queue    chan coverFrame
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewCoverTraffic(conn *transport.Conn, interval time.Duration, poisson bool, rnd io.Reader) *CoverTraffic {
+	if rnd == nil {
+		rnd = rand.Reader
+	}
+	return &CoverTraffic{conn: conn, interval: interval, poisson: poisson, rand: rnd}
+}
+
+func (c *CoverTraffic) Start() {
+	c.queue = make(chan coverFrame)
+	c.stop = make(chan struct{})
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run()
+	}()
+}
+
+// Stop returns after the last frame has been written. Frames that have not
+// been sent yet fail with an error. Calling Stop again does nothing.
+func (c *CoverTraffic) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.wg.Wait()
+}
+
+// WriteFrame queues a frame to be sent instead of the next dummy frame and
+// waits until it has been written to the connection.
+func (c *CoverTraffic) WriteFrame(b []byte) (int, error) {
+	f := coverFrame{frame: b, done: make(chan error, 1)}
+	select {
+	case c.queue <- f:
+	case <-c.stop:
+		return 0, errCoverStopped
+	}
+	if err := <-f.done; err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *CoverTraffic) WriteProtobuf(message *proto.ClientToServer) error {
+	unpadMsg, err := protobuf.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = c.WriteFrame(proto.Pad(unpadMsg, proto.SERVER_MESSAGE_SIZE))
+	return err
+}
+
+func (c *CoverTraffic) run() {
+	unpadDummy, err := protobuf.Marshal(&proto.ClientToServer{Cover: protobuf.Bool(true)})
+	if err != nil {
+		panic(err)
+	}
+	dummy := proto.Pad(unpadDummy, proto.SERVER_MESSAGE_SIZE)
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.pickDelay()):
+		}
+		select {
+		case f := <-c.queue:
+			_, err := c.conn.WriteFrame(f.frame)
+			f.done <- err
+		default:
+			// a failed dummy write means a broken connection, which the next
+			// real write (or the reader) will report
+			c.conn.WriteFrame(dummy)
+		}
+	}
+}
+
+// pickDelay returns the time until the next tick. If no randomness can be
+// read, the ticks fall back to being spaced evenly.
+func (c *CoverTraffic) pickDelay() time.Duration {
+	if !c.poisson {
+		return c.interval
+	}
+	u, err := RandomFloat(c.rand)
+	if err != nil {
+		return c.interval
+	}
+	return time.Duration(-math.Log(1-u) * float64(c.interval))
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	protobuf "code.google.com/p/gogoprotobuf/proto"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+)
+
+func pipeConns(t *testing.T) (*transport.Conn, *transport.Conn) {
+	p1, p2 := net.Pipe()
+	pk1, sk1, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk2, sk2, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c2 *transport.Conn
+	var err2 error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c2, _, err2 = transport.Handshake(p2, pk2, sk2, nil, proto.SERVER_MESSAGE_SIZE)
+	}()
+	c1, _, err := transport.Handshake(p1, pk1, sk1, pk2, proto.SERVER_MESSAGE_SIZE)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	return c1, c2
+}
+
+func readCommands(conn *transport.Conn, commands chan<- *proto.ClientToServer) {
+	defer close(commands)
+	inBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	for {
+		num, err := conn.ReadFrame(inBuf)
+		if err != nil {
+			return
+		}
+		cmd := new(proto.ClientToServer)
+		if err := cmd.Unmarshal(proto.Unpad(inBuf[:num])); err != nil {
+			return
+		}
+		commands <- cmd
+	}
+}
+
+func TestCoverTrafficReplacesDummies(t *testing.T) {
+	c1, c2 := pipeConns(t)
+	defer c1.Close()
+	defer c2.Close()
+
+	commands := make(chan *proto.ClientToServer)
+	go readCommands(c2, commands)
+
+	cover := NewCoverTraffic(c1, time.Millisecond, false, nil)
+	cover.Start()
+
+	for i := 0; i < 3; i++ {
+		if cmd := <-commands; cmd.Cover == nil || !*cmd.Cover {
+			t.Fatalf("expected a dummy frame, got %v", cmd)
+		}
+	}
+
+	errCh := make(chan error)
+	go func() {
+		errCh <- cover.WriteProtobuf(&proto.ClientToServer{ListMessages: protobuf.Bool(true)})
+	}()
+	for cmd := range commands {
+		if cmd.Cover != nil {
+			continue
+		}
+		if cmd.ListMessages == nil || !*cmd.ListMessages {
+			t.Fatalf("expected the queued command, got %v", cmd)
+		}
+		break
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for _ = range commands {
+		}
+	}()
+	cover.Stop()
+	cover.Stop()
+	if err := cover.WriteProtobuf(&proto.ClientToServer{ListMessages: protobuf.Bool(true)}); err == nil {
+		t.Error("write after Stop succeeded")
+	}
+}
+
+func TestCoverTrafficPoissonDelay(t *testing.T) {
+	const n = 10000
+	cover := NewCoverTraffic(nil, time.Second, true, nil)
+	var sum time.Duration
+	for i := 0; i < n; i++ {
+		sum += cover.pickDelay()
+	}
+	if mean := sum / n; mean < 900*time.Millisecond || mean > 1100*time.Millisecond {
+		t.Errorf("mean delay %v is far from %v", mean, time.Second)
+	}
+}
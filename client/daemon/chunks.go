@@ -0,0 +1,357 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// A message whose payload does not fit in one envelope is sent as the message
+// without its contents, but with their size and hash and the number of chunks
+// they are split into, followed by the chunks, each in an envelope of its
+// own. The journal batch of such a message has an entry for the message and
+// one for every chunk for each recipient, named so that they are sent in
+// order; giving up on one of them gives up on the rest.
+//
+// The receiver keeps the message and the chunks that have arrived in the
+// transfers directory, in a directory per message, and files the message only
+// once all of its chunks are there and their size and hash match. The message
+// is only kept if it is no larger than the account's MaxTransferSize and
+// claims as many chunks as its size takes, and a chunk only if its index is
+// below that number, so a peer cannot make the receiver keep more than
+// MaxTransferSize per transfer. Transfers that have not made progress for
+// maxSendAge, after which the sender has given up, are deleted. Both sides
+// publish their progress, see persistence.ProgressPath.
+
+// maxPayloadSize is the size of the largest payload that fits in an envelope,
+// even in a first message
+const maxPayloadSize = proto.MAX_MESSAGE_SIZE - util.ENCRYPT_FIRST_ADDED_LEN - 32 - 1
+
+const transferCorruptNotice = "The message %s from %s arrived damaged and was discarded."
+
+func (d *Daemon) transfersDir() string { return filepath.Join(d.privDir(), "transfers") }
+
+// transferDir returns the directory in which the chunks of the message with
+// id from sender are put together
+func (d *Daemon) transferDir(sender string, id []byte) string {
+	return filepath.Join(d.transfersDir(), encoding.EscapeFilename(sender)+"-"+hex.EncodeToString(id))
+}
+
+// maxTransferSize returns the size of the largest message that is accepted in
+// chunks
+func (d *Daemon) maxTransferSize() int64 {
+	if d.MaxTransferSize == 0 {
+		return defaultMaxTransferSize
+	}
+	return d.MaxTransferSize
+}
+
+// SetMaxTransferSize changes the size of the largest message that is accepted
+// in chunks; 0 restores the default
+func (d *Daemon) SetMaxTransferSize(size int64) error {
+	d.MaxTransferSize = size
+	return StoreLocalAccountConfig(d, &d.LocalAccountConfig)
+}
+
+// chunkEntryName returns the name of the journal entry for chunk (from 1, or 0
+// for the message itself) of a message to the user whose entries are called
+// name
+func chunkEntryName(name string, chunk int) string {
+	if chunk == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s.%06d", name, chunk)
+}
+
+// newChunk returns a chunk of the message with the given id, without its
+// index and contents. m is the message or any of its chunks.
+func newChunk(m *proto.Message, id []byte) proto.Message {
+	return proto.Message{
+		Dename:       m.Dename,
+		DenameLookup: m.DenameLookup,
+		Subject:      m.Subject,
+		Participants: m.Participants,
+		Date:         m.Date,
+		Kind:         proto.Message_CHUNK,
+		Target:       id,
+	}
+}
+
+// chunkSize returns how many bytes of contents each chunk of the message with
+// the given id carries. m is the message or any of its chunks, so that sender
+// and receiver agree on it.
+func chunkSize(m *proto.Message, id []byte) (int, error) {
+	chunk := newChunk(m, id)
+	chunk.ChunkIndex = math.MaxInt32
+	// the contents are preceded by a tag and a length of at most 3 bytes
+	size := maxPayloadSize - chunk.Size() - 4
+	if size <= 0 {
+		return 0, fmt.Errorf("no room for contents in a chunk of %d bytes", chunk.Size())
+	}
+	return size, nil
+}
+
+// numChunks returns how many chunks of size chunkSize length bytes take
+func numChunks(length int64, chunkSize int) int64 {
+	return (length + int64(chunkSize) - 1) / int64(chunkSize)
+}
+
+// splitPayload returns the payloads that a message which is too large for one
+// envelope is sent as: the message without its contents, followed by the
+// chunks of the contents
+func splitPayload(payload *proto.Message) ([][]byte, error) {
+	chunkSize, err := chunkSize(payload, payload.Id)
+	if err != nil {
+		return nil, err
+	}
+	chunk := newChunk(payload, payload.Id)
+	contents := payload.Contents
+	hash := sha256.Sum256(contents)
+	message := *payload
+	message.Contents = nil
+	message.Chunks = int32(numChunks(int64(len(contents)), chunkSize))
+	message.Length = int64(len(contents))
+	message.Hash = hash[:]
+	messageBytes, err := message.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if len(messageBytes) > maxPayloadSize {
+		return nil, fmt.Errorf("message is %d bytes without its contents", len(messageBytes))
+	}
+	ret := [][]byte{messageBytes}
+	for i := int32(0); i < message.Chunks; i++ {
+		end := (int(i) + 1) * chunkSize
+		if end > len(contents) {
+			end = len(contents)
+		}
+		chunk.ChunkIndex = i
+		chunk.Contents = contents[int(i)*chunkSize : end]
+		chunkBytes, err := chunk.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, chunkBytes)
+	}
+	return ret, nil
+}
+
+// updateProgress publishes that done of the total chunks of message, its path
+// relative to the conversations directory, have been sent to or received from
+// name. Once all of them have, name is removed from the progress file.
+func (d *Daemon) updateProgress(message, name string, done, total int) error {
+	if message == "" {
+		return nil
+	}
+	path := filepath.Join(d.ProgressDir(), message)
+	progress, err := persistence.ReadProgress(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	updated := progress[:0]
+	for _, p := range progress {
+		if p.Name != name {
+			updated = append(updated, p)
+		}
+	}
+	if done < total {
+		updated = append(updated, persistence.Progress{Name: name, Done: done, Total: total})
+	}
+	return d.WriteProgress(path, updated)
+}
+
+// abandonChunks removes the remaining journal entries of a message sent in
+// chunks to the recipient of the entry at path, which is being given up on:
+// the message could not be put together without it
+func (d *Daemon) abandonChunks(path string, entry *proto.JournalEntry) error {
+	dir := filepath.Dir(path)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		other := filepath.Join(dir, file.Name())
+		if other == path {
+			continue
+		}
+		e, err := d.loadJournalEntry(other)
+		if err != nil {
+			continue
+		}
+		if e.Name == entry.Name && e.Chunk > entry.Chunk {
+			if err := shred.Remove(other); err != nil {
+				return err
+			}
+		}
+	}
+	return d.updateProgress(entry.Message, entry.Name, int(entry.Chunks), int(entry.Chunks))
+}
+
+// receiveChunk keeps a received message that is sent in chunks, or one of its
+// chunks, and returns the message with its contents once all of them have
+// arrived
+func (d *Daemon) receiveChunk(message *proto.Message) (*proto.Message, error) {
+	id := message.Id
+	if message.Kind == proto.Message_CHUNK {
+		id = message.Target
+	}
+	if len(id) != messageIdSize {
+		log.Printf("ignoring chunked message from %s without an id", message.Dename)
+		return nil, nil
+	}
+	size, err := chunkSize(message, id)
+	if err != nil {
+		log.Printf("ignoring chunked message from %s: %s", message.Dename, err)
+		return nil, nil
+	}
+	dir := d.transferDir(message.Dename, id)
+	if message.Kind == proto.Message_CHUNK {
+		// until the message arrives, its number of chunks is bounded by the
+		// largest one we accept
+		chunks := numChunks(d.maxTransferSize(), size)
+		header := new(proto.Message)
+		if err := d.UnmarshalFromFile(filepath.Join(dir, "message"), header); err == nil {
+			chunks = int64(header.Chunks)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if message.ChunkIndex < 0 || int64(message.ChunkIndex) >= chunks {
+			log.Printf("ignoring chunk %d of %d from %s", message.ChunkIndex, chunks, message.Dename)
+			return nil, nil
+		}
+	} else if message.Length < 0 || message.Length > d.maxTransferSize() || int64(message.Chunks) != numChunks(message.Length, size) {
+		log.Printf("discarding a message of %d bytes in %d chunks from %s", message.Length, message.Chunks, message.Dename)
+		return nil, shred.RemoveAll(dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if message.Kind == proto.Message_CHUNK {
+		path := filepath.Join(dir, fmt.Sprintf("%06d", message.ChunkIndex))
+		if err := d.AtomicWriteFile(path, persistence.Seal(message.Contents, d.StorageKey), 0600); err != nil {
+			return nil, err
+		}
+	} else if err := d.MarshalToFile(filepath.Join(dir, "message"), message); err != nil {
+		return nil, err
+	}
+	return d.completeTransfer(dir)
+}
+
+// completeTransfer returns the message whose chunks are kept in dir with its
+// contents, or nil if some of them have not arrived yet
+func (d *Daemon) completeTransfer(dir string) (*proto.Message, error) {
+	message := new(proto.Message)
+	if err := d.UnmarshalFromFile(filepath.Join(dir, "message"), message); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	convName, err := d.conversationOf(message)
+	if err != nil {
+		return nil, err
+	}
+	messageName, err := d.messageNameFor(convName, time.Unix(0, message.Date), message.Dename, message.ContentType, message.Id)
+	if err != nil {
+		return nil, err
+	}
+	progress := filepath.Join(convName, messageName)
+	var arrived int
+	for i := int32(0); i < message.Chunks; i++ {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("%06d", i))); err == nil {
+			arrived++
+		}
+	}
+	if arrived < int(message.Chunks) {
+		return nil, d.updateProgress(progress, message.Dename, arrived, int(message.Chunks))
+	}
+	var contents bytes.Buffer
+	for i := int32(0); i < message.Chunks; i++ {
+		chunk, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%06d", i)))
+		if err != nil {
+			return nil, err
+		}
+		if chunk, err = persistence.Open(chunk, d.StorageKey); err != nil {
+			return nil, err
+		}
+		contents.Write(chunk)
+	}
+	if err := d.updateProgress(progress, message.Dename, arrived, arrived); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(contents.Bytes())
+	if int64(contents.Len()) != message.Length || !bytes.Equal(hash[:], message.Hash) {
+		log.Printf("discarding %s from %s: its chunks do not match", messageName, message.Dename)
+		notice := fmt.Sprintf(transferCorruptNotice, messageName, message.Dename)
+		if err := d.writeNotice(filepath.Join(d.ConversationDir(), convName), notice); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, shred.RemoveAll(dir)
+	}
+	message.Contents = contents.Bytes()
+	return message, nil
+}
+
+// finishTransfer deletes what was kept of a message that was received in
+// chunks once it has been filed and acknowledged
+func (d *Daemon) finishTransfer(message *proto.Message) error {
+	return shred.RemoveAll(d.transferDir(message.Dename, message.Id))
+}
+
+// pruneTransfers deletes the transfers that have not made progress for
+// maxSendAge
+func (d *Daemon) pruneTransfers() error {
+	transfers, err := ioutil.ReadDir(d.transfersDir())
+	if err != nil {
+		return err
+	}
+	now := d.Now()
+	for _, transfer := range transfers {
+		dir := filepath.Join(d.transfersDir(), transfer.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		latest := transfer.ModTime()
+		for _, file := range files {
+			if file.ModTime().After(latest) {
+				latest = file.ModTime()
+			}
+		}
+		if now.Sub(latest) <= maxSendAge {
+			continue
+		}
+		message := new(proto.Message)
+		if err := d.UnmarshalFromFile(filepath.Join(dir, "message"), message); err == nil {
+			convName, err := d.findConversationOf(message)
+			if err != nil {
+				return err
+			}
+			if convName != "" {
+				messageName, err := d.messageNameFor(convName, time.Unix(0, message.Date), message.Dename, message.ContentType, message.Id)
+				if err != nil {
+					return err
+				}
+				if err := d.updateProgress(filepath.Join(convName, messageName), message.Dename, 0, 0); err != nil {
+					return err
+				}
+			}
+		}
+		if err := shred.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// Every conversation has a Lamport clock, which is kept in the clock directory
+// along with how many messages each participant has sent in it. The first line
+// of the file of a conversation is the clock, and every other line is
+// "<user><TAB><sequence>": the sequence number of the last message we sent, or
+// received from user. A message we send has the clock one more than the
+// largest we have sent or seen in the conversation, and the sequence number
+// one more than our last; see persistence.ClockPath for how this orders the
+// conversation. A received message whose sequence number skips ahead of the
+// last we have from its sender is preceded by a notice that messages may be
+// missing, and one with a number behind it by a notice that it arrived late.
+
+const (
+	missingMessagesNotice = "%d earlier messages from %s have not arrived."
+	lateMessageNotice     = "A message from %s arrived late and was put in its place."
+)
+
+func (d *Daemon) clockDir() string { return filepath.Join(d.privDir(), "clock") }
+
+// conversationClock is the clock of a conversation and the last sequence
+// number of each participant
+type conversationClock struct {
+	clock     uint64
+	sequences map[string]uint64
+}
+
+func (d *Daemon) loadClock(convName string) (*conversationClock, error) {
+	ret := &conversationClock{sequences: make(map[string]uint64)}
+	bs, err := ioutil.ReadFile(filepath.Join(d.clockDir(), convName))
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	if scanner.Scan() {
+		if ret.clock, err = strconv.ParseUint(scanner.Text(), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("badly formatted clock of %s: %q", convName, scanner.Text())
+		}
+		if ret.sequences[fields[0]], err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func (d *Daemon) storeClock(convName string, c *conversationClock) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", c.clock)
+	for name, sequence := range c.sequences {
+		fmt.Fprintf(&buf, "%s\t%d\n", name, sequence)
+	}
+	return d.AtomicWriteFile(filepath.Join(d.clockDir(), convName), buf.Bytes(), 0600)
+}
+
+// tick returns the clock of a conversation advanced for a message we send in
+// it: c.clock and c.sequences[d.Dename] are the clock and the sequence number
+// of the message. The caller stores it once the message has been journaled,
+// so that a message that is not sent does not use up a sequence number, and
+// records it in the journal entries so that it can be restored if the daemon
+// stops in between.
+func (d *Daemon) tick(convName string) (c *conversationClock, err error) {
+	if c, err = d.loadClock(convName); err != nil {
+		return nil, err
+	}
+	c.clock++
+	c.sequences[d.Dename]++
+	return c, nil
+}
+
+// restoreClock advances the clock of a conversation past a message from the
+// outbox that has been journaled, given one of its journal entries, in case
+// the daemon stopped after journaling it but before storing its clock. It does
+// nothing if the clock was stored.
+func (d *Daemon) restoreClock(convName string, entry *proto.JournalEntry) error {
+	c, err := d.loadClock(convName)
+	if err != nil {
+		return err
+	}
+	if entry.Clock <= c.clock && entry.Sequence <= c.sequences[d.Dename] {
+		return nil
+	}
+	if entry.Clock > c.clock {
+		c.clock = entry.Clock
+	}
+	if entry.Sequence > c.sequences[d.Dename] {
+		c.sequences[d.Dename] = entry.Sequence
+	}
+	return d.storeClock(convName, c)
+}
+
+// observeClock advances the clock of a conversation past a received message
+// and records its place in the conversation, adding a notice if it suggests
+// that messages are missing or out of order. Seeing the same message again
+// changes nothing.
+func (d *Daemon) observeClock(convName, messageName string, message *proto.Message) error {
+	if message.Clock == 0 {
+		return nil
+	}
+	c, err := d.loadClock(convName)
+	if err != nil {
+		return err
+	}
+	// the notice about missing messages comes right before the message,
+	// and the one about a late message after everything seen so far
+	convDir := filepath.Join(d.ConversationDir(), convName)
+	if last, ok := c.sequences[message.Dename]; ok && message.Sequence > last+1 {
+		if err := d.writeNoticeAt(convDir, fmt.Sprintf(missingMessagesNotice, message.Sequence-last-1, message.Dename), message.Clock); err != nil {
+			return err
+		}
+	} else if ok && message.Sequence < last {
+		if err := d.writeNoticeAt(convDir, fmt.Sprintf(lateMessageNotice, message.Dename), c.clock+1); err != nil {
+			return err
+		}
+	}
+	if err := d.WriteClock(d.ClockPath(convName, messageName), message.Clock); err != nil {
+		return err
+	}
+	if message.Clock > c.clock {
+		c.clock = message.Clock
+	}
+	if message.Sequence > c.sequences[message.Dename] {
+		c.sequences[message.Dename] = message.Sequence
+	}
+	return d.storeClock(convName, c)
+}
@@ -0,0 +1,250 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// The directory of a conversation is named when it is created, after the
+// date of the first message, its sender and the other participants, see
+// persistence.ConversationName. The number in the name is the smallest that
+// no other conversation has taken. Directories from before conversations had
+// ids, which were named after the subject and the participants, are renamed
+// when the daemon starts, along with everything that is kept about their
+// messages elsewhere.
+
+// messageConversationId returns the id of the conversation of a message
+func messageConversationId(message *proto.Message) []byte {
+	if message.ConversationId != nil {
+		return message.ConversationId
+	}
+	return persistence.ConversationId(&proto.ConversationMetadata{
+		Participants: message.Participants,
+		Subject:      message.Subject,
+	})
+}
+
+// findConversationOf returns the name of the directory of the conversation of
+// message, or "" if there is none. A message from a client that does not know
+// about conversation ids is filed in a conversation with its participants and
+// subject.
+func (d *Daemon) findConversationOf(message *proto.Message) (string, error) {
+	id := messageConversationId(message)
+	convName, err := d.FindConversation(id)
+	if err != nil || convName != "" || message.ConversationId != nil {
+		return convName, err
+	}
+	convs, err := ioutil.ReadDir(d.ConversationDir())
+	if err != nil {
+		return "", err
+	}
+	for _, conv := range convs {
+		metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), conv.Name()))
+		if err != nil {
+			continue
+		}
+		legacy := persistence.ConversationId(&proto.ConversationMetadata{
+			Participants: metadata.Participants,
+			Subject:      metadata.Subject,
+		})
+		if bytes.Equal(legacy, id) {
+			return conv.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// conversationOf returns the name of the directory of the conversation of a
+// received message, which is created if it does not exist yet
+func (d *Daemon) conversationOf(message *proto.Message) (string, error) {
+	convName, err := d.findConversationOf(message)
+	if err != nil || convName != "" {
+		return convName, err
+	}
+	return d.createConversation(&proto.ConversationMetadata{
+		Participants: message.Participants,
+		Subject:      message.Subject,
+		Id:           messageConversationId(message),
+	}, time.Unix(0, message.Date), message.Dename)
+}
+
+// createConversation creates the directory of a new conversation that sender
+// started at date and returns its name. The conversation is given a random id
+// unless metadata has one already.
+func (d *Daemon) createConversation(metadata *proto.ConversationMetadata, date time.Time, sender string) (string, error) {
+	if metadata.Id == nil {
+		metadata.Id = make([]byte, persistence.ConversationIdSize)
+		if _, err := rand.Read(metadata.Id); err != nil {
+			return "", err
+		}
+	}
+	recipients := make([]string, 0, len(metadata.Participants))
+	for _, participant := range metadata.Participants {
+		if participant != sender && participant != d.Dename {
+			recipients = append(recipients, participant)
+		}
+	}
+	for number := 0; ; number++ {
+		convName := persistence.ConversationName(date, number, sender, recipients)
+		err := d.makeConversationDir(convName, metadata)
+		if err == nil {
+			return convName, nil
+		} else if !os.IsExist(err) && !strings.Contains(err.Error(), "directory not empty") {
+			return "", err
+		}
+	}
+}
+
+// storeConversationMetadata replaces the metadata of a conversation, and of
+// its outbox directory if it has one
+func (d *Daemon) storeConversationMetadata(convName string, metadata *proto.ConversationMetadata) error {
+	if err := d.WriteConversationMetadata(filepath.Join(d.ConversationDir(), convName), metadata); err != nil {
+		return err
+	}
+	outbox := filepath.Join(d.OutboxDir(), convName)
+	if _, err := os.Stat(outbox); err != nil {
+		return nil
+	}
+	return d.WriteConversationMetadata(outbox, metadata)
+}
+
+// migrateConversations gives every conversation from before there were ids
+// its id, so that it stays the same when the participants change, and the
+// name that it would be given now
+func (d *Daemon) migrateConversations() error {
+	convs, err := ioutil.ReadDir(d.ConversationDir())
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), conv.Name()))
+		if err != nil {
+			continue
+		}
+		if metadata.Id == nil {
+			metadata.Id = persistence.ConversationId(metadata)
+			if err := d.storeConversationMetadata(conv.Name(), metadata); err != nil {
+				return err
+			}
+		}
+		if !persistence.IsLegacyConversationName(conv.Name(), metadata) {
+			continue
+		}
+		date, sender, err := d.firstMessage(conv.Name())
+		if err != nil {
+			return err
+		}
+		if date.IsZero() {
+			date = conv.ModTime()
+		}
+		var recipients []string
+		for _, participant := range metadata.Participants {
+			if participant != sender && participant != d.Dename {
+				recipients = append(recipients, participant)
+			}
+		}
+		var convName string
+		for number := 0; ; number++ {
+			convName = persistence.ConversationName(date, number, sender, recipients)
+			if _, err := os.Stat(filepath.Join(d.ConversationDir(), convName)); os.IsNotExist(err) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		log.Printf("renaming conversation %q to %q", conv.Name(), convName)
+		if err := d.renameConversation(conv.Name(), convName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstMessage returns the date and the sender of the first message in the
+// conversation convName that is not a notice, or the zero time and our name if
+// there is none
+func (d *Daemon) firstMessage(convName string) (time.Time, string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	// message names start with their date, so they are listed in order
+	for _, file := range files {
+		sender, err := persistence.MessageSender(file.Name())
+		if err != nil || sender == persistence.NoticeSender {
+			continue
+		}
+		date, err := time.Parse(time.RFC3339, file.Name()[:len("2015-02-16T07:09:55Z")])
+		if err != nil {
+			continue
+		}
+		return date, sender, nil
+	}
+	return time.Time{}, d.Dename, nil
+}
+
+// renameConversation renames the directory of a conversation, and those that
+// the daemon keeps about its messages. The directory in conversations is
+// renamed last, so that an interrupted rename is finished when the daemon
+// starts again.
+func (d *Daemon) renameConversation(from, to string) error {
+	for _, dir := range append(d.conversationDirs(), d.OutboxDir()) {
+		if err := os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// the ids of sent messages and the journal refer to messages by their
+	// path in the conversations directory
+	prefix := from + string(filepath.Separator)
+	sent, err := ioutil.ReadDir(d.sentDir())
+	if err != nil {
+		return err
+	}
+	for _, file := range sent {
+		path := filepath.Join(d.sentDir(), file.Name())
+		message, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(string(message), prefix) {
+			renamed := filepath.Join(to, strings.TrimPrefix(string(message), prefix))
+			if err := d.AtomicWriteFile(path, []byte(renamed), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	batches, err := ioutil.ReadDir(d.journalDir())
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		dir := filepath.Join(d.journalDir(), batch.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			entry, err := d.loadJournalEntry(path)
+			if err != nil {
+				continue
+			}
+			if strings.HasPrefix(entry.Message, prefix) {
+				entry.Message = filepath.Join(to, strings.TrimPrefix(entry.Message, prefix))
+				if err := d.storeJournalEntry(path, entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return os.Rename(filepath.Join(d.ConversationDir(), from), filepath.Join(d.ConversationDir(), to))
+}
@@ -4,6 +4,8 @@
 package daemon
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -19,11 +21,13 @@ import (
 
 	"code.google.com/p/go.exp/fsnotify"
 	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/encoding"
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/client/profilesyncd"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/ratchet"
 	"github.com/andres-erbsen/chatterbox/shred"
+	"github.com/andres-erbsen/chatterbox/transport"
 	"github.com/andres-erbsen/dename/client"
 	dename "github.com/andres-erbsen/dename/protocol"
 )
@@ -33,6 +37,31 @@ const (
 	maxPrekeys  = 100 //TODO make this configurable
 	minPrekeys  = 50
 	daemonAppID = "daemon"
+
+	// Used unless LocalAccountConfig says otherwise
+	defaultRatchetMaxMissingMessages = 256
+	defaultRatchetSavedKeyLifetime   = ratchet.DefaultSavedKeyLifetime
+	defaultMaxTransferSize           = 64 << 20
+	// How often to delete the expired keys of missing messages and prekeys
+	savedKeyFlushInterval = time.Hour
+	// How long the prekeys we upload are valid for. New ones are uploaded when
+	// the latest one has less than half of its lifetime left.
+	prekeyLifetime = 7 * 24 * time.Hour
+	// How long the secret of an expired prekey is kept for first messages that
+	// were encrypted to it before it expired but are delivered late
+	prekeyGracePeriod = 7 * 24 * time.Hour
+	// How long to wait before trying to send a message again after the first
+	// failure. The delay doubles with every failure up to the maximum.
+	sendRetryInitialDelay = 30 * time.Second
+	sendRetryMaxDelay     = 4 * time.Hour
+	// How long to keep trying to send a message before giving up on it
+	maxSendAge = 7 * 24 * time.Hour
+	// How long before messages are deleted because of their age the user is
+	// warned about it
+	retentionWarning = 24 * time.Hour
+	// How long a temporary file may go untouched before it is considered left
+	// behind by a program that crashed
+	maxTempAge = 24 * time.Hour
 )
 
 // Daemon encapsulates long-running client-side chatterbox functionality
@@ -60,24 +89,34 @@ type Daemon struct {
 	checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error
 	fillAuth  func(tag, data []byte, theirAuthPublic *[32]byte)
 
-	cc *util.ConnectionCache
+	cc       *util.ConnectionCache
+	ratchets *ratchetIndex
+	seen     *seenIndex
+	// holds the lock of the account, see lockAccount
+	lock *os.File
+
+	// set when a message that disappears has been filed, so that the run
+	// loop reschedules deleting messages
+	expiryChanged bool
 }
 
-// Init creates a new account locally and at the server
-func Init(rootDir, dename, serverAddr string, serverPort int, serverPK *[32]byte) error {
+// Init creates a new account locally and at the server. serverOnion is the
+// onion service address of the server, or empty if it does not have one.
+func Init(rootDir, dename, serverAddr, serverOnion string, serverPort int, serverPK *[32]byte, dialer util.Dialer) error {
 	d := &Daemon{
 		Paths: persistence.Paths{
 			RootDir:     rootDir,
 			Application: "daemon",
 		},
 		LocalAccountConfig: proto.LocalAccountConfig{
-			ServerAddressTCP:  serverAddr,
-			ServerPortTCP:     int32(serverPort),
-			ServerTransportPK: (proto.Byte32)(*serverPK),
-			Dename:            dename,
+			ServerAddressTCP:   serverAddr,
+			ServerAddressOnion: serverOnion,
+			ServerPortTCP:      int32(serverPort),
+			ServerTransportPK:  (proto.Byte32)(*serverPK),
+			Dename:             dename,
 		},
 		Now: time.Now,
-		cc:  util.NewConnectionCache("127.0.0.1:9050"),
+		cc:  util.NewConnectionCache(dialer),
 	}
 	if err := os.MkdirAll(rootDir, 0700); err != nil {
 		return err
@@ -90,9 +129,10 @@ func Init(rootDir, dename, serverAddr string, serverPort int, serverPK *[32]byte
 	}
 
 	publicProfile := &proto.Profile{
-		ServerAddressTCP:  serverAddr,
-		ServerPortTCP:     int32(serverPort),
-		ServerTransportPK: (proto.Byte32)(*serverPK),
+		ServerAddressTCP:   serverAddr,
+		ServerAddressOnion: serverOnion,
+		ServerPortTCP:      int32(serverPort),
+		ServerTransportPK:  (proto.Byte32)(*serverPK),
 	}
 	if err := util.GenerateLongTermKeys(&d.LocalAccountConfig, publicProfile, rand.Reader); err != nil {
 		panic(err)
@@ -101,47 +141,59 @@ func Init(rootDir, dename, serverAddr string, serverPort int, serverPK *[32]byte
 	if err := d.MarshalToFile(d.configPath(), &d.LocalAccountConfig); err != nil {
 		return err
 	}
-	if err := d.MarshalToFile(d.ourChatterboxProfilePath(), publicProfile); err != nil {
+	if err := d.MarshalToPlaintextFile(d.ourChatterboxProfilePath(), publicProfile); err != nil {
 		return err
 	}
 
-	conn, err := d.cc.DialServer(dename, serverAddr, serverPort, serverPK,
-		(*[32]byte)(&publicProfile.UserIDAtServer), (*[32]byte)(&d.TransportSecretKeyForServer))
-	if err != nil {
-		return err
-	}
-	err = util.CreateAccount(conn, make([]byte, proto.SERVER_MESSAGE_SIZE))
-	if err != nil {
-		conn.Close()
-		d.cc.PutClose(dename)
-		return err
-	}
-	d.cc.Put(dename, conn)
-	return nil
+	return d.cc.WithConn(dename, serverAddr, serverOnion, serverPort, serverPK,
+		(*[32]byte)(&publicProfile.UserIDAtServer), (*[32]byte)(&d.TransportSecretKeyForServer),
+		func(conn *transport.Conn) error {
+			return util.CreateAccount(conn, make([]byte, proto.SERVER_MESSAGE_SIZE))
+		})
 }
 
-// Load initializes a chatterbox daemon from rootDir
-func Load(rootDir string) (*Daemon, error) {
+// Load initializes a chatterbox daemon from rootDir. All connections to
+// chatterbox servers are made using dialer. The passphrase is only used if the
+// account has one, see persistence.Paths.HasPassphrase.
+func Load(rootDir string, passphrase []byte, dialer util.Dialer) (*Daemon, error) {
 	d := &Daemon{
 		Paths: persistence.Paths{
 			RootDir:     rootDir,
 			Application: "daemon",
 		},
 		Now: time.Now,
-		cc:  util.NewConnectionCache("127.0.0.1:9050"),
+		cc:  util.NewConnectionCache(dialer),
 	}
 
-	if err := persistence.UnmarshalFromFile(d.configPath(), &d.LocalAccountConfig); err != nil {
+	// the lock is held until the process exits
+	lock, err := d.lockAccount()
+	if err != nil {
 		return nil, err
 	}
+	d.lock = lock
+	if err := d.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	if err := d.UnmarshalFromFile(d.configPath(), &d.LocalAccountConfig); err != nil {
+		return nil, err
+	}
+	if d.EncryptConversations && d.StorageKey == nil {
+		return nil, errors.New("conversations are to be encrypted, but the account has no passphrase")
+	}
 	d.ourDenameLookup = new(dename.ClientReply)
-	persistence.UnmarshalFromFile(d.ourDenameLookupReplyPath(), d.ourDenameLookup)
+	d.UnmarshalFromFile(d.ourDenameLookupReplyPath(), d.ourDenameLookup)
 
+	if err := d.removeStaleTemp(); err != nil {
+		return nil, err
+	}
 	// ensure that we have a correct directory structure
 	// including a correctly-populated outbox
 	if err := InitFs(d); err != nil {
 		return nil, err
 	}
+	if err := d.migrateConversations(); err != nil {
+		return nil, err
+	}
 	inBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
 	outBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
 
@@ -170,6 +222,12 @@ func Load(rootDir string) (*Daemon, error) {
 	d.fillAuth = util.FillAuthWith((*[32]byte)(&d.MessageAuthSecretKey))
 	d.checkAuth = util.CheckAuthWith(d.ProfileRatchet)
 
+	// finish what we were doing when we were stopped, as far as possible
+	// without a connection
+	if _, err := d.replayJournal(nil); err != nil {
+		return nil, err
+	}
+
 	return d, nil
 }
 
@@ -197,14 +255,22 @@ func (d *Daemon) Stop() {
 	d.wg.Wait()
 }
 
+// SetCoverTraffic changes how often a frame is sent to our server, and whether
+// at random; 0 turns cover traffic off. It takes effect when the daemon is
+// started.
+func (d *Daemon) SetCoverTraffic(interval time.Duration, poisson bool) error {
+	d.CoverTrafficInterval, d.CoverTrafficPoisson = int64(interval), poisson
+	return StoreLocalAccountConfig(d, &d.LocalAccountConfig)
+}
+
 // run executes the main loop of the chatterbox daemon
 func (d *Daemon) run() error {
 	profile := new(proto.Profile)
-	if err := persistence.UnmarshalFromFile(d.ourChatterboxProfilePath(), profile); err != nil {
+	if err := persistence.UnmarshalFromPlaintextFile(d.ourChatterboxProfilePath(), profile); err != nil {
 		return err
 	}
 
-	ourConn, err := d.cc.DialServer(d.Dename, d.ServerAddressTCP, 1984,
+	ourConn, err := d.cc.Dial(d.ServerAddressTCP, d.ServerAddressOnion, 1984,
 		(*[32]byte)(&d.ServerTransportPK), (*[32]byte)(&profile.UserIDAtServer),
 		(*[32]byte)(&d.TransportSecretKeyForServer))
 	if err != nil {
@@ -221,9 +287,54 @@ func (d *Daemon) run() error {
 		ReadReply:    replies,
 		ReadEnvelope: notifies,
 	}
+	if d.CoverTrafficInterval > 0 {
+		connToServer.Cover = util.NewCoverTraffic(ourConn, time.Duration(d.CoverTrafficInterval), d.CoverTrafficPoisson, nil)
+		connToServer.Cover.Start()
+		defer connToServer.Cover.Stop()
+	}
 
 	go connToServer.ReceiveMessages()
 
+	if d.ratchets, err = loadRatchetIndex(d); err != nil {
+		return err
+	}
+	if d.seen, err = loadSeenIndex(d); err != nil {
+		return err
+	}
+	if err := d.expireSavedKeys(); err != nil {
+		return err
+	}
+	if err := d.shredRetiredSessions(); err != nil {
+		return err
+	}
+	flushTicker := time.NewTicker(savedKeyFlushInterval)
+	defer flushTicker.Stop()
+	// connections to the servers of others are closed when idle even if we
+	// do not send anything else
+	evictTicker := time.NewTicker(d.cc.IdleTimeout / 2)
+	defer evictTicker.Stop()
+	retryTimer := time.NewTimer(savedKeyFlushInterval)
+	defer retryTimer.Stop()
+	replayJournal := func() error {
+		next, err := d.replayJournal(connToServer)
+		if err == nil && !next.IsZero() {
+			retryTimer.Reset(next.Sub(d.Now()))
+		}
+		return err
+	}
+	expiryTimer := time.NewTimer(savedKeyFlushInterval)
+	defer expiryTimer.Stop()
+	expireMessages := func() error {
+		next, err := d.expireMessages()
+		if err == nil && !next.IsZero() {
+			expiryTimer.Reset(next.Sub(d.Now()))
+		}
+		return err
+	}
+	if err := expireMessages(); err != nil {
+		return err
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -237,15 +348,38 @@ func (d *Daemon) run() error {
 		return d.processOutboxDir(filepath.Dir(path))
 	}
 
-	prekeyPublics, prekeySecrets, err := d.updatePrekeys(connToServer)
+	prekeyPublics, prekeySecrets, _, err := d.updatePrekeys(connToServer)
 	if err != nil {
 		return err
 	}
+	prekeyIndex := indexPrekeys(prekeyPublics)
 
 	err = WatchDir(watcher, d.OutboxDir(), initFn)
 	if err != nil {
 		return err
 	}
+	noInit := func(path string, f os.FileInfo, err error) error { return nil }
+	if err := WatchDir(watcher, d.MembershipDir(), noInit); err != nil {
+		return err
+	}
+	if err := d.processMembershipRequests(); err != nil {
+		return err
+	}
+	if err := WatchDir(watcher, d.ReviseDir(), noInit); err != nil {
+		return err
+	}
+	if err := d.processRevisionRequests(); err != nil {
+		return err
+	}
+	if err := replayJournal(); err != nil {
+		return err
+	}
+	if err := WatchDir(watcher, d.ReadMarkDir(), noInit); err != nil {
+		return err
+	}
+	if err := d.processReadMarks(); err != nil {
+		return err
+	}
 
 	if err = util.EnablePush(connToServer); err != nil {
 		return err
@@ -254,53 +388,188 @@ func (d *Daemon) run() error {
 	d.requestAllMessages(connToServer)
 
 	for {
+		if d.expiryChanged {
+			d.expiryChanged = false
+			if err := expireMessages(); err != nil {
+				return err
+			}
+		}
 		select {
 		case <-d.stop:
 			return nil
+		case <-flushTicker.C:
+			if err := d.expireSavedKeys(); err != nil {
+				return err
+			}
+			if err := d.shredRetiredSessions(); err != nil {
+				return err
+			}
+			if prekeyPublics, prekeySecrets, _, err = d.updatePrekeys(connToServer); err != nil {
+				return err
+			}
+			prekeyIndex = indexPrekeys(prekeyPublics)
+			if err := expireMessages(); err != nil {
+				return err
+			}
+		case <-expiryTimer.C:
+			if err := expireMessages(); err != nil {
+				return err
+			}
+		case <-evictTicker.C:
+			d.cc.Evict()
+		case <-retryTimer.C:
+			if err := replayJournal(); err != nil {
+				return err
+			}
 		case ev := <-watcher.Event:
 			fmt.Printf("event: %v\n", ev)
 			// event in the directory structure; watch any new directories
-			if _, err = os.Stat(ev.Name); err == nil {
+			if fi, err := os.Stat(ev.Name); err == nil && strings.HasPrefix(ev.Name, d.ReadMarkDir()+string(filepath.Separator)) {
+				if fi.IsDir() {
+					if err := WatchDir(watcher, ev.Name, noInit); err != nil {
+						log.Printf("watch %s: %s", ev.Name, err)
+					}
+				}
+				if err := d.processReadMarks(); err != nil {
+					return err
+				}
+			} else if err == nil && strings.HasPrefix(ev.Name, d.MembershipDir()+string(filepath.Separator)) {
+				if fi.IsDir() {
+					if err := WatchDir(watcher, ev.Name, noInit); err != nil {
+						log.Printf("watch %s: %s", ev.Name, err)
+					}
+				}
+				if err := d.processMembershipRequests(); err != nil {
+					return err
+				}
+				if err := replayJournal(); err != nil {
+					return err
+				}
+			} else if err == nil && strings.HasPrefix(ev.Name, d.ReviseDir()+string(filepath.Separator)) {
+				if fi.IsDir() {
+					if err := WatchDir(watcher, ev.Name, noInit); err != nil {
+						log.Printf("watch %s: %s", ev.Name, err)
+					}
+				}
+				if err := d.processRevisionRequests(); err != nil {
+					return err
+				}
+				if err := replayJournal(); err != nil {
+					return err
+				}
+			} else if err == nil {
 				err = WatchDir(watcher, ev.Name, initFn)
 				if err != nil {
 					log.Printf("watch %s: %s", ev.Name, err) // TODO
 				}
 
 				d.processOutboxDir(ev.Name)
+				if err := replayJournal(); err != nil {
+					return err
+				}
 			}
 		case envelope := <-connToServer.ReadEnvelope:
 			msgHash := sha256.Sum256(envelope)
-			// assume it's the first message we're receiving from the person; try to decrypt
-			message, ratch, index, err := d.decryptFirstMessage(envelope, prekeyPublics, prekeySecrets)
-			if err == nil {
-				// assumption was correct, found a prekey that matched
-				if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+			if seen, err := d.seenBefore(msgHash[:]); err != nil {
+				return err
+			} else if seen {
+				if err := util.DeleteMessages(connToServer, [][32]byte{msgHash}); err != nil {
 					return err
 				}
-
-				newPrekeyPublics := append(prekeyPublics[:index], prekeyPublics[index+1:]...)
-				newPrekeySecrets := append(prekeySecrets[:index], prekeySecrets[index+1:]...)
-				if err = StorePrekeys(d, newPrekeyPublics, newPrekeySecrets); err != nil {
+				continue
+			}
+			var prekey [32]byte
+			copy(prekey[:], envelope)
+			if i, ok := prekeyIndex[prekey]; len(envelope) >= len(prekey) && ok {
+				// the first message we're receiving from the person
+				message, ratch, _, err := d.decryptFirstMessage(envelope, prekeyPublics[i:i+1], prekeySecrets[i:i+1])
+				if err != nil {
+					log.Printf("RECEIVE ANOMALY: first message: %s", err)
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					continue
+				}
+				payload, ratchBytes, err := marshalReceived(message, ratch)
+				if err != nil {
 					return err
 				}
-				//TODO: Update prekeys by removing index, store
-				if err = d.receiveMessage(connToServer, message, &msgHash); err != nil {
+				if err := d.receiveJournaled(connToServer, &proto.JournalEntry{
+					Name:        message.Dename,
+					Payload:     payload,
+					Ratchet:     ratchBytes,
+					MessageHash: msgHash[:],
+					Prekey:      prekey[:],
+				}); err != nil {
 					return err
 				}
-			} else { // try decrypting with a ratchet
-				ratchets, err := AllRatchets(d, d.fillAuth, d.checkAuth)
-				if err != nil {
+				if prekeyPublics, prekeySecrets, _, err = LoadPrekeys(d); err != nil {
 					return err
 				}
-
-				message, ratch, err := d.decryptMessage(envelope, ratchets)
+				prekeyIndex = indexPrekeys(prekeyPublics)
+			} else { // route to the ratchet of an existing conversation
+				s, ok := d.ratchets.lookup(envelope)
+				if !ok {
+					log.Printf("RECEIVE ANOMALY: no ratchet matches envelope %x", msgHash)
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					continue
+				}
+				ratch, err := d.loadSession(s)
 				if err != nil {
-					fmt.Printf("RECEIVE ANOMALY: %s\n", err)
+					log.Printf("RECEIVE ANOMALY: corrupt ratchet for \"%s\": %s", s.name, err)
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					continue
 				}
-				if err = d.receiveMessage(connToServer, message, &msgHash); err != nil {
+				message, ratch, err := d.decryptMessage(envelope, []*ratchet.Ratchet{ratch})
+				if err == ratchet.ErrDuplicate {
+					if err := util.DeleteMessages(connToServer, [][32]byte{msgHash}); err != nil {
+						return err
+					}
+					continue
+				} else if err != nil && ratch != nil {
+					// the sender's ratchet is fine, but what they sent is not
+					log.Printf("RECEIVE ANOMALY: unreadable message from %s: %s", s.name, err)
+					if err := d.storeSession(s, ratch); err != nil {
+						return err
+					}
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					continue
+				} else if err != nil {
+					log.Printf("RECEIVE ANOMALY: %s", err)
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					if s.retired == "" && outOfSync(err) {
+						if err := d.resetSession(s.name); err != nil {
+							log.Printf("reset session with %s: %s", s.name, err)
+						}
+					}
+					continue
+				}
+				if message.Dename != s.name {
+					log.Printf("RECEIVE ANOMALY: %s sent a message using the ratchet of %s", message.Dename, s.name)
+					if err := d.quarantine(connToServer, envelope, &msgHash); err != nil {
+						return err
+					}
+					continue
+				}
+				payload, ratchBytes, err := marshalReceived(message, ratch)
+				if err != nil {
 					return err
 				}
-				if err := StoreRatchet(d, message.Dename, ratch); err != nil {
+				if err := d.receiveJournaled(connToServer, &proto.JournalEntry{
+					Name:        s.name,
+					Retired:     s.retired,
+					Payload:     payload,
+					Ratchet:     ratchBytes,
+					MessageHash: msgHash[:],
+				}); err != nil {
 					return err
 				}
 			}
@@ -313,32 +582,105 @@ func (d *Daemon) run() error {
 
 }
 
-func (d *Daemon) updatePrekeys(connToServer *util.ConnectionToServer) (prekeyPublics, prekeySecrets []*[32]byte, err error) {
-	// load prekeys and ensure that we have enough of them
-	prekeyPublics, prekeySecrets, err = LoadPrekeys(d)
+// configureRatchet applies the account's ratchet settings to ratch
+func (d *Daemon) configureRatchet(ratch *ratchet.Ratchet) {
+	ratch.Now = d.Now
+	ratch.MaxMissingMessages = d.RatchetMaxMissingMessages
+	if ratch.MaxMissingMessages == 0 {
+		ratch.MaxMissingMessages = defaultRatchetMaxMissingMessages
+	}
+	ratch.SavedKeyLifetime = d.savedKeyLifetime()
+}
+
+func (d *Daemon) savedKeyLifetime() time.Duration {
+	if d.RatchetSavedKeyLifetime == 0 {
+		return defaultRatchetSavedKeyLifetime
+	}
+	return time.Duration(d.RatchetSavedKeyLifetime)
+}
+
+// expireSavedKeys deletes expired message keys from all stored ratchets
+func (d *Daemon) expireSavedKeys() error {
+	files, err := ioutil.ReadDir(d.ratchetKeysDir())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name, err := encoding.UnescapeFilename(file.Name())
+		if err != nil {
+			return err
+		}
+		ratch, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+		if err != nil {
+			log.Printf("skipping corrupt ratchet for \"%s\": %s", name, err)
+			continue
+		}
+		if ratch.ExpireSavedKeys() > 0 {
+			if err := StoreRatchet(d, name, ratch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updatePrekeys shreds the prekeys that have expired, and uploads new ones if
+// the server is running low on them or the ones we have are about to expire
+func (d *Daemon) updatePrekeys(connToServer *util.ConnectionToServer) (prekeyPublics, prekeySecrets []*[32]byte, prekeyExpiries []time.Time, err error) {
+	prekeyPublics, prekeySecrets, prekeyExpiries, err = LoadPrekeys(d)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := d.Now()
+	numStored := len(prekeyPublics)
+	prekeyPublics, prekeySecrets, prekeyExpiries = dropExpiredPrekeys(now.Add(-prekeyGracePeriod), prekeyPublics, prekeySecrets, prekeyExpiries)
+	changed := len(prekeyPublics) != numStored
+
 	numKeys, err := util.GetNumKeys(connToServer)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
+	numNew := 0
 	if numKeys < minPrekeys {
-		newPublicPrekeys, newSecretPrekeys, err := GeneratePrekeys(maxPrekeys - int(numKeys))
+		numNew = maxPrekeys - int(numKeys)
+	}
+	if latestExpiry(prekeyExpiries).Sub(now) < prekeyLifetime/2 {
+		// the server drops the old ones when they expire
+		numNew = maxPrekeys
+	}
+	var newPublicPrekeys []*[32]byte
+	if numNew > 0 {
+		var newSecretPrekeys []*[32]byte
+		newPublicPrekeys, newSecretPrekeys, err = GeneratePrekeys(numNew)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		expiry := time.Unix(now.Add(prekeyLifetime).Unix(), 0)
 		prekeySecrets = append(prekeySecrets, newSecretPrekeys...)
 		prekeyPublics = append(prekeyPublics, newPublicPrekeys...)
-		if err = StorePrekeys(d, prekeyPublics, prekeySecrets); err != nil {
-			return nil, nil, err
+		for _ = range newPublicPrekeys {
+			prekeyExpiries = append(prekeyExpiries, expiry)
 		}
+		changed = true
+	}
+	if changed {
+		if err = StorePrekeys(d, prekeyPublics, prekeySecrets, prekeyExpiries); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if numNew > 0 {
 		var signingKey [64]byte
 		copy(signingKey[:], d.KeySigningSecretKey[:64])
-		err = util.UploadKeys(connToServer, util.SignKeys(newPublicPrekeys, &signingKey))
+		expiry := prekeyExpiries[len(prekeyExpiries)-1]
+		err = util.UploadKeys(connToServer, util.SignKeys(newPublicPrekeys, expiry, &signingKey))
 		if err != nil {
-			return nil, nil, err // TODO handle this nicely
+			return nil, nil, nil, err // TODO handle this nicely
 		}
 	}
-	err = nil
-	return
+	return prekeyPublics, prekeySecrets, prekeyExpiries, nil
 }
 
 func (d *Daemon) requestAllMessages(conn *util.ConnectionToServer) error {
@@ -399,119 +741,21 @@ func (d *Daemon) onOurDenameProfileDownload(p *dename.Profile, r *dename.ClientR
 	}
 }
 
+// sendFirstMessage starts a session with theirDename by sending them msg
 func (d *Daemon) sendFirstMessage(msg []byte, theirDename string) error {
-	profile, err := d.foreignDenameClient.Lookup(theirDename)
-	if err != nil {
-		return err
-	}
-	if profile == nil {
-		fmt.Errorf("unkown dename on to line: " + theirDename)
-	}
-	if err := d.MarshalToFile(d.profilePath(theirDename), profile); err != nil {
-		return err
-	}
-
-	chatProfileBytes, err := client.GetProfileField(profile, util.PROFILE_FIELD_ID)
-	if err != nil {
-		return err
-	}
-
-	chatProfile := new(proto.Profile)
-	if err := chatProfile.Unmarshal(chatProfileBytes); err != nil {
-		return err
-	}
-
-	addr := chatProfile.ServerAddressTCP
-	pkSig := (*[32]byte)(&chatProfile.KeySigningKey)
-	port := (int)(chatProfile.ServerPortTCP)
-	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
-	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
-
-	ourSkAuth := (*[32]byte)(&d.MessageAuthSecretKey)
-
-	theirConn, err := d.cc.DialServer(theirDename, addr, port, pkTransport, nil, nil)
-	if err != nil {
-		return err
-	}
-
-	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
-	theirKey, err := util.GetKey(theirConn, theirInBuf, theirPk, theirDename, pkSig)
+	envelope, ratch, err := d.encryptFirstMessage(msg, theirDename)
 	if err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
 		return err
 	}
-	encMsg, ratch, err := util.EncryptAuthFirst(msg, ourSkAuth, theirKey, d.ProfileRatchet)
-	if err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	if err := StoreRatchet(d, theirDename, ratch); err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	err = util.UploadMessageToUser(theirConn, theirInBuf, theirPk, encMsg)
-	if err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	d.cc.Put(theirDename, theirConn)
-	return nil
+	return d.sendJournaled(theirDename, envelope, ratch)
 }
 
 func (d *Daemon) sendMessage(msg []byte, theirDename string, msgRatch *ratchet.Ratchet) error {
-	profile := new(dename.Profile)
-	err := persistence.UnmarshalFromFile(d.profilePath(theirDename), profile)
-	if err != nil {
-		return err
-	}
-
-	chatProfileBytes, err := client.GetProfileField(profile, util.PROFILE_FIELD_ID)
-	if err != nil {
-		return err
-	}
-
-	chatProfile := new(proto.Profile)
-	if err := chatProfile.Unmarshal(chatProfileBytes); err != nil {
-		return err
-	}
-
-	addr := chatProfile.ServerAddressTCP
-	port := (int)(chatProfile.ServerPortTCP)
-	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
-	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
-
+	envelope, ratch, err := util.EncryptAuth(msg, msgRatch)
 	if err != nil {
 		return err
 	}
-
-	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
-
-	encMsg, ratch, err := util.EncryptAuth(msg, msgRatch)
-	if err != nil {
-		return err
-	}
-
-	theirConn, err := d.cc.DialServer(theirDename, addr, port, pkTransport, nil, nil)
-	if err != nil {
-		return err
-	}
-	if err := StoreRatchet(d, theirDename, ratch); err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	err = util.UploadMessageToUser(theirConn, theirInBuf, theirPk, encMsg)
-	if err != nil {
-		theirConn.Close()
-		d.cc.PutClose(theirDename)
-		return err
-	}
-	d.cc.Put(theirDename, theirConn)
-	return nil
+	return d.sendJournaled(theirDename, envelope, ratch)
 }
 
 func (d *Daemon) decryptFirstMessage(envelope []byte, pkList []*[32]byte, skList []*[32]byte) (*proto.Message, *ratchet.Ratchet, int, error) {
@@ -529,6 +773,9 @@ func (d *Daemon) decryptFirstMessage(envelope []byte, pkList []*[32]byte, skList
 	return message, ratch, index, nil
 }
 
+// decryptMessage decrypts envelope with the first of ratchets that can. If the
+// decrypted message cannot be parsed, the advanced ratchet is returned along
+// with the error.
 func (d *Daemon) decryptMessage(envelope []byte, ratchets []*ratchet.Ratchet) (*proto.Message, *ratchet.Ratchet, error) {
 	var ratch *ratchet.Ratchet
 	var msg []byte
@@ -540,15 +787,27 @@ func (d *Daemon) decryptMessage(envelope []byte, ratchets []*ratchet.Ratchet) (*
 		}
 	}
 	if msg == nil {
-		return nil, nil, fmt.Errorf("could not find suitable ratchet: %v", err)
+		if err == nil {
+			err = errors.New("could not find suitable ratchet")
+		}
+		return nil, nil, err
 	}
 	message := new(proto.Message)
 	if err := message.Unmarshal(msg); err != nil {
-		return nil, nil, err
+		return nil, ratch, err
 	}
 	return message, ratch, nil
 }
 
+// outOfSync tells whether a decryption error means that the ratchet of the
+// sender is out of sync with ours, so that the session has to be reset.
+// ErrCorrupt does not: the header opened, so our ratchets agree and the body
+// has been tampered with. Such an envelope is quarantined like any other
+// unreadable one and the session is kept.
+func outOfSync(err error) bool {
+	return err == ratchet.ErrCannotDecrypt || err == ratchet.ErrReorderingLimit
+}
+
 func undupStrings(ss []string) []string {
 	ret := []string{}
 	seen := make(map[string]struct{})
@@ -570,82 +829,111 @@ func (d *Daemon) processOutboxDir(dirname string) error {
 	}
 
 	metadata := proto.ConversationMetadata{}
-	err := persistence.UnmarshalFromFile(metadataFile, &metadata)
+	err := persistence.UnmarshalFromPlaintextFile(metadataFile, &metadata)
 	if err != nil {
 		return err
 	}
 
 	metadata.Participants = append(metadata.Participants, d.Dename)
-	undupStrings(metadata.Participants)
+	metadata.Participants = undupStrings(metadata.Participants)
 	sort.Strings(metadata.Participants)
-	convName := persistence.ConversationName(&metadata)
 
 	// load messages
 	potentialMessages, err := ioutil.ReadDir(dirname)
 	if err != nil {
 		return err
 	}
-	messages := make([][]byte, 0, len(potentialMessages))
+	var messages []os.FileInfo
 	for _, finfo := range potentialMessages {
 		if !finfo.IsDir() && finfo.Name() != persistence.MetadataFileName {
-			msg, err := ioutil.ReadFile(filepath.Join(dirname, finfo.Name()))
-			if err != nil {
-				return err
-			}
-
-			// make protobuf for message; append it
-			d.ourDenameLookupMu.Lock()
-			payload := proto.Message{
-				Dename:       d.Dename,
-				DenameLookup: d.ourDenameLookup,
-				Contents:     msg,
-				Subject:      metadata.Subject,
-				Participants: metadata.Participants,
-				Date:         finfo.ModTime().UnixNano(),
-			}
-			d.ourDenameLookupMu.Unlock()
-			payloadBytes, err := payload.Marshal()
-			if err != nil {
-				return err
-			}
-			messages = append(messages, payloadBytes)
+			messages = append(messages, finfo)
 		}
 	}
 	if len(messages) == 0 {
 		return nil // no messages to send, just the metadata file
 	}
 
-	if err := d.conversationToConversations(&metadata); err != nil && !os.IsExist(err) && !strings.Contains(fmt.Sprint(err), "directory not empty") {
-		log.Fatal(err)
+	// the participants and settings of the conversation may have been
+	// changed since it was created; metadata without an id is that of a new
+	// conversation
+	var convName string
+	if metadata.Id != nil {
+		if convName, err = d.FindConversation(metadata.Id); err != nil {
+			return err
+		}
 	}
-
-	for _, recipient := range metadata.Participants {
-		if recipient == d.Dename {
-			continue
+	if convName == "" {
+		date := messages[0].ModTime()
+		for _, finfo := range messages {
+			if finfo.ModTime().Before(date) {
+				date = finfo.ModTime()
+			}
 		}
-		for _, msg := range messages {
-			if err != nil {
+		if convName, err = d.createConversation(&metadata, date, d.Dename); err != nil {
+			return err
+		}
+	} else {
+		stored, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+		if err != nil {
+			return err
+		}
+		metadata = *stored
+	}
+	if !isParticipant(&metadata, d.Dename) {
+		log.Printf("not sending to %s: we are no longer a participant", convName)
+		return nil
+	}
+
+	// journal the messages for all recipients and move them to the
+	// conversation folder; they are sent when the journal is replayed
+	for _, finfo := range messages {
+		contentType := persistence.ContentTypeOfFile(finfo.Name())
+		messageName := persistence.MessageFileName(finfo.ModTime(), string(d.Dename), contentType)
+		// if the message has been journaled already, sending it may have
+		// progressed since, and it keeps the name it was journaled under
+		batch := batchName(finfo.ModTime(), "out", []byte(convName+"/"+finfo.Name()))
+		replyPath := d.ReplyPath(filepath.Base(dirname), finfo.Name())
+		inReplyTo, err := persistence.ReadId(replyPath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("not sending %s as a reply: %s", finfo.Name(), err)
+		}
+		if _, err := os.Stat(filepath.Join(d.journalDir(), batch)); os.IsNotExist(err) {
+			if messageName, err = d.messageNameFor(convName, finfo.ModTime(), d.Dename, contentType, nil); err != nil {
 				return err
 			}
-			if msgRatch, err := LoadRatchet(d, recipient, d.fillAuth, d.checkAuth); err != nil { //First message to this recipien
-				if err := d.sendFirstMessage(msg, recipient); err != nil {
-					return err
-				}
-			} else {
-				if err := d.sendMessage(msg, recipient, msgRatch); err != nil {
-					return err
-				}
+			if err := d.journalOutgoing(batch, filepath.Join(dirname, finfo.Name()), filepath.Join(convName, messageName), contentType, inReplyTo, &metadata); err != nil {
+				return err
+			}
+		} else if entry, err := d.journaledEntry(batch); err != nil {
+			return err
+		} else if entry != nil {
+			messageName = filepath.Base(entry.Message)
+			if err := d.restoreClock(convName, entry); err != nil {
+				return err
 			}
 		}
-	}
-
-	// move the sent messages to the conversation folder
-	for _, finfo := range potentialMessages {
-		if !finfo.IsDir() && finfo.Name() != persistence.MetadataFileName {
-			if err = os.Rename(filepath.Join(dirname, finfo.Name()), filepath.Join(d.ConversationDir(), persistence.ConversationName(&metadata), persistence.MessageName(finfo.ModTime(), string(d.Dename)))); err != nil {
-				log.Fatal(err)
+		message := filepath.Join(convName, messageName)
+		if inReplyTo != nil {
+			if err := d.WriteId(d.ReplyPath(convName, messageName), inReplyTo); err != nil {
+				return err
+			}
+		}
+		if contentType != "" {
+			if err := d.WriteFilename(convName, messageName, finfo.Name(), d.conversationKey()); err != nil {
+				return err
 			}
 		}
+		if metadata.MessageLifetime > 0 {
+			if err := d.setExpiry(convName, messageName, time.Duration(metadata.MessageLifetime)); err != nil {
+				return err
+			}
+		}
+		if err = d.moveToConversation(filepath.Join(dirname, finfo.Name()), filepath.Join(d.ConversationDir(), message)); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Remove(replyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 
 	// canonicalize the outbox folder name
@@ -654,41 +942,178 @@ func (d *Daemon) processOutboxDir(dirname string) error {
 			shred.RemoveAll(dirname)
 		}
 	}
+	return d.WriteConversationMetadata(filepath.Join(d.OutboxDir(), convName), &metadata)
+}
 
-	return nil
+// journalOutgoing adds the message in the file at path to the journal as
+// batch, with an entry for every recipient. message is the path that the
+// message is filed under relative to the conversations directory, contentType
+// is the type of the file, or "" for text, and inReplyTo is the id of the
+// message that it replies to, if any.
+func (d *Daemon) journalOutgoing(batch, path, message, contentType string, inReplyTo []byte, metadata *proto.ConversationMetadata) error {
+	msg, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// make protobuf for message
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c, err := d.tick(filepath.Dir(message))
+	if err != nil {
+		return err
+	}
+	d.ourDenameLookupMu.Lock()
+	payload := proto.Message{
+		Dename:       d.Dename,
+		DenameLookup: d.ourDenameLookup,
+		Contents:     msg,
+		Subject:      metadata.Subject,
+		Participants: metadata.Participants,
+		Date:         finfo.ModTime().UnixNano(),
+		Id:           newMessageId(),
+		Lifetime:     metadata.MessageLifetime,
+		ContentType:  contentType,
+		InReplyTo:    inReplyTo,
+		Clock:        c.clock,
+		Sequence:     c.sequences[d.Dename],
+	}
+	d.ourDenameLookupMu.Unlock()
+	payload.ConversationId = persistence.ConversationId(metadata)
+	if contentType != "" {
+		payload.Filename = filepath.Base(path)
+	}
+	payloadBytes, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	payloads := [][]byte{payloadBytes}
+	if len(payloadBytes) > maxPayloadSize {
+		if payloads, err = splitPayload(&payload); err != nil {
+			return err
+		}
+	}
+	chunks := len(payloads) - 1
+
+	entries := make(map[string]*proto.JournalEntry)
+	var statuses []persistence.DeliveryStatus
+	var progress []persistence.Progress
+	for _, recipient := range metadata.Participants {
+		if recipient != d.Dename {
+			statuses = append(statuses, persistence.DeliveryStatus{Recipient: recipient, Status: persistence.StatusQueued})
+			if chunks > 0 {
+				progress = append(progress, persistence.Progress{Name: recipient, Total: chunks})
+			}
+			for i, p := range payloads {
+				entries[chunkEntryName(encoding.EscapeFilename(recipient), i)] = &proto.JournalEntry{
+					Name:     recipient,
+					Payload:  p,
+					Created:  d.Now().UnixNano(),
+					Message:  message,
+					Chunk:    int32(i),
+					Chunks:   int32(chunks),
+					Clock:    c.clock,
+					Sequence: c.sequences[d.Dename],
+				}
+			}
+		}
+	}
+	if err := d.WriteDeliveryStatus(filepath.Join(d.StatusDir(), message), statuses); err != nil {
+		return err
+	}
+	if err := d.WriteProgress(filepath.Join(d.ProgressDir(), message), progress); err != nil {
+		return err
+	}
+	if err := d.recordSent(payload.Id, message); err != nil {
+		return err
+	}
+	if err := d.WriteId(filepath.Join(d.IdDir(), message), payload.Id); err != nil {
+		return err
+	}
+	if err := d.WriteClock(filepath.Join(d.ClockDir(), message), c.clock); err != nil {
+		return err
+	}
+	if _, err := d.journalBatch(batch, entries); err != nil {
+		return err
+	}
+	return d.storeClock(filepath.Dir(message), c)
+}
+
+// marshalReceived serializes a message that has been decrypted and the
+// ratchet it was decrypted with for the journal
+func marshalReceived(message *proto.Message, ratch *ratchet.Ratchet) (payload, ratchBytes []byte, err error) {
+	if payload, err = message.Marshal(); err != nil {
+		return nil, nil, err
+	}
+	if ratchBytes, err = ratch.Marshal(); err != nil {
+		return nil, nil, err
+	}
+	return payload, ratchBytes, nil
 }
 
 func (d *Daemon) receiveMessage(connToServer *util.ConnectionToServer, message *proto.Message, msgHash *[32]byte) error {
-	if err := d.saveMessage(message); err != nil {
+	if err := d.saveMessage(message); err != nil && err != errNotParticipant {
 		return err
 	}
 	return util.DeleteMessages(connToServer, [][32]byte{*msgHash})
 }
 
+// errNotParticipant is returned by saveMessage for a message that was not
+// filed because its sender is not a participant of its conversation
+var errNotParticipant = errors.New("sender is not a participant of the conversation")
+
 func (d *Daemon) saveMessage(message *proto.Message) error {
-	// generate metadata file
-	metadata := proto.ConversationMetadata{
-		Participants: message.Participants,
-		Subject:      message.Subject,
+	// find the conversation, creating its directory if it doesn't exist
+	convName, err := d.findConversationOf(message)
+	existing := convName != ""
+	if err == nil && !existing {
+		convName, err = d.conversationOf(message)
+	}
+	if err != nil {
+		return err
+	}
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return err
+	}
+	if existing && !isParticipant(metadata, message.Dename) {
+		log.Printf("ignoring message in %s from %s, who is not one of its participants", convName, message.Dename)
+		return errNotParticipant
+	}
+	messageName, err := d.messageNameFor(convName, time.Unix(0, message.Date), message.Dename, message.ContentType, message.Id)
+	if err != nil {
+		return err
 	}
-	// generate conversation name
-	convName := persistence.ConversationName(&metadata)
-	messageName := persistence.MessageName(time.Unix(0, message.Date), string(message.Dename))
-
-	// create conversation directory if it doesn't already exist
 	convDir := filepath.Join(d.ConversationDir(), convName)
 	outboxDir := filepath.Join(d.OutboxDir(), convName)
-	_, err := os.Stat(convDir)
-	if err != nil && !os.IsNotExist(err) {
+
+	if message.Lifetime > 0 {
+		if err := d.setExpiry(convName, messageName, time.Duration(message.Lifetime)); err != nil {
+			return err
+		}
+	}
+	if message.Id != nil {
+		if err := d.WriteId(d.IdPath(convName, messageName), message.Id); err != nil {
+			return err
+		}
+	}
+	if message.InReplyTo != nil {
+		if err := d.WriteId(d.ReplyPath(convName, messageName), message.InReplyTo); err != nil {
+			return err
+		}
+	}
+	if err := d.observeClock(convName, messageName, message); err != nil {
 		return err
-	} else if err != nil && os.IsNotExist(err) {
-		// new message in existing conversation
-		if err := d.conversationToConversations(&metadata); err != nil {
+	}
+	if message.ContentType != "" && message.Filename != "" {
+		// only for display; the file is always written under messageName
+		if err := d.WriteFilename(convName, messageName, filepath.Base(message.Filename), d.conversationKey()); err != nil {
 			return err
 		}
 	}
-
-	err = d.AtomicWriteFile(filepath.Join(convDir, messageName), message.Contents, 0600)
+	err = d.writeMessage(filepath.Join(convDir, messageName), message.Contents)
 	if err != nil {
 		return err
 	}
@@ -699,7 +1124,7 @@ func (d *Daemon) saveMessage(message *proto.Message) error {
 		return err
 	}
 	defer shred.RemoveAll(tdir)
-	err = d.MarshalToFile(filepath.Join(tdir, persistence.MetadataFileName), &metadata)
+	err = d.WriteConversationMetadata(tdir, metadata)
 	if err != nil {
 		return err
 	}
@@ -709,14 +1134,89 @@ func (d *Daemon) saveMessage(message *proto.Message) error {
 	return nil
 }
 
-func (p *Daemon) conversationToConversations(metadata *proto.ConversationMetadata) error {
-	path := filepath.Join(p.ConversationDir(), persistence.ConversationName(metadata))
+// messageNameFor returns the name under which a message from sender dated
+// date is filed in the conversation convName: the one that its date gives it,
+// or if another message has that name already, the one of the next second
+// that is free, so that messages from the same second do not replace each
+// other. A message that has been filed already, because it is saved again
+// when the journal is replayed, keeps its name: the file with the same id, or
+// without an id if the message has none.
+func (d *Daemon) messageNameFor(convName string, date time.Time, sender, contentType string, id []byte) (string, error) {
+	for ; ; date = date.Add(time.Second) {
+		messageName := persistence.MessageFileName(date, sender, contentType)
+		if _, err := os.Stat(filepath.Join(d.ConversationDir(), convName, messageName)); os.IsNotExist(err) {
+			return messageName, nil
+		} else if err != nil {
+			return "", err
+		}
+		other, err := persistence.ReadId(d.IdPath(convName, messageName))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if bytes.Equal(other, id) {
+			return messageName, nil
+		}
+	}
+}
+
+// writeMessage writes a message file to a conversation directory
+func (d *Daemon) writeMessage(path string, contents []byte) error {
+	return d.AtomicWriteFile(path, persistence.Seal(contents, d.conversationKey()), 0600)
+}
+
+// writeNotice adds a notice to the conversation in convDir, at the current
+// clock of the conversation. If there already is one from the same second, the
+// new one is appended to it.
+func (d *Daemon) writeNotice(convDir, notice string) error {
+	c, err := d.loadClock(filepath.Base(convDir))
+	if err != nil {
+		return err
+	}
+	return d.writeNoticeAt(convDir, notice, c.clock)
+}
+
+// writeNoticeAt is writeNotice with the notice at the given clock, which
+// puts it before the messages from participants with the same clock
+func (d *Daemon) writeNoticeAt(convDir, notice string, clock uint64) error {
+	convName, messageName := filepath.Base(convDir), persistence.MessageName(d.Now(), persistence.NoticeSender)
+	path := filepath.Join(convDir, messageName)
+	if previous, err := d.ReadMessageFromFile(path); err == nil {
+		notice = previous.Content + "\n" + notice
+	}
+	if clock != 0 {
+		if err := d.WriteClock(d.ClockPath(convName, messageName), clock); err != nil {
+			return err
+		}
+	}
+	return d.writeMessage(path, []byte(notice))
+}
+
+// moveToConversation moves a sent message from the outbox to a conversation
+// directory
+func (d *Daemon) moveToConversation(src, dst string) error {
+	if d.conversationKey() == nil {
+		return os.Rename(src, dst)
+	}
+	contents, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := d.writeMessage(dst, contents); err != nil {
+		return err
+	}
+	return shred.Remove(src)
+}
+
+// makeConversationDir creates the conversation directory convName with
+// metadata in it, failing if it exists already
+func (p *Daemon) makeConversationDir(convName string, metadata *proto.ConversationMetadata) error {
+	path := filepath.Join(p.ConversationDir(), convName)
 	tmpDir, err := p.MkdirInTemp()
 	if err != nil {
 		return err
 	}
 	defer shred.RemoveAll(tmpDir)
-	if err := p.MarshalToFile(filepath.Join(tmpDir, persistence.MetadataFileName), metadata); err != nil {
+	if err := p.WriteConversationMetadata(tmpDir, metadata); err != nil {
 		return err
 	}
 	return os.Rename(filepath.Join(tmpDir), path)
@@ -1,15 +1,26 @@
 package daemon
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"code.google.com/p/go.crypto/curve25519"
 	util "github.com/andres-erbsen/chatterbox/client"
 	"github.com/andres-erbsen/chatterbox/client/persistence"
 	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
 	"github.com/andres-erbsen/chatterbox/server"
 	"github.com/andres-erbsen/chatterbox/shred"
 	denameClient "github.com/andres-erbsen/dename/client"
@@ -58,7 +69,7 @@ func TestEncryptFirstMessage(t *testing.T) {
 		LocalAccountConfig: proto.LocalAccountConfig{
 			Dename: alice,
 		},
-		cc: util.NewConnectionCache("DANGEROUS_NO_TOR"),
+		cc: util.NewConnectionCache(util.DirectDialer{}),
 	}
 
 	bobConf := &Daemon{
@@ -74,7 +85,7 @@ func TestEncryptFirstMessage(t *testing.T) {
 		LocalAccountConfig: proto.LocalAccountConfig{
 			Dename: bob,
 		},
-		cc: util.NewConnectionCache("DANGEROUS_NO_TOR"),
+		cc: util.NewConnectionCache(util.DirectDialer{}),
 	}
 
 	aliceHomeConn := util.CreateTestAccount(alice, aliceDnmc, &aliceConf.LocalAccountConfig, serverAddr, serverPubkey, t)
@@ -118,7 +129,7 @@ func TestEncryptFirstMessage(t *testing.T) {
 	bobPublicPrekeys, bobSecretPrekeys, err := GeneratePrekeys(maxPrekeys)
 	var bobSigningKey [64]byte
 	copy(bobSigningKey[:], bobConf.KeySigningSecretKey[:64])
-	err = util.UploadKeys(bobConnToServer, util.SignKeys(bobPublicPrekeys, &bobSigningKey))
+	err = util.UploadKeys(bobConnToServer, util.SignKeys(bobPublicPrekeys, time.Now().Add(prekeyLifetime), &bobSigningKey))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -132,7 +143,7 @@ func TestEncryptFirstMessage(t *testing.T) {
 	alicePublicPrekeys, _, err := GeneratePrekeys(maxPrekeys)
 	var aliceSigningKey [64]byte
 	copy(aliceSigningKey[:], aliceConf.KeySigningSecretKey[:64])
-	err = util.UploadKeys(aliceConnToServer, util.SignKeys(alicePublicPrekeys, &aliceSigningKey))
+	err = util.UploadKeys(aliceConnToServer, util.SignKeys(alicePublicPrekeys, time.Now().Add(prekeyLifetime), &aliceSigningKey))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -208,3 +219,2072 @@ func TestEncryptFirstMessage(t *testing.T) {
 
 	//TODO: Confirm message is as expected within the test
 }
+
+var dontFillAuth = func([]byte, []byte, *[32]byte) {}
+var dontCheckAuth = func([]byte, []byte, []byte, *[32]byte) error { return nil }
+
+// pairedRatchets returns the ratchets of both sides of a new conversation
+func pairedRatchets(t *testing.T) (ours, theirs *ratchet.Ratchet) {
+	var prekey, prekeyPrivate [32]byte
+	if _, err := rand.Read(prekeyPrivate[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&prekey, &prekeyPrivate)
+	ours = &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	theirs = &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	if _, err := ours.DecryptFirst(theirs.EncryptFirst(nil, nil, &prekey), &prekeyPrivate); err != nil {
+		t.Fatal(err)
+	}
+	return ours, theirs
+}
+
+// localDaemon returns a daemon that stores its state in a new temporary
+// directory, but does not talk to any servers
+func localDaemon(t *testing.T) *Daemon {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Daemon{
+		Paths: persistence.Paths{
+			RootDir:     dir,
+			Application: "daemon",
+		},
+		Now:       time.Now,
+		fillAuth:  dontFillAuth,
+		checkAuth: dontCheckAuth,
+		ratchets:  newRatchetIndex(),
+	}
+	if err := InitFs(d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestRatchetIndex(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	peers := make(map[string]*ratchet.Ratchet)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		ours, theirs := pairedRatchets(t)
+		if err := StoreRatchet(d, name, ours); err != nil {
+			t.Fatal(err)
+		}
+		peers[name] = theirs
+	}
+
+	for name, theirs := range peers {
+		delayed := theirs.Encrypt(nil, nil)
+		envelope := theirs.Encrypt(nil, nil)
+		if found, ok := d.ratchets.lookup(envelope); !ok || found != (session{name: name}) {
+			t.Fatalf("envelope from %s routed to %+v", name, found)
+		}
+		ours, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ours.Decrypt(envelope); err != nil {
+			t.Fatal(err)
+		}
+		// after a round trip the peer uses the next header key
+		if _, err := theirs.Decrypt(ours.Encrypt(nil, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if err := StoreRatchet(d, name, ours); err != nil {
+			t.Fatal(err)
+		}
+		if found, ok := d.ratchets.lookup(theirs.Encrypt(nil, nil)); !ok || found != (session{name: name}) {
+			t.Errorf("envelope from %s after ratchet step routed to %+v", name, found)
+		}
+		if found, ok := d.ratchets.lookup(delayed); !ok || found != (session{name: name}) {
+			t.Errorf("delayed envelope from %s routed to %+v", name, found)
+		}
+	}
+
+	loaded, err := loadRatchetIndex(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, ok := loaded.lookup(peers["bob"].Encrypt(nil, nil)); !ok || found != (session{name: "bob"}) {
+		t.Errorf("index loaded from disk routed envelope from bob to %+v", found)
+	}
+	if _, ok := loaded.lookup(make([]byte, 200)); ok {
+		t.Error("garbage envelope was routed")
+	}
+}
+
+func TestDuplicateSessions(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	newPrekey := func() (pk, sk *[32]byte) {
+		pk, sk = new([32]byte), new([32]byte)
+		if _, err := rand.Read(sk[:]); err != nil {
+			t.Fatal(err)
+		}
+		curve25519.ScalarBaseMult(pk, sk)
+		return
+	}
+	ourPrekey, ourPrekeySecret := newPrekey()
+	theirPrekey, theirPrekeySecret := newPrekey()
+
+	// both sides send a first message at the same time
+	ours := &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	theirs := &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	ourFirst := ours.EncryptFirst(nil, nil, theirPrekey)
+	if err := StoreRatchet(d, "bob", ours); err != nil {
+		t.Fatal(err)
+	}
+	theirFirst := theirs.EncryptFirst(nil, nil, ourPrekey)
+	oursAtThem := &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	if _, err := oursAtThem.DecryptFirst(ourFirst, theirPrekeySecret); err != nil {
+		t.Fatal(err)
+	}
+	theirsAtUs := &ratchet.Ratchet{FillAuth: dontFillAuth, CheckAuth: dontCheckAuth}
+	if _, err := theirsAtUs.DecryptFirst(theirFirst, ourPrekeySecret); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.acceptSession("bob", theirsAtUs); err != nil {
+		t.Fatal(err)
+	}
+
+	winner, loser := theirs, oursAtThem
+	if bytes.Compare(theirPrekey[:], ourPrekey[:]) < 0 {
+		winner, loser = oursAtThem, theirs
+	}
+	primary, err := LoadRatchet(d, "bob", d.fillAuth, d.checkAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *primary.GetHandshakeKey() != *winner.GetHandshakeKey() {
+		t.Error("the session with the larger handshake key won")
+	}
+	// messages on both sessions are still received
+	if s, ok := d.ratchets.lookup(winner.Encrypt(nil, nil)); !ok || s != (session{name: "bob"}) {
+		t.Errorf("message on the winning session routed to %+v", s)
+	}
+	retired, ok := d.ratchets.lookup(loser.Encrypt(nil, nil))
+	if !ok || retired.name != "bob" || retired.retired == "" {
+		t.Errorf("message on the retired session routed to %+v", retired)
+	}
+
+	// a new session from a peer that has lost the one we have received on
+	if !supersedes(oursAtThem, theirsAtUs) {
+		t.Error("new session did not replace a session that had been used")
+	}
+
+	now := time.Now()
+	d.Now = func() time.Time { return now.Add(defaultRatchetSavedKeyLifetime + time.Hour) }
+	if err := d.shredRetiredSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.sessionPath(retired)); !os.IsNotExist(err) {
+		t.Errorf("retired session not shredded: %v", err)
+	}
+	if _, ok := d.ratchets.lookup(loser.Encrypt(nil, nil)); ok {
+		t.Error("message routed to a shredded session")
+	}
+	if _, err := LoadRatchet(d, "bob", d.fillAuth, d.checkAuth); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcceptReset(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	conversationDir(t, d, conv)
+
+	old, theirOld := pairedRatchets(t)
+	if err := StoreRatchet(d, "bob", old); err != nil {
+		t.Fatal(err)
+	}
+	retired, _ := pairedRatchets(t)
+	if err := d.storeSession(retiredSession("bob", retired), retired); err != nil {
+		t.Fatal(err)
+	}
+	ours, theirs := pairedRatchets(t)
+	if err := d.acceptReset("bob", ours); err != nil {
+		t.Fatal(err)
+	}
+
+	primary, err := LoadRatchet(d, "bob", d.fillAuth, d.checkAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *primary.GetHandshakeKey() != *ours.GetHandshakeKey() {
+		t.Error("reset did not replace the ratchet")
+	}
+	if s, err := retiredSessions(d); err != nil || len(s) != 0 {
+		t.Errorf("retired sessions left after reset: %v %v", s, err)
+	}
+	if _, ok := d.ratchets.lookup(theirOld.Encrypt(nil, nil)); ok {
+		t.Error("message on the old ratchet was routed")
+	}
+	if s, ok := d.ratchets.lookup(theirs.Encrypt(nil, nil)); !ok || s != (session{name: "bob"}) {
+		t.Errorf("message on the new ratchet routed to %+v", s)
+	}
+
+	messages, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Sender != persistence.NoticeSender {
+		t.Errorf("expected a notice in the conversation, got %v", messages)
+	}
+}
+
+func TestCorruptRatchetSkipped(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	ours, theirs := pairedRatchets(t)
+	if err := StoreRatchet(d, "bob", ours); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.ratchetPath("mallory"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ratchets, err := AllRatchets(d, d.fillAuth, d.checkAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratchets) != 1 {
+		t.Errorf("loaded %d ratchets, expected 1", len(ratchets))
+	}
+	idx, err := loadRatchetIndex(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := idx.lookup(theirs.Encrypt(nil, nil)); !ok || s != (session{name: "bob"}) {
+		t.Errorf("envelope from bob routed to %+v", s)
+	}
+	if err := d.expireSavedKeys(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnreadableMessage(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	ours, theirs := pairedRatchets(t)
+	envelope := theirs.Encrypt(nil, proto.Pad([]byte{0xff, 0xff, 0xff}, 64))
+	tampered := append([]byte{}, envelope...)
+	tampered[len(tampered)-1] ^= 1
+	if _, ratch, err := d.decryptMessage(tampered, []*ratchet.Ratchet{ours}); err != ratchet.ErrCorrupt || ratch != nil || outOfSync(err) {
+		t.Errorf("tampered message: got ratchet %v and error %v, expected to keep the session", ratch, err)
+	}
+	// the session that the tampered copy was tried with still opens the original
+	message, ratch, err := d.decryptMessage(envelope, []*ratchet.Ratchet{ours})
+	if err == nil || message != nil {
+		t.Fatalf("garbage parsed as %v", message)
+	}
+	if ratch == nil || outOfSync(err) {
+		t.Errorf("garbage: got ratchet %v and error %v, expected to keep the session", ratch, err)
+	}
+	if _, _, err := d.decryptMessage(envelope, []*ratchet.Ratchet{ratch}); err != ratchet.ErrDuplicate {
+		t.Errorf("decrypting the garbage again: got error %v, expected the ratchet to have advanced", err)
+	}
+}
+
+func TestPrekeyExpiry(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	now := time.Unix(time.Now().Unix(), 0)
+	publics, secrets, err := GeneratePrekeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiries := []time.Time{now.Add(-prekeyGracePeriod - time.Second), now.Add(-time.Second), now.Add(prekeyLifetime)}
+	if err := StorePrekeys(d, publics, secrets, expiries); err != nil {
+		t.Fatal(err)
+	}
+	loadedPublics, loadedSecrets, loadedExpiries, err := LoadPrekeys(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range publics {
+		if *loadedPublics[i] != *publics[i] || *loadedSecrets[i] != *secrets[i] || !loadedExpiries[i].Equal(expiries[i]) {
+			t.Errorf("prekey %d did not survive storage", i)
+		}
+	}
+
+	keptPublics, keptSecrets, keptExpiries := dropExpiredPrekeys(now.Add(-prekeyGracePeriod), loadedPublics, loadedSecrets, loadedExpiries)
+	if len(keptPublics) != 2 || len(keptSecrets) != 2 || len(keptExpiries) != 2 || *keptPublics[0] != *publics[1] {
+		t.Fatalf("kept %d prekeys, expected only the one past its grace period to be dropped", len(keptPublics))
+	}
+	if !latestExpiry(keptExpiries).Equal(expiries[2]) {
+		t.Errorf("latest expiry %v, expected %v", latestExpiry(keptExpiries), expiries[2])
+	}
+	if err := StorePrekeys(d, keptPublics, keptSecrets, keptExpiries); err != nil {
+		t.Fatal(err)
+	}
+	loadedPublics, _, _, err = LoadPrekeys(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loadedPublics) != 2 {
+		t.Errorf("loaded %d prekeys, expected 2", len(loadedPublics))
+	}
+	if files, err := ioutil.ReadDir(d.TempDir()); err != nil || len(files) != 0 {
+		t.Errorf("old prekeys left in %s (%v)", d.TempDir(), err)
+	}
+}
+
+func TestLegacyPrekeys(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	publics, secrets, err := GeneratePrekeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prekeysProto := proto.Prekeys{
+		PrekeyPublics: []proto.Byte32{proto.Byte32(*publics[0]), proto.Byte32(*publics[1])},
+		PrekeySecrets: []proto.Byte32{proto.Byte32(*secrets[0]), proto.Byte32(*secrets[1])},
+	}
+	if err := d.MarshalToFile(d.prekeysPath(), &prekeysProto); err != nil {
+		t.Fatal(err)
+	}
+	_, _, expiries, err := LoadPrekeys(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiries) != 2 || expiries[0].After(time.Now()) {
+		t.Errorf("prekeys without expiries loaded as expiring at %v", expiries)
+	}
+	if latestExpiry(expiries).Sub(time.Now()) >= prekeyLifetime/2 {
+		t.Error("prekeys without expiries would not be replaced")
+	}
+	if publics, _, _ := dropExpiredPrekeys(time.Now().Add(-prekeyGracePeriod), publics, secrets, expiries); len(publics) != 2 {
+		t.Errorf("kept %d prekeys without expiries, expected them to last the grace period", len(publics))
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	d.LocalAccountConfig.Dename = "alice"
+	if err := StoreLocalAccountConfig(d, &d.LocalAccountConfig); err != nil {
+		t.Fatal(err)
+	}
+	publics, secrets, err := GeneratePrekeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StorePrekeys(d, publics, secrets, []time.Time{time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	ours, _ := pairedRatchets(t)
+	if err := StoreRatchet(d, "bob", ours); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSealed := func(sealed bool) {
+		for _, path := range []string{d.configPath(), d.prekeysPath(), d.ratchetPath("bob")} {
+			bs, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if persistence.IsSealed(bs) != sealed {
+				t.Errorf("%s: sealed is %v, expected %v", path, !sealed, sealed)
+			}
+		}
+		if hasPassphrase, err := d.HasPassphrase(); err != nil || hasPassphrase != sealed {
+			t.Errorf("HasPassphrase returned %v (%v), expected %v", hasPassphrase, err, sealed)
+		}
+	}
+	checkLoad := func(passphrase []byte) {
+		loaded := &Daemon{Paths: d.Paths, Now: time.Now, fillAuth: dontFillAuth, checkAuth: dontCheckAuth}
+		if err := loaded.Unlock(passphrase); err != nil {
+			t.Fatal(err)
+		}
+		config := new(proto.LocalAccountConfig)
+		if err := loaded.UnmarshalFromFile(loaded.configPath(), config); err != nil || config.Dename != "alice" {
+			t.Errorf("config not readable: %v", err)
+		}
+		if loadedPublics, _, _, err := LoadPrekeys(loaded); err != nil || len(loadedPublics) != 1 || *loadedPublics[0] != *publics[0] {
+			t.Errorf("prekeys not readable: %v", err)
+		}
+		if _, err := LoadRatchet(loaded, "bob", loaded.fillAuth, loaded.checkAuth); err != nil {
+			t.Errorf("ratchet not readable: %v", err)
+		}
+	}
+
+	lock, err := d.lockAccount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangePassphrase(d.RootDir, nil, []byte("correct horse")); err != ErrAccountInUse {
+		t.Errorf("passphrase added while the account was in use: %v", err)
+	}
+	checkSealed(false)
+	lock.Close()
+
+	if err := ChangePassphrase(d.RootDir, nil, []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(true)
+	checkLoad([]byte("correct horse"))
+	if err := (&Daemon{Paths: d.Paths}).Unlock(nil); err != persistence.ErrLocked {
+		t.Errorf("unlocked without a passphrase: %v", err)
+	}
+	if err := ChangePassphrase(d.RootDir, []byte("battery staple"), []byte("x")); err != persistence.ErrWrongPassphrase {
+		t.Errorf("passphrase changed with a wrong one: %v", err)
+	}
+
+	if err := ChangePassphrase(d.RootDir, []byte("correct horse"), []byte("battery staple")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(true)
+	checkLoad([]byte("battery staple"))
+
+	if err := ChangePassphrase(d.RootDir, []byte("battery staple"), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(false)
+	checkLoad(nil)
+	if files, err := ioutil.ReadDir(d.TempDir()); err != nil || len(files) != 0 {
+		t.Errorf("old key material left in %s (%v)", d.TempDir(), err)
+	}
+
+	// adding a passphrase is interrupted before anything has been sealed
+	if err := d.AtomicWriteFile(d.resealPendingPath(), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteStorageKey(d.StorageKeyPath(), persistence.NewStorageKey(), []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Daemon{Paths: d.Paths}
+	if err := loaded.Unlock([]byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := LoadPrekeys(loaded); err != persistence.ErrNotSealed {
+		t.Errorf("plaintext prekeys loaded with a storage key: %v", err)
+	}
+	if err := ChangePassphrase(d.RootDir, []byte("correct horse"), []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	checkSealed(true)
+	checkLoad([]byte("correct horse"))
+	if _, err := os.Stat(d.resealPendingPath()); !os.IsNotExist(err) {
+		t.Errorf("conversion still pending: %v", err)
+	}
+}
+
+func TestEncryptConversations(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+
+	if err := StoreLocalAccountConfig(d, &d.LocalAccountConfig); err != nil {
+		t.Fatal(err)
+	}
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "sealed"}
+	conversationDir(t, d, conv)
+	old := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: []byte("before"), Date: 1}
+	if err := d.saveMessage(old); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptConversations(d.RootDir, nil, true); err == nil {
+		t.Error("conversations encrypted without a passphrase")
+	}
+	if err := ChangePassphrase(d.RootDir, nil, []byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptConversations(d.RootDir, []byte("pass"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unlock([]byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UnmarshalFromFile(d.configPath(), &d.LocalAccountConfig); err != nil || !d.EncryptConversations {
+		t.Fatalf("conversation encryption not enabled in config (%v)", err)
+	}
+	if err := d.saveMessage(&proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: []byte("after"), Date: int64(time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkMessages := func(paths *persistence.Paths, sealed bool) {
+		messages, err := paths.LoadMessages(conv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != 2 || messages[0].Content != "before" || messages[1].Content != "after" {
+			t.Fatalf("got messages %v", messages)
+		}
+		for _, msg := range messages {
+			if bs, err := ioutil.ReadFile(msg.Path); err != nil || persistence.IsSealed(bs) != sealed {
+				t.Errorf("%s: expected sealed to be %v (%v)", msg.Path, sealed, err)
+			}
+		}
+	}
+	ui := &persistence.Paths{RootDir: d.RootDir, Application: "test"}
+	if _, err := ui.LoadMessages(conv); err == nil {
+		t.Error("sealed messages read without the storage key")
+	}
+	if err := ui.Unlock([]byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(ui, true)
+
+	// the names of attachments are sealed too
+	attachment := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "attachment"}
+	attachmentConv := conversationDir(t, d, attachment)
+	if err := d.saveMessage(&proto.Message{Dename: "bob", Participants: attachment.Participants, Subject: attachment.Subject, Contents: []byte("%PDF"), Date: 1, ContentType: "application/pdf", Filename: "plans.pdf"}); err != nil {
+		t.Fatal(err)
+	}
+	attachmentName := persistence.MessageFileName(time.Unix(0, 1), "bob", "application/pdf")
+	checkFilename := func(paths *persistence.Paths, sealed bool) {
+		if bs, err := ioutil.ReadFile(d.FilenamePath(attachmentConv, attachmentName)); err != nil || persistence.IsSealed(bs) != sealed {
+			t.Errorf("filename of attachment: expected sealed to be %v (%v)", sealed, err)
+		}
+		if name, err := paths.ReadFilename(attachmentConv, attachmentName); err != nil || name != "plans.pdf" {
+			t.Errorf("filename of attachment %q (%v)", name, err)
+		}
+	}
+	checkFilename(ui, true)
+
+	// removing the passphrase decrypts the conversations too
+	if err := ChangePassphrase(d.RootDir, []byte("pass"), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkMessages(&persistence.Paths{RootDir: d.RootDir}, false)
+	checkFilename(&persistence.Paths{RootDir: d.RootDir}, false)
+
+	// a message that looks like a sealed file is still plaintext
+	d.StorageKey, d.EncryptConversations = nil, false
+	forged := persistence.Seal([]byte("forged"), persistence.NewStorageKey())
+	if err := d.saveMessage(&proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: forged, Date: int64(2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := (&persistence.Paths{RootDir: d.RootDir}).LoadMessages(conv)
+	if err != nil || len(messages) != 3 || messages[2].Content != string(forged) {
+		t.Errorf("got messages %v (%v), expected the forged one last", messages, err)
+	}
+}
+
+// journalEntries returns the journal entries in the batch directories
+// conversationDir returns the name of the directory of conv, which is created
+// if it does not exist yet
+func conversationDir(t *testing.T, d *Daemon, conv *proto.ConversationMetadata) string {
+	if conv.Id != nil {
+		convName, err := d.FindConversation(conv.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if convName != "" {
+			return convName
+		}
+	}
+	convName, err := d.createConversation(conv, d.Now(), d.Dename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return convName
+}
+
+func journalEntries(t *testing.T, d *Daemon) map[string]*proto.JournalEntry {
+	ret := make(map[string]*proto.JournalEntry)
+	batches, err := ioutil.ReadDir(d.journalDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range batches {
+		files, err := ioutil.ReadDir(filepath.Join(d.journalDir(), batch.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			path := filepath.Join(d.journalDir(), batch.Name(), file.Name())
+			if ret[path], err = d.loadJournalEntry(path); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return ret
+}
+
+func TestJournalReplayReceived(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	// we crashed right after journaling a message from bob
+	ours, theirs := pairedRatchets(t)
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	payload, ratchBytes, err := marshalReceived(&proto.Message{Dename: "bob", Participants: conv.Participants, Contents: []byte("hi"), Date: 1}, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &proto.JournalEntry{Name: "bob", Payload: payload, Ratchet: ratchBytes, MessageHash: make([]byte, 32)}
+	if _, err := d.journalBatch(batchName(d.Now(), "in", entry.MessageHash), map[string]*proto.JournalEntry{incomingEntry: entry}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := d.replayJournal(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s, ok := d.ratchets.lookup(theirs.Encrypt(nil, nil)); !ok || s != (session{name: "bob"}) {
+		t.Errorf("ratchet from the journal not stored, message routed to %+v", s)
+	}
+	messages, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Content != "hi" {
+		t.Errorf("expected the message to be saved once, got %v", messages)
+	}
+	// the message still has to be deleted from the server
+	entries := journalEntries(t, d)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 journal entry, got %d", len(entries))
+	}
+	for _, e := range entries {
+		if e.Ratchet != nil || e.MessageHash == nil {
+			t.Errorf("unexpected journal entry after replay: %+v", e)
+		}
+	}
+}
+
+func TestJournalOutbox(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"bob", "carol"}, Subject: "journal"}
+	outbox := filepath.Join(d.OutboxDir(), "new")
+	if err := os.Mkdir(outbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteConversationMetadata(outbox, conv); err != nil {
+		t.Fatal(err)
+	}
+	msgPath := filepath.Join(outbox, "msg")
+	date := time.Unix(1000, 0)
+	// a crash after journaling but before the message was moved out of the
+	// outbox makes the daemon process it again
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile(msgPath, []byte("hello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(msgPath, date, date); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.processOutboxDir(outbox); err != nil {
+			t.Fatal(err)
+		}
+		convs, err := ioutil.ReadDir(d.ConversationDir())
+		if err != nil || len(convs) != 1 {
+			t.Fatalf("%d conversations (%v)", len(convs), err)
+		}
+		outbox = filepath.Join(d.OutboxDir(), convs[0].Name())
+		msgPath = filepath.Join(outbox, "msg")
+	}
+
+	entries := journalEntries(t, d)
+	recipients := make(map[string]bool)
+	for _, e := range entries {
+		message := new(proto.Message)
+		if err := message.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if string(message.Contents) != "hello" || message.Date != date.UnixNano() {
+			t.Errorf("journaled message %+v", message)
+		}
+		recipients[e.Name] = true
+	}
+	if len(entries) != 2 || !recipients["bob"] || !recipients["carol"] {
+		t.Errorf("expected one entry for each of bob and carol, got %v", recipients)
+	}
+	var statusPath string
+	for _, e := range entries {
+		statusPath = filepath.Join(d.StatusDir(), e.Message)
+	}
+	statuses, err := persistence.ReadDeliveryStatus(statusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0] != (persistence.DeliveryStatus{Recipient: "bob", Status: persistence.StatusQueued}) || statuses[1].Recipient != "carol" {
+		t.Errorf("got delivery status %v", statuses)
+	}
+
+	// without a connection, nothing can be sent
+	if _, err := d.replayJournal(nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journalEntries(t, d)); n != 2 {
+		t.Errorf("%d journal entries left after an offline replay", n)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts := int32(1); attempts < 100; attempts++ {
+		delay := retryDelay(attempts)
+		if delay > sendRetryMaxDelay || attempts == 1 && (delay < sendRetryInitialDelay/2 || delay > sendRetryInitialDelay) {
+			t.Errorf("delay %s after %d attempts", delay, attempts)
+		}
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	now := time.Unix(1000000, 0)
+	d.Now = func() time.Time { return now }
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	conversationDir(t, d, conv)
+	// bob has no profile, so uploading to him fails
+	for i, msg := range []string{"first", "second"} {
+		entry := &proto.JournalEntry{Name: "bob", Envelope: []byte(msg), Created: now.UnixNano(), Message: filepath.Join(conversationDir(t, d, conv), msg)}
+		if _, err := d.journalBatch(batchName(now.Add(time.Duration(i)), "out", entry.Envelope), map[string]*proto.JournalEntry{"bob": entry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	online := new(util.ConnectionToServer)
+	for i := 0; i < 2; i++ {
+		next, err := d.replayJournal(online)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Sub(now) < sendRetryInitialDelay/2 || next.Sub(now) > sendRetryInitialDelay {
+			t.Errorf("retry scheduled at %s, %s from now", next, next.Sub(now))
+		}
+	}
+	for _, entry := range journalEntries(t, d) {
+		if string(entry.Envelope) == "first" && entry.Attempts != 1 || string(entry.Envelope) == "second" && entry.Attempts != 0 {
+			t.Errorf("%s: %d attempts", entry.Envelope, entry.Attempts)
+		}
+	}
+	checkStatus := func(msg, status string) {
+		statuses, err := persistence.ReadDeliveryStatus(d.StatusPath(conversationDir(t, d, conv), msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 1 || statuses[0].Recipient != "bob" || statuses[0].Status != status || statuses[0].Reason == "" {
+			t.Errorf("%s: got delivery status %v, expected %s", msg, statuses, status)
+		}
+	}
+	checkStatus("first", persistence.StatusQueued)
+
+	// both are given up on once they are too old
+	now = now.Add(maxSendAge + time.Second)
+	if _, err := d.replayJournal(online); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journalEntries(t, d)); n != 0 {
+		t.Errorf("%d journal entries left", n)
+	}
+	checkStatus("first", persistence.StatusFailed)
+	checkStatus("second", persistence.StatusFailed)
+	messages, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Sender != persistence.NoticeSender || strings.Count(messages[0].Content, "bob") != 2 {
+		t.Errorf("expected a notice about the failed messages, got %v", messages)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob", "carol"}, Subject: "receipts"}
+	if err := d.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	outbox := filepath.Join(d.OutboxDir(), persistence.OutboxName(conv))
+	if err := ioutil.WriteFile(filepath.Join(outbox, "msg"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	var id []byte
+	var statusPath string
+	for _, e := range journalEntries(t, d) {
+		message := new(proto.Message)
+		if err := message.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		id, statusPath = message.Id, filepath.Join(d.StatusDir(), e.Message)
+	}
+	if len(id) != messageIdSize {
+		t.Fatalf("message id %x", id)
+	}
+
+	receive := func(from string, kind proto.Message_Kind, target []byte) {
+		payload, err := (&proto.Message{Dename: from, Participants: conv.Participants, Subject: conv.Subject, Kind: kind, Target: target}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := &proto.JournalEntry{Name: from, Payload: payload, MessageHash: []byte(from + kind.String())}
+		if err := d.receiveJournaled(nil, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStatus := func(bob, carol string) {
+		statuses, err := persistence.ReadDeliveryStatus(statusPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(statuses) != 2 || statuses[0].Status != bob || statuses[1].Status != carol {
+			t.Errorf("got delivery status %v, expected bob %s and carol %s", statuses, bob, carol)
+		}
+	}
+	receive("bob", proto.Message_READ_RECEIPT, id)
+	receive("carol", proto.Message_DELIVERY_RECEIPT, id)
+	checkStatus(persistence.StatusRead, persistence.StatusDelivered)
+	// a late delivery receipt does not undo the read receipt, and receipts
+	// from others and for unknown messages are ignored
+	receive("bob", proto.Message_DELIVERY_RECEIPT, id)
+	receive("mallory", proto.Message_READ_RECEIPT, id)
+	receive("carol", proto.Message_READ_RECEIPT, make([]byte, messageIdSize))
+	checkStatus(persistence.StatusRead, persistence.StatusDelivered)
+	messages, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("receipts saved as messages: %v", messages)
+	}
+}
+
+func TestReadReceiptsDisabled(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	disabled := false
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, DeliveryReceipts: &disabled}
+	conversationDir(t, d, conv)
+	message := &proto.Message{Dename: "bob", Participants: conv.Participants, Contents: []byte("hi"), Date: 1, Id: newMessageId()}
+	if err := d.saveMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.acknowledge(message); err != nil {
+		t.Fatal(err)
+	}
+	convName := conversationDir(t, d, conv)
+	messageName := persistence.MessageName(time.Unix(0, 1), "bob")
+	unread := filepath.Join(d.unreadDir(), convName, messageName)
+	if _, err := os.Stat(unread); err != nil {
+		t.Errorf("message not marked unread: %s", err)
+	}
+
+	if err := d.MarkRead(convName, messageName); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processReadMarks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unread); !os.IsNotExist(err) {
+		t.Errorf("read message still unread: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d.ReadMarkDir(), convName, messageName)); !os.IsNotExist(err) {
+		t.Errorf("read mark not removed: %v", err)
+	}
+	if n := len(journalEntries(t, d)); n != 0 {
+		t.Errorf("%d receipts sent with receipts disabled", n)
+	}
+}
+
+func TestExpireMessages(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	d.MessageRetention = int64(30 * 24 * time.Hour)
+	now := time.Now()
+	d.Now = func() time.Time { return now }
+
+	write := func(conv *proto.ConversationMetadata, sender string, age time.Duration) string {
+		date := now.Add(-age)
+		path := filepath.Join(d.ConversationDir(), conversationDir(t, d, conv), persistence.MessageName(date, sender))
+		if err := d.writeMessage(path, []byte("hi")); err != nil {
+			t.Fatal(err)
+		}
+		// rewriting a message does not make it younger
+		if err := os.Chtimes(path, now, now); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	notices := func(conv *proto.ConversationMetadata) (n int) {
+		messages, err := d.LoadMessages(conv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range messages {
+			if m.Sender == persistence.NoticeSender {
+				n++
+			}
+		}
+		return n
+	}
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "expiring"}
+	old := write(conv, "bob", 40*24*time.Hour)
+	recent := write(conv, "alice", 24*time.Hour)
+	kept := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "kept", Keep: true}
+	keptOld := write(kept, "bob", 40*24*time.Hour)
+	gone := &proto.ConversationMetadata{Participants: []string{"alice", "carol"}, Subject: "gone"}
+	goneOld := write(gone, "carol", 40*24*time.Hour)
+	goneName := conversationDir(t, d, gone)
+
+	// expired messages are only deleted a while after the user was warned
+	next, err := d.expireMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists(old) || !exists(goneOld) || notices(conv) != 1 || notices(gone) != 1 {
+		t.Errorf("expired messages deleted without a warning")
+	}
+	if !next.Equal(now.Add(retentionWarning)) {
+		t.Errorf("next expiry at %s, expected %s", next, now.Add(retentionWarning))
+	}
+	if _, err := d.expireMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if notices(conv) != 1 {
+		t.Errorf("warned twice about the same messages")
+	}
+
+	now = now.Add(retentionWarning + time.Second)
+	if _, err := d.expireMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(old) || !exists(recent) || !exists(keptOld) || exists(goneOld) {
+		t.Errorf("after the warning: old %v, recent %v, kept %v, gone %v", exists(old), exists(recent), exists(keptOld), exists(goneOld))
+	}
+
+	// once the notice has expired as well, nothing is left of the conversation,
+	// not even requests that were not handled yet
+	for _, dir := range []string{d.MembershipDir(), d.ReviseDir()} {
+		if err := os.MkdirAll(filepath.Join(dir, goneName), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.MembershipDir(), goneName, "dave"), []byte(persistence.MembershipAdd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.ReviseDir(), goneName, filepath.Base(goneOld)), []byte(persistence.RevisionDelete), 0600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(31 * 24 * time.Hour)
+	if _, err := d.expireMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(filepath.Join(d.ConversationDir(), goneName)) {
+		t.Errorf("empty conversation not deleted")
+	}
+	for _, dir := range d.conversationDirs() {
+		if exists(filepath.Join(dir, goneName)) {
+			t.Errorf("%s left of a deleted conversation", filepath.Join(dir, goneName))
+		}
+	}
+	if !exists(recent) || notices(conv) != 1 {
+		t.Errorf("expected the recent message to be warned about, not deleted")
+	}
+}
+
+func TestRemoveStaleTemp(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	old := d.Now().Add(-2 * maxTempAge)
+
+	fresh := filepath.Join(d.TempDir(), "fresh")
+	stale := filepath.Join(d.TempDir(), "stale")
+	otherDir := filepath.Join(filepath.Dir(d.TempDir()), "crashed")
+	otherStale := filepath.Join(otherDir, "stale")
+	if err := os.Mkdir(otherDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{fresh, stale, otherStale} {
+		if err := ioutil.WriteFile(path, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{stale, otherStale, otherDir} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.removeStaleTemp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temporary file removed: %s", err)
+	}
+	for _, path := range []string{stale, otherDir} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s not removed", path)
+		}
+	}
+}
+
+func TestDisappearingMessages(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	now := time.Now()
+	d.Now = func() time.Time { return now }
+
+	// a message from bob disappears an hour after we received it
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "secret"}
+	message := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: []byte("hi"), Date: 1, Lifetime: int64(time.Hour)}
+	if err := d.saveMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	convName, err := d.findConversationOf(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := filepath.Join(d.ConversationDir(), convName, persistence.MessageName(time.Unix(0, 1), "bob"))
+	expiry, err := persistence.ReadExpiry(d.ExpiryPath(convName, filepath.Base(received)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiry.Equal(now.Add(time.Hour)) || !d.expiryChanged {
+		t.Errorf("message expires at %s, expected %s", expiry, now.Add(time.Hour))
+	}
+
+	// the messages we send in the conversation disappear as well
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.MessageLifetime = int64(2 * time.Hour)
+	if err := d.WriteConversationMetadata(filepath.Join(d.ConversationDir(), convName), metadata); err != nil {
+		t.Fatal(err)
+	}
+	outbox := filepath.Join(d.OutboxDir(), convName)
+	if err := ioutil.WriteFile(filepath.Join(outbox, "msg"), []byte("bye"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	var sent string
+	for _, e := range journalEntries(t, d) {
+		payload := new(proto.Message)
+		if err := payload.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Lifetime != int64(2*time.Hour) {
+			t.Errorf("sent message with lifetime %d", payload.Lifetime)
+		}
+		sent = filepath.Join(d.ConversationDir(), e.Message)
+	}
+
+	next, err := d.expireMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("next expiry at %s, expected %s", next, now.Add(time.Hour))
+	}
+	now = now.Add(time.Hour)
+	if _, err := d.expireMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(received); !os.IsNotExist(err) {
+		t.Errorf("received message did not disappear: %v", err)
+	}
+	if _, err := os.Stat(d.ExpiryPath(convName, filepath.Base(received))); !os.IsNotExist(err) {
+		t.Errorf("expiry of deleted message left behind: %v", err)
+	}
+	if _, err := os.Stat(sent); err != nil {
+		t.Errorf("sent message disappeared too early: %s", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := d.expireMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sent); !os.IsNotExist(err) {
+		t.Errorf("sent message did not disappear: %v", err)
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	// a file put in the outbox is sent as an attachment of its type
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "pictures"}
+	if err := d.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.FileToOutbox(persistence.OutboxName(conv), writeTempFile(t, d, "photo.png", "\x89PNG")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(filepath.Join(d.OutboxDir(), persistence.OutboxName(conv))); err != nil {
+		t.Fatal(err)
+	}
+	convName := conversationDir(t, d, conv)
+	entries := journalEntries(t, d)
+	if len(entries) != 1 {
+		t.Fatalf("%d journal entries, expected 1", len(entries))
+	}
+	var entry *proto.JournalEntry
+	for _, e := range entries {
+		entry = e
+	}
+	payload := new(proto.Message)
+	if err := payload.Unmarshal(entry.Payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ContentType != "image/png" || payload.Filename != "photo.png" {
+		t.Errorf("sent %q as %q", payload.Filename, payload.ContentType)
+	}
+	if filepath.Ext(entry.Message) != ".png" {
+		t.Errorf("sent attachment filed as %s", entry.Message)
+	}
+	if name, err := d.ReadFilename(convName, filepath.Base(entry.Message)); err != nil || name != "photo.png" {
+		t.Errorf("filename of sent attachment %q (%v)", name, err)
+	}
+
+	// a received file of a type that might be run is not saved as one
+	message := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: []byte("rm -rf ~"), Date: 1, ContentType: "application/x-sh", Filename: "../../run-me.sh"}
+	if err := d.saveMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	messageName := persistence.MessageName(time.Unix(0, 1), "bob") + ".bin"
+	received, err := d.ReadMessageFromFile(filepath.Join(d.ConversationDir(), convName, messageName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Sender != "bob" || received.ContentType != persistence.OctetStream {
+		t.Errorf("received attachment from %q of type %q", received.Sender, received.ContentType)
+	}
+	if name, err := d.ReadFilename(convName, messageName); err != nil || name != "run-me.sh" {
+		t.Errorf("filename of received attachment %q (%v)", name, err)
+	}
+}
+
+func writeTempFile(t *testing.T, d *Daemon, name, contents string) string {
+	dir, err := d.MkdirInTemp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestChunkedMessages(t *testing.T) {
+	alice := localDaemon(t)
+	defer shred.RemoveAll(alice.RootDir)
+	alice.Dename = "alice"
+	bob := localDaemon(t)
+	defer shred.RemoveAll(bob.RootDir)
+	bob.Dename = "bob"
+
+	// a file that does not fit in one envelope is split into chunks
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "big"}
+	if err := alice.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]byte, 3*maxPayloadSize)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.FileToOutbox(persistence.OutboxName(conv), writeTempFile(t, alice, "big.zip", string(contents))); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.processOutboxDir(filepath.Join(alice.OutboxDir(), persistence.OutboxName(conv))); err != nil {
+		t.Fatal(err)
+	}
+	entries := journalEntries(t, alice)
+	var paths []string
+	for path, entry := range entries {
+		if len(entry.Payload) > maxPayloadSize {
+			t.Errorf("%s: %d bytes of payload", path, len(entry.Payload))
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if len(paths) != 5 || entries[paths[0]].Chunk != 0 || entries[paths[4]].Chunk != 4 || entries[paths[4]].Chunks != 4 {
+		t.Fatalf("journaled %d entries for 4 chunks", len(paths))
+	}
+	sent := filepath.Join(alice.ProgressDir(), entries[paths[0]].Message)
+	if progress, err := persistence.ReadProgress(sent); err != nil || len(progress) != 1 || progress[0] != (persistence.Progress{Name: "bob", Done: 0, Total: 4}) {
+		t.Errorf("progress of sending: %v (%v)", progress, err)
+	}
+
+	// the message is filed once all chunks have arrived, in whatever order
+	receive := func(path string) {
+		entry := &proto.JournalEntry{Name: "alice", Payload: entries[path].Payload, MessageHash: []byte(path)}
+		if err := bob.finishReceive(nil, "", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messageName := filepath.Base(entries[paths[0]].Message)
+	for _, path := range []string{paths[2], paths[0], paths[4], paths[1]} {
+		receive(path)
+		if filed, err := filepath.Glob(filepath.Join(bob.ConversationDir(), "*", messageName)); err != nil || len(filed) != 0 {
+			t.Fatalf("message filed before all chunks arrived: %v (%v)", filed, err)
+		}
+	}
+	convName := conversationDir(t, bob, conv)
+	received := filepath.Join(bob.ConversationDir(), convName, messageName)
+	progress, err := persistence.ReadProgress(bob.ProgressPath(convName, messageName))
+	if err != nil || len(progress) != 1 || progress[0] != (persistence.Progress{Name: "alice", Done: 3, Total: 4}) {
+		t.Errorf("progress of receiving: %v (%v)", progress, err)
+	}
+	receive(paths[3])
+	if bs, err := ioutil.ReadFile(received); err != nil || !bytes.Equal(bs, contents) {
+		t.Errorf("received %d bytes, expected %d (%v)", len(bs), len(contents), err)
+	}
+	if _, err := os.Stat(bob.ProgressPath(convName, messageName)); !os.IsNotExist(err) {
+		t.Errorf("progress left after receiving: %v", err)
+	}
+
+	// giving up on a chunk gives up on the ones after it
+	alice.Now = func() time.Time { return time.Now().Add(maxSendAge + time.Hour) }
+	if _, err := alice.sendFailed(paths[2], entries[paths[2]], fmt.Errorf("stub")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(journalEntries(t, alice)); n != 2 {
+		t.Errorf("%d journal entries left, expected 2", n)
+	}
+	if _, err := os.Stat(sent); !os.IsNotExist(err) {
+		t.Errorf("progress left after giving up: %v", err)
+	}
+}
+
+func TestChunksDoNotMatch(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "bob"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	conversationDir(t, d, conv)
+	contents := bytes.Repeat([]byte("x"), 2*maxPayloadSize)
+	payload := &proto.Message{Dename: "alice", Participants: conv.Participants, Contents: contents, Date: 1, Id: newMessageId()}
+	payloads, err := splitPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := new(proto.Message)
+	if err := chunk.Unmarshal(payloads[1]); err != nil {
+		t.Fatal(err)
+	}
+	chunk.Contents[0] = 'y'
+	if payloads[1], err = chunk.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range payloads {
+		entry := &proto.JournalEntry{Name: "alice", Payload: p}
+		if err := d.finishReceive(nil, "", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	messages, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Sender != persistence.NoticeSender {
+		t.Errorf("expected a notice about the damaged message, got %v", messages)
+	}
+	if transfers, err := ioutil.ReadDir(d.transfersDir()); err != nil || len(transfers) != 0 {
+		t.Errorf("%d transfers left (%v)", len(transfers), err)
+	}
+}
+
+func TestChunksOutOfBounds(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "bob"
+	if err := d.SetMaxTransferSize(3 * maxPayloadSize); err != nil {
+		t.Fatal(err)
+	}
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}}
+	conversationDir(t, d, conv)
+	receive := func(m *proto.Message) {
+		payload, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.finishReceive(nil, "", &proto.JournalEntry{Name: "alice", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transfers := func() int {
+		files, err := ioutil.ReadDir(d.transfersDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(files)
+	}
+	payload := &proto.Message{Dename: "alice", Participants: conv.Participants, Contents: make([]byte, 2*maxPayloadSize), Date: 1, Id: newMessageId()}
+	payloads, err := splitPayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, chunk := new(proto.Message), new(proto.Message)
+	if err := message.Unmarshal(payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunk.Unmarshal(payloads[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// a chunk beyond the largest message we accept is not kept
+	chunk.ChunkIndex = math.MaxInt32
+	receive(chunk)
+	if n := transfers(); n != 0 {
+		t.Errorf("kept %d transfers for a chunk out of bounds", n)
+	}
+
+	// nor is a message that is too large, or claims the wrong number of chunks
+	large := *message
+	large.Id = newMessageId()
+	large.Length = 4 * maxPayloadSize
+	large.Chunks = message.Chunks * 2
+	receive(&large)
+	few := *message
+	few.Id = newMessageId()
+	few.Chunks = 1
+	receive(&few)
+	if n := transfers(); n != 0 {
+		t.Errorf("kept %d transfers for messages out of bounds", n)
+	}
+
+	// once the message has arrived, a chunk beyond its last one is not kept
+	receive(message)
+	chunk.ChunkIndex = message.Chunks
+	receive(chunk)
+	files, err := ioutil.ReadDir(d.transferDir("alice", payload.Id))
+	if err != nil || len(files) != 1 {
+		t.Errorf("kept %d files of the transfer, expected 1 (%v)", len(files), err)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "team"}
+	if err := d.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	outbox := filepath.Join(d.OutboxDir(), persistence.OutboxName(conv))
+	if err := ioutil.WriteFile(filepath.Join(outbox, "msg"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	convName := conversationDir(t, d, conv)
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := metadata.Id
+	if len(id) != persistence.ConversationIdSize {
+		t.Fatalf("conversation id %x", id)
+	}
+	for _, e := range journalEntries(t, d) {
+		message := new(proto.Message)
+		if err := message.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message.ConversationId, id) {
+			t.Errorf("sent with conversation id %x, expected %x", message.ConversationId, id)
+		}
+	}
+	if err := shred.RemoveAll(d.journalDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(d.journalDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	checkParticipants := func(expected ...string) {
+		metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(metadata.Id, id) || fmt.Sprint(metadata.Participants) != fmt.Sprint(expected) {
+			t.Errorf("conversation %x with %v, expected %x with %v", metadata.Id, metadata.Participants, id, expected)
+		}
+	}
+
+	// adding carol tells both bob and carol, and keeps the conversation
+	if err := d.ChangeMembership(convName, "carol", persistence.MembershipAdd); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processMembershipRequests(); err != nil {
+		t.Fatal(err)
+	}
+	checkParticipants("alice", "bob", "carol")
+	if _, err := os.Stat(filepath.Join(d.MembershipDir(), convName, "carol")); !os.IsNotExist(err) {
+		t.Errorf("membership request not removed: %v", err)
+	}
+	recipients := make(map[string]bool)
+	for _, e := range journalEntries(t, d) {
+		message := new(proto.Message)
+		if err := message.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if message.Kind != proto.Message_ADD_PARTICIPANT || message.Participant != "carol" || !bytes.Equal(message.ConversationId, id) {
+			t.Errorf("sent %v to %s", message, e.Name)
+		}
+		recipients[e.Name] = true
+	}
+	if len(recipients) != 2 || !recipients["bob"] || !recipients["carol"] {
+		t.Errorf("told %v about adding carol", recipients)
+	}
+
+	receive := func(from string, message *proto.Message) {
+		message.Dename = from
+		payload, err := message.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := &proto.JournalEntry{Name: from, Payload: payload, MessageHash: []byte(from + message.Kind.String() + message.Participant)}
+		if err := d.receiveJournaled(nil, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// participants can remove others, and messages are filed by the id of
+	// their conversation
+	receive("bob", &proto.Message{Kind: proto.Message_REMOVE_PARTICIPANT, Participant: "carol", ConversationId: id, Subject: "team"})
+	checkParticipants("alice", "bob")
+	receive("bob", &proto.Message{Contents: []byte("just us"), Participants: []string{"alice", "bob"}, Subject: "team", ConversationId: id, Date: 1})
+	// others cannot change the participants
+	receive("carol", &proto.Message{Kind: proto.Message_ADD_PARTICIPANT, Participant: "carol", ConversationId: id, Subject: "team"})
+	receive("mallory", &proto.Message{Kind: proto.Message_ADD_PARTICIPANT, Participant: "mallory", ConversationId: id, Subject: "team"})
+	checkParticipants("alice", "bob")
+	// and their messages are not filed
+	receive("carol", &proto.Message{Contents: []byte("still here"), Participants: []string{"alice", "bob", "carol"}, Subject: "team", ConversationId: id, Date: 2})
+	convs, err := ioutil.ReadDir(d.ConversationDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 {
+		t.Errorf("%d conversations, expected 1", len(convs))
+	}
+	messages, err := d.LoadMessages(metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notices := 0
+	for _, m := range messages {
+		if m.Sender == persistence.NoticeSender {
+			notices += strings.Count(m.Content, "\n") + 1
+		}
+		if m.Sender == "carol" {
+			t.Errorf("filed %q from carol, who had been removed", m.Content)
+		}
+	}
+	if len(messages) < 3 || notices != 2 {
+		t.Errorf("messages %v, expected one received and notices of 2 changes", messages)
+	}
+
+	// being added to a conversation we do not know about creates it
+	other := make([]byte, persistence.ConversationIdSize)
+	receive("dave", &proto.Message{Kind: proto.Message_ADD_PARTICIPANT, Participant: "alice", Participants: []string{"alice", "dave"}, ConversationId: other, Subject: "hi"})
+	otherName, err := d.FindConversation(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherName == "" {
+		t.Fatal("conversation that we were added to not created")
+	}
+	added, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), otherName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(added.Participants) != "[alice dave]" {
+		t.Errorf("added to conversation with %v", added.Participants)
+	}
+}
+
+func TestMigrateConversations(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	// a conversation from before there were ids, named after its subject and
+	// participants, with a message we sent in it
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob", "carol"}, Subject: "old"}
+	legacy := "old %between alice %and bob %and carol"
+	if !persistence.IsLegacyConversationName(legacy, conv) {
+		t.Fatalf("%q is not the legacy name", legacy)
+	}
+	if err := d.makeConversationDir(legacy, conv); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2015, 2, 16, 7, 9, 55, 0, time.UTC)
+	messageName := persistence.MessageName(date, "bob")
+	if err := d.writeMessage(filepath.Join(d.ConversationDir(), legacy, messageName), []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteDeliveryStatus(d.StatusPath(legacy, messageName), []persistence.DeliveryStatus{{Recipient: "carol", Status: persistence.StatusSent}}); err != nil {
+		t.Fatal(err)
+	}
+	id := newMessageId()
+	if err := d.recordSent(id, filepath.Join(legacy, messageName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.migrateConversations(); err != nil {
+		t.Fatal(err)
+	}
+	convName := persistence.ConversationName(date, 0, "bob", []string{"carol"})
+	if convName != "2015-02-16T07:09:55-0-bob-carol" {
+		t.Errorf("conversation named %q", convName)
+	}
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(metadata.Id, persistence.ConversationId(conv)) {
+		t.Errorf("migrated conversation has id %x, expected %x", metadata.Id, persistence.ConversationId(conv))
+	}
+	if _, err := os.Stat(filepath.Join(d.ConversationDir(), legacy)); !os.IsNotExist(err) {
+		t.Errorf("legacy directory left: %v", err)
+	}
+	if _, err := persistence.ReadDeliveryStatus(d.StatusPath(convName, messageName)); err != nil {
+		t.Errorf("delivery status not moved: %v", err)
+	}
+	if sent, err := ioutil.ReadFile(d.sentPath(id)); err != nil || string(sent) != filepath.Join(convName, messageName) {
+		t.Errorf("sent message recorded as %q (%v)", sent, err)
+	}
+
+	// messages from clients that do not send ids are still filed there, and
+	// a new conversation with the same people is a different one
+	message := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, Contents: []byte("hi again"), Date: int64(time.Hour)}
+	if err := d.saveMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := d.findConversationOf(message); err != nil || name != convName {
+		t.Errorf("message filed in %q (%v), expected %q", name, err, convName)
+	}
+	same := &proto.ConversationMetadata{Participants: []string{"alice", "bob", "carol"}, Subject: "old"}
+	d.Now = func() time.Time { return date }
+	sameName := conversationDir(t, d, same)
+	if sameName != "2015-02-16T07:09:55-0-alice-bob-carol" || bytes.Equal(same.Id, metadata.Id) {
+		t.Errorf("new conversation %q with id %x", sameName, same.Id)
+	}
+	if clash := conversationDir(t, d, &proto.ConversationMetadata{Participants: same.Participants}); clash != "2015-02-16T07:09:55-1-alice-bob-carol" {
+		t.Errorf("conversation with a taken name named %q", clash)
+	}
+}
+
+func TestConversationNameLength(t *testing.T) {
+	var recipients []string
+	for i := 0; i < 100; i++ {
+		recipients = append(recipients, fmt.Sprintf("recipient%dé", i))
+	}
+	name := persistence.ConversationName(time.Unix(0, 0), 12, "sender", recipients)
+	if len(name) > persistence.MaxConversationNameLength || !utf8.ValidString(name) {
+		t.Errorf("%d bytes: %q", len(name), name)
+	}
+	if !strings.HasPrefix(name, "1970-01-01T00:00:00-12-sender-recipient0") {
+		t.Errorf("conversation named %q", name)
+	}
+}
+
+func TestReplies(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	// a received message has its id, and a reply the id of its parent
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "threads"}
+	convName := conversationDir(t, d, conv)
+	question := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("lunch?"), Date: 1, Id: newMessageId()}
+	if err := d.saveMessage(question); err != nil {
+		t.Fatal(err)
+	}
+	questionName := persistence.MessageName(time.Unix(0, 1), "bob")
+	if id, err := persistence.ReadId(d.IdPath(convName, questionName)); err != nil || !bytes.Equal(id, question.Id) {
+		t.Errorf("received message has id %x (%v), expected %x", id, err, question.Id)
+	}
+	if _, err := os.Stat(d.ReplyPath(convName, questionName)); !os.IsNotExist(err) {
+		t.Errorf("message that is not a reply has a parent: %v", err)
+	}
+
+	// a reply from the outbox is sent with the id of its parent
+	if err := d.ReplyToOutbox(convName, "sure", question.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(filepath.Join(d.OutboxDir(), convName)); err != nil {
+		t.Fatal(err)
+	}
+	entries := journalEntries(t, d)
+	if len(entries) != 1 {
+		t.Fatalf("%d journal entries, expected 1", len(entries))
+	}
+	for _, e := range entries {
+		payload := new(proto.Message)
+		if err := payload.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload.InReplyTo, question.Id) {
+			t.Errorf("reply sent in reply to %x, expected %x", payload.InReplyTo, question.Id)
+		}
+		replyName := filepath.Base(e.Message)
+		if id, err := persistence.ReadId(d.IdPath(convName, replyName)); err != nil || !bytes.Equal(id, payload.Id) {
+			t.Errorf("sent message has id %x (%v), expected %x", id, err, payload.Id)
+		}
+		if parent, err := persistence.ReadId(d.ReplyPath(convName, replyName)); err != nil || !bytes.Equal(parent, question.Id) {
+			t.Errorf("sent reply has parent %x (%v), expected %x", parent, err, question.Id)
+		}
+	}
+	if left, err := ioutil.ReadDir(filepath.Join(d.ReplyDir(), convName)); err != nil || len(left) != 1 {
+		t.Errorf("reply files %v (%v), expected only the one of the sent reply", left, err)
+	}
+
+	// replies are forgotten along with the messages
+	answer := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("great"), Date: 2, Id: newMessageId(), InReplyTo: question.Id}
+	if err := d.saveMessage(answer); err != nil {
+		t.Fatal(err)
+	}
+	// it is from the same second as the question, and filed after it
+	answerName, err := d.FindMessage(convName, answer.Id)
+	if err != nil || answerName != persistence.MessageName(time.Unix(1, 0), "bob") {
+		t.Errorf("answer filed as %q (%v)", answerName, err)
+	}
+	if parent, err := persistence.ReadId(d.ReplyPath(convName, answerName)); err != nil || !bytes.Equal(parent, question.Id) {
+		t.Errorf("received reply has parent %x (%v), expected %x", parent, err, question.Id)
+	}
+	if err := d.shredMessage(convName, answerName); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{d.IdPath(convName, answerName), d.ReplyPath(convName, answerName)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left after the message was deleted: %v", path, err)
+		}
+	}
+}
+
+func TestMessageOrder(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+	now := time.Now()
+	d.Now = func() time.Time { return now }
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "order"}
+	convName := conversationDir(t, d, conv)
+	receive := func(clock, sequence uint64, date int64, contents string) {
+		id := sha256.Sum256([]byte(contents))
+		message := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte(contents), Date: date * int64(time.Second), Id: id[:messageIdSize], Clock: clock, Sequence: sequence}
+		if err := d.saveMessage(message); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	// bob's clock is ahead of ours, and his computer's clock behind
+	receive(5, 1, 3, "first")
+	if err := d.MessageToOutbox(convName, "second"); err != nil {
+		t.Fatal(err)
+	}
+	// a message that could not be journaled does not advance the clock
+	if err := os.Rename(d.journalDir(), d.journalDir()+"-away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(filepath.Join(d.OutboxDir(), convName)); err == nil {
+		t.Fatal("journaled without a journal")
+	}
+	if c, err := d.loadClock(convName); err != nil || c.clock != 5 || c.sequences["alice"] != 0 {
+		t.Errorf("clock advanced to %v (%v) by a message that was not journaled", c, err)
+	}
+	if err := os.Rename(d.journalDir()+"-away", d.journalDir()); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(filepath.Join(d.OutboxDir(), convName)); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range journalEntries(t, d) {
+		payload := new(proto.Message)
+		if err := payload.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Clock != 6 || payload.Sequence != 1 {
+			t.Errorf("sent with clock %d and sequence %d, expected 6 and 1", payload.Clock, payload.Sequence)
+		}
+		if clock, err := persistence.ReadClock(filepath.Join(d.ClockDir(), e.Message)); err != nil || clock != 6 {
+			t.Errorf("sent message has clock %d (%v), expected 6", clock, err)
+		}
+	}
+
+	// bob's second message overtakes his third
+	receive(7, 3, 1, "fourth")
+	receive(7, 3, 1, "fourth") // replayed from the journal
+	receive(6, 2, 2, "third")
+
+	msgs, err := d.LoadMessages(conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.Content)
+	}
+	expected := []string{
+		"first",
+		"second",
+		"third",
+		fmt.Sprintf(missingMessagesNotice, 1, "bob"),
+		"fourth",
+		fmt.Sprintf(lateMessageNotice, "bob"),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("conversation is %q, expected %q", got, expected)
+	}
+	c, err := d.loadClock(convName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.clock != 7 || c.sequences["alice"] != 1 || c.sequences["bob"] != 3 {
+		t.Errorf("clock of the conversation is %d, %v", c.clock, c.sequences)
+	}
+}
+
+func TestSameSecondMessages(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "quick"}
+	convName := conversationDir(t, d, conv)
+	contents := func() (ret []string) {
+		messages, err := d.LoadMessages(conv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range messages {
+			ret = append(ret, m.Content)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	// messages from bob in the same second do not replace each other, but
+	// one that is saved again does not get a second file
+	first := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("one"), Date: 1, Id: newMessageId()}
+	second := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("two"), Date: 2, Id: newMessageId()}
+	for _, m := range []*proto.Message{first, second, first} {
+		if err := d.saveMessage(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := contents(); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("conversation is %q, expected one and two", got)
+	}
+	for _, m := range []*proto.Message{first, second} {
+		if name, err := d.FindMessage(convName, m.Id); err != nil || name == "" {
+			t.Errorf("id of %q not kept (%v)", m.Contents, err)
+		}
+	}
+
+	// neither do ours
+	outbox := filepath.Join(d.OutboxDir(), convName)
+	if err := os.MkdirAll(outbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.WriteConversationMetadata(outbox, conv); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Unix(100, 0)
+	for _, name := range []string{"three", "four"} {
+		path := filepath.Join(outbox, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, date, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(); !reflect.DeepEqual(got, []string{"four", "one", "three", "two"}) {
+		t.Errorf("conversation is %q, expected all four messages", got)
+	}
+	sent := make(map[string]bool)
+	for _, e := range journalEntries(t, d) {
+		sent[e.Message] = true
+	}
+	if len(sent) != 2 {
+		t.Errorf("sent %v, expected two messages", sent)
+	}
+}
+
+func TestClockRestoredAfterCrash(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "crash"}
+	if err := d.ConversationToOutbox(conv); err != nil {
+		t.Fatal(err)
+	}
+	outbox := filepath.Join(d.OutboxDir(), persistence.OutboxName(conv))
+	if err := d.MessageToOutbox(persistence.OutboxName(conv), "first"); err != nil {
+		t.Fatal(err)
+	}
+	var queued os.FileInfo
+	files, err := ioutil.ReadDir(outbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != persistence.MetadataFileName {
+			queued = file
+		}
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	convName := conversationDir(t, d, conv)
+	outbox = filepath.Join(d.OutboxDir(), convName)
+
+	// the daemon stopped after journaling the message, before storing the
+	// clock and moving the message out of the outbox
+	if err := os.Remove(filepath.Join(d.clockDir(), convName)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(outbox, queued.Name())
+	if err := ioutil.WriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, queued.ModTime(), queued.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	// when the outbox is processed again, the clock is restored from the
+	// journal, so the next message does not reuse its sequence number
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.loadClock(convName); err != nil || c.clock != 1 || c.sequences["alice"] != 1 {
+		t.Errorf("clock is %v (%v) after the crash, expected 1 and 1", c, err)
+	}
+	if err := d.MessageToOutbox(convName, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(outbox); err != nil {
+		t.Fatal(err)
+	}
+	sequences := make(map[uint64]bool)
+	for _, e := range journalEntries(t, d) {
+		payload := new(proto.Message)
+		if err := payload.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		sequences[payload.Sequence] = true
+	}
+	if len(sequences) != 2 || !sequences[1] || !sequences[2] {
+		t.Errorf("sent with sequence numbers %v, expected 1 and 2", sequences)
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob", "carol"}, Subject: "typos"}
+	convName := conversationDir(t, d, conv)
+	contentsOf := func(messageName string) string {
+		msg, err := d.ReadMessageFromFile(filepath.Join(d.ConversationDir(), convName, messageName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Content
+	}
+	revisionOf := func(messageName string) string {
+		revision, _, err := persistence.ReadRevision(d.RevisedPath(convName, messageName))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return revision
+	}
+
+	received := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("secret"), Date: 1, Id: newMessageId()}
+	if err := d.saveMessage(received); err != nil {
+		t.Fatal(err)
+	}
+	receivedName := persistence.MessageName(time.Unix(0, 1), "bob")
+
+	// we edit a message that we sent, and everyone else is told
+	if err := d.MessageToOutbox(convName, "helo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processOutboxDir(filepath.Join(d.OutboxDir(), convName)); err != nil {
+		t.Fatal(err)
+	}
+	var sentName string
+	for _, e := range journalEntries(t, d) {
+		sentName = filepath.Base(e.Message)
+	}
+	sentId, err := persistence.ReadId(d.IdPath(convName, sentName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.EditMessage(convName, sentName, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processRevisionRequests(); err != nil {
+		t.Fatal(err)
+	}
+	if got := contentsOf(sentName); got != "hello" || revisionOf(sentName) != persistence.RevisionEdited {
+		t.Errorf("edited message is %q, %q", got, revisionOf(sentName))
+	}
+	edits := 0
+	for _, e := range journalEntries(t, d) {
+		payload := new(proto.Message)
+		if err := payload.Unmarshal(e.Payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Kind == proto.Message_EDIT {
+			edits++
+			if !bytes.Equal(payload.Target, sentId) || string(payload.Contents) != "hello" {
+				t.Errorf("edit of %x to %q sent, expected of %x to %q", payload.Target, payload.Contents, sentId, "hello")
+			}
+		}
+	}
+	if edits != 2 {
+		t.Errorf("edit sent to %d participants, expected 2", edits)
+	}
+	if files, err := ioutil.ReadDir(filepath.Join(d.ReviseDir(), convName)); err != nil || len(files) != 0 {
+		t.Errorf("requests left: %v (%v)", files, err)
+	}
+
+	// an edit that does not fit in one envelope is refused
+	if err := d.EditMessage(convName, sentName, strings.Repeat("x", maxPayloadSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processRevisionRequests(); err != nil {
+		t.Fatal(err)
+	}
+	if got := contentsOf(sentName); got != "hello" {
+		t.Errorf("message edited to %d bytes, which cannot be sent", len(got))
+	}
+	if n := len(journalEntries(t, d)); n != 4 {
+		t.Errorf("%d journal entries after a refused edit, expected 4", n)
+	}
+
+	// only the sender of a message can change it
+	if err := d.EditMessage(convName, receivedName, "forged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.processRevisionRequests(); err != nil {
+		t.Fatal(err)
+	}
+	forged := &proto.Message{Dename: "carol", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Date: 2, Id: newMessageId(), Kind: proto.Message_DELETE, Target: received.Id}
+	if err := d.receiveRevision("carol", forged); err != nil {
+		t.Fatal(err)
+	}
+	if got := contentsOf(receivedName); got != "secret" || revisionOf(receivedName) != "" {
+		t.Errorf("message changed by someone else than its sender to %q, %q", got, revisionOf(receivedName))
+	}
+
+	// a deleted message is shredded and stays deleted
+	deletion := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Date: 3, Id: newMessageId(), Kind: proto.Message_DELETE, Target: received.Id}
+	if err := d.receiveRevision("bob", deletion); err != nil {
+		t.Fatal(err)
+	}
+	edit := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("undeleted"), Date: 4, Id: newMessageId(), Kind: proto.Message_EDIT, Target: received.Id}
+	if err := d.receiveRevision("bob", edit); err != nil {
+		t.Fatal(err)
+	}
+	if got := contentsOf(receivedName); got != "" || revisionOf(receivedName) != persistence.RevisionDeleted {
+		t.Errorf("deleted message is %q, %q", got, revisionOf(receivedName))
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	d := localDaemon(t)
+	defer shred.RemoveAll(d.RootDir)
+	d.Dename = "alice"
+
+	// a message that was sent twice is only filed once
+	conv := &proto.ConversationMetadata{Participants: []string{"alice", "bob"}, Subject: "twice"}
+	convName := conversationDir(t, d, conv)
+	message := &proto.Message{Dename: "bob", Participants: conv.Participants, Subject: conv.Subject, ConversationId: conv.Id, Contents: []byte("once"), Date: 1, Id: newMessageId()}
+	payload, err := message.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.finishReceive(nil, "", &proto.JournalEntry{Name: "bob", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	// as when the message has been deleted from our server
+	if err := d.markSeen(messageKey("bob", message.Id)); err != nil {
+		t.Fatal(err)
+	}
+	message.Contents = []byte("twice")
+	if payload, err = message.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.finishReceive(nil, "", &proto.JournalEntry{Name: "bob", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.ReadMessageFromFile(filepath.Join(d.ConversationDir(), convName, persistence.MessageName(time.Unix(0, 1), "bob")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "once" {
+		t.Errorf("message sent twice was filed again: %q", msg.Content)
+	}
+
+	// someone else cannot keep a message from being filed by using its id
+	other := &proto.ConversationMetadata{Participants: []string{"alice", "carol"}, Subject: "copied"}
+	otherName := conversationDir(t, d, other)
+	copied := &proto.Message{Dename: "carol", Participants: other.Participants, Subject: other.Subject, ConversationId: other.Id, Contents: []byte("mine"), Date: 1, Id: message.Id}
+	if payload, err = copied.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.finishReceive(nil, "", &proto.JournalEntry{Name: "carol", Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := d.ReadMessageFromFile(filepath.Join(d.ConversationDir(), otherName, persistence.MessageName(time.Unix(0, 1), "carol"))); err != nil || msg.Content != "mine" {
+		t.Errorf("message with an id seen from someone else not filed: %v (%v)", msg, err)
+	}
+
+	// what has been seen is remembered across restarts, but not forever
+	var first [32]byte
+	if err := d.markSeen(first[:]); err != nil {
+		t.Fatal(err)
+	}
+	d.seen = nil
+	if seen, err := d.seenBefore(first[:]); err != nil || !seen {
+		t.Errorf("envelope forgotten after a restart: %v (%v)", seen, err)
+	}
+	for i := 0; i < maxSeen; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprint(i)))
+		if err := d.markSeen(hash[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seen, err := d.seenBefore(first[:]); err != nil || seen {
+		t.Errorf("oldest envelope still remembered: %v (%v)", seen, err)
+	}
+	if files, err := ioutil.ReadDir(d.seenDir()); err != nil || len(files) != maxSeen {
+		t.Errorf("%d envelopes and messages remembered (%v), expected %d", len(files), err, maxSeen)
+	}
+}
@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The server can send us the same envelope twice, for example once pushed
+// and again when all messages are requested when the daemon starts, and a
+// sender can send the same message twice if it crashed while sending it. The
+// daemon remembers the hashes of the envelopes it has received and the ids of
+// the messages it has filed in the seen directory, as empty files named after
+// them in hex. An id is remembered hashed with the user whose session the
+// message came in on, see messageKey: senders choose the ids of their
+// messages, so one sender cannot keep a message of another from being filed by
+// reusing its id. An envelope or a message that has been seen already is
+// deleted from our server without anything else being done about it. Only the
+// maxSeen most recent are remembered.
+
+const maxSeen = 4096
+
+func (d *Daemon) seenDir() string { return filepath.Join(d.privDir(), "seen") }
+
+// seenIndex holds the names of the files in the seen directory, oldest first
+type seenIndex struct {
+	names map[string]bool
+	order []string
+}
+
+type byModTime []os.FileInfo
+
+func (fs byModTime) Len() int           { return len(fs) }
+func (fs byModTime) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+func (fs byModTime) Less(i, j int) bool { return fs[i].ModTime().Before(fs[j].ModTime()) }
+
+// loadSeenIndex indexes the seen directory
+func loadSeenIndex(d *Daemon) (*seenIndex, error) {
+	files, err := ioutil.ReadDir(d.seenDir())
+	if err != nil {
+		return nil, err
+	}
+	sort.Stable(byModTime(files))
+	idx := &seenIndex{names: make(map[string]bool)}
+	for _, file := range files {
+		idx.names[file.Name()] = true
+		idx.order = append(idx.order, file.Name())
+	}
+	return idx, nil
+}
+
+// messageKey returns the key that the message with id from sender is
+// remembered by
+func messageKey(sender string, id []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(sender))
+	h.Write([]byte{0})
+	h.Write(id)
+	return h.Sum(nil)
+}
+
+// seenBefore tells whether the envelope with hash key, or the message with
+// messageKey key, has been seen already
+func (d *Daemon) seenBefore(key []byte) (bool, error) {
+	if d.seen == nil {
+		var err error
+		if d.seen, err = loadSeenIndex(d); err != nil {
+			return false, err
+		}
+	}
+	return d.seen.names[hex.EncodeToString(key)], nil
+}
+
+// markSeen remembers an envelope hash or a messageKey, and forgets the oldest
+// if there are more than maxSeen
+func (d *Daemon) markSeen(key []byte) error {
+	if seen, err := d.seenBefore(key); err != nil || seen {
+		return err
+	}
+	name := hex.EncodeToString(key)
+	if err := ioutil.WriteFile(filepath.Join(d.seenDir(), name), nil, 0600); err != nil {
+		return err
+	}
+	d.seen.names[name] = true
+	d.seen.order = append(d.seen.order, name)
+	for len(d.seen.order) > maxSeen {
+		oldest := d.seen.order[0]
+		if err := os.Remove(filepath.Join(d.seenDir(), oldest)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(d.seen.names, oldest)
+		d.seen.order = d.seen.order[1:]
+	}
+	return nil
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"code.google.com/p/go.exp/fsnotify"
 	"github.com/andres-erbsen/chatterbox/client/encoding"
@@ -26,6 +28,29 @@ func (d *Daemon) prekeysPath() string    { return filepath.Join(d.privDir(), "pr
 func (d *Daemon) ratchetKeysDir() string { return filepath.Join(d.privDir(), "ratchet") }
 func (d *Daemon) configPath() string     { return filepath.Join(d.privDir(), "config.pb") }
 
+func (d *Daemon) quarantineDir() string { return filepath.Join(d.privDir(), "quarantine") }
+func (d *Daemon) lockPath() string      { return filepath.Join(d.privDir(), "lock") }
+func (d *Daemon) journalDir() string    { return filepath.Join(d.privDir(), "journal") }
+func (d *Daemon) sentDir() string       { return filepath.Join(d.privDir(), "sent") }
+func (d *Daemon) unreadDir() string     { return filepath.Join(d.privDir(), "unread") }
+
+// messageDirs returns the directories that keep something about a message at
+// the same relative path as the message in the conversations directory
+func (d *Daemon) messageDirs() []string {
+	return []string{d.StatusDir(), d.unreadDir(), d.ReadMarkDir(), d.ReviseDir(), d.RevisedDir(), d.ExpiryDir(), d.FilenameDir(), d.ProgressDir(), d.IdDir(), d.ReplyDir(), d.ClockDir()}
+}
+
+// conversationDirs returns the directories other than the outbox that keep
+// something about a conversation under its name in the conversations
+// directory
+func (d *Daemon) conversationDirs() []string {
+	return append(d.messageDirs(), d.MembershipDir(), d.retentionDir(), d.clockDir())
+}
+
+func (d *Daemon) retiredRatchetsDir() string {
+	return filepath.Join(d.privDir(), "ratchet-retired")
+}
+
 func (d *Daemon) ourDenameLookupReplyPath() string {
 	return filepath.Join(d.privDir(), "ourDenameLookupReply.pb")
 }
@@ -37,6 +62,12 @@ func (d *Daemon) ourChatterboxProfilePath() string {
 func (d *Daemon) ratchetPath(name string) string {
 	return filepath.Join(d.ratchetKeysDir(), encoding.EscapeFilename(name))
 }
+func (d *Daemon) sessionPath(s session) string {
+	if s.retired == "" {
+		return d.ratchetPath(s.name)
+	}
+	return filepath.Join(d.retiredRatchetsDir(), encoding.EscapeFilename(s.name), s.retired)
+}
 func (d *Daemon) profilePath(name string) string {
 	return filepath.Join(d.profilesDir(), encoding.EscapeFilename(name))
 }
@@ -65,43 +96,88 @@ func Copy(source string, dest string, perm os.FileMode) error {
 	return cerr
 }
 
-func LoadPrekeys(d *Daemon) ([]*[32]byte, []*[32]byte, error) {
+// LoadPrekeys returns the public and secret prekeys we have uploaded and the
+// times their signatures expire at
+func LoadPrekeys(d *Daemon) (prekeyPublics, prekeySecrets []*[32]byte, prekeyExpiries []time.Time, err error) {
 	prekeysProto := new(proto.Prekeys)
-	err := persistence.UnmarshalFromFile(d.prekeysPath(), prekeysProto)
+	err = d.UnmarshalFromFile(d.prekeysPath(), prekeysProto)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil, nil
+			return nil, nil, nil, nil
 		}
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	if len(prekeysProto.PrekeyPublics) != len(prekeysProto.PrekeySecrets) {
-		return nil, nil, fmt.Errorf("len(prekeysProto.prekeyPublics) != len(prekeysProto.prekeySecrets)")
+		return nil, nil, nil, fmt.Errorf("len(prekeysProto.prekeyPublics) != len(prekeysProto.prekeySecrets)")
 	}
+	// prekeys stored before they had expiries were uploaded in a format that
+	// the server no longer hands out: they expire now, so that new ones are
+	// uploaded at once, and are kept for the grace period
+	legacy := len(prekeysProto.PrekeyExpiries) != len(prekeysProto.PrekeyPublics)
 	// convert protobuf proto.Byte32 to *[32]byte
-	prekeySecrets := make([]*[32]byte, len(prekeysProto.PrekeySecrets))
-	prekeyPublics := make([]*[32]byte, len(prekeysProto.PrekeyPublics))
+	prekeySecrets = make([]*[32]byte, len(prekeysProto.PrekeySecrets))
+	prekeyPublics = make([]*[32]byte, len(prekeysProto.PrekeyPublics))
+	prekeyExpiries = make([]time.Time, len(prekeysProto.PrekeyPublics))
 	for i := 0; i < len(prekeySecrets); i++ {
 		prekeySecrets[i] = (*[32]byte)(&prekeysProto.PrekeySecrets[i])
 		prekeyPublics[i] = (*[32]byte)(&prekeysProto.PrekeyPublics[i])
+		if legacy {
+			prekeyExpiries[i] = d.Now()
+		} else {
+			prekeyExpiries[i] = time.Unix(prekeysProto.PrekeyExpiries[i], 0)
+		}
 	}
-	return prekeyPublics, prekeySecrets, nil
+	return prekeyPublics, prekeySecrets, prekeyExpiries, nil
 }
 
-func StorePrekeys(d *Daemon, prekeyPublics, prekeySecrets []*[32]byte) error {
-	if len(prekeyPublics) != len(prekeySecrets) {
-		panic("len(prekeysPublics) != len(prekeySecrets)")
+// StorePrekeys replaces the stored prekeys and shreds the previous version of
+// the file: the secrets of used and expired prekeys must not survive on disk.
+func StorePrekeys(d *Daemon, prekeyPublics, prekeySecrets []*[32]byte, prekeyExpiries []time.Time) error {
+	if len(prekeyPublics) != len(prekeySecrets) || len(prekeyPublics) != len(prekeyExpiries) {
+		panic("prekeyPublics, prekeySecrets and prekeyExpiries differ in length")
 	}
 	// convert [32]byte to proto.Byte32
 	prekeysProto := proto.Prekeys{
-		PrekeySecrets: make([]proto.Byte32, len(prekeySecrets)),
-		PrekeyPublics: make([]proto.Byte32, len(prekeySecrets)),
+		PrekeySecrets:  make([]proto.Byte32, len(prekeySecrets)),
+		PrekeyPublics:  make([]proto.Byte32, len(prekeySecrets)),
+		PrekeyExpiries: make([]int64, len(prekeySecrets)),
 	}
 	for i := 0; i < len(prekeyPublics); i++ {
 		prekeysProto.PrekeySecrets[i] = (proto.Byte32)(*prekeySecrets[i])
 		prekeysProto.PrekeyPublics[i] = (proto.Byte32)(*prekeyPublics[i])
+		prekeysProto.PrekeyExpiries[i] = prekeyExpiries[i].Unix()
 	}
-	return d.MarshalToFile(d.prekeysPath(), &prekeysProto)
+	return d.shredReplaced(d.prekeysPath(), func() error {
+		return d.MarshalToFile(d.prekeysPath(), &prekeysProto)
+	})
+}
+
+// shredReplaced calls replace, which atomically replaces the file at path, and
+// then shreds the previous contents of the file
+func (d *Daemon) shredReplaced(path string, replace func() error) error {
+	// keep a link to the old version so that it can be shredded once the new
+	// one has replaced it
+	old, err := d.TempFile()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(old); err != nil {
+		return err
+	}
+	if err := os.Link(path, old); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		old = ""
+	}
+	if err := replace(); err != nil {
+		return err
+	}
+	if old != "" {
+		return shred.Remove(old)
+	}
+	return nil
 }
 
 func StoreLocalAccountConfig(d *Daemon, localAccountConfig *proto.LocalAccountConfig) error {
@@ -110,21 +186,22 @@ func StoreLocalAccountConfig(d *Daemon, localAccountConfig *proto.LocalAccountCo
 
 func LoadRatchet(d *Daemon, name string, fillAuth func(tag, data []byte, theirAuthPublic *[32]byte), checkAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error) (*ratchet.Ratchet, error) {
 	ratch := new(ratchet.Ratchet)
-	if err := persistence.UnmarshalFromFile(d.ratchetPath(name), ratch); err != nil {
+	if err := d.UnmarshalFromFile(d.ratchetPath(name), ratch); err != nil {
 		return nil, err
 	}
 	ratch.FillAuth = fillAuth
 	ratch.CheckAuth = checkAuth
+	d.configureRatchet(ratch)
 	return ratch, nil
 }
 
 func StoreRatchet(d *Daemon, name string, ratch *ratchet.Ratchet) error {
-	return d.MarshalToFile(d.ratchetPath(name), ratch)
+	return d.storeSession(session{name: name}, ratch)
 }
 
 func (d *Daemon) LatestProfile(name string, received *dename.Profile) (*dename.Profile, error) {
 	stored := new(dename.Profile)
-	err := persistence.UnmarshalFromFile(d.profilePath(name), stored)
+	err := d.UnmarshalFromFile(d.profilePath(name), stored)
 	if err != nil {
 		stored = nil
 	}
@@ -145,12 +222,14 @@ func AllRatchets(d *Daemon, fillAuth func(tag, data []byte, theirAuthPublic *[32
 			continue
 		}
 		ratch := new(ratchet.Ratchet)
-		err := persistence.UnmarshalFromFile(filepath.Join(d.ratchetKeysDir(), file.Name()), ratch)
+		err := d.UnmarshalFromFile(filepath.Join(d.ratchetKeysDir(), file.Name()), ratch)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse ratchet for \"%s\": %s", file.Name(), err)
+			log.Printf("skipping corrupt ratchet for \"%s\": %s", file.Name(), err)
+			continue
 		}
 		ratch.FillAuth = fillAuth
 		ratch.CheckAuth = checkAuth
+		d.configureRatchet(ratch)
 		ret = append(ret, ratch)
 	}
 	return ret, nil
@@ -162,10 +241,30 @@ func InitFs(d *Daemon) error {
 	subdirs := []string{
 		d.ConversationDir(),
 		d.OutboxDir(),
+		d.StatusDir(),
+		d.ReadMarkDir(),
+		d.MembershipDir(),
+		d.ReviseDir(),
+		d.RevisedDir(),
+		d.ExpiryDir(),
+		d.FilenameDir(),
+		d.ProgressDir(),
+		d.IdDir(),
+		d.ReplyDir(),
+		d.ClockDir(),
 		d.TempDir(),
 		d.privDir(),
 		d.profilesDir(),
 		d.ratchetKeysDir(),
+		d.retiredRatchetsDir(),
+		d.quarantineDir(),
+		d.journalDir(),
+		d.sentDir(),
+		d.unreadDir(),
+		d.retentionDir(),
+		d.clockDir(),
+		d.transfersDir(),
+		d.seenDir(),
 	}
 	for _, dir := range subdirs {
 		os.MkdirAll(dir, 0700) // FIXME: handle error
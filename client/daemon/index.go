@@ -0,0 +1,121 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+)
+
+// session identifies a stored ratchet: the one used to talk to name or, if
+// retired is not empty, one of the retired ones kept around to receive
+// messages that were sent before the peer learned which session we use.
+type session struct {
+	name    string
+	retired string
+}
+
+// ratchetIndex maps the receive header keys of all ratchets to the sessions
+// they belong to, so that an incoming envelope can be routed to the one
+// ratchet that can decrypt it without loading every ratchet from disk. It must
+// be updated whenever a ratchet is stored.
+type ratchetIndex struct {
+	sync.Mutex
+	byHeaderKey map[[32]byte]session
+	bySession   map[session][][32]byte
+}
+
+func newRatchetIndex() *ratchetIndex {
+	return &ratchetIndex{
+		byHeaderKey: make(map[[32]byte]session),
+		bySession:   make(map[session][][32]byte),
+	}
+}
+
+// loadRatchetIndex indexes all ratchets on disk
+func loadRatchetIndex(d *Daemon) (*ratchetIndex, error) {
+	idx := newRatchetIndex()
+	files, err := ioutil.ReadDir(d.ratchetKeysDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name, err := encoding.UnescapeFilename(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		ratch, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+		if err != nil {
+			log.Printf("skipping corrupt ratchet for \"%s\": %s", name, err)
+			continue
+		}
+		idx.update(session{name: name}, ratch)
+	}
+	retired, err := retiredSessions(d)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range retired {
+		ratch, err := d.loadSession(s)
+		if err != nil {
+			log.Printf("skipping corrupt retired ratchet for \"%s\": %s", s.name, err)
+			continue
+		}
+		idx.update(s, ratch)
+	}
+	return idx, nil
+}
+
+// update replaces the header keys indexed for s with those of ratch
+func (idx *ratchetIndex) update(s session, ratch *ratchet.Ratchet) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeLocked(s)
+	keys := ratch.ReceiveHeaderKeys()
+	for _, key := range keys {
+		idx.byHeaderKey[key] = s
+	}
+	idx.bySession[s] = keys
+}
+
+func (idx *ratchetIndex) remove(s session) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeLocked(s)
+}
+
+func (idx *ratchetIndex) removeLocked(s session) {
+	for _, key := range idx.bySession[s] {
+		if idx.byHeaderKey[key] == s {
+			delete(idx.byHeaderKey, key)
+		}
+	}
+	delete(idx.bySession, s)
+}
+
+// lookup returns the session whose header key envelope was sealed with. Only
+// headers are opened, the ratchets themselves are not touched.
+func (idx *ratchetIndex) lookup(envelope []byte) (session, bool) {
+	idx.Lock()
+	defer idx.Unlock()
+	for key, s := range idx.byHeaderKey {
+		if ratchet.HeaderKeyMatches(envelope, &key) {
+			return s, true
+		}
+	}
+	return session{}, false
+}
+
+// indexPrekeys maps each prekey public key to its position in prekeyPublics
+func indexPrekeys(prekeyPublics []*[32]byte) map[[32]byte]int {
+	ret := make(map[[32]byte]int, len(prekeyPublics))
+	for i, pk := range prekeyPublics {
+		ret[*pk] = i
+	}
+	return ret
+}
@@ -0,0 +1,590 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+	"github.com/andres-erbsen/chatterbox/transport"
+	"github.com/andres-erbsen/dename/client"
+	dename "github.com/andres-erbsen/dename/protocol"
+)
+
+// Sending or receiving a message takes several steps that must each happen
+// exactly once: the ratchet is advanced and stored, the envelope is uploaded
+// to the server of the recipient or deleted from ours, and the message is
+// filed in its conversation. Before the first of them, a journal entry with
+// everything that is needed to finish is written, and it is updated as the
+// steps are completed and removed after the last one. Whatever a crash
+// interrupted is finished by replaying the journal when the daemon is loaded
+// (only the steps that need no connection) and when it has connected to our
+// server.
+//
+// An outgoing message starts as an entry with its payload for each recipient;
+// encrypting it to one of them replaces the payload with the envelope and the
+// new ratchet. An incoming message starts as an entry with the decrypted
+// payload and the new ratchet. The entries that are created together are kept
+// in one directory in the journal, named so that they sort in the order in
+// which they were created.
+
+// incomingEntry is the name of the only entry of an incoming message
+const incomingEntry = "incoming"
+
+const sendFailedNotice = "The message %s could not be delivered to %s."
+
+// retryDelay returns how long to wait before trying to send a message again
+// after attempts failures: the delay doubles with every failure, and a random
+// part of it is left out so that the messages that failed together are not
+// all retried at once. If no randomness can be read, the whole delay is used.
+func retryDelay(attempts int32) time.Duration {
+	delay := sendRetryInitialDelay
+	for i := int32(1); i < attempts && delay < sendRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > sendRetryMaxDelay {
+		delay = sendRetryMaxDelay
+	}
+	u, err := util.RandomFloat(rand.Reader)
+	if err != nil {
+		log.Printf("retry delay: %s", err)
+		return delay
+	}
+	return delay/2 + time.Duration(u*float64(delay/2))
+}
+
+// batchName returns the name of the journal directory for the entries created
+// at t for the message identified by id
+func batchName(t time.Time, direction string, id []byte) string {
+	h := sha256.Sum256(id)
+	return fmt.Sprintf("%020d-%s-%x", t.UnixNano(), direction, h[:8])
+}
+
+func (d *Daemon) loadJournalEntry(path string) (*proto.JournalEntry, error) {
+	entry := new(proto.JournalEntry)
+	if err := d.UnmarshalFromFile(path, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// storeJournalEntry writes entry to path and shreds what was there before,
+// which may have been a plaintext or a ratchet state
+func (d *Daemon) storeJournalEntry(path string, entry *proto.JournalEntry) error {
+	return d.shredReplaced(path, func() error {
+		return d.MarshalToFile(path, entry)
+	})
+}
+
+// journalBatch atomically adds the entries, keyed by file name, to the journal
+// as the directory batch. It returns the path of the directory, or "" if the
+// batch was already in the journal.
+func (d *Daemon) journalBatch(batch string, entries map[string]*proto.JournalEntry) (string, error) {
+	dir := filepath.Join(d.journalDir(), batch)
+	if _, err := os.Stat(dir); err == nil {
+		return "", nil
+	}
+	tmpDir, err := d.MkdirInTemp()
+	if err != nil {
+		return "", err
+	}
+	defer shred.RemoveAll(tmpDir)
+	for name, entry := range entries {
+		if err := d.MarshalToFile(filepath.Join(tmpDir, name), entry); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmpDir, dir); err != nil {
+		if os.IsExist(err) || strings.Contains(err.Error(), "directory not empty") {
+			return "", nil
+		}
+		return "", err
+	}
+	return dir, nil
+}
+
+// journaledEntry returns one of the journal entries in batch, or nil if there
+// are none left
+func (d *Daemon) journaledEntry(batch string) (*proto.JournalEntry, error) {
+	dir := filepath.Join(d.journalDir(), batch)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if entry, err := d.loadJournalEntry(filepath.Join(dir, file.Name())); err == nil {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// replayJournal finishes sending and receiving the messages in the journal.
+// If connToServer is nil, only the steps that need no connection are taken.
+// It returns when the next message that could not be sent is to be retried,
+// or the zero time if there is none.
+func (d *Daemon) replayJournal(connToServer *util.ConnectionToServer) (time.Time, error) {
+	var next time.Time
+	batches, err := ioutil.ReadDir(d.journalDir())
+	if err != nil {
+		return next, err
+	}
+	now := d.Now()
+	// messages to a recipient must be sent in order, so once one of them
+	// is waiting to be retried the later ones wait for it
+	waiting := make(map[string]bool)
+	for _, batch := range batches {
+		dir := filepath.Join(d.journalDir(), batch.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return next, err
+		}
+		for _, file := range files {
+			path := filepath.Join(dir, file.Name())
+			entry, err := d.loadJournalEntry(path)
+			if os.IsNotExist(err) {
+				continue // a chunk of a message that has been given up on
+			} else if err != nil {
+				log.Printf("skipping corrupt journal entry %s: %s", path, err)
+				continue
+			}
+			if entry.MessageHash != nil {
+				if err := d.finishReceive(connToServer, path, entry); err != nil {
+					log.Printf("journal entry %s: %s", path, err)
+				}
+				continue
+			}
+			if waiting[entry.Name] {
+				continue
+			}
+			if retry := time.Unix(0, entry.NextAttempt); entry.NextAttempt != 0 && retry.After(now) {
+				waiting[entry.Name] = true
+				if next.IsZero() || retry.Before(next) {
+					next = retry
+				}
+				continue
+			}
+			if err := d.finishSend(connToServer != nil, path, entry); err != nil {
+				log.Printf("sending to %s failed: %s", entry.Name, err)
+				retry, err := d.sendFailed(path, entry, err)
+				if err != nil {
+					return next, err
+				}
+				if !retry.IsZero() {
+					waiting[entry.Name] = true
+					if next.IsZero() || retry.Before(next) {
+						next = retry
+					}
+				}
+			}
+		}
+		os.Remove(dir) // only succeeds once all entries are done
+	}
+	return next, nil
+}
+
+// sendFailed records a failed attempt to send the message in the journal
+// entry at path and returns when to try again. A message that is older than
+// maxSendAge is given up on instead, and the user is told about it.
+func (d *Daemon) sendFailed(path string, entry *proto.JournalEntry, cause error) (time.Time, error) {
+	now := d.Now()
+	if now.Sub(time.Unix(0, entry.Created)) <= maxSendAge {
+		entry.Attempts++
+		retry := now.Add(retryDelay(entry.Attempts))
+		entry.NextAttempt = retry.UnixNano()
+		if err := d.storeJournalEntry(path, entry); err != nil {
+			return time.Time{}, err
+		}
+		return retry, d.setDeliveryStatus(entry, persistence.StatusQueued, cause.Error())
+	}
+	log.Printf("giving up on sending %s to %s", entry.Message, entry.Name)
+	if err := d.setDeliveryStatus(entry, persistence.StatusFailed, cause.Error()); err != nil {
+		return time.Time{}, err
+	}
+	if entry.Chunks > 0 {
+		if err := d.abandonChunks(path, entry); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if entry.Message != "" {
+		notice := fmt.Sprintf(sendFailedNotice, filepath.Base(entry.Message), entry.Name)
+		if err := d.writeNotice(filepath.Join(d.ConversationDir(), filepath.Dir(entry.Message)), notice); err != nil && !os.IsNotExist(err) {
+			return time.Time{}, err
+		}
+	}
+	return time.Time{}, shred.Remove(path)
+}
+
+// unmarshalRatchet reads a ratchet state stored in a journal entry
+func (d *Daemon) unmarshalRatchet(bs []byte) (*ratchet.Ratchet, error) {
+	ratch := new(ratchet.Ratchet)
+	if err := ratch.Unmarshal(bs); err != nil {
+		return nil, err
+	}
+	ratch.FillAuth = d.fillAuth
+	ratch.CheckAuth = d.checkAuth
+	d.configureRatchet(ratch)
+	return ratch, nil
+}
+
+// sendJournaled adds an envelope that has been encrypted with ratch to the
+// journal and then sends it
+func (d *Daemon) sendJournaled(theirDename string, envelope []byte, ratch *ratchet.Ratchet) error {
+	ratchBytes, err := ratch.Marshal()
+	if err != nil {
+		return err
+	}
+	entry := &proto.JournalEntry{Name: theirDename, Envelope: envelope, Ratchet: ratchBytes, Created: d.Now().UnixNano()}
+	return d.sendJournalEntry(batchName(d.Now(), "out", envelope), entry)
+}
+
+// sendJournalEntry adds entry to the journal as the only one in batch and
+// then sends it. If sending fails, it is retried later.
+func (d *Daemon) sendJournalEntry(batch string, entry *proto.JournalEntry) error {
+	name := encoding.EscapeFilename(entry.Name)
+	dir, err := d.journalBatch(batch, map[string]*proto.JournalEntry{name: entry})
+	if err != nil || dir == "" {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if err := d.finishSend(true, path, entry); err != nil {
+		log.Printf("sending to %s failed: %s", entry.Name, err)
+		_, err = d.sendFailed(path, entry, err)
+		return err
+	}
+	return nil
+}
+
+// finishSend takes the remaining steps of sending the message in the journal
+// entry at path: encrypting it, storing the ratchet and uploading the
+// envelope. The entry is updated as the steps are completed.
+func (d *Daemon) finishSend(online bool, path string, entry *proto.JournalEntry) error {
+	if entry.Payload != nil {
+		if !online {
+			return nil // encrypting a first message needs a key from their server
+		}
+		var envelope []byte
+		var ratch *ratchet.Ratchet
+		msgRatch, err := LoadRatchet(d, entry.Name, d.fillAuth, d.checkAuth)
+		if err != nil { // first message to this recipient
+			envelope, ratch, err = d.encryptFirstMessage(entry.Payload, entry.Name)
+		} else {
+			envelope, ratch, err = util.EncryptAuth(entry.Payload, msgRatch)
+		}
+		if err != nil {
+			return err
+		}
+		ratchBytes, err := ratch.Marshal()
+		if err != nil {
+			return err
+		}
+		entry.Payload, entry.Envelope, entry.Ratchet = nil, envelope, ratchBytes
+		if err := d.storeJournalEntry(path, entry); err != nil {
+			return err
+		}
+	}
+	if entry.Ratchet != nil {
+		ratch, err := d.unmarshalRatchet(entry.Ratchet)
+		if err != nil {
+			return err
+		}
+		if err := StoreRatchet(d, entry.Name, ratch); err != nil {
+			return err
+		}
+		entry.Ratchet = nil
+		if err := d.storeJournalEntry(path, entry); err != nil {
+			return err
+		}
+	}
+	if !online {
+		return nil
+	}
+	if err := d.uploadEnvelope(entry.Name, entry.Envelope); err != nil {
+		return err
+	}
+	if entry.Chunks > 0 {
+		if err := d.updateProgress(entry.Message, entry.Name, int(entry.Chunk), int(entry.Chunks)); err != nil {
+			return err
+		}
+	}
+	// a message sent in chunks has been sent once the last one has
+	if entry.Chunk == entry.Chunks {
+		if err := d.setDeliveryStatus(entry, persistence.StatusSent, ""); err != nil {
+			return err
+		}
+	}
+	return shred.Remove(path)
+}
+
+// deliveryProgress orders the statuses that a message goes through for a
+// recipient. A status is never replaced by an earlier one, which could
+// otherwise happen when a replayed upload is recorded after a receipt.
+var deliveryProgress = map[string]int{
+	persistence.StatusQueued:    0,
+	persistence.StatusFailed:    0,
+	persistence.StatusSent:      1,
+	persistence.StatusDelivered: 2,
+	persistence.StatusRead:      3,
+}
+
+// setDeliveryStatus publishes the status of the message in a journal entry
+// for its recipient, see persistence.DeliveryStatus. Messages that did not
+// come from the outbox have no status.
+func (d *Daemon) setDeliveryStatus(entry *proto.JournalEntry, status, reason string) error {
+	if entry.Message == "" {
+		return nil
+	}
+	return d.updateDeliveryStatus(entry.Message, entry.Name, status, reason, true)
+}
+
+// updateDeliveryStatus publishes the status of message, its path relative to
+// the conversations directory, for recipient. Recipients that are not yet in
+// the status file are only added if add is set.
+func (d *Daemon) updateDeliveryStatus(message, recipient, status, reason string, add bool) error {
+	path := filepath.Join(d.StatusDir(), message)
+	statuses, err := persistence.ReadDeliveryStatus(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	updated := persistence.DeliveryStatus{Recipient: recipient, Status: status, Reason: reason}
+	for i := range statuses {
+		if statuses[i].Recipient == recipient {
+			if deliveryProgress[status] < deliveryProgress[statuses[i].Status] {
+				return nil
+			}
+			statuses[i] = updated
+			return d.WriteDeliveryStatus(path, statuses)
+		}
+	}
+	if !add {
+		log.Printf("ignoring %s status for %s from %s, who it was not sent to", status, message, recipient)
+		return nil
+	}
+	return d.WriteDeliveryStatus(path, append(statuses, updated))
+}
+
+// receiveJournaled adds a message that has been decrypted to the journal and
+// then files it and deletes it from our server
+func (d *Daemon) receiveJournaled(connToServer *util.ConnectionToServer, entry *proto.JournalEntry) error {
+	dir, err := d.journalBatch(batchName(d.Now(), "in", entry.MessageHash), map[string]*proto.JournalEntry{incomingEntry: entry})
+	if err != nil || dir == "" {
+		return err
+	}
+	// the ratchet has moved past the envelope, which could not be decrypted
+	// again
+	if err := d.markSeen(entry.MessageHash); err != nil {
+		return err
+	}
+	return d.finishReceive(connToServer, filepath.Join(dir, incomingEntry), entry)
+}
+
+// finishReceive takes the remaining steps of receiving the message in the
+// journal entry at path: storing the ratchet, using up the prekey, saving the
+// message (or the receipt in it), acknowledging it and deleting it from our
+// server.
+func (d *Daemon) finishReceive(connToServer *util.ConnectionToServer, path string, entry *proto.JournalEntry) error {
+	message := new(proto.Message)
+	if err := message.Unmarshal(entry.Payload); err != nil {
+		return err
+	}
+	if entry.Ratchet != nil {
+		ratch, err := d.unmarshalRatchet(entry.Ratchet)
+		if err != nil {
+			return err
+		}
+		if entry.Prekey != nil {
+			if err := d.acceptFirstMessage(entry.Name, ratch, message.SessionReset); err != nil {
+				return err
+			}
+			if err := d.usePrekey(entry.Prekey); err != nil {
+				return err
+			}
+		} else if err := d.storeSession(session{name: entry.Name, retired: entry.Retired}, ratch); err != nil {
+			return err
+		}
+		entry.Ratchet, entry.Prekey = nil, nil
+		if err := d.storeJournalEntry(path, entry); err != nil {
+			return err
+		}
+	}
+	// saved is the message that has been filed, if any
+	saved := message
+	var err error
+	// a message that its sender sent twice is only filed once
+	duplicate := false
+	if message.Id != nil {
+		if duplicate, err = d.seenBefore(messageKey(entry.Name, message.Id)); err != nil {
+			return err
+		}
+	}
+	switch {
+	case duplicate:
+		saved = nil
+	case message.SessionReset:
+	case message.Kind == proto.Message_CHUNK || message.Chunks > 0:
+		if saved, err = d.receiveChunk(message); err == nil && saved != nil {
+			err = d.saveMessage(saved)
+		}
+	case message.Kind == proto.Message_ADD_PARTICIPANT || message.Kind == proto.Message_REMOVE_PARTICIPANT:
+		err = d.receiveMembership(entry.Name, message)
+	case message.Kind == proto.Message_EDIT || message.Kind == proto.Message_DELETE:
+		err = d.receiveRevision(entry.Name, message)
+	case message.Kind != proto.Message_TEXT:
+		err = d.receiveReceipt(message)
+	default:
+		err = d.saveMessage(message)
+	}
+	if err == errNotParticipant {
+		saved, err = nil, nil
+	}
+	if err != nil || connToServer == nil {
+		return err
+	}
+	if saved != nil {
+		if err := d.acknowledge(saved); err != nil {
+			return err
+		}
+	}
+	if message.Id != nil {
+		if err := d.markSeen(messageKey(entry.Name, message.Id)); err != nil {
+			return err
+		}
+	}
+	var msgHash [32]byte
+	copy(msgHash[:], entry.MessageHash)
+	if err := util.DeleteMessages(connToServer, [][32]byte{msgHash}); err != nil {
+		return err
+	}
+	if err := shred.Remove(path); err != nil {
+		return err
+	}
+	if saved != nil && saved.Chunks > 0 {
+		return d.finishTransfer(saved)
+	}
+	return nil
+}
+
+// acceptFirstMessage stores ratch, which was established by a first message
+// from name. If the journal is being replayed, the session may have been
+// accepted already, and is then only stored again.
+func (d *Daemon) acceptFirstMessage(name string, ratch *ratchet.Ratchet, reset bool) error {
+	if handshakeKey := ratch.GetHandshakeKey(); handshakeKey != nil {
+		existing, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+		if err == nil && existing.GetHandshakeKey() != nil && bytes.Equal(existing.GetHandshakeKey()[:], handshakeKey[:]) {
+			return StoreRatchet(d, name, ratch)
+		}
+		retired := retiredSession(name, ratch)
+		if _, err := os.Stat(d.sessionPath(retired)); err == nil {
+			return d.storeSession(retired, ratch)
+		}
+	}
+	if reset {
+		return d.acceptReset(name, ratch)
+	}
+	return d.acceptSession(name, ratch)
+}
+
+// usePrekey removes the prekey with public key pk, which a first message has
+// been encrypted to, from the ones we keep
+func (d *Daemon) usePrekey(pk []byte) error {
+	prekeyPublics, prekeySecrets, prekeyExpiries, err := LoadPrekeys(d)
+	if err != nil {
+		return err
+	}
+	for i, public := range prekeyPublics {
+		if bytes.Equal(public[:], pk) {
+			prekeyPublics = append(prekeyPublics[:i], prekeyPublics[i+1:]...)
+			prekeySecrets = append(prekeySecrets[:i], prekeySecrets[i+1:]...)
+			prekeyExpiries = append(prekeyExpiries[:i], prekeyExpiries[i+1:]...)
+			return StorePrekeys(d, prekeyPublics, prekeySecrets, prekeyExpiries)
+		}
+	}
+	return nil // already used up
+}
+
+// chatProfile returns the chatterbox profile in the dename profile of a user
+func chatProfile(profile *dename.Profile) (*proto.Profile, error) {
+	chatProfileBytes, err := client.GetProfileField(profile, util.PROFILE_FIELD_ID)
+	if err != nil {
+		return nil, err
+	}
+	chatProfile := new(proto.Profile)
+	if err := chatProfile.Unmarshal(chatProfileBytes); err != nil {
+		return nil, err
+	}
+	return chatProfile, nil
+}
+
+// encryptFirstMessage looks up the profile of theirDename, gets a prekey of
+// theirs from their server and encrypts msg to it
+func (d *Daemon) encryptFirstMessage(msg []byte, theirDename string) ([]byte, *ratchet.Ratchet, error) {
+	profile, err := d.foreignDenameClient.Lookup(theirDename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile == nil {
+		return nil, nil, fmt.Errorf("unkown dename on to line: " + theirDename)
+	}
+	if err := d.MarshalToFile(d.profilePath(theirDename), profile); err != nil {
+		return nil, nil, err
+	}
+	chatProfile, err := chatProfile(profile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, onionAddr := chatProfile.ServerAddressTCP, chatProfile.ServerAddressOnion
+	pkSig := (*[32]byte)(&chatProfile.KeySigningKey)
+	port := (int)(chatProfile.ServerPortTCP)
+	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
+	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
+
+	ourSkAuth := (*[32]byte)(&d.MessageAuthSecretKey)
+
+	var theirKey *[32]byte
+	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	err = d.cc.WithConn(theirDename, addr, onionAddr, port, pkTransport, nil, nil, func(theirConn *transport.Conn) error {
+		theirKey, err = util.GetKey(theirConn, theirInBuf, theirPk, theirDename, pkSig)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return util.EncryptAuthFirst(msg, ourSkAuth, theirKey, d.ProfileRatchet)
+}
+
+// uploadEnvelope uploads an envelope to the server of theirDename
+func (d *Daemon) uploadEnvelope(theirDename string, envelope []byte) error {
+	profile := new(dename.Profile)
+	if err := d.UnmarshalFromFile(d.profilePath(theirDename), profile); err != nil {
+		return err
+	}
+	chatProfile, err := chatProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	addr, onionAddr := chatProfile.ServerAddressTCP, chatProfile.ServerAddressOnion
+	port := (int)(chatProfile.ServerPortTCP)
+	pkTransport := (*[32]byte)(&chatProfile.ServerTransportPK)
+	theirPk := (*[32]byte)(&chatProfile.UserIDAtServer)
+
+	theirInBuf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	return d.cc.WithConn(theirDename, addr, onionAddr, port, pkTransport, nil, nil, func(theirConn *transport.Conn) error {
+		return util.UploadMessageToUser(theirConn, theirInBuf, theirPk, envelope)
+	})
+}
@@ -0,0 +1,207 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// Every message carries the id of its conversation, and is filed in the
+// conversation with that id whatever its participants; see
+// persistence.ConversationId for the conversations from before there were ids.
+// The participants of a conversation are changed by a message of kind
+// ADD_PARTICIPANT or REMOVE_PARTICIPANT, which is sent to everyone who is a
+// participant before or after the change. It is only accepted from a
+// participant, and is the only way that a conversation we already have changes
+// participants: the participants that other messages list are ignored.
+
+const (
+	participantAddedNotice   = "%s added %s to the conversation."
+	participantRemovedNotice = "%s removed %s from the conversation."
+)
+
+func isParticipant(metadata *proto.ConversationMetadata, name string) bool {
+	for _, participant := range metadata.Participants {
+		if participant == name {
+			return true
+		}
+	}
+	return false
+}
+
+// processMembershipRequests changes the participants of conversations as UIs
+// have asked, see persistence.ChangeMembership, and removes the requests
+func (d *Daemon) processMembershipRequests() error {
+	convs, err := ioutil.ReadDir(d.MembershipDir())
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		if !conv.IsDir() {
+			continue
+		}
+		dir := filepath.Join(d.MembershipDir(), conv.Name())
+		requests, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, request := range requests {
+			path := filepath.Join(dir, request.Name())
+			change, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := d.changeMembership(conv.Name(), request.Name(), strings.TrimSpace(string(change))); err != nil {
+				log.Printf("not changing the participants of %s: %s", conv.Name(), err)
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// changeMembership adds name to, or removes them from, the conversation
+// convName, and journals a message that tells everyone who is a participant
+// before or after; it is sent when the journal is replayed
+func (d *Daemon) changeMembership(convName, name, change string) error {
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return err
+	}
+	if !isParticipant(metadata, d.Dename) {
+		return fmt.Errorf("we are not a participant")
+	}
+	metadata.Id = persistence.ConversationId(metadata)
+	recipients := append([]string{}, metadata.Participants...)
+	var kind proto.Message_Kind
+	var notice string
+	switch change {
+	case persistence.MembershipAdd:
+		if isParticipant(metadata, name) {
+			return nil
+		}
+		kind, notice = proto.Message_ADD_PARTICIPANT, fmt.Sprintf(participantAddedNotice, "You", name)
+		recipients = append(recipients, name)
+		metadata.Participants = append(metadata.Participants, name)
+		sort.Strings(metadata.Participants)
+	case persistence.MembershipRemove:
+		if !isParticipant(metadata, name) {
+			return nil
+		}
+		kind, notice = proto.Message_REMOVE_PARTICIPANT, fmt.Sprintf(participantRemovedNotice, "You", name)
+		metadata.Participants = removeString(metadata.Participants, name)
+	default:
+		return fmt.Errorf("unknown change %q", change)
+	}
+
+	d.ourDenameLookupMu.Lock()
+	payload := proto.Message{
+		Dename:         d.Dename,
+		DenameLookup:   d.ourDenameLookup,
+		Subject:        metadata.Subject,
+		Participants:   metadata.Participants,
+		Date:           d.Now().UnixNano(),
+		Id:             newMessageId(),
+		Kind:           kind,
+		ConversationId: metadata.Id,
+		Participant:    name,
+	}
+	d.ourDenameLookupMu.Unlock()
+	payloadBytes, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	if err := d.writeNotice(filepath.Join(d.ConversationDir(), convName), notice); err != nil {
+		return err
+	}
+	entries := make(map[string]*proto.JournalEntry)
+	for _, recipient := range recipients {
+		if recipient != d.Dename {
+			entries[encoding.EscapeFilename(recipient)] = &proto.JournalEntry{Name: recipient, Payload: payloadBytes, Created: d.Now().UnixNano()}
+		}
+	}
+	_, err = d.journalBatch(batchName(d.Now(), "members", payload.Id), entries)
+	return err
+}
+
+// receiveMembership applies a change of participants that sender, the user
+// whose session the message came in on, has made
+func (d *Daemon) receiveMembership(sender string, message *proto.Message) error {
+	if message.Dename != sender || message.ConversationId == nil {
+		log.Printf("ignoring change of participants from %s that claims to be from %s", sender, message.Dename)
+		return nil
+	}
+	convName, err := d.FindConversation(message.ConversationId)
+	if err != nil {
+		return err
+	}
+	var metadata *proto.ConversationMetadata
+	if convName != "" {
+		if metadata, err = persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName)); err != nil {
+			return err
+		}
+	} else if message.Kind == proto.Message_ADD_PARTICIPANT && message.Participant == d.Dename {
+		// we have been added to a conversation that we did not know about
+		metadata = &proto.ConversationMetadata{Subject: message.Subject, Id: message.ConversationId}
+		metadata.Participants = removeString(undupStrings(message.Participants), d.Dename)
+		if convName, err = d.createConversation(metadata, time.Unix(0, message.Date), sender); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("ignoring change of participants from %s in a conversation we are not in", sender)
+		return nil
+	}
+	if !isParticipant(metadata, sender) {
+		log.Printf("ignoring change of participants of %s from %s, who is not one of them", convName, sender)
+		return nil
+	}
+
+	name := message.Participant
+	if name == d.Dename {
+		name = "you"
+	}
+	var notice string
+	switch message.Kind {
+	case proto.Message_ADD_PARTICIPANT:
+		if isParticipant(metadata, message.Participant) {
+			return nil
+		}
+		metadata.Participants = append(metadata.Participants, message.Participant)
+		sort.Strings(metadata.Participants)
+		notice = fmt.Sprintf(participantAddedNotice, sender, name)
+	case proto.Message_REMOVE_PARTICIPANT:
+		if !isParticipant(metadata, message.Participant) {
+			return nil
+		}
+		metadata.Participants = removeString(metadata.Participants, message.Participant)
+		notice = fmt.Sprintf(participantRemovedNotice, sender, name)
+	}
+	if err := d.storeConversationMetadata(convName, metadata); err != nil {
+		return err
+	}
+	return d.writeNotice(filepath.Join(d.ConversationDir(), convName), notice)
+}
+
+func removeString(ss []string, s string) []string {
+	ret := make([]string, 0, len(ss))
+	for _, x := range ss {
+		if x != s {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
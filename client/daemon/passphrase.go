@@ -0,0 +1,207 @@
+package daemon
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// The key material of an account (its configuration, prekeys and ratchets) can
+// be protected with a passphrase. It is then sealed with a storage key, which
+// is kept in StorageKeyPath sealed with the passphrase; see
+// persistence.Paths.MarshalToFile. Conversations are only sealed if
+// EncryptConversations is set. Adding or removing a passphrase converts all
+// key material; if that is interrupted, the daemon refuses to read the files
+// that have not been converted yet, and changing the passphrase again (or
+// removing it again) finishes the conversion. The daemon holds the lock of the
+// account while it runs, and the conversions refuse to start without it.
+
+// ErrAccountInUse is returned when the lock of an account is held by another
+// process, usually chatterboxd
+var ErrAccountInUse = errors.New("the account is in use: stop chatterboxd first")
+
+// lockAccount takes the lock of the account, which is released when the
+// returned file is closed
+func (d *Daemon) lockAccount() (*os.File, error) {
+	f, err := os.OpenFile(d.lockPath(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrAccountInUse
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// ChangePassphrase replaces the passphrase of the account in rootDir. An empty
+// oldPassphrase is used for accounts without one, and an empty newPassphrase
+// removes the passphrase. It fails with ErrAccountInUse while chatterboxd is
+// running.
+func ChangePassphrase(rootDir string, oldPassphrase, newPassphrase []byte) error {
+	d := &Daemon{Paths: persistence.Paths{RootDir: rootDir, Application: "daemon"}}
+	lock, err := d.lockAccount()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := d.Unlock(oldPassphrase); err != nil {
+		return err
+	}
+	switch {
+	case len(newPassphrase) == 0 && d.StorageKey == nil:
+		return nil
+	case len(newPassphrase) == 0:
+		// the configuration is converted last, so it is only in plaintext
+		// if removing the passphrase was interrupted right at the end
+		contents, err := ioutil.ReadFile(d.configPath())
+		if err != nil {
+			return err
+		}
+		bs, _ := persistence.OpenAllowingPlaintext(contents, d.StorageKey)
+		if err := d.LocalAccountConfig.Unmarshal(bs); err != nil {
+			return err
+		}
+		if d.EncryptConversations {
+			if err := d.setConversationEncryption(false); err != nil {
+				return err
+			}
+		}
+		if err := d.resealKeyMaterial(nil); err != nil {
+			return err
+		}
+		return shred.Remove(d.StorageKeyPath())
+	case d.StorageKey == nil:
+		if err := d.AtomicWriteFile(d.resealPendingPath(), nil, 0600); err != nil {
+			return err
+		}
+		storageKey := persistence.NewStorageKey()
+		if err := d.WriteStorageKey(d.StorageKeyPath(), storageKey, newPassphrase); err != nil {
+			return err
+		}
+		if err := d.resealKeyMaterial(storageKey); err != nil {
+			return err
+		}
+		return os.Remove(d.resealPendingPath())
+	default:
+		if _, err := os.Stat(d.resealPendingPath()); err == nil {
+			// adding the passphrase was interrupted
+			if err := d.resealKeyMaterial(d.StorageKey); err != nil {
+				return err
+			}
+			if err := os.Remove(d.resealPendingPath()); err != nil {
+				return err
+			}
+		}
+		return d.shredReplaced(d.StorageKeyPath(), func() error {
+			return d.WriteStorageKey(d.StorageKeyPath(), d.StorageKey, newPassphrase)
+		})
+	}
+}
+
+// EncryptConversations turns sealing the messages in the conversations
+// directory with the storage key on or off, and converts the messages that are
+// already there. The account must have a passphrase. It fails with
+// ErrAccountInUse while chatterboxd is running.
+func EncryptConversations(rootDir string, passphrase []byte, enable bool) error {
+	d := &Daemon{Paths: persistence.Paths{RootDir: rootDir, Application: "daemon"}}
+	lock, err := d.lockAccount()
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := d.Unlock(passphrase); err != nil {
+		return err
+	}
+	if d.StorageKey == nil {
+		if enable {
+			return errors.New("conversations can only be encrypted if the account has a passphrase")
+		}
+		return nil
+	}
+	if err := d.UnmarshalFromFile(d.configPath(), &d.LocalAccountConfig); err != nil {
+		return err
+	}
+	return d.setConversationEncryption(enable)
+}
+
+// setConversationEncryption stores the new setting and then converts the
+// messages, so that an interrupted conversion can simply be run again
+func (d *Daemon) setConversationEncryption(enable bool) error {
+	d.EncryptConversations = enable
+	if err := StoreLocalAccountConfig(d, &d.LocalAccountConfig); err != nil {
+		return err
+	}
+	// the names of attachments are sealed like the attachments
+	for _, dir := range []string{d.ConversationDir(), d.FilenameDir()} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || info.Name() == persistence.MetadataFileName {
+				return err
+			}
+			return d.reseal(path, d.conversationKey())
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// conversationKey returns the key to seal messages in the conversations
+// directory, and the names of attachments, with, or nil if they are not to be
+// sealed
+func (d *Daemon) conversationKey() *[32]byte {
+	if d.EncryptConversations {
+		return d.StorageKey
+	}
+	return nil
+}
+
+// resealPendingPath exists while key material is being sealed with a new
+// storage key
+func (d *Daemon) resealPendingPath() string { return filepath.Join(d.privDir(), "reseal-pending") }
+
+// resealKeyMaterial rewrites all key material sealed with storageKey, or in
+// plaintext if it is nil, and shreds the old versions. The configuration is
+// rewritten last.
+func (d *Daemon) resealKeyMaterial(storageKey *[32]byte) error {
+	paths := []string{d.prekeysPath(), d.ourDenameLookupReplyPath()}
+	for _, dir := range []string{d.ratchetKeysDir(), d.retiredRatchetsDir(), d.journalDir(), d.transfersDir(), d.profilesDir()} {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				paths = append(paths, path)
+			}
+			return err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, path := range append(paths, d.configPath()) {
+		if err := d.reseal(path, storageKey); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// reseal rewrites the file at path sealed with key, or in plaintext if key is
+// nil, and shreds the old version. The file may or may not be sealed already.
+func (d *Daemon) reseal(path string, key *[32]byte) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bs, _ := persistence.OpenAllowingPlaintext(contents, d.StorageKey)
+	return d.shredReplaced(path, func() error {
+		return d.AtomicWriteFile(path, persistence.Seal(bs, key), 0600)
+	})
+}
@@ -0,0 +1,190 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// A message that has been received and saved is acknowledged with a delivery
+// receipt, and once a UI has marked it read, with a read receipt. A receipt
+// is a message of another kind that is encrypted and authenticated like any
+// other, and refers to the message by the random id that its sender gave it.
+// Receipts are never saved in a conversation and never acknowledged
+// themselves. Whether they are sent is a setting of each conversation.
+//
+// The sender remembers which message each id it chose belongs to in the sent
+// directory, and publishes the receipts as the delivery status of the
+// message. The receiver remembers the id of each message it has acknowledged
+// but not yet seen marked read in the unread directory.
+
+const messageIdSize = 16
+
+func newMessageId() []byte {
+	id := make([]byte, messageIdSize)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (d *Daemon) sentPath(id []byte) string {
+	return filepath.Join(d.sentDir(), hex.EncodeToString(id))
+}
+
+// deliveryReceiptsEnabled tells whether we acknowledge the messages we
+// receive in a conversation; unless disabled, we do
+func deliveryReceiptsEnabled(metadata *proto.ConversationMetadata) bool {
+	return metadata.DeliveryReceipts == nil || *metadata.DeliveryReceipts
+}
+
+// readReceiptsEnabled tells whether we tell the senders of the messages in a
+// conversation that we have read them; unless enabled, we do not
+func readReceiptsEnabled(metadata *proto.ConversationMetadata) bool {
+	return metadata.ReadReceipts != nil && *metadata.ReadReceipts
+}
+
+// recordSent remembers that id was given to message, its path relative to the
+// conversations directory
+func (d *Daemon) recordSent(id []byte, message string) error {
+	return d.AtomicWriteFile(d.sentPath(id), []byte(message), 0600)
+}
+
+// acknowledge marks a message that has been saved as unread and sends a
+// delivery receipt for it if the conversation has them enabled
+func (d *Daemon) acknowledge(message *proto.Message) error {
+	if message.Id == nil || message.Kind != proto.Message_TEXT || message.SessionReset {
+		return nil
+	}
+	convName, err := d.findConversationOf(message)
+	if err != nil {
+		return err
+	}
+	messageName, err := d.FindMessage(convName, message.Id)
+	if err != nil || messageName == "" {
+		return err
+	}
+	unread := filepath.Join(d.unreadDir(), convName, messageName)
+	if err := os.MkdirAll(filepath.Dir(unread), 0700); err != nil {
+		return err
+	}
+	if err := d.AtomicWriteFile(unread, message.Id, 0600); err != nil {
+		return err
+	}
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return err
+	}
+	if !deliveryReceiptsEnabled(metadata) {
+		return nil
+	}
+	return d.sendReceipt(metadata, message.Dename, proto.Message_DELIVERY_RECEIPT, message.Id)
+}
+
+// sendReceipt sends a receipt of kind for the message with id target to name
+func (d *Daemon) sendReceipt(metadata *proto.ConversationMetadata, name string, kind proto.Message_Kind, target []byte) error {
+	d.ourDenameLookupMu.Lock()
+	payload := proto.Message{
+		Dename:       d.Dename,
+		DenameLookup: d.ourDenameLookup,
+		Subject:      metadata.Subject,
+		Participants: metadata.Participants,
+		Date:         d.Now().UnixNano(),
+		Kind:         kind,
+		Target:       target,
+	}
+	d.ourDenameLookupMu.Unlock()
+	payloadBytes, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	entry := &proto.JournalEntry{Name: name, Payload: payloadBytes, Created: d.Now().UnixNano()}
+	return d.sendJournalEntry(batchName(d.Now(), "receipt", target), entry)
+}
+
+// receiveReceipt publishes a receipt from message.Dename as the delivery
+// status of the message it is for
+func (d *Daemon) receiveReceipt(message *proto.Message) error {
+	var status string
+	switch message.Kind {
+	case proto.Message_DELIVERY_RECEIPT:
+		status = persistence.StatusDelivered
+	case proto.Message_READ_RECEIPT:
+		status = persistence.StatusRead
+	default:
+		log.Printf("ignoring message of unknown kind %d from %s", message.Kind, message.Dename)
+		return nil
+	}
+	var sent []byte
+	var err error
+	if len(message.Target) == messageIdSize {
+		sent, err = ioutil.ReadFile(d.sentPath(message.Target))
+	}
+	if len(message.Target) != messageIdSize || os.IsNotExist(err) {
+		log.Printf("ignoring %s receipt from %s for a message we did not send", status, message.Dename)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return d.updateDeliveryStatus(string(sent), message.Dename, status, "", false)
+}
+
+// processReadMarks sends read receipts for the messages that UIs have marked
+// read, see persistence.MarkRead, and removes the marks
+func (d *Daemon) processReadMarks() error {
+	convs, err := ioutil.ReadDir(d.ReadMarkDir())
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		if !conv.IsDir() {
+			continue
+		}
+		dir := filepath.Join(d.ReadMarkDir(), conv.Name())
+		marks, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, mark := range marks {
+			if err := d.markRead(conv.Name(), mark.Name()); err != nil {
+				return err
+			}
+			if err := os.Remove(filepath.Join(dir, mark.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markRead sends a read receipt for a message that has been read if it has
+// not been read before and the conversation has them enabled
+func (d *Daemon) markRead(convName, messageName string) error {
+	unread := filepath.Join(d.unreadDir(), convName, messageName)
+	id, err := ioutil.ReadFile(unread)
+	if os.IsNotExist(err) {
+		return nil // sent by us, a notice, or already read
+	} else if err != nil {
+		return err
+	}
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return err
+	}
+	if readReceiptsEnabled(metadata) {
+		sender, err := persistence.MessageSender(messageName)
+		if err != nil {
+			return err
+		}
+		if err := d.sendReceipt(metadata, sender, proto.Message_READ_RECEIPT, id); err != nil {
+			return err
+		}
+	}
+	return os.Remove(unread)
+}
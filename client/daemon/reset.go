@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	util "github.com/andres-erbsen/chatterbox/client"
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// When a message cannot be decrypted with the ratchet that its header key
+// belongs to, our ratchet and the one of the sender have diverged and no later
+// message on it is going to be readable either. The receiver then shreds its
+// ratchet and sends a session reset: a first message, authenticated like all
+// first messages, that tells the peer to shred its ratchet too and use the
+// new one instead. Both users are told that messages may have been lost. A
+// message that decrypts but cannot be parsed only says something about its
+// sender, so it is quarantined and the session is kept.
+
+const sessionResetNotice = "The encrypted session with %s was reset because it got out of sync. Some messages may have been lost."
+
+// quarantine moves an envelope that could not be decrypted from the server to
+// the quarantine directory, so that it is not requested again but can still
+// be inspected.
+func (d *Daemon) quarantine(connToServer *util.ConnectionToServer, envelope []byte, msgHash *[32]byte) error {
+	path := filepath.Join(d.quarantineDir(), fmt.Sprintf("%x", msgHash[:]))
+	if err := d.AtomicWriteFile(path, envelope, 0600); err != nil {
+		return err
+	}
+	return util.DeleteMessages(connToServer, [][32]byte{*msgHash})
+}
+
+// shredSessions deletes all ratchets with name, including the retired ones
+func (d *Daemon) shredSessions(name string) error {
+	if err := shred.Remove(d.ratchetPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if d.ratchets != nil {
+		d.ratchets.remove(session{name: name})
+	}
+	return d.shredRetiredSessionsWith(name)
+}
+
+func (d *Daemon) shredRetiredSessionsWith(name string) error {
+	retired, err := retiredSessions(d)
+	if err != nil {
+		return err
+	}
+	for _, s := range retired {
+		if s.name == name && d.ratchets != nil {
+			d.ratchets.remove(s)
+		}
+	}
+	return shred.RemoveAll(filepath.Join(d.retiredRatchetsDir(), encoding.EscapeFilename(name)))
+}
+
+// resetSession replaces the ratchet with name by a new one and sends the
+// first message of the new one to them as a session reset
+func (d *Daemon) resetSession(name string) error {
+	if err := d.shredSessions(name); err != nil {
+		return err
+	}
+	if err := d.sessionResetNotice(name); err != nil {
+		return err
+	}
+	d.ourDenameLookupMu.Lock()
+	payload := proto.Message{
+		Dename:       d.Dename,
+		DenameLookup: d.ourDenameLookup,
+		Date:         d.Now().UnixNano(),
+		SessionReset: true,
+	}
+	d.ourDenameLookupMu.Unlock()
+	payloadBytes, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	return d.sendFirstMessage(payloadBytes, name)
+}
+
+// acceptReset replaces the ratchets with name by ratch, which was established
+// by a session reset from them. A session with name that nothing has been
+// received on is kept: it may be from a reset that we sent at the same time,
+// and acceptSession chooses between the two.
+func (d *Daemon) acceptReset(name string, ratch *ratchet.Ratchet) error {
+	existing, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+	if os.IsNotExist(err) || err == nil && !existing.Received() {
+		err = d.shredRetiredSessionsWith(name)
+	} else {
+		err = d.shredSessions(name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.acceptSession(name, ratch); err != nil {
+		return err
+	}
+	return d.sessionResetNotice(name)
+}
+
+// sessionResetNotice tells the user in every conversation with name that
+// messages may have been lost
+func (d *Daemon) sessionResetNotice(name string) error {
+	conversations, err := d.ListConversations()
+	if err != nil {
+		return err
+	}
+	notice := fmt.Sprintf(sessionResetNotice, name)
+	for _, conv := range conversations {
+		for _, participant := range conv.Participants {
+			if participant != name {
+				continue
+			}
+			convName, err := d.ConversationDirName(conv)
+			if err != nil {
+				return err
+			}
+			if err := d.writeNotice(filepath.Join(d.ConversationDir(), convName), notice); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
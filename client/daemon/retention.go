@@ -0,0 +1,393 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// Messages are deleted once they are older than the retention of their
+// conversation, which is MessageRetention of the account unless the metadata
+// of the conversation sets its own or says to keep them. retentionWarning
+// before the first messages of a conversation would be deleted, a notice is
+// added to it, and no message is deleted until retentionWarning after the
+// notice about it, even if the daemon was not running in the meantime. The
+// notices that have been written are remembered in the retention directory, as
+// lines of "<covered> <written>": the notice written at <written> (in Unix
+// nanoseconds) was about all messages that are dated <covered> or before. A
+// conversation in which all messages have been deleted is deleted too.
+//
+// The age of a message is measured by the date in its name, see
+// persistence.MessageName. Files are rewritten when messages are edited, when
+// the passphrase changes and when the journal is replayed, so their
+// modification times say nothing about it. The date in the name is the one the
+// sender put in the message, not the time we received it: a peer can backdate
+// its messages so that they are deleted (after the warning) as soon as they
+// arrive, or postdate them far enough that they are never deleted. Only the
+// messages of that peer are affected.
+//
+// Messages that disappear are deleted when their expiry file says, without a
+// warning and whatever the retention, see persistence.ExpiryPath.
+
+const retentionNotice = "%d messages in this conversation will be deleted from %s on, because they are older than %s. To keep them, run chatterbox-create -keep for the conversation."
+
+func (d *Daemon) retentionDir() string { return filepath.Join(d.privDir(), "retention") }
+
+// expiryWarning is a notice about the messages dated covered or before, which
+// was written at written
+type expiryWarning struct {
+	covered, written time.Time
+}
+
+func (d *Daemon) loadExpiryWarnings(convName string) ([]expiryWarning, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(d.retentionDir(), convName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ret []expiryWarning
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for scanner.Scan() {
+		var covered, written int64
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &covered, &written); err != nil {
+			return nil, err
+		}
+		ret = append(ret, expiryWarning{time.Unix(0, covered), time.Unix(0, written)})
+	}
+	return ret, scanner.Err()
+}
+
+func (d *Daemon) storeExpiryWarnings(convName string, warnings []expiryWarning) error {
+	path := filepath.Join(d.retentionDir(), convName)
+	if len(warnings) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, w := range warnings {
+		fmt.Fprintf(&buf, "%d %d\n", w.covered.UnixNano(), w.written.UnixNano())
+	}
+	return d.AtomicWriteFile(path, buf.Bytes(), 0600)
+}
+
+// messageRetention returns how long the messages of a conversation are kept
+// for, or 0 if they are kept forever
+func (d *Daemon) messageRetention(metadata *proto.ConversationMetadata) time.Duration {
+	retention := time.Duration(d.MessageRetention)
+	if metadata.Retention != 0 {
+		retention = time.Duration(metadata.Retention)
+	}
+	if metadata.Keep || retention < 0 {
+		return 0
+	}
+	return retention
+}
+
+// SetMessageRetention changes how long messages are kept for unless their
+// conversation says otherwise; 0 keeps them forever
+func (d *Daemon) SetMessageRetention(retention time.Duration) error {
+	d.MessageRetention = int64(retention)
+	return StoreLocalAccountConfig(d, &d.LocalAccountConfig)
+}
+
+// expireMessages deletes the messages that have expired, warns about the
+// ones that are about to, and returns when it should be called next, or the
+// zero time if no message is going to expire
+func (d *Daemon) expireMessages() (time.Time, error) {
+	var next time.Time
+	schedule := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	convs, err := ioutil.ReadDir(d.ConversationDir())
+	if err != nil {
+		return next, err
+	}
+	for _, conv := range convs {
+		if !conv.IsDir() {
+			continue
+		}
+		t, err := d.expireConversation(conv.Name())
+		if err != nil {
+			return next, err
+		}
+		if !t.IsZero() {
+			schedule(t)
+		}
+	}
+	if err := d.pruneSent(); err != nil {
+		return next, err
+	}
+	return next, d.pruneTransfers()
+}
+
+// expireConversation is expireMessages for one conversation
+func (d *Daemon) expireConversation(convName string) (time.Time, error) {
+	var next time.Time
+	schedule := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	dir := filepath.Join(d.ConversationDir(), convName)
+	metadata, err := persistence.ReadConversationMetadata(dir)
+	if err != nil {
+		log.Printf("not expiring messages in %s: %s", dir, err)
+		return next, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return next, err
+	}
+	now := d.Now()
+	files, err = d.expireDisappearing(convName, files, schedule)
+	if err != nil {
+		return next, err
+	}
+	retention := d.messageRetention(metadata)
+	if retention == 0 {
+		return next, nil
+	}
+	warnings, err := d.loadExpiryWarnings(convName)
+	if err != nil {
+		return next, err
+	}
+	var deleted, unwarned int
+	var remaining []os.FileInfo
+	var covered time.Time
+	for _, file := range files {
+		date := messageDate(file)
+		expiry := date.Add(retention)
+		sender, _ := persistence.MessageSender(file.Name())
+		if sender != persistence.NoticeSender {
+			warned := false
+			for _, w := range warnings {
+				if !date.After(w.covered) {
+					warned = true
+					if t := w.written.Add(retentionWarning); t.After(expiry) {
+						expiry = t
+					}
+					break
+				}
+			}
+			if !warned {
+				if expiry.After(now.Add(retentionWarning)) {
+					schedule(expiry.Add(-retentionWarning))
+				} else {
+					unwarned++
+					if date.After(covered) {
+						covered = date
+					}
+					schedule(now.Add(retentionWarning))
+				}
+				remaining = append(remaining, file)
+				continue
+			}
+		}
+		if expiry.After(now) {
+			schedule(expiry)
+			remaining = append(remaining, file)
+			continue
+		}
+		if err := d.shredMessage(convName, file.Name()); err != nil {
+			return next, err
+		}
+		deleted++
+	}
+
+	if unwarned > 0 {
+		firstDeletion := now.Add(retentionWarning)
+		notice := fmt.Sprintf(retentionNotice, unwarned, firstDeletion.Format(time.RFC1123), retention)
+		if err := d.writeNotice(dir, notice); err != nil {
+			return next, err
+		}
+		warnings = append(warnings, expiryWarning{covered, now})
+	} else if deleted > 0 && len(remaining) == 0 {
+		return time.Time{}, d.shredConversation(convName)
+	}
+	// the warnings about messages that have all been deleted are not needed
+	// anymore
+	for len(warnings) > 0 {
+		needed := false
+		for _, file := range remaining {
+			if !messageDate(file).After(warnings[0].covered) {
+				needed = true
+				break
+			}
+		}
+		if needed {
+			break
+		}
+		warnings = warnings[1:]
+	}
+	return next, d.storeExpiryWarnings(convName, warnings)
+}
+
+// messageDate returns the date of the message in file, or its modification
+// time if its name does not have one
+func messageDate(file os.FileInfo) time.Time {
+	date, err := persistence.MessageDate(file.Name())
+	if err != nil {
+		return file.ModTime()
+	}
+	return date
+}
+
+// expireDisappearing deletes the messages among files, the contents of the
+// directory of a conversation, that have expiry files and have expired, and
+// schedules the ones that have not. It returns the remaining messages.
+func (d *Daemon) expireDisappearing(convName string, files []os.FileInfo, schedule func(time.Time)) ([]os.FileInfo, error) {
+	expiries := make(map[string]time.Time)
+	expiryFiles, err := ioutil.ReadDir(filepath.Join(d.ExpiryDir(), convName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, file := range expiryFiles {
+		expiry, err := persistence.ReadExpiry(d.ExpiryPath(convName, file.Name()))
+		if err != nil {
+			log.Printf("ignoring expiry of %s in %s: %s", file.Name(), convName, err)
+			continue
+		}
+		expiries[file.Name()] = expiry
+	}
+	now := d.Now()
+	ret := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if file.Name() == persistence.MetadataFileName {
+			continue
+		}
+		if expiry, ok := expiries[file.Name()]; ok {
+			delete(expiries, file.Name())
+			if !expiry.After(now) {
+				if err := d.shredMessage(convName, file.Name()); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			schedule(expiry)
+		}
+		ret = append(ret, file)
+	}
+	// the messages that are left have been deleted by the user, or were never
+	// filed
+	for name, expiry := range expiries {
+		if !expiry.After(now) {
+			if err := os.Remove(d.ExpiryPath(convName, name)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	return ret, nil
+}
+
+// setExpiry makes a message that is about to be filed disappear after
+// lifetime. If it has been given an expiry already, that one is kept.
+func (d *Daemon) setExpiry(convName, messageName string, lifetime time.Duration) error {
+	path := d.ExpiryPath(convName, messageName)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	d.expiryChanged = true
+	return d.WriteExpiry(path, d.Now().Add(lifetime))
+}
+
+// shredMessage deletes a message from a conversation, along with what the
+// daemon knows about it
+func (d *Daemon) shredMessage(convName, messageName string) error {
+	if err := shred.Remove(filepath.Join(d.ConversationDir(), convName, messageName)); err != nil {
+		return err
+	}
+	for _, dir := range d.messageDirs() {
+		if err := os.Remove(filepath.Join(dir, convName, messageName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// shredConversation deletes a conversation that has no messages left. Its
+// outbox directory is kept if there is a message in it waiting to be sent.
+func (d *Daemon) shredConversation(convName string) error {
+	outbox := filepath.Join(d.OutboxDir(), convName)
+	if files, err := ioutil.ReadDir(outbox); err == nil && len(files) <= 1 {
+		if err := shred.RemoveAll(outbox); err != nil {
+			return err
+		}
+	}
+	for _, dir := range d.conversationDirs() {
+		if err := os.RemoveAll(filepath.Join(dir, convName)); err != nil {
+			return err
+		}
+	}
+	return shred.RemoveAll(filepath.Join(d.ConversationDir(), convName))
+}
+
+// pruneSent forgets the ids of the sent messages that have been deleted,
+// which receipts can no longer be shown for
+func (d *Daemon) pruneSent() error {
+	files, err := ioutil.ReadDir(d.sentDir())
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		path := filepath.Join(d.sentDir(), file.Name())
+		message, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(d.ConversationDir(), string(message))); os.IsNotExist(err) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeStaleTemp shreds whatever has been left in the temporary directories
+// of all programs and not been touched for maxTempAge, and the directories of
+// programs that have not used theirs for that long
+func (d *Daemon) removeStaleTemp() error {
+	root := filepath.Dir(d.TempDir())
+	apps, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := d.Now()
+	for _, app := range apps {
+		dir := filepath.Join(root, app.Name())
+		if !app.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if now.Sub(file.ModTime()) > maxTempAge {
+				if err := shred.RemoveAll(filepath.Join(dir, file.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		if dir != d.TempDir() && now.Sub(app.ModTime()) > maxTempAge {
+			os.Remove(dir) // only succeeds if nothing is left in it
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/client/persistence"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// A message is edited or deleted by a message of kind EDIT or DELETE with its
+// id as the target, which its sender sends to everyone who is a participant;
+// see persistence.EditMessage for how UIs ask for it. It is only accepted from
+// the user who sent the message, on their own session. A change to a message
+// that we do not have, maybe because it has been deleted already, is ignored.
+
+// processRevisionRequests edits and deletes the messages that UIs have asked
+// to, see persistence.EditMessage, and removes the requests
+func (d *Daemon) processRevisionRequests() error {
+	convs, err := ioutil.ReadDir(d.ReviseDir())
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		if !conv.IsDir() {
+			continue
+		}
+		dir := filepath.Join(d.ReviseDir(), conv.Name())
+		requests, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, request := range requests {
+			path := filepath.Join(dir, request.Name())
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := d.requestedRevision(conv.Name(), request.Name(), contents); err != nil {
+				log.Printf("not changing %s in %s: %s", request.Name(), conv.Name(), err)
+			}
+			if err := shred.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requestedRevision edits or deletes a message that we sent in the
+// conversation convName as request says, and journals a message that tells
+// the other participants; it is sent when the journal is replayed. An edit
+// that does not fit in one envelope is refused, as it cannot be sent in
+// chunks.
+func (d *Daemon) requestedRevision(convName, messageName string, request []byte) error {
+	change, contents, err := persistence.ParseRevisionRequest(request)
+	if err != nil {
+		return err
+	}
+	if sender, err := persistence.MessageSender(messageName); err != nil || sender != d.Dename {
+		return fmt.Errorf("we did not send it")
+	}
+	id, err := persistence.ReadId(d.IdPath(convName, messageName))
+	if err != nil {
+		return fmt.Errorf("it has no id: %s", err)
+	}
+	metadata, err := persistence.ReadConversationMetadata(filepath.Join(d.ConversationDir(), convName))
+	if err != nil {
+		return err
+	}
+	kind := proto.Message_EDIT
+	if change == persistence.RevisionDelete {
+		kind, contents = proto.Message_DELETE, ""
+	}
+	d.ourDenameLookupMu.Lock()
+	payload := proto.Message{
+		Dename:         d.Dename,
+		DenameLookup:   d.ourDenameLookup,
+		Contents:       []byte(contents),
+		Subject:        metadata.Subject,
+		Participants:   metadata.Participants,
+		Date:           d.Now().UnixNano(),
+		Id:             newMessageId(),
+		Kind:           kind,
+		Target:         id,
+		ConversationId: persistence.ConversationId(metadata),
+	}
+	d.ourDenameLookupMu.Unlock()
+	payloadBytes, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	if len(payloadBytes) > maxPayloadSize {
+		return fmt.Errorf("the edit is %d bytes, more than the %d that fit in a message", len(payloadBytes), maxPayloadSize)
+	}
+	if err := d.reviseMessage(convName, messageName, kind, []byte(contents), d.Now()); err != nil {
+		return err
+	}
+	entries := make(map[string]*proto.JournalEntry)
+	for _, recipient := range metadata.Participants {
+		if recipient != d.Dename {
+			entries[encoding.EscapeFilename(recipient)] = &proto.JournalEntry{Name: recipient, Payload: payloadBytes, Created: d.Now().UnixNano()}
+		}
+	}
+	_, err = d.journalBatch(batchName(d.Now(), "revise", payload.Id), entries)
+	return err
+}
+
+// receiveRevision applies an edit or a deletion from sender, the user whose
+// session the message came in on
+func (d *Daemon) receiveRevision(sender string, message *proto.Message) error {
+	if message.Dename != sender || message.Target == nil {
+		log.Printf("ignoring change of a message from %s that claims to be from %s", sender, message.Dename)
+		return nil
+	}
+	convName, err := d.findConversationOf(message)
+	if err != nil || convName == "" {
+		return err
+	}
+	messageName, err := d.FindMessage(convName, message.Target)
+	if err != nil || messageName == "" {
+		return err
+	}
+	if original, err := persistence.MessageSender(messageName); err != nil || original != sender {
+		log.Printf("ignoring change of %s in %s from %s, who did not send it", messageName, convName, sender)
+		return nil
+	}
+	if err := d.reviseMessage(convName, messageName, message.Kind, message.Contents, time.Unix(0, message.Date)); err != nil {
+		log.Printf("not changing %s in %s: %s", messageName, convName, err)
+	}
+	return nil
+}
+
+// reviseMessage replaces the contents of a message with contents or deletes
+// it, and marks it as edited or deleted at date. A message that has been
+// deleted stays deleted.
+func (d *Daemon) reviseMessage(convName, messageName string, kind proto.Message_Kind, contents []byte, date time.Time) error {
+	path := filepath.Join(d.ConversationDir(), convName, messageName)
+	marker := d.RevisedPath(convName, messageName)
+	if revision, _, err := persistence.ReadRevision(marker); err == nil && revision == persistence.RevisionDeleted {
+		return nil
+	}
+	switch kind {
+	case proto.Message_EDIT:
+		if persistence.ContentType(messageName) != "" {
+			return fmt.Errorf("only text can be edited")
+		}
+		if err := d.WriteRevision(marker, persistence.RevisionEdited, date); err != nil {
+			return err
+		}
+		return d.writeMessage(path, contents)
+	case proto.Message_DELETE:
+		if err := d.WriteRevision(marker, persistence.RevisionDeleted, date); err != nil {
+			return err
+		}
+		if err := os.Remove(d.FilenamePath(convName, messageName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := shred.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return d.writeMessage(path, nil)
+	}
+	return fmt.Errorf("unknown change %s", kind)
+}
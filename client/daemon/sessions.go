@@ -0,0 +1,160 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/andres-erbsen/chatterbox/client/encoding"
+	"github.com/andres-erbsen/chatterbox/ratchet"
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// If both parties send a first message at the same time, two ratchet sessions
+// get established between them. Both are kept: the one that wins is used for
+// sending and the other one is retired. Retired sessions are only used to
+// decrypt messages that were sent before the peer made the same choice, and
+// they are shredded once no message has arrived on them for as long as the
+// keys of missing messages are kept.
+
+func (d *Daemon) loadSession(s session) (*ratchet.Ratchet, error) {
+	ratch := new(ratchet.Ratchet)
+	if err := d.UnmarshalFromFile(d.sessionPath(s), ratch); err != nil {
+		return nil, err
+	}
+	ratch.FillAuth = d.fillAuth
+	ratch.CheckAuth = d.checkAuth
+	d.configureRatchet(ratch)
+	return ratch, nil
+}
+
+func (d *Daemon) storeSession(s session, ratch *ratchet.Ratchet) error {
+	if s.retired != "" {
+		if err := os.MkdirAll(filepath.Dir(d.sessionPath(s)), 0700); err != nil {
+			return err
+		}
+	}
+	if err := d.MarshalToFile(d.sessionPath(s), ratch); err != nil {
+		return err
+	}
+	if d.ratchets != nil {
+		d.ratchets.update(s, ratch)
+	}
+	return nil
+}
+
+// retiredSession returns the name under which ratch is kept once retired. A
+// session without a handshake key gets a random name, so that retiring one
+// does not overwrite another.
+func retiredSession(name string, ratch *ratchet.Ratchet) session {
+	retired := fmt.Sprintf("unknown-handshake-%x", newMessageId())
+	if handshakeKey := ratch.GetHandshakeKey(); handshakeKey != nil {
+		retired = fmt.Sprintf("%x", handshakeKey[:])
+	}
+	return session{name: name, retired: retired}
+}
+
+// supersedes returns true if the session ratch should replace the session
+// existing with the same peer. If we have received a message on existing, the
+// peer has used it and must have lost it since. Otherwise both sides sent a
+// first message at the same time, and both keep the session with the smaller
+// handshake key.
+func supersedes(ratch, existing *ratchet.Ratchet) bool {
+	if existing.Received() {
+		return true
+	}
+	var newKey, oldKey []byte
+	if handshakeKey := ratch.GetHandshakeKey(); handshakeKey != nil {
+		newKey = handshakeKey[:]
+	}
+	if handshakeKey := existing.GetHandshakeKey(); handshakeKey != nil {
+		oldKey = handshakeKey[:]
+	}
+	return bytes.Compare(newKey, oldKey) < 0
+}
+
+// acceptSession stores ratch, which was established by a first message from
+// name. If we already have a session with name, one of the two is retired.
+func (d *Daemon) acceptSession(name string, ratch *ratchet.Ratchet) error {
+	existing, err := LoadRatchet(d, name, d.fillAuth, d.checkAuth)
+	if os.IsNotExist(err) {
+		return StoreRatchet(d, name, ratch)
+	} else if err != nil {
+		log.Printf("replacing corrupt ratchet for \"%s\": %s", name, err)
+		return StoreRatchet(d, name, ratch)
+	}
+	if !supersedes(ratch, existing) {
+		return d.storeSession(retiredSession(name, ratch), ratch)
+	}
+	retired := retiredSession(name, existing)
+	if err := os.MkdirAll(filepath.Dir(d.sessionPath(retired)), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(d.ratchetPath(name), d.sessionPath(retired)); err != nil {
+		return err
+	}
+	// the grace period starts now
+	now := d.Now()
+	if err := os.Chtimes(d.sessionPath(retired), now, now); err != nil {
+		return err
+	}
+	if d.ratchets != nil {
+		d.ratchets.update(retired, existing)
+	}
+	return StoreRatchet(d, name, ratch)
+}
+
+func retiredSessions(d *Daemon) ([]session, error) {
+	dirs, err := ioutil.ReadDir(d.retiredRatchetsDir())
+	if err != nil {
+		return nil, err
+	}
+	var ret []session
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		name, err := encoding.UnescapeFilename(dir.Name())
+		if err != nil {
+			return nil, err
+		}
+		files, err := ioutil.ReadDir(filepath.Join(d.retiredRatchetsDir(), dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			ret = append(ret, session{name: name, retired: file.Name()})
+		}
+	}
+	return ret, nil
+}
+
+// shredRetiredSessions deletes the retired sessions that no message has
+// arrived on for longer than the saved key lifetime
+func (d *Daemon) shredRetiredSessions() error {
+	retired, err := retiredSessions(d)
+	if err != nil {
+		return err
+	}
+	for _, s := range retired {
+		path := d.sessionPath(s)
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if d.Now().Sub(fi.ModTime()) <= d.savedKeyLifetime() {
+			continue
+		}
+		if err := shred.Remove(path); err != nil {
+			return err
+		}
+		if d.ratchets != nil {
+			d.ratchets.remove(s)
+		}
+		os.Remove(filepath.Dir(path)) // only succeeds once the directory is empty
+	}
+	return nil
+}
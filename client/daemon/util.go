@@ -3,6 +3,7 @@ package daemon
 import (
 	"code.google.com/p/go.crypto/nacl/box"
 	"crypto/rand"
+	"time"
 )
 
 // returns public, secret, error
@@ -22,3 +23,28 @@ func GeneratePrekeys(numKeys int) ([]*[32]byte, []*[32]byte, error) {
 
 	return public, secret, nil
 }
+
+// dropExpiredPrekeys returns the prekeys that expire after cutoff
+func dropExpiredPrekeys(cutoff time.Time, publics, secrets []*[32]byte, expiries []time.Time) ([]*[32]byte, []*[32]byte, []time.Time) {
+	var keptPublics, keptSecrets []*[32]byte
+	var keptExpiries []time.Time
+	for i, expiry := range expiries {
+		if expiry.After(cutoff) {
+			keptPublics = append(keptPublics, publics[i])
+			keptSecrets = append(keptSecrets, secrets[i])
+			keptExpiries = append(keptExpiries, expiry)
+		}
+	}
+	return keptPublics, keptSecrets, keptExpiries
+}
+
+// latestExpiry returns the time the last of the prekeys expires at
+func latestExpiry(expiries []time.Time) time.Time {
+	var latest time.Time
+	for _, expiry := range expiries {
+		if expiry.After(latest) {
+			latest = expiry
+		}
+	}
+	return latest
+}
@@ -1,94 +1,357 @@
 package client
 
 import (
+	"crypto/rand"
+	"fmt"
+	"io"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/transport"
 	"golang.org/x/net/proxy"
 )
 
+// Dialer opens the plaintext connections that chatterbox transport sessions
+// run over.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+	// ReachesOnionServices tells whether Dial can connect to .onion addresses
+	ReachesOnionServices() bool
+}
+
+// IsolationPolicy determines which connections a TorDialer lets Tor send over
+// the same circuit.
+type IsolationPolicy int
+
+const (
+	// IsolateConnection uses a fresh circuit for every connection
+	IsolateConnection IsolationPolicy = iota
+	// IsolateDestination shares circuits between connections to the same
+	// address, but not between different addresses
+	IsolateDestination
+	// IsolateNone leaves circuit selection to Tor
+	IsolateNone
+)
+
+// ParseIsolationPolicy parses "connection", "destination" or "none"
+func ParseIsolationPolicy(s string) (IsolationPolicy, error) {
+	switch s {
+	case "connection":
+		return IsolateConnection, nil
+	case "destination":
+		return IsolateDestination, nil
+	case "none":
+		return IsolateNone, nil
+	}
+	return 0, fmt.Errorf("unknown circuit isolation policy %q", s)
+}
+
+const DefaultTorAddress = "127.0.0.1:9050"
+
+// TorDialer connects through the Tor SOCKS5 proxy at Addr. Circuits are
+// isolated by giving Tor different SOCKS credentials, which it treats as
+// separate streams by default (IsolateSOCKSAuth).
+type TorDialer struct {
+	Addr      string
+	Isolation IsolationPolicy
+
+	sync.Mutex
+	identities map[string]*proxy.Auth
+}
+
+func NewTorDialer(addr string, isolation IsolationPolicy) *TorDialer {
+	if addr == "" {
+		addr = DefaultTorAddress
+	}
+	return &TorDialer{
+		Addr:       addr,
+		Isolation:  isolation,
+		identities: make(map[string]*proxy.Auth),
+	}
+}
+
+func (d *TorDialer) Dial(network, addr string) (net.Conn, error) {
+	socks, err := proxy.SOCKS5("tcp", d.Addr, d.auth(addr), proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return socks.Dial(network, addr)
+}
+
+func (d *TorDialer) ReachesOnionServices() bool {
+	return true
+}
+
+// auth returns the SOCKS credentials to use for a connection to addr
+func (d *TorDialer) auth(addr string) *proxy.Auth {
+	switch d.Isolation {
+	case IsolateDestination:
+	case IsolateNone:
+		addr = ""
+	default:
+		return randomAuth()
+	}
+	d.Lock()
+	defer d.Unlock()
+	auth, ok := d.identities[addr]
+	if !ok {
+		auth = randomAuth()
+		d.identities[addr] = auth
+	}
+	return auth
+}
+
+func randomAuth() *proxy.Auth {
+	var identity [16]byte
+	if _, err := rand.Read(identity[:]); err != nil {
+		panic(err)
+	}
+	return &proxy.Auth{
+		User:     fmt.Sprintf("%x", identity[:8]),
+		Password: fmt.Sprintf("%x", identity[8:]),
+	}
+}
+
+// DirectDialer connects without Tor. Meant for tests and local deployments:
+// the server learns our IP address.
+type DirectDialer struct{}
+
+func (DirectDialer) Dial(network, addr string) (net.Conn, error) {
+	if isOnion(addr) {
+		return nil, fmt.Errorf("cannot reach onion service %s without Tor", addr)
+	}
+	return net.Dial(network, addr)
+}
+
+func (DirectDialer) ReachesOnionServices() bool {
+	return false
+}
+
+func isOnion(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return strings.HasSuffix(strings.ToLower(host), ".onion")
+}
+
+// ConnectionCache keeps connections to chatterbox servers open between uses.
+// Every key has a single slot, so at most one caller at a time uses the
+// connection for a key: DialServer waits for the previous caller to Put or
+// PutClose. Parked connections that have been idle for longer than
+// IdleTimeout are closed, and so are the least recently used ones when more
+// than MaxConnections are parked.
 type ConnectionCache struct {
 	sync.Mutex
-	connections map[string]chan *transport.Conn
+	slots map[string]*connSlot
+
+	dialer Dialer
 
-	torAddr string
+	IdleTimeout    time.Duration
+	MaxConnections int
+	Now            func() time.Time
 }
 
-func NewConnectionCache(torAddr string) *ConnectionCache {
+type cachedConn struct {
+	conn     *transport.Conn
+	lastUsed time.Time
+}
+
+// connSlot holds a token (a parked connection or nil) whenever nobody is using
+// its key. waiting counts the callers that are waiting for the token.
+type connSlot struct {
+	ch      chan *cachedConn
+	waiting int
+}
+
+const (
+	DefaultIdleTimeout    = 10 * time.Minute
+	DefaultMaxConnections = 32
+)
+
+func NewConnectionCache(dialer Dialer) *ConnectionCache {
 	return &ConnectionCache{
-		connections: make(map[string]chan *transport.Conn),
-		torAddr:     torAddr,
+		slots:          make(map[string]*connSlot),
+		dialer:         dialer,
+		IdleTimeout:    DefaultIdleTimeout,
+		MaxConnections: DefaultMaxConnections,
+		Now:            time.Now,
 	}
 }
 
-func (cc *ConnectionCache) Put(k string, conn *transport.Conn) {
-	cc.Lock()
-	ch, ok := cc.connections[k]
+// slot returns the slot for key k, creating it if there is none
+func (cc *ConnectionCache) slot(k string) *connSlot {
+	s, ok := cc.slots[k]
 	if !ok {
-		ch = make(chan *transport.Conn, 1)
-		cc.connections[k] = ch
+		s = &connSlot{ch: make(chan *cachedConn, 1)}
+		s.ch <- nil
+		cc.slots[k] = s
 	}
+	return s
+}
+
+// take waits until nobody else is using key k and returns its token
+func (cc *ConnectionCache) take(k string) *cachedConn {
+	cc.Lock()
+	s := cc.slot(k)
+	s.waiting++
+	cc.Unlock()
+	c := <-s.ch
+	cc.Lock()
+	s.waiting--
 	cc.Unlock()
+	return c
+}
 
-	select {
-	case ch <- conn:
-	default:
-		conn.Close()
-	}
-	return
+// release returns the token of key k
+func (cc *ConnectionCache) release(k string, c *cachedConn) {
+	cc.Lock()
+	s := cc.slot(k)
+	cc.Unlock()
+	s.ch <- c
 }
 
-// there must be a conn with the key k and no Puts to k may be issued in
-// parallel with Close
+// Put parks conn for later use with the key k
+func (cc *ConnectionCache) Put(k string, conn *transport.Conn) {
+	cc.release(k, &cachedConn{conn: conn, lastUsed: cc.Now()})
+	cc.Evict()
+}
+
+// PutClose gives up the use of key k without parking a connection. The caller
+// is responsible for closing the connection it got from DialServer.
 func (cc *ConnectionCache) PutClose(k string) {
+	cc.release(k, nil)
+}
+
+// Evict closes the parked connections that have been idle for too long and
+// the least recently used ones in excess of MaxConnections. The slots of keys
+// that are not in use and have no parked connection are forgotten.
+func (cc *ConnectionCache) Evict() {
 	cc.Lock()
 	defer cc.Unlock()
-	ch, ok := cc.connections[k]
-	if !ok {
-		return
+	now := cc.Now()
+	var parked []parkedConn
+	for k, s := range cc.slots {
+		select {
+		case c := <-s.ch:
+			if c != nil && now.Sub(c.lastUsed) > cc.IdleTimeout {
+				c.conn.Close()
+				c = nil
+			}
+			if c == nil && s.waiting == 0 {
+				delete(cc.slots, k)
+			} else if c == nil {
+				s.ch <- nil
+			} else {
+				parked = append(parked, parkedConn{s.ch, c})
+			}
+		default: // in use
+		}
 	}
-	delete(cc.connections, k)
+	sort.Sort(byLastUsed(parked))
+	for i, p := range parked {
+		if i < len(parked)-cc.MaxConnections {
+			p.conn.Close()
+			p.slot <- nil
+		} else {
+			p.slot <- p.cachedConn
+		}
+	}
+}
 
-	close(ch)
+type parkedConn struct {
+	slot chan *cachedConn
+	*cachedConn
 }
 
-// Caller MUST call Put or PutClose after this
-func (cc *ConnectionCache) DialServer(cacheKey, addr string, port int, serverPK, pk, sk *[32]byte) (conn *transport.Conn, err error) {
-	cc.Lock()
-	ch, ok := cc.connections[cacheKey]
-	if !ok {
-		ch = make(chan *transport.Conn, 1)
-		cc.connections[cacheKey] = ch
+type byLastUsed []parkedConn
+
+func (s byLastUsed) Len() int           { return len(s) }
+func (s byLastUsed) Less(i, j int) bool { return s[i].lastUsed.Before(s[j].lastUsed) }
+func (s byLastUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Dial connects to a server without involving the cache. The server is dialed
+// at onionAddr if it is not empty and the dialer can reach onion services, and
+// at addr otherwise.
+func (cc *ConnectionCache) Dial(addr, onionAddr string, port int, serverPK, pk, sk *[32]byte) (*transport.Conn, error) {
+	if onionAddr != "" && cc.dialer.ReachesOnionServices() {
+		addr = onionAddr
 	}
-	cc.Unlock()
+	plainconn, err := cc.dialer.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := transport.Handshake(plainconn, pk, sk, serverPK, proto.SERVER_MESSAGE_SIZE)
+	if err != nil {
+		plainconn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	if ok {
-		conn := <-ch
-		if conn != nil {
-			return conn, nil
+// Caller MUST call Put or PutClose after this unless an error is returned
+func (cc *ConnectionCache) DialServer(cacheKey, addr, onionAddr string, port int, serverPK, pk, sk *[32]byte) (*transport.Conn, error) {
+	conn, _, err := cc.dialServer(cacheKey, addr, onionAddr, port, serverPK, pk, sk)
+	return conn, err
+}
+
+func (cc *ConnectionCache) dialServer(cacheKey, addr, onionAddr string, port int, serverPK, pk, sk *[32]byte) (conn *transport.Conn, cached bool, err error) {
+	c := cc.take(cacheKey)
+	if c != nil {
+		if cc.Now().Sub(c.lastUsed) <= cc.IdleTimeout {
+			return c.conn, true, nil
 		}
+		c.conn.Close()
 	}
-	// ch is empty now
-
-	dialer := TorAnon(cc.torAddr)
-	if cc.torAddr == "DANGEROUS_NO_TOR" {
-		dialer = proxy.Direct
+	conn, err = cc.Dial(addr, onionAddr, port, serverPK, pk, sk)
+	if err != nil {
+		cc.PutClose(cacheKey)
+		return nil, false, err
 	}
+	return conn, false, nil
+}
 
-	plainconn, err := dialer.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
+// WithConn calls f with a connection to the server. If a parked connection
+// fails with an I/O error before f has read anything from it, it is assumed to
+// have gone stale: a new connection is dialed and f is called once more. f
+// should only send one request and read its reply, so that the server has at
+// most seen the request when f is retried.
+func (cc *ConnectionCache) WithConn(cacheKey, addr, onionAddr string, port int, serverPK, pk, sk *[32]byte, f func(*transport.Conn) error) error {
+	conn, cached, err := cc.dialServer(cacheKey, addr, onionAddr, port, serverPK, pk, sk)
 	if err != nil {
-		cc.PutClose(cacheKey)
-		return nil, err
+		return err
+	}
+	framesRead := conn.FramesRead()
+	err = f(conn)
+	if err != nil && cached && conn.FramesRead() == framesRead && isConnError(err) {
+		conn.Close()
+		conn, err = cc.Dial(addr, onionAddr, port, serverPK, pk, sk)
+		if err != nil {
+			cc.PutClose(cacheKey)
+			return err
+		}
+		err = f(conn)
 	}
-	conn, _, err = transport.Handshake(plainconn, pk, sk, serverPK, proto.SERVER_MESSAGE_SIZE)
 	if err != nil {
 		conn.Close()
 		cc.PutClose(cacheKey)
-		return nil, err
+		return err
 	}
+	cc.Put(cacheKey, conn)
+	return nil
+}
 
-	return conn, nil
+// isConnError tells whether err came from the underlying connection rather
+// than from the server or the protocol
+func isConnError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
 }
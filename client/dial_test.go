@@ -0,0 +1,274 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"code.google.com/p/go.crypto/nacl/box"
+	"github.com/andres-erbsen/chatterbox/proto"
+	"github.com/andres-erbsen/chatterbox/transport"
+)
+
+type recordingDialer struct {
+	onion bool
+	addrs []string
+}
+
+func (d *recordingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	return nil, errors.New("recordingDialer does not connect")
+}
+
+func (d *recordingDialer) ReachesOnionServices() bool {
+	return d.onion
+}
+
+func TestDialServerPrefersOnion(t *testing.T) {
+	for _, onion := range []bool{false, true} {
+		dialer := &recordingDialer{onion: onion}
+		cc := NewConnectionCache(dialer)
+		if _, err := cc.DialServer("alice", "example.com", "example.onion", 1984, new([32]byte), nil, nil); err == nil {
+			t.Fatal("dial should have failed")
+		}
+		expected := "example.com:1984"
+		if onion {
+			expected = "example.onion:1984"
+		}
+		if len(dialer.addrs) != 1 || dialer.addrs[0] != expected {
+			t.Errorf("dialed %v, expected %s", dialer.addrs, expected)
+		}
+	}
+}
+
+func TestDirectDialerRefusesOnion(t *testing.T) {
+	if _, err := (DirectDialer{}).Dial("tcp", "expyuzz4wqqyqhjn.ONION:80"); err == nil {
+		t.Error("DirectDialer connected to an onion service")
+	}
+}
+
+func TestTorDialerIsolation(t *testing.T) {
+	for _, test := range []struct {
+		isolation               IsolationPolicy
+		sameDestination, shared bool
+	}{
+		{IsolateConnection, false, false},
+		{IsolateDestination, true, false},
+		{IsolateNone, true, true},
+	} {
+		d := NewTorDialer("", test.isolation)
+		a1, a2, b := d.auth("a.onion:1984"), d.auth("a.onion:1984"), d.auth("b.onion:1984")
+		if (*a1 == *a2) != test.sameDestination {
+			t.Errorf("isolation %d: same destination got credentials %v and %v", test.isolation, a1, a2)
+		}
+		if (*a1 == *b) != test.shared {
+			t.Errorf("isolation %d: different destinations got credentials %v and %v", test.isolation, a1, b)
+		}
+	}
+}
+
+// echoDialer connects to an in-process server that echoes every frame back
+type echoDialer struct {
+	pk, sk *[32]byte
+
+	sync.Mutex
+	serverConns []*transport.Conn
+}
+
+func newEchoDialer(t *testing.T) *echoDialer {
+	pk, sk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &echoDialer{pk: pk, sk: sk}
+}
+
+func (d *echoDialer) Dial(network, addr string) (net.Conn, error) {
+	p1, p2 := net.Pipe()
+	go func() {
+		conn, _, err := transport.Handshake(p2, d.pk, d.sk, nil, proto.SERVER_MESSAGE_SIZE)
+		if err != nil {
+			return
+		}
+		d.Lock()
+		d.serverConns = append(d.serverConns, conn)
+		d.Unlock()
+		buf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+		for {
+			n, err := conn.ReadFrame(buf)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteFrame(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return p1, nil
+}
+
+func (d *echoDialer) ReachesOnionServices() bool {
+	return false
+}
+
+func (d *echoDialer) dials() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.serverConns)
+}
+
+func echo(conn *transport.Conn) error {
+	msg := []byte("ping")
+	if _, err := conn.WriteFrame(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, proto.SERVER_MESSAGE_SIZE)
+	n, err := conn.ReadFrame(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		return errors.New("echo mismatch")
+	}
+	return nil
+}
+
+func (d *echoDialer) withConn(cc *ConnectionCache, k string) error {
+	return cc.WithConn(k, "localhost", "", 1984, d.pk, nil, nil, echo)
+}
+
+func TestConnectionCacheConcurrentSenders(t *testing.T) {
+	d := newEchoDialer(t)
+	cc := NewConnectionCache(d)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inUse := false
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- cc.WithConn("alice", "localhost", "", 1984, d.pk, nil, nil, func(conn *transport.Conn) error {
+				mu.Lock()
+				if inUse {
+					mu.Unlock()
+					return errors.New("connection used by two senders at once")
+				}
+				inUse = true
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					inUse = false
+					mu.Unlock()
+				}()
+				return echo(conn)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := d.dials(); n != 1 {
+		t.Errorf("dialed %d times, expected the connection to be reused", n)
+	}
+}
+
+func TestConnectionCacheRedialsStale(t *testing.T) {
+	d := newEchoDialer(t)
+	cc := NewConnectionCache(d)
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	d.serverConns[0].Close()
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.dials(); n != 2 {
+		t.Errorf("dialed %d times, expected 2", n)
+	}
+}
+
+func TestConnectionCacheRetriesOnlyStale(t *testing.T) {
+	d := newEchoDialer(t)
+	cc := NewConnectionCache(d)
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	badReply := errors.New("bad reply")
+	for _, f := range []func(*transport.Conn) error{
+		func(conn *transport.Conn) error { return badReply },
+		func(conn *transport.Conn) error {
+			if err := echo(conn); err != nil {
+				return err
+			}
+			return badReply
+		},
+	} {
+		calls := 0
+		err := cc.WithConn("alice", "localhost", "", 1984, d.pk, nil, nil, func(conn *transport.Conn) error {
+			calls++
+			return f(conn)
+		})
+		if err != badReply {
+			t.Errorf("got error %v, expected %v", err, badReply)
+		}
+		if calls != 1 {
+			t.Errorf("called %d times, expected no retry", calls)
+		}
+		if err := d.withConn(cc, "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionCacheIdleEviction(t *testing.T) {
+	d := newEchoDialer(t)
+	cc := NewConnectionCache(d)
+	now := time.Now()
+	cc.Now = func() time.Time { return now }
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(cc.IdleTimeout + time.Second)
+	cc.Evict()
+	if n := len(cc.slots); n != 0 {
+		t.Errorf("%d slots left after evicting every connection", n)
+	}
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.dials(); n != 2 {
+		t.Errorf("dialed %d times, expected 2", n)
+	}
+}
+
+func TestConnectionCacheMaxConnections(t *testing.T) {
+	d := newEchoDialer(t)
+	cc := NewConnectionCache(d)
+	cc.MaxConnections = 2
+	now := time.Now()
+	cc.Now = func() time.Time { return now }
+	for _, k := range []string{"alice", "bob", "carol", "bob", "carol"} {
+		now = now.Add(time.Second)
+		if err := d.withConn(cc, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := d.dials(); n != 3 {
+		t.Errorf("dialed %d times, expected 3", n)
+	}
+	if err := d.withConn(cc, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if n := d.dials(); n != 4 {
+		t.Errorf("dialed %d times, expected the least recently used connection to have been evicted", n)
+	}
+}
@@ -0,0 +1,129 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A message that is not text is an attachment: a file of any type, which is
+// sent with its MIME type and the name it had. In the conversations directory
+// its name is followed by an extension for the type. The extensions come from
+// a fixed list, whatever the sender claims, so that opening a received file
+// never runs it; other types are written as .bin. The name the sender gave the
+// file is kept in the filename directory, in a file at the same relative path
+// as the message in the conversations directory, sealed like the message.
+
+// OctetStream is the type of files whose type is not known
+const OctetStream = "application/octet-stream"
+
+var attachmentExtensions = map[string]string{
+	"text/plain":      "txt",
+	"image/png":       "png",
+	"image/jpeg":      "jpg",
+	"image/gif":       "gif",
+	"image/webp":      "webp",
+	"audio/mpeg":      "mp3",
+	"audio/ogg":       "ogg",
+	"video/mp4":       "mp4",
+	"video/webm":      "webm",
+	"application/pdf": "pdf",
+	"application/zip": "zip",
+	OctetStream:       "bin",
+}
+
+// AttachmentExtension returns the extension that a received file of
+// contentType is written with
+func AttachmentExtension(contentType string) string {
+	if ext, ok := attachmentExtensions[contentType]; ok {
+		return ext
+	}
+	return attachmentExtensions[OctetStream]
+}
+
+// ContentType returns the type of the contents of a message from its name, or
+// "" for text
+func ContentType(messageName string) string {
+	ext := strings.TrimPrefix(filepath.Ext(messageName), ".")
+	for contentType, e := range attachmentExtensions {
+		if e == ext && ext != "" {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// ContentTypeOfFile guesses the type of a file that is to be sent from its
+// name. A file without an extension is text.
+func ContentTypeOfFile(name string) string {
+	ext := filepath.Ext(name)
+	if ext == "" {
+		return ""
+	}
+	contentType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return OctetStream
+	}
+	return contentType
+}
+
+// MessageFileName returns the name of the file of a message with contentType
+// in its conversation directory, see MessageName
+func MessageFileName(date time.Time, sender, contentType string) string {
+	if contentType == "" {
+		return MessageName(date, sender)
+	}
+	return MessageName(date, sender) + "." + AttachmentExtension(contentType)
+}
+
+func (p *Paths) FilenameDir() string { return filepath.Join(p.RootDir, "filename") }
+
+// FilenamePath returns the path of the file with the original name of an
+// attachment
+func (p *Paths) FilenamePath(conversationName, messageName string) string {
+	return filepath.Join(p.FilenameDir(), conversationName, messageName)
+}
+
+// ReadFilename returns the name that the sender of an attachment gave it,
+// decrypting it if it has been sealed with the storage key
+func (p *Paths) ReadFilename(conversationName, messageName string) (string, error) {
+	bs, err := ioutil.ReadFile(p.FilenamePath(conversationName, messageName))
+	if err != nil {
+		return "", err
+	}
+	bs, _ = OpenAllowingPlaintext(bs, p.StorageKey)
+	return string(bs), nil
+}
+
+// WriteFilename records the name that the sender of an attachment gave it,
+// sealed with key unless it is nil
+func (p *Paths) WriteFilename(conversationName, messageName, filename string, key *[32]byte) error {
+	path := p.FilenamePath(conversationName, messageName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, Seal([]byte(filename), key), 0600)
+}
+
+// FileToOutbox sends the file at path as an attachment to a conversation. If
+// a file with the same name is already waiting to be sent, a number is put in
+// front of the name.
+func (p *Paths) FileToOutbox(conversationName, path string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	outbox := filepath.Join(p.OutboxDir(), conversationName)
+	name := filepath.Base(path)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(outbox, name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%d-%s", i, filepath.Base(path))
+	}
+	return p.AtomicWriteFile(filepath.Join(outbox, name), contents, 0600)
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every message that is filed in a conversation has its place in the
+// conversation in the clock directory, in a file at the same relative path as
+// the message in the conversations directory: the Lamport clock it was sent
+// with (see proto.Message.Clock), in decimal. Notices have the clock of the
+// conversation when they were written. The daemon writes the file before the
+// message is filed. All participants order the messages of a conversation the
+// same way, by clock, then by sender and then by name, whatever the clocks of
+// their computers say; see SortMessages. Messages from before there were
+// clocks have none and come first, in the order of their names.
+
+func (p *Paths) ClockDir() string { return filepath.Join(p.RootDir, "clock") }
+
+// ClockPath returns the path of the file with the clock of a message
+func (p *Paths) ClockPath(conversationName, messageName string) string {
+	return filepath.Join(p.ClockDir(), conversationName, messageName)
+}
+
+// ReadClock reads a file with the clock of a message
+func ReadClock(path string) (uint64, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64)
+}
+
+// WriteClock atomically replaces the file with the clock of a message at path
+func (p *Paths) WriteClock(path string, clock uint64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(strconv.FormatUint(clock, 10)+"\n"), 0600)
+}
+
+type byClock []*Message
+
+func (ms byClock) Len() int      { return len(ms) }
+func (ms byClock) Swap(i, j int) { ms[i], ms[j] = ms[j], ms[i] }
+func (ms byClock) Less(i, j int) bool {
+	a, b := ms[i], ms[j]
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	if a.Clock != 0 && a.Sender != b.Sender {
+		return a.Sender < b.Sender
+	}
+	return filepath.Base(a.Path) < filepath.Base(b.Path)
+}
+
+// SortMessages puts the messages of a conversation, given in the order of
+// their names, in the order that all participants agree on. A message without
+// a clock that comes after one with a clock, such as a notice from before
+// there were clocks, keeps its place after it.
+func SortMessages(messages []*Message) {
+	var clock uint64
+	for _, m := range messages {
+		if m.Clock == 0 {
+			m.Clock = clock
+		}
+		clock = m.Clock
+	}
+	sort.Stable(byClock(messages))
+}
@@ -0,0 +1,85 @@
+package persistence
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andres-erbsen/chatterbox/proto"
+)
+
+// A conversation is identified by a random id that is chosen when it is
+// created and is in its metadata. The directory of a conversation is named
+// when it is created, see ConversationName, and keeps its name when
+// participants are added or removed, so the name does not say what the
+// conversation is: use FindConversation or ConversationDirName to get from
+// metadata to the directory. Conversations from before there were ids are
+// identified by their subject and participants, which all of them derive the
+// same id from.
+
+// ConversationIdSize is the size of the id of a conversation in bytes
+const ConversationIdSize = 16
+
+// ConversationId returns the id of the conversation that metadata describes
+func ConversationId(metadata *proto.ConversationMetadata) []byte {
+	if metadata.Id != nil {
+		return metadata.Id
+	}
+	h := sha256.Sum256([]byte(legacyConversationName(metadata)))
+	return h[:ConversationIdSize]
+}
+
+// FindConversation returns the name of the directory of the conversation with
+// id, or "" if there is none
+func (p *Paths) FindConversation(id []byte) (string, error) {
+	fis, err := ioutil.ReadDir(p.ConversationDir())
+	if err != nil {
+		return "", err
+	}
+	for _, fi := range fis {
+		c, err := ReadConversationMetadata(filepath.Join(p.ConversationDir(), fi.Name()))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(ConversationId(c), id) {
+			return fi.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// ConversationDirName returns the name of the directory of the conversation
+// that metadata describes, or the name of its outbox directory if there is no
+// such directory yet, see OutboxName
+func (p *Paths) ConversationDirName(metadata *proto.ConversationMetadata) (string, error) {
+	name, err := p.FindConversation(ConversationId(metadata))
+	if err != nil || name != "" {
+		return name, err
+	}
+	return OutboxName(metadata), nil
+}
+
+// UIs change the participants of a conversation by asking the daemon to: a
+// file named after the user to add or remove in the members directory, in a
+// directory named after the conversation, with "add" or "remove" in it. The
+// daemon tells all participants, including the one that is added or removed,
+// updates the metadata of the conversation, and removes the request.
+
+const (
+	MembershipAdd    = "add"
+	MembershipRemove = "remove"
+)
+
+func (p *Paths) MembershipDir() string { return filepath.Join(p.RootDir, "members") }
+
+// ChangeMembership asks the daemon to add name to, or remove them from, a
+// conversation; change is MembershipAdd or MembershipRemove
+func (p *Paths) ChangeMembership(conversationName, name, change string) error {
+	path := filepath.Join(p.MembershipDir(), conversationName, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(change), 0600)
+}
@@ -0,0 +1,39 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A message that disappears (see proto.Message.Lifetime) has the time at
+// which the daemon deletes it in the expiry directory, in a file at the same
+// relative path as the message in the conversations directory, in RFC 3339
+// format. The file is written before the message is filed, so UIs can show
+// the time along with the message.
+
+func (p *Paths) ExpiryDir() string { return filepath.Join(p.RootDir, "expiry") }
+
+// ExpiryPath returns the path of the expiry file of a message
+func (p *Paths) ExpiryPath(conversationName, messageName string) string {
+	return filepath.Join(p.ExpiryDir(), conversationName, messageName)
+}
+
+// ReadExpiry reads an expiry file
+func ReadExpiry(path string) (time.Time, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(bs)))
+}
+
+// WriteExpiry atomically replaces the expiry file at path
+func (p *Paths) WriteExpiry(path string, expiry time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(expiry.UTC().Format(time.RFC3339Nano)+"\n"), 0600)
+}
@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/andres-erbsen/chatterbox/client/encoding"
 	"github.com/andres-erbsen/chatterbox/proto"
@@ -19,10 +20,16 @@ import (
 type Paths struct {
 	RootDir     string
 	Application string
+	// StorageKey opens sealed files; it is nil unless the account has a
+	// passphrase and Unlock has been called
+	StorageKey *[32]byte
 }
 
 const (
 	MetadataFileName = "metadata.pb"
+	// NoticeSender is the sender of messages written by chatterbox itself,
+	// not by a participant of the conversation
+	NoticeSender = "%notice"
 )
 
 func (p *Paths) ConversationDir() string { return filepath.Join(p.RootDir, "conversations") }
@@ -33,7 +40,42 @@ func (p *Paths) TempDir() string {
 	return filepath.Join(p.RootDir, ".tmp", p.Application)
 }
 
-func ConversationName(metadata *proto.ConversationMetadata) string {
+// MaxConversationNameLength is the length in bytes that the names of
+// conversation directories are truncated to, well below the limits of file
+// systems
+const MaxConversationNameLength = 200
+
+// ConversationName returns the name of the directory of a conversation that
+// sender started at date with recipients, which do not include the user the
+// directory belongs to: "date-number-sender-recipient-recipient-...", where
+// number distinguishes it from other conversations that would get the same
+// name. The name describes the conversation to people and is not to be parsed.
+func ConversationName(date time.Time, number int, sender string, recipients []string) string {
+	names := make([]string, 0, len(recipients))
+	already := map[string]struct{}{sender: struct{}{}}
+	for _, s := range recipients {
+		if _, ok := already[s]; !ok {
+			names = append(names, encoding.EscapeFilename(s))
+			already[s] = struct{}{}
+		}
+	}
+	sort.Strings(names)
+	name := fmt.Sprintf("%s-%d-%s", date.UTC().Format("2006-01-02T15:04:05"), number, encoding.EscapeFilename(sender))
+	if len(names) > 0 {
+		name += "-" + strings.Join(names, "-")
+	}
+	if len(name) > MaxConversationNameLength {
+		name = name[:MaxConversationNameLength]
+		for !utf8.ValidString(name) {
+			name = name[:len(name)-1]
+		}
+	}
+	return name
+}
+
+// legacyConversationName returns the name that the directory of a
+// conversation had before conversations had ids, "subject %between a %and b"
+func legacyConversationName(metadata *proto.ConversationMetadata) string {
 	names := make([]string, 0, len(metadata.Participants))
 	already := make(map[string]struct{})
 	for _, s := range metadata.Participants {
@@ -46,6 +88,13 @@ func ConversationName(metadata *proto.ConversationMetadata) string {
 	return encoding.EscapeFilename(metadata.Subject) + " %between " + strings.Join(names, " %and ")
 }
 
+// IsLegacyConversationName tells whether convName is the name that the
+// directory of the conversation with metadata had before conversations had
+// ids
+func IsLegacyConversationName(convName string, metadata *proto.ConversationMetadata) bool {
+	return convName == legacyConversationName(metadata)
+}
+
 func MessageName(date time.Time, sender string) string {
 	//messageName := "date-sender"
 	dateStr := date.UTC().Format(time.RFC3339)
@@ -72,20 +121,25 @@ func (p *Paths) TempFile() (string, error) {
 	return ret, nil
 }
 
-// Unmarshal reads an Unmarshal()-able from a file
-func UnmarshalFromFile(path string, out interface {
+// UnmarshalFromFile reads an Unmarshal()-able from a file that has been
+// written using MarshalToFile. If the account has a storage key, the file
+// must have been sealed with it.
+func (p *Paths) UnmarshalFromFile(path string, out interface {
 	Unmarshal([]byte) error
 }) error {
 	fileContents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	return out.Unmarshal(fileContents)
+	bs, err := Open(fileContents, p.StorageKey)
+	if err != nil {
+		return err
+	}
+	return out.Unmarshal(bs)
 }
 
-// MarshalToFile atomically writes a Marshal()-able object to a file by first
-// writing to a new file in tmpDir and then atomically renaming it to the
-// destination file.
+// MarshalToFile atomically writes a Marshal()-able object to a file, sealed
+// with the storage key if the account has one.
 func (p *Paths) MarshalToFile(path string, in interface {
 	Marshal() ([]byte, error)
 }) error {
@@ -93,29 +147,58 @@ func (p *Paths) MarshalToFile(path string, in interface {
 	if err != nil {
 		return err
 	}
-	tmpFile, err := p.TempFile()
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(tmpFile, inBytes, 0600)
+	return p.AtomicWriteFile(path, Seal(inBytes, p.StorageKey), 0600)
+}
+
+// UnmarshalFromPlaintextFile reads an Unmarshal()-able from a file that has
+// been written using MarshalToPlaintextFile
+func UnmarshalFromPlaintextFile(path string, out interface {
+	Unmarshal([]byte) error
+}) error {
+	fileContents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tmpFile, path)
+	return out.Unmarshal(fileContents)
+}
+
+// MarshalToPlaintextFile is like MarshalToFile, but never seals the file. It
+// is only for files that other programs read without the storage key:
+// conversation metadata and our public profile.
+func (p *Paths) MarshalToPlaintextFile(path string, in interface {
+	Marshal() ([]byte, error)
+}) error {
+	inBytes, err := in.Marshal()
 	if err != nil {
 		return err
 	}
-	return nil
+	return p.AtomicWriteFile(path, inBytes, 0600)
 }
 
+// OutboxName returns the name of the outbox directory of a new conversation,
+// which the daemon renames to the name of the conversation once it has sent
+// the first message
+func OutboxName(metadata *proto.ConversationMetadata) string {
+	return "new-" + hex.EncodeToString(ConversationId(metadata))
+}
+
+// ConversationToOutbox creates the outbox directory of a new conversation,
+// see OutboxName. The conversation is given a random id unless metadata has
+// one already.
 func (p *Paths) ConversationToOutbox(metadata *proto.ConversationMetadata, msgs ...string) error {
-	path := filepath.Join(p.OutboxDir(), ConversationName(metadata))
+	if metadata.Id == nil {
+		metadata.Id = make([]byte, ConversationIdSize)
+		if _, err := rand.Read(metadata.Id); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(p.OutboxDir(), OutboxName(metadata))
 	tmpDir, err := p.MkdirInTemp()
 	if err != nil {
 		return err
 	}
 	defer shred.RemoveAll(tmpDir)
-	if err := p.MarshalToFile(filepath.Join(tmpDir, MetadataFileName), metadata); err != nil {
+	if err := p.WriteConversationMetadata(tmpDir, metadata); err != nil {
 		return err
 	}
 	return os.Rename(filepath.Join(tmpDir), path)
@@ -151,7 +234,13 @@ func (p *Paths) AtomicWriteFile(path string, bs []byte, perm os.FileMode) error
 
 func ReadConversationMetadata(dir string) (*proto.ConversationMetadata, error) {
 	c := new(proto.ConversationMetadata)
-	return c, UnmarshalFromFile(filepath.Join(dir, MetadataFileName), c)
+	return c, UnmarshalFromPlaintextFile(filepath.Join(dir, MetadataFileName), c)
+}
+
+// WriteConversationMetadata writes the metadata of the conversation or outbox
+// directory dir. It is never sealed.
+func (p *Paths) WriteConversationMetadata(dir string, metadata *proto.ConversationMetadata) error {
+	return p.MarshalToPlaintextFile(filepath.Join(dir, MetadataFileName), metadata)
 }
 
 func (p *Paths) ListConversations() ([]*proto.ConversationMetadata, error) {
@@ -170,25 +259,67 @@ func (p *Paths) ListConversations() ([]*proto.ConversationMetadata, error) {
 	return ret, nil
 }
 
+// MessageDate returns the date of a message from its name, see MessageName
+func MessageDate(messageName string) (time.Time, error) {
+	if len(messageName) < len("2015-02-16T07:09:55Z") {
+		return time.Time{}, fmt.Errorf("badly formatted message filename : " + messageName)
+	}
+	return time.Parse(time.RFC3339, messageName[:len("2015-02-16T07:09:55Z")])
+}
+
+// MessageSender returns the sender of a message from its name, see
+// MessageFileName
+func MessageSender(messageName string) (string, error) {
+	if len(messageName) < len("2015-02-16T07:09:55Z-") {
+		return "", fmt.Errorf("badly formatted message filename : " + messageName)
+	}
+	sender := messageName[len("2015-02-16T07:09:55Z-"):]
+	if ContentType(messageName) != "" {
+		sender = strings.TrimSuffix(sender, filepath.Ext(sender))
+	}
+	return sender, nil
+}
+
 type Message struct {
 	Path, Sender, Content string
+	// empty for text, see ContentType
+	ContentType string
+	// the place of the message in the conversation, see ClockPath; 0 for
+	// none
+	Clock uint64
 }
 
-func ReadMessageFromFile(path string) (*Message, error) {
-	base := filepath.Base(path)
-	if len(base) < len("2015-02-16T07:09:55Z-") {
+// ReadMessageFromFile reads a message from a conversation directory,
+// decrypting it if it has been sealed with the storage key. Messages are only
+// sealed if the account is set to, so plaintext is accepted as well. If the
+// account has a passphrase, Unlock must have been called first.
+func (p *Paths) ReadMessageFromFile(path string) (*Message, error) {
+	sender, err := MessageSender(filepath.Base(path))
+	if err != nil {
 		return nil, fmt.Errorf("badly formatted message filename : " + path)
 	}
-	sender := base[len("2015-02-16T07:09:55Z-"):]
+	if p.StorageKey == nil {
+		if hasPassphrase, err := p.HasPassphrase(); err != nil {
+			return nil, err
+		} else if hasPassphrase {
+			return nil, ErrLocked
+		}
+	}
 	contents, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("badly formatted message filename : " + path)
 	}
-	return &Message{Path: path, Sender: sender, Content: string(contents)}, nil
+	contents, _ = OpenAllowingPlaintext(contents, p.StorageKey)
+	clock, _ := ReadClock(p.ClockPath(filepath.Base(filepath.Dir(path)), filepath.Base(path)))
+	return &Message{Path: path, Sender: sender, Content: string(contents), ContentType: ContentType(path), Clock: clock}, nil
 }
 
 func (p *Paths) LoadMessages(conv *proto.ConversationMetadata) ([]*Message, error) {
-	convpath := filepath.Join(p.ConversationDir(), ConversationName(conv))
+	convName, err := p.ConversationDirName(conv)
+	if err != nil {
+		return nil, err
+	}
+	convpath := filepath.Join(p.ConversationDir(), convName)
 	fis, err := ioutil.ReadDir(convpath)
 	if err != nil {
 		return nil, err
@@ -198,12 +329,13 @@ func (p *Paths) LoadMessages(conv *proto.ConversationMetadata) ([]*Message, erro
 		if fi.Name() == MetadataFileName {
 			continue
 		}
-		msg, err := ReadMessageFromFile(filepath.Join(p.ConversationDir(), ConversationName(conv), fi.Name()))
+		msg, err := p.ReadMessageFromFile(filepath.Join(convpath, fi.Name()))
 		if err != nil {
 			return nil, err
 		}
 		ret = append(ret, msg)
 	}
+	SortMessages(ret)
 	return ret, nil
 }
 
@@ -0,0 +1,70 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A message that is too large for one envelope is sent in chunks. While they
+// are being sent or received, the daemon publishes how many have been in the
+// progress directory, in a file at the same relative path that the message
+// has in the conversations directory; a received message is only filed once
+// all its chunks have arrived. Every line of the file is the progress for one
+// user: their name, a tab, the number of chunks that have been sent to them
+// or received from them, another tab and the number of chunks. A user is
+// removed from the file once the transfer is complete, and the file once it is
+// empty.
+
+// Progress is how far a message has been sent to or received from one user
+type Progress struct {
+	Name        string
+	Done, Total int
+}
+
+func (p *Paths) ProgressDir() string { return filepath.Join(p.RootDir, "progress") }
+
+// ProgressPath returns the path of the progress file of a message
+func (p *Paths) ProgressPath(conversationName, messageName string) string {
+	return filepath.Join(p.ProgressDir(), conversationName, messageName)
+}
+
+// ReadProgress reads a progress file
+func ReadProgress(path string) ([]Progress, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ret []Progress
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var progress Progress
+		if _, err := fmt.Sscanf(scanner.Text(), "%s\t%d\t%d", &progress.Name, &progress.Done, &progress.Total); err != nil {
+			return nil, fmt.Errorf("badly formatted progress file: %s", path)
+		}
+		ret = append(ret, progress)
+	}
+	return ret, scanner.Err()
+}
+
+// WriteProgress atomically replaces the progress file at path, or removes it
+// if there is no progress left to report
+func (p *Paths) WriteProgress(path string, progress []Progress) error {
+	if len(progress) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, pr := range progress {
+		fmt.Fprintf(&buf, "%s\t%d\t%d\n", pr.Name, pr.Done, pr.Total)
+	}
+	return p.AtomicWriteFile(path, buf.Bytes(), 0600)
+}
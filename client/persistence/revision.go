@@ -0,0 +1,99 @@
+package persistence
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The sender of a message can edit or delete it after it has been sent. A UI
+// asks the daemon to by writing a file in the revise directory, at the same
+// relative path as the message in the conversations directory: "edit" followed
+// by a newline and the new contents, or "delete"; see EditMessage and
+// DeleteMessage. Only text can be edited, and only messages that we sent and
+// that have an id can be changed at all. The daemon changes the message, tells
+// the other participants, and removes the request.
+//
+// Every message that has been edited or deleted, by us or by its sender, has a
+// marker in the revised directory at the same path: "edited" or "deleted",
+// followed by a space and the time of the change in RFC 3339 format. It is
+// written before the message is changed. The file of an edited message has the
+// new contents, and that of a deleted message is shredded and replaced by an
+// empty one, which keeps its place in the conversation.
+
+const (
+	// requests in the revise directory
+	RevisionEdit   = "edit"
+	RevisionDelete = "delete"
+	// markers in the revised directory
+	RevisionEdited  = "edited"
+	RevisionDeleted = "deleted"
+)
+
+func (p *Paths) ReviseDir() string  { return filepath.Join(p.RootDir, "revise") }
+func (p *Paths) RevisedDir() string { return filepath.Join(p.RootDir, "revised") }
+
+// RevisedPath returns the path of the marker of a message that has been edited
+// or deleted
+func (p *Paths) RevisedPath(conversationName, messageName string) string {
+	return filepath.Join(p.RevisedDir(), conversationName, messageName)
+}
+
+func (p *Paths) requestRevision(conversationName, messageName, request string) error {
+	path := filepath.Join(p.ReviseDir(), conversationName, messageName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(request), 0600)
+}
+
+// EditMessage asks the daemon to replace the contents of a message that we
+// sent with contents
+func (p *Paths) EditMessage(conversationName, messageName, contents string) error {
+	return p.requestRevision(conversationName, messageName, RevisionEdit+"\n"+contents)
+}
+
+// DeleteMessage asks the daemon to delete a message that we sent, here and
+// for everyone else in the conversation
+func (p *Paths) DeleteMessage(conversationName, messageName string) error {
+	return p.requestRevision(conversationName, messageName, RevisionDelete+"\n")
+}
+
+// ParseRevisionRequest splits a request from the revise directory into what
+// to do and, for an edit, the new contents
+func ParseRevisionRequest(request []byte) (change, contents string, err error) {
+	s := string(request)
+	change, contents = s, ""
+	if i := strings.Index(s, "\n"); i >= 0 {
+		change, contents = s[:i], s[i+1:]
+	}
+	if change != RevisionEdit && change != RevisionDelete {
+		return "", "", fmt.Errorf("unknown revision %q", change)
+	}
+	return change, contents, nil
+}
+
+// ReadRevision reads the marker of a message that has been edited or deleted
+func ReadRevision(path string) (revision string, date time.Time, err error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	fields := strings.Fields(string(bs))
+	if len(fields) != 2 || (fields[0] != RevisionEdited && fields[0] != RevisionDeleted) {
+		return "", time.Time{}, fmt.Errorf("badly formatted revision marker %s", path)
+	}
+	date, err = time.Parse(time.RFC3339Nano, fields[1])
+	return fields[0], date, err
+}
+
+// WriteRevision atomically replaces the marker of a message at path
+func (p *Paths) WriteRevision(path, revision string, date time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(revision+" "+date.UTC().Format(time.RFC3339Nano)+"\n"), 0600)
+}
@@ -0,0 +1,214 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.google.com/p/go.crypto/nacl/secretbox"
+	"code.google.com/p/go.crypto/scrypt"
+	"code.google.com/p/go.crypto/ssh/terminal"
+)
+
+// Files with secrets in them can be sealed: encrypted and authenticated with
+// a random storage key, which is in turn kept in a file sealed with a key
+// derived from the passphrase of the user. Changing the passphrase therefore
+// only rewrites that one file. A sealed file starts with sealedMagic and a
+// version byte. Once an account has a storage key, everything written using
+// Paths.MarshalToFile is sealed: a plaintext file in its place has not been
+// written by us and is rejected by Open.
+//
+// Files that are sealed only if the user asked for it (the messages in
+// conversations) can hold anything a peer sent, including something that looks
+// like a sealed file. Whether such a file is sealed is therefore never decided
+// by its first bytes: OpenAllowingPlaintext only takes a file to be sealed if
+// it authenticates with the storage key.
+
+const (
+	sealedMagic    = "\x00chatterbox-sealed"
+	sealedVersion  = 1
+	sealedOverhead = len(sealedMagic) + 1 + 24 + secretbox.Overhead
+
+	// storage key file: version, scrypt salt, sealed storage key
+	storageKeyVersion = 2
+	saltSize          = 32
+	scryptN           = 1 << 15
+	scryptR           = 8
+	scryptP           = 1
+)
+
+var (
+	ErrLocked          = errors.New("file is encrypted but no passphrase was given")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrNotSealed       = errors.New("file is not encrypted although the account has a passphrase")
+)
+
+// IsSealed tells whether bs has the format of a sealed file. It does not tell
+// whether bs has been sealed by us, see OpenAllowingPlaintext.
+func IsSealed(bs []byte) bool {
+	return len(bs) >= sealedOverhead && string(bs[:len(sealedMagic)]) == sealedMagic
+}
+
+// Seal encrypts bs with key. If key is nil, bs is returned as is.
+func Seal(bs []byte, key *[32]byte) []byte {
+	if key == nil {
+		return bs
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	out := make([]byte, 0, len(bs)+sealedOverhead)
+	out = append(append(append(out, sealedMagic...), sealedVersion), nonce[:]...)
+	return secretbox.Seal(out, bs, &nonce, key)
+}
+
+// Open decrypts the contents of a file sealed with key. If key is nil, bs is
+// returned as is; otherwise plaintext is rejected.
+func Open(bs []byte, key *[32]byte) ([]byte, error) {
+	if key == nil {
+		return bs, nil
+	}
+	if !IsSealed(bs) {
+		return nil, ErrNotSealed
+	}
+	if version := bs[len(sealedMagic)]; version != sealedVersion {
+		return nil, fmt.Errorf("unsupported sealed file version %d", version)
+	}
+	var nonce [24]byte
+	copy(nonce[:], bs[len(sealedMagic)+1:])
+	out, ok := secretbox.Open(nil, bs[len(sealedMagic)+1+24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("sealed file does not match the storage key")
+	}
+	return out, nil
+}
+
+// OpenAllowingPlaintext decrypts bs if it has been sealed with key, and
+// returns it as is otherwise. The result tells which it was.
+func OpenAllowingPlaintext(bs []byte, key *[32]byte) ([]byte, bool) {
+	if key == nil || !IsSealed(bs) {
+		return bs, false
+	}
+	out, err := Open(bs, key)
+	if err != nil {
+		return bs, false
+	}
+	return out, true
+}
+
+func passphraseKey(passphrase, salt []byte) (*[32]byte, error) {
+	bs, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	key := new([32]byte)
+	copy(key[:], bs)
+	return key, nil
+}
+
+// NewStorageKey generates a random storage key
+func NewStorageKey() *[32]byte {
+	key := new([32]byte)
+	if _, err := rand.Read(key[:]); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// WriteStorageKey stores storageKey at path, sealed with passphrase
+func (p *Paths) WriteStorageKey(path string, storageKey *[32]byte, passphrase []byte) error {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := passphraseKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	out := append([]byte{storageKeyVersion}, salt...)
+	return p.AtomicWriteFile(path, append(out, Seal(storageKey[:], key)...), 0600)
+}
+
+// ReadStorageKey reads the storage key at path that has been sealed with
+// passphrase
+func ReadStorageKey(path string, passphrase []byte) (*[32]byte, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) != 1+saltSize+sealedOverhead+32 || bs[0] != storageKeyVersion {
+		return nil, errors.New("unsupported storage key file " + path)
+	}
+	key, err := passphraseKey(passphrase, bs[1:1+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	storageKeyBytes, err := Open(bs[1+saltSize:], key)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	storageKey := new([32]byte)
+	copy(storageKey[:], storageKeyBytes)
+	return storageKey, nil
+}
+
+// StorageKeyPath is where the storage key of the account is kept
+func (p *Paths) StorageKeyPath() string {
+	return filepath.Join(p.RootDir, ".daemon", "storage-key")
+}
+
+// HasPassphrase tells whether the account is protected with a passphrase
+func (p *Paths) HasPassphrase() (bool, error) {
+	_, err := os.Stat(p.StorageKeyPath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock sets StorageKey to the storage key of the account, if it has one
+func (p *Paths) Unlock(passphrase []byte) error {
+	hasPassphrase, err := p.HasPassphrase()
+	if err != nil || !hasPassphrase {
+		return err
+	}
+	if passphrase == nil {
+		return ErrLocked
+	}
+	p.StorageKey, err = ReadStorageKey(p.StorageKeyPath(), passphrase)
+	return err
+}
+
+// ReadPassphrase reads a passphrase from r, up to the next newline, or
+// prompts for it on the terminal if r is nil
+func ReadPassphrase(r *bufio.Reader, prompt string) ([]byte, error) {
+	if r != nil {
+		line, err := r.ReadBytes('\n')
+		if err != nil && !(err == io.EOF && len(line) > 0) {
+			return nil, err
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("cannot prompt for a passphrase: standard input is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return terminal.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// PassphraseReader returns a reader for ReadPassphrase that reads from the
+// file descriptor fd, or nil if fd is negative
+func PassphraseReader(fd int) *bufio.Reader {
+	if fd < 0 {
+		return nil
+	}
+	return bufio.NewReader(os.NewFile(uintptr(fd), "passphrase"))
+}
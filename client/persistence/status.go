@@ -0,0 +1,97 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The daemon publishes the delivery status of each message it sends in the
+// status directory, in a file at the same relative path as the message in the
+// conversations directory. Every line of the file is the status for one
+// recipient: their name, a tab and one of the statuses below, and if sending
+// has failed, another tab and the reason. A message is delivered or read once
+// the recipient has sent a receipt for it.
+
+const (
+	// StatusQueued messages are waiting to be sent, or to be retried
+	StatusQueued = "queued"
+	// StatusSent messages have been uploaded to the server of the recipient
+	StatusSent = "sent"
+	// StatusDelivered messages have been decrypted and saved by the recipient
+	StatusDelivered = "delivered"
+	// StatusRead messages have been shown to the recipient
+	StatusRead = "read"
+	// StatusFailed messages have been given up on
+	StatusFailed = "failed"
+)
+
+// DeliveryStatus is the status of a sent message for one recipient
+type DeliveryStatus struct {
+	Recipient, Status, Reason string
+}
+
+func (p *Paths) StatusDir() string { return filepath.Join(p.RootDir, "status") }
+
+// StatusPath returns the path of the status file of a message
+func (p *Paths) StatusPath(conversationName, messageName string) string {
+	return filepath.Join(p.StatusDir(), conversationName, messageName)
+}
+
+// ReadDeliveryStatus reads a status file
+func ReadDeliveryStatus(path string) ([]DeliveryStatus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ret []DeliveryStatus
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("badly formatted status file: %s", path)
+		}
+		status := DeliveryStatus{Recipient: fields[0], Status: fields[1]}
+		if len(fields) == 3 {
+			status.Reason = fields[2]
+		}
+		ret = append(ret, status)
+	}
+	return ret, scanner.Err()
+}
+
+// WriteDeliveryStatus atomically replaces the status file at path
+func (p *Paths) WriteDeliveryStatus(path string, statuses []DeliveryStatus) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, s := range statuses {
+		buf.WriteString(s.Recipient + "\t" + s.Status)
+		if s.Reason != "" {
+			buf.WriteString("\t" + strings.Replace(s.Reason, "\n", " ", -1))
+		}
+		buf.WriteString("\n")
+	}
+	return p.AtomicWriteFile(path, buf.Bytes(), 0600)
+}
+
+// UIs tell the daemon that the user has seen a received message by marking it
+// read: an empty file at the same relative path as the message in the read
+// directory. The daemon sends a read receipt for the message if the
+// conversation has them enabled, and removes the mark.
+
+func (p *Paths) ReadMarkDir() string { return filepath.Join(p.RootDir, "read") }
+
+// MarkRead tells the daemon that the user has read a message
+func (p *Paths) MarkRead(conversationName, messageName string) error {
+	path := filepath.Join(p.ReadMarkDir(), conversationName, messageName)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, nil, 0600)
+}
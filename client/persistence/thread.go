@@ -0,0 +1,92 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andres-erbsen/chatterbox/shred"
+)
+
+// Every message that has an id (see proto.Message.Id) has it in the id
+// directory, and every message that is a reply has the id of the message it
+// replies to in the reply directory, both hex-encoded in a file at the same
+// relative path as the message in the conversations directory. The daemon
+// writes them before the message is filed. The message that another replies to
+// is found by its id; it may not have arrived yet, or have been deleted.
+//
+// To send a reply, a UI writes the id of the message it replies to in the
+// reply directory, at the path that the reply is going to have in the outbox,
+// before it moves the reply there; see ReplyToOutbox. The daemon moves the
+// file along with the message when it sends it.
+
+func (p *Paths) IdDir() string { return filepath.Join(p.RootDir, "id") }
+
+// IdPath returns the path of the file with the id of a message
+func (p *Paths) IdPath(conversationName, messageName string) string {
+	return filepath.Join(p.IdDir(), conversationName, messageName)
+}
+
+func (p *Paths) ReplyDir() string { return filepath.Join(p.RootDir, "reply") }
+
+// ReplyPath returns the path of the file with the id of the message that a
+// message replies to
+func (p *Paths) ReplyPath(conversationName, messageName string) string {
+	return filepath.Join(p.ReplyDir(), conversationName, messageName)
+}
+
+// ReadId reads a file with the id of a message
+func ReadId(path string) ([]byte, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimSpace(string(bs)))
+}
+
+// WriteId atomically replaces the file with the id of a message at path
+func (p *Paths) WriteId(path string, id []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return p.AtomicWriteFile(path, []byte(hex.EncodeToString(id)+"\n"), 0600)
+}
+
+// FindMessage returns the name of the message with id in a conversation, or ""
+// if there is none
+func (p *Paths) FindMessage(conversationName string, id []byte) (string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(p.IdDir(), conversationName))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		other, err := ReadId(p.IdPath(conversationName, file.Name()))
+		if err == nil && bytes.Equal(other, id) {
+			return file.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// ReplyToOutbox puts a message that replies to the message with id inReplyTo
+// in the outbox directory of a conversation
+func (p *Paths) ReplyToOutbox(conversationName, message string, inReplyTo []byte) error {
+	tempfile, err := p.TempFile()
+	defer shred.Remove(tempfile)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(tempfile, []byte(message), 0600); err != nil {
+		return err
+	}
+	base := filepath.Base(tempfile)
+	if err := p.WriteId(p.ReplyPath(conversationName, base), inReplyTo); err != nil {
+		return err
+	}
+	return os.Rename(tempfile, filepath.Join(p.OutboxDir(), conversationName, base))
+}
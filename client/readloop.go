@@ -11,6 +11,9 @@ type ConnectionToServer struct {
 	Conn         *transport.Conn
 	ReadReply    chan *proto.ServerToClient // TODO: do we want to return an error?
 	ReadEnvelope chan []byte
+	// Cover, if set, paces all writes to Conn and fills the gaps with dummy
+	// frames
+	Cover *CoverTraffic
 
 	Shutdown     <-chan struct{}
 	waitShutdown sync.WaitGroup
@@ -33,7 +36,9 @@ func (c *ConnectionToServer) ReceiveMessages() error {
 				return err
 			}
 		}
-		if msg.Envelope != nil {
+		if msg.Cover != nil && *msg.Cover {
+			continue
+		} else if msg.Envelope != nil {
 			go func() { c.ReadEnvelope <- msg.Envelope }() // TODO: bounded buffer?
 		} else {
 			c.ReadReply <- msg
@@ -42,5 +47,8 @@ func (c *ConnectionToServer) ReceiveMessages() error {
 }
 
 func (conn *ConnectionToServer) WriteProtobuf(msg *proto.ClientToServer) error {
+	if conn.Cover != nil {
+		return conn.Cover.WriteProtobuf(msg)
+	}
 	return WriteProtobuf(conn.Conn, msg)
 }
@@ -35,6 +35,57 @@ import bytes "bytes"
 var _ = proto1.Marshal
 var _ = math.Inf
 
+type Message_Kind int32
+
+const (
+	Message_TEXT               Message_Kind = 0
+	Message_DELIVERY_RECEIPT   Message_Kind = 1
+	Message_READ_RECEIPT       Message_Kind = 2
+	Message_CHUNK              Message_Kind = 3
+	Message_ADD_PARTICIPANT    Message_Kind = 4
+	Message_REMOVE_PARTICIPANT Message_Kind = 5
+	Message_EDIT               Message_Kind = 6
+	Message_DELETE             Message_Kind = 7
+)
+
+var Message_Kind_name = map[int32]string{
+	0: "TEXT",
+	1: "DELIVERY_RECEIPT",
+	2: "READ_RECEIPT",
+	3: "CHUNK",
+	4: "ADD_PARTICIPANT",
+	5: "REMOVE_PARTICIPANT",
+	6: "EDIT",
+	7: "DELETE",
+}
+var Message_Kind_value = map[string]int32{
+	"TEXT":               0,
+	"DELIVERY_RECEIPT":   1,
+	"READ_RECEIPT":       2,
+	"CHUNK":              3,
+	"ADD_PARTICIPANT":    4,
+	"REMOVE_PARTICIPANT": 5,
+	"EDIT":               6,
+	"DELETE":             7,
+}
+
+func (x Message_Kind) Enum() *Message_Kind {
+	p := new(Message_Kind)
+	*p = x
+	return p
+}
+func (x Message_Kind) String() string {
+	return proto1.EnumName(Message_Kind_name, int32(x))
+}
+func (x *Message_Kind) UnmarshalJSON(data []byte) error {
+	value, err := proto1.UnmarshalJSONEnum(Message_Kind_value, data, "Message_Kind")
+	if err != nil {
+		return err
+	}
+	*x = Message_Kind(value)
+	return nil
+}
+
 type Message struct {
 	Contents         []byte                                                `protobuf:"bytes,1,req,name=contents" json:"contents"`
 	Subject          string                                                `protobuf:"bytes,2,req,name=subject" json:"subject"`
@@ -42,6 +93,22 @@ type Message struct {
 	Date             int64                                                 `protobuf:"varint,4,req,name=date" json:"date"`
 	Dename           string                                                `protobuf:"bytes,5,req,name=dename" json:"dename"`
 	DenameLookup     *github_com_andres_erbsen_dename_protocol.ClientReply `protobuf:"bytes,6,req,name=dename_lookup,customtype=github.com/andres-erbsen/dename/protocol.ClientReply" json:"dename_lookup,omitempty"`
+	SessionReset     bool                                                  `protobuf:"varint,7,opt,name=session_reset" json:"session_reset"`
+	Id               []byte                                                `protobuf:"bytes,8,opt,name=id" json:"id,omitempty"`
+	Kind             Message_Kind                                          `protobuf:"varint,9,opt,name=kind,enum=proto.Message_Kind" json:"kind"`
+	Target           []byte                                                `protobuf:"bytes,10,opt,name=target" json:"target,omitempty"`
+	Lifetime         int64                                                 `protobuf:"varint,11,opt,name=lifetime" json:"lifetime"`
+	ContentType      string                                                `protobuf:"bytes,12,opt,name=content_type" json:"content_type"`
+	Filename         string                                                `protobuf:"bytes,13,opt,name=filename" json:"filename"`
+	Chunks           int32                                                 `protobuf:"varint,14,opt,name=chunks" json:"chunks"`
+	Length           int64                                                 `protobuf:"varint,15,opt,name=length" json:"length"`
+	Hash             []byte                                                `protobuf:"bytes,16,opt,name=hash" json:"hash,omitempty"`
+	ChunkIndex       int32                                                 `protobuf:"varint,17,opt,name=chunk_index" json:"chunk_index"`
+	ConversationId   []byte                                                `protobuf:"bytes,18,opt,name=conversation_id" json:"conversation_id,omitempty"`
+	Participant      string                                                `protobuf:"bytes,19,opt,name=participant" json:"participant"`
+	InReplyTo        []byte                                                `protobuf:"bytes,20,opt,name=in_reply_to" json:"in_reply_to,omitempty"`
+	Clock            uint64                                                `protobuf:"varint,21,opt,name=clock" json:"clock"`
+	Sequence         uint64                                                `protobuf:"varint,22,opt,name=sequence" json:"sequence"`
 	XXX_unrecognized []byte                                                `json:"-"`
 }
 
@@ -50,6 +117,7 @@ func (m *Message) String() string { return proto1.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 
 func init() {
+	proto1.RegisterEnum("proto.Message_Kind", Message_Kind_name, Message_Kind_value)
 }
 func (m *Message) Unmarshal(data []byte) error {
 	l := len(data)
@@ -198,6 +266,304 @@ func (m *Message) Unmarshal(data []byte) error {
 				return err
 			}
 			index = postIndex
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SessionReset", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.SessionReset = bool(v != 0)
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Id = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Kind", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Kind |= (Message_Kind(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Target", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Target = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Lifetime", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Lifetime |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ContentType", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ContentType = string(data[index:postIndex])
+			index = postIndex
+		case 13:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Filename", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Filename = string(data[index:postIndex])
+			index = postIndex
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Chunks", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Chunks |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Length", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Length |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hash", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hash = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 17:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChunkIndex", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.ChunkIndex |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ConversationId", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ConversationId = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 19:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Participant", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Participant = string(data[index:postIndex])
+			index = postIndex
+		case 20:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InReplyTo", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.InReplyTo = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 21:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Clock", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Clock |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 22:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sequence", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Sequence |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -243,6 +609,40 @@ func (m *Message) Size() (n int) {
 		l = m.DenameLookup.Size()
 		n += 1 + l + sovClientClient(uint64(l))
 	}
+	n += 2
+	if m.Id != nil {
+		l = len(m.Id)
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	n += 1 + sovClientClient(uint64(m.Kind))
+	if m.Target != nil {
+		l = len(m.Target)
+		n += 1 + l + sovClientClient(uint64(l))
+	}
+	n += 1 + sovClientClient(uint64(m.Lifetime))
+	l = len(m.ContentType)
+	n += 1 + l + sovClientClient(uint64(l))
+	l = len(m.Filename)
+	n += 1 + l + sovClientClient(uint64(l))
+	n += 1 + sovClientClient(uint64(m.Chunks))
+	n += 1 + sovClientClient(uint64(m.Length))
+	if m.Hash != nil {
+		l = len(m.Hash)
+		n += 2 + l + sovClientClient(uint64(l))
+	}
+	n += 2 + sovClientClient(uint64(m.ChunkIndex))
+	if m.ConversationId != nil {
+		l = len(m.ConversationId)
+		n += 2 + l + sovClientClient(uint64(l))
+	}
+	l = len(m.Participant)
+	n += 2 + l + sovClientClient(uint64(l))
+	if m.InReplyTo != nil {
+		l = len(m.InReplyTo)
+		n += 2 + l + sovClientClient(uint64(l))
+	}
+	n += 2 + sovClientClient(uint64(m.Clock))
+	n += 2 + sovClientClient(uint64(m.Sequence))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -319,6 +719,91 @@ func (m *Message) MarshalTo(data []byte) (n int, err error) {
 		}
 		i += n1
 	}
+	data[i] = 0x38
+	i++
+	if m.SessionReset {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	if m.Id != nil {
+		data[i] = 0x42
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.Id)))
+		i += copy(data[i:], m.Id)
+	}
+	data[i] = 0x48
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Kind))
+	if m.Target != nil {
+		data[i] = 0x52
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.Target)))
+		i += copy(data[i:], m.Target)
+	}
+	data[i] = 0x58
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Lifetime))
+	data[i] = 0x62
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.ContentType)))
+	i += copy(data[i:], m.ContentType)
+	data[i] = 0x6a
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.Filename)))
+	i += copy(data[i:], m.Filename)
+	data[i] = 0x70
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Chunks))
+	data[i] = 0x78
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Length))
+	if m.Hash != nil {
+		data[i] = 0x82
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.Hash)))
+		i += copy(data[i:], m.Hash)
+	}
+	data[i] = 0x88
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.ChunkIndex))
+	if m.ConversationId != nil {
+		data[i] = 0x92
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.ConversationId)))
+		i += copy(data[i:], m.ConversationId)
+	}
+	data[i] = 0x9a
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintClientClient(data, i, uint64(len(m.Participant)))
+	i += copy(data[i:], m.Participant)
+	if m.InReplyTo != nil {
+		data[i] = 0xa2
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintClientClient(data, i, uint64(len(m.InReplyTo)))
+		i += copy(data[i:], m.InReplyTo)
+	}
+	data[i] = 0xa8
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Clock))
+	data[i] = 0xb0
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintClientClient(data, i, uint64(m.Sequence))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -399,6 +884,54 @@ func (this *Message) Equal(that interface{}) bool {
 	} else if !this.DenameLookup.Equal(*that1.DenameLookup) {
 		return false
 	}
+	if this.SessionReset != that1.SessionReset {
+		return false
+	}
+	if !bytes.Equal(this.Id, that1.Id) {
+		return false
+	}
+	if this.Kind != that1.Kind {
+		return false
+	}
+	if !bytes.Equal(this.Target, that1.Target) {
+		return false
+	}
+	if this.Lifetime != that1.Lifetime {
+		return false
+	}
+	if this.ContentType != that1.ContentType {
+		return false
+	}
+	if this.Filename != that1.Filename {
+		return false
+	}
+	if this.Chunks != that1.Chunks {
+		return false
+	}
+	if this.Length != that1.Length {
+		return false
+	}
+	if !bytes.Equal(this.Hash, that1.Hash) {
+		return false
+	}
+	if this.ChunkIndex != that1.ChunkIndex {
+		return false
+	}
+	if !bytes.Equal(this.ConversationId, that1.ConversationId) {
+		return false
+	}
+	if this.Participant != that1.Participant {
+		return false
+	}
+	if !bytes.Equal(this.InReplyTo, that1.InReplyTo) {
+		return false
+	}
+	if this.Clock != that1.Clock {
+		return false
+	}
+	if this.Sequence != that1.Sequence {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -59,6 +59,7 @@ type ServerToClient struct {
 	SignedKey        []byte                     `protobuf:"bytes,5,opt,name=signed_key" json:"signed_key,omitempty"`
 	Notification     []byte                     `protobuf:"bytes,6,opt,name=notification" json:"notification,omitempty"`
 	NumKeys          *int64                     `protobuf:"varint,7,opt,name=num_keys" json:"num_keys,omitempty"`
+	Cover            *bool                      `protobuf:"varint,8,opt,name=cover" json:"cover,omitempty"`
 	XXX_unrecognized []byte                     `json:"-"`
 }
 
@@ -76,6 +77,7 @@ type ClientToServer struct {
 	GetSignedKey     *Byte32                         `protobuf:"bytes,9,opt,name=get_signed_key,customtype=Byte32" json:"get_signed_key,omitempty"`
 	ReceiveEnvelopes *bool                           `protobuf:"varint,10,opt,name=receive_envelopes" json:"receive_envelopes,omitempty"`
 	GetNumKeys       *bool                           `protobuf:"varint,11,opt,name=get_num_keys" json:"get_num_keys,omitempty"`
+	Cover            *bool                           `protobuf:"varint,12,opt,name=cover" json:"cover,omitempty"`
 	XXX_unrecognized []byte                          `json:"-"`
 }
 
@@ -238,6 +240,24 @@ func (m *ServerToClient) Unmarshal(data []byte) error {
 				}
 			}
 			m.NumKeys = &v
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cover", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.Cover = &b
 		default:
 			var sizeOfWire int
 			for {
@@ -475,6 +495,24 @@ func (m *ClientToServer) Unmarshal(data []byte) error {
 			}
 			b := bool(v != 0)
 			m.GetNumKeys = &b
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cover", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.Cover = &b
 		default:
 			var sizeOfWire int
 			for {
@@ -614,6 +652,9 @@ func (m *ServerToClient) Size() (n int) {
 	if m.NumKeys != nil {
 		n += 1 + sovClientServer(uint64(*m.NumKeys))
 	}
+	if m.Cover != nil {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -659,6 +700,9 @@ func (m *ClientToServer) Size() (n int) {
 	if m.GetNumKeys != nil {
 		n += 2
 	}
+	if m.Cover != nil {
+		n += 2
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -735,8 +779,12 @@ func NewPopulatedServerToClient(r randyClientServer, easy bool) *ServerToClient
 		}
 		this.NumKeys = &v7
 	}
+	if r.Intn(10) != 0 {
+		v8 := bool(r.Intn(2) == 0)
+		this.Cover = &v8
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedClientServer(r, 8)
+		this.XXX_unrecognized = randUnrecognizedClientServer(r, 9)
 	}
 	return this
 }
@@ -744,8 +792,8 @@ func NewPopulatedServerToClient(r randyClientServer, easy bool) *ServerToClient
 func NewPopulatedClientToServer(r randyClientServer, easy bool) *ClientToServer {
 	this := &ClientToServer{}
 	if r.Intn(10) != 0 {
-		v8 := bool(r.Intn(2) == 0)
-		this.CreateAccount = &v8
+		v9 := bool(r.Intn(2) == 0)
+		this.CreateAccount = &v9
 	}
 	if r.Intn(10) != 0 {
 		this.DeliverEnvelope = NewPopulatedClientToServer_DeliverEnvelope(r, easy)
@@ -754,24 +802,24 @@ func NewPopulatedClientToServer(r randyClientServer, easy bool) *ClientToServer
 		this.DownloadEnvelope = NewPopulatedByte32(r)
 	}
 	if r.Intn(10) != 0 {
-		v9 := bool(r.Intn(2) == 0)
-		this.ListMessages = &v9
+		v10 := bool(r.Intn(2) == 0)
+		this.ListMessages = &v10
 	}
 	if r.Intn(10) != 0 {
-		v10 := r.Intn(10)
-		this.DeleteMessages = make([]Byte32, v10)
-		for i := 0; i < v10; i++ {
-			v11 := NewPopulatedByte32(r)
-			this.DeleteMessages[i] = *v11
+		v11 := r.Intn(10)
+		this.DeleteMessages = make([]Byte32, v11)
+		for i := 0; i < v11; i++ {
+			v12 := NewPopulatedByte32(r)
+			this.DeleteMessages[i] = *v12
 		}
 	}
 	if r.Intn(10) != 0 {
-		v12 := r.Intn(100)
-		this.UploadSignedKeys = make([][]byte, v12)
-		for i := 0; i < v12; i++ {
-			v13 := r.Intn(100)
-			this.UploadSignedKeys[i] = make([]byte, v13)
-			for j := 0; j < v13; j++ {
+		v13 := r.Intn(100)
+		this.UploadSignedKeys = make([][]byte, v13)
+		for i := 0; i < v13; i++ {
+			v14 := r.Intn(100)
+			this.UploadSignedKeys[i] = make([]byte, v14)
+			for j := 0; j < v14; j++ {
 				this.UploadSignedKeys[i][j] = byte(r.Intn(256))
 			}
 		}
@@ -780,15 +828,19 @@ func NewPopulatedClientToServer(r randyClientServer, easy bool) *ClientToServer
 		this.GetSignedKey = NewPopulatedByte32(r)
 	}
 	if r.Intn(10) != 0 {
-		v14 := bool(r.Intn(2) == 0)
-		this.ReceiveEnvelopes = &v14
+		v15 := bool(r.Intn(2) == 0)
+		this.ReceiveEnvelopes = &v15
 	}
 	if r.Intn(10) != 0 {
-		v15 := bool(r.Intn(2) == 0)
-		this.GetNumKeys = &v15
+		v16 := bool(r.Intn(2) == 0)
+		this.GetNumKeys = &v16
+	}
+	if r.Intn(10) != 0 {
+		v17 := bool(r.Intn(2) == 0)
+		this.Cover = &v17
 	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedClientServer(r, 12)
+		this.XXX_unrecognized = randUnrecognizedClientServer(r, 13)
 	}
 	return this
 }
@@ -796,9 +848,9 @@ func NewPopulatedClientToServer(r randyClientServer, easy bool) *ClientToServer
 func NewPopulatedClientToServer_DeliverEnvelope(r randyClientServer, easy bool) *ClientToServer_DeliverEnvelope {
 	this := &ClientToServer_DeliverEnvelope{}
 	this.User = NewPopulatedByte32(r)
-	v16 := r.Intn(100)
-	this.Envelope = make([]byte, v16)
-	for i := 0; i < v16; i++ {
+	v18 := r.Intn(100)
+	this.Envelope = make([]byte, v18)
+	for i := 0; i < v18; i++ {
 		this.Envelope[i] = byte(r.Intn(256))
 	}
 	if !easy && r.Intn(10) != 0 {
@@ -820,9 +872,9 @@ func randUTF8RuneClientServer(r randyClientServer) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringClientServer(r randyClientServer) string {
-	v17 := r.Intn(100)
-	tmps := make([]rune, v17)
-	for i := 0; i < v17; i++ {
+	v19 := r.Intn(100)
+	tmps := make([]rune, v19)
+	for i := 0; i < v19; i++ {
 		tmps[i] = randUTF8RuneClientServer(r)
 	}
 	return string(tmps)
@@ -844,11 +896,11 @@ func randFieldClientServer(data []byte, r randyClientServer, fieldNumber int, wi
 	switch wire {
 	case 0:
 		data = encodeVarintPopulateClientServer(data, uint64(key))
-		v18 := r.Int63()
+		v20 := r.Int63()
 		if r.Intn(2) == 0 {
-			v18 *= -1
+			v20 *= -1
 		}
-		data = encodeVarintPopulateClientServer(data, uint64(v18))
+		data = encodeVarintPopulateClientServer(data, uint64(v20))
 	case 1:
 		data = encodeVarintPopulateClientServer(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -928,6 +980,16 @@ func (m *ServerToClient) MarshalTo(data []byte) (n int, err error) {
 		i++
 		i = encodeVarintClientServer(data, i, uint64(*m.NumKeys))
 	}
+	if m.Cover != nil {
+		data[i] = 0x40
+		i++
+		if *m.Cover {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1039,6 +1101,16 @@ func (m *ClientToServer) MarshalTo(data []byte) (n int, err error) {
 		}
 		i++
 	}
+	if m.Cover != nil {
+		data[i] = 0x60
+		i++
+		if *m.Cover {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1164,6 +1236,15 @@ func (this *ServerToClient) Equal(that interface{}) bool {
 	} else if that1.NumKeys != nil {
 		return false
 	}
+	if this.Cover != nil && that1.Cover != nil {
+		if *this.Cover != *that1.Cover {
+			return false
+		}
+	} else if this.Cover != nil {
+		return false
+	} else if that1.Cover != nil {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -1258,6 +1339,15 @@ func (this *ClientToServer) Equal(that interface{}) bool {
 	} else if that1.GetNumKeys != nil {
 		return false
 	}
+	if this.Cover != nil && that1.Cover != nil {
+		if *this.Cover != *that1.Cover {
+			return false
+		}
+	} else if this.Cover != nil {
+		return false
+	} else if that1.Cover != nil {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -20,13 +20,14 @@ var _ = proto1.Marshal
 var _ = math.Inf
 
 type Profile struct {
-	ServerAddressTCP  string `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
-	ServerPortTCP     int32  `protobuf:"varint,2,req" json:"ServerPortTCP"`
-	ServerTransportPK Byte32 `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
-	UserIDAtServer    Byte32 `protobuf:"bytes,4,req,customtype=Byte32" json:"UserIDAtServer"`
-	KeySigningKey     Byte32 `protobuf:"bytes,5,req,customtype=Byte32" json:"KeySigningKey"`
-	MessageAuthKey    Byte32 `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthKey"`
-	XXX_unrecognized  []byte `json:"-"`
+	ServerAddressTCP   string `protobuf:"bytes,1,req" json:"ServerAddressTCP"`
+	ServerPortTCP      int32  `protobuf:"varint,2,req" json:"ServerPortTCP"`
+	ServerTransportPK  Byte32 `protobuf:"bytes,3,req,customtype=Byte32" json:"ServerTransportPK"`
+	UserIDAtServer     Byte32 `protobuf:"bytes,4,req,customtype=Byte32" json:"UserIDAtServer"`
+	KeySigningKey      Byte32 `protobuf:"bytes,5,req,customtype=Byte32" json:"KeySigningKey"`
+	MessageAuthKey     Byte32 `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthKey"`
+	ServerAddressOnion string `protobuf:"bytes,7,opt" json:"ServerAddressOnion"`
+	XXX_unrecognized   []byte `json:"-"`
 }
 
 func (m *Profile) Reset()         { *m = Profile{} }
@@ -187,6 +188,28 @@ func (m *Profile) Unmarshal(data []byte) error {
 				return err
 			}
 			index = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerAddressOnion", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerAddressOnion = string(data[index:postIndex])
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -224,6 +247,8 @@ func (m *Profile) Size() (n int) {
 	n += 1 + l + sovDenameChatProfile(uint64(l))
 	l = m.MessageAuthKey.Size()
 	n += 1 + l + sovDenameChatProfile(uint64(l))
+	l = len(m.ServerAddressOnion)
+	n += 1 + l + sovDenameChatProfile(uint64(l))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -258,8 +283,9 @@ func NewPopulatedProfile(r randyDenameChatProfile, easy bool) *Profile {
 	this.KeySigningKey = *v3
 	v4 := NewPopulatedByte32(r)
 	this.MessageAuthKey = *v4
+	this.ServerAddressOnion = randStringDenameChatProfile(r)
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedDenameChatProfile(r, 7)
+		this.XXX_unrecognized = randUnrecognizedDenameChatProfile(r, 8)
 	}
 	return this
 }
@@ -384,6 +410,10 @@ func (m *Profile) MarshalTo(data []byte) (n int, err error) {
 		return 0, err
 	}
 	i += n4
+	data[i] = 0x3a
+	i++
+	i = encodeVarintDenameChatProfile(data, i, uint64(len(m.ServerAddressOnion)))
+	i += copy(data[i:], m.ServerAddressOnion)
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -455,6 +485,9 @@ func (this *Profile) Equal(that interface{}) bool {
 	if !this.MessageAuthKey.Equal(that1.MessageAuthKey) {
 		return false
 	}
+	if this.ServerAddressOnion != that1.ServerAddressOnion {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
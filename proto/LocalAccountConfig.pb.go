@@ -27,6 +27,14 @@ type LocalAccountConfig struct {
 	KeySigningSecretKey         []byte `protobuf:"bytes,5,req" json:"KeySigningSecretKey"`
 	MessageAuthSecretKey        Byte32 `protobuf:"bytes,6,req,customtype=Byte32" json:"MessageAuthSecretKey"`
 	Dename                      string `protobuf:"bytes,7,req" json:"Dename"`
+	CoverTrafficInterval        int64  `protobuf:"varint,8,opt" json:"CoverTrafficInterval"`
+	CoverTrafficPoisson         bool   `protobuf:"varint,9,opt" json:"CoverTrafficPoisson"`
+	ServerAddressOnion          string `protobuf:"bytes,10,opt" json:"ServerAddressOnion"`
+	RatchetMaxMissingMessages   uint32 `protobuf:"varint,11,opt" json:"RatchetMaxMissingMessages"`
+	RatchetSavedKeyLifetime     int64  `protobuf:"varint,12,opt" json:"RatchetSavedKeyLifetime"`
+	EncryptConversations        bool   `protobuf:"varint,13,opt" json:"EncryptConversations"`
+	MessageRetention            int64  `protobuf:"varint,14,opt" json:"MessageRetention"`
+	MaxTransferSize             int64  `protobuf:"varint,15,opt" json:"MaxTransferSize"`
 	XXX_unrecognized            []byte `json:"-"`
 }
 
@@ -208,6 +216,137 @@ func (m *LocalAccountConfig) Unmarshal(data []byte) error {
 			}
 			m.Dename = string(data[index:postIndex])
 			index = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CoverTrafficInterval", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.CoverTrafficInterval |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CoverTrafficPoisson", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.CoverTrafficPoisson = bool(v != 0)
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ServerAddressOnion", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ServerAddressOnion = string(data[index:postIndex])
+			index = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RatchetMaxMissingMessages", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.RatchetMaxMissingMessages |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RatchetSavedKeyLifetime", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.RatchetSavedKeyLifetime |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EncryptConversations", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.EncryptConversations = bool(v != 0)
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MessageRetention", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MessageRetention |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxTransferSize", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MaxTransferSize |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -249,6 +388,15 @@ func (m *LocalAccountConfig) Size() (n int) {
 	n += 1 + l + sovLocalAccountConfig(uint64(l))
 	l = len(m.Dename)
 	n += 1 + l + sovLocalAccountConfig(uint64(l))
+	n += 1 + sovLocalAccountConfig(uint64(m.CoverTrafficInterval))
+	n += 2
+	l = len(m.ServerAddressOnion)
+	n += 1 + l + sovLocalAccountConfig(uint64(l))
+	n += 1 + sovLocalAccountConfig(uint64(m.RatchetMaxMissingMessages))
+	n += 1 + sovLocalAccountConfig(uint64(m.RatchetSavedKeyLifetime))
+	n += 2
+	n += 1 + sovLocalAccountConfig(uint64(m.MessageRetention))
+	n += 1 + sovLocalAccountConfig(uint64(m.MaxTransferSize))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -287,8 +435,28 @@ func NewPopulatedLocalAccountConfig(r randyLocalAccountConfig, easy bool) *Local
 	v4 := NewPopulatedByte32(r)
 	this.MessageAuthSecretKey = *v4
 	this.Dename = randStringLocalAccountConfig(r)
+	this.CoverTrafficInterval = r.Int63()
+	if r.Intn(2) == 0 {
+		this.CoverTrafficInterval *= -1
+	}
+	this.CoverTrafficPoisson = bool(r.Intn(2) == 0)
+	this.ServerAddressOnion = randStringLocalAccountConfig(r)
+	this.RatchetMaxMissingMessages = r.Uint32()
+	this.RatchetSavedKeyLifetime = r.Int63()
+	if r.Intn(2) == 0 {
+		this.RatchetSavedKeyLifetime *= -1
+	}
+	this.EncryptConversations = bool(r.Intn(2) == 0)
+	this.MessageRetention = r.Int63()
+	if r.Intn(2) == 0 {
+		this.MessageRetention *= -1
+	}
+	this.MaxTransferSize = r.Int63()
+	if r.Intn(2) == 0 {
+		this.MaxTransferSize *= -1
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedLocalAccountConfig(r, 8)
+		this.XXX_unrecognized = randUnrecognizedLocalAccountConfig(r, 16)
 	}
 	return this
 }
@@ -415,6 +583,41 @@ func (m *LocalAccountConfig) MarshalTo(data []byte) (n int, err error) {
 	i++
 	i = encodeVarintLocalAccountConfig(data, i, uint64(len(m.Dename)))
 	i += copy(data[i:], m.Dename)
+	data[i] = 0x40
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.CoverTrafficInterval))
+	data[i] = 0x48
+	i++
+	if m.CoverTrafficPoisson {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x52
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(len(m.ServerAddressOnion)))
+	i += copy(data[i:], m.ServerAddressOnion)
+	data[i] = 0x58
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.RatchetMaxMissingMessages))
+	data[i] = 0x60
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.RatchetSavedKeyLifetime))
+	data[i] = 0x68
+	i++
+	if m.EncryptConversations {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x70
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.MessageRetention))
+	data[i] = 0x78
+	i++
+	i = encodeVarintLocalAccountConfig(data, i, uint64(m.MaxTransferSize))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -489,6 +692,30 @@ func (this *LocalAccountConfig) Equal(that interface{}) bool {
 	if this.Dename != that1.Dename {
 		return false
 	}
+	if this.CoverTrafficInterval != that1.CoverTrafficInterval {
+		return false
+	}
+	if this.CoverTrafficPoisson != that1.CoverTrafficPoisson {
+		return false
+	}
+	if this.ServerAddressOnion != that1.ServerAddressOnion {
+		return false
+	}
+	if this.RatchetMaxMissingMessages != that1.RatchetMaxMissingMessages {
+		return false
+	}
+	if this.RatchetSavedKeyLifetime != that1.RatchetSavedKeyLifetime {
+		return false
+	}
+	if this.EncryptConversations != that1.EncryptConversations {
+		return false
+	}
+	if this.MessageRetention != that1.MessageRetention {
+		return false
+	}
+	if this.MaxTransferSize != that1.MaxTransferSize {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -22,6 +22,12 @@ var _ = math.Inf
 type ConversationMetadata struct {
 	Participants     []string `protobuf:"bytes,1,rep" json:"Participants"`
 	Subject          string   `protobuf:"bytes,2,req" json:"Subject"`
+	DeliveryReceipts *bool    `protobuf:"varint,3,opt" json:"DeliveryReceipts,omitempty"`
+	ReadReceipts     *bool    `protobuf:"varint,4,opt" json:"ReadReceipts,omitempty"`
+	Retention        int64    `protobuf:"varint,5,opt" json:"Retention"`
+	Keep             bool     `protobuf:"varint,6,opt" json:"Keep"`
+	MessageLifetime  int64    `protobuf:"varint,7,opt" json:"MessageLifetime"`
+	Id               []byte   `protobuf:"bytes,8,opt" json:"Id,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -94,6 +100,111 @@ func (m *ConversationMetadata) Unmarshal(data []byte) error {
 			}
 			m.Subject = string(data[index:postIndex])
 			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DeliveryReceipts", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.DeliveryReceipts = &b
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReadReceipts", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			b := bool(v != 0)
+			m.ReadReceipts = &b
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Retention", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Retention |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Keep", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Keep = bool(v != 0)
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MessageLifetime", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.MessageLifetime |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Id", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Id = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
 		default:
 			var sizeOfWire int
 			for {
@@ -128,6 +239,19 @@ func (m *ConversationMetadata) Size() (n int) {
 	}
 	l = len(m.Subject)
 	n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	if m.DeliveryReceipts != nil {
+		n += 2
+	}
+	if m.ReadReceipts != nil {
+		n += 2
+	}
+	n += 1 + sovLocalConversationMetadata(uint64(m.Retention))
+	n += 2
+	n += 1 + sovLocalConversationMetadata(uint64(m.MessageLifetime))
+	if m.Id != nil {
+		l = len(m.Id)
+		n += 1 + l + sovLocalConversationMetadata(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -157,8 +281,32 @@ func NewPopulatedConversationMetadata(r randyLocalConversationMetadata, easy boo
 		}
 	}
 	this.Subject = randStringLocalConversationMetadata(r)
+	if r.Intn(10) != 0 {
+		v2 := bool(r.Intn(2) == 0)
+		this.DeliveryReceipts = &v2
+	}
+	if r.Intn(10) != 0 {
+		v3 := bool(r.Intn(2) == 0)
+		this.ReadReceipts = &v3
+	}
+	this.Retention = r.Int63()
+	if r.Intn(2) == 0 {
+		this.Retention *= -1
+	}
+	this.Keep = bool(r.Intn(2) == 0)
+	this.MessageLifetime = r.Int63()
+	if r.Intn(2) == 0 {
+		this.MessageLifetime *= -1
+	}
+	if r.Intn(10) != 0 {
+		v4 := r.Intn(100)
+		this.Id = make([]byte, v4)
+		for i := 0; i < v4; i++ {
+			this.Id[i] = byte(r.Intn(256))
+		}
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 3)
+		this.XXX_unrecognized = randUnrecognizedLocalConversationMetadata(r, 9)
 	}
 	return this
 }
@@ -263,6 +411,46 @@ func (m *ConversationMetadata) MarshalTo(data []byte) (n int, err error) {
 	i++
 	i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Subject)))
 	i += copy(data[i:], m.Subject)
+	if m.DeliveryReceipts != nil {
+		data[i] = 0x18
+		i++
+		if *m.DeliveryReceipts {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
+	if m.ReadReceipts != nil {
+		data[i] = 0x20
+		i++
+		if *m.ReadReceipts {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
+	data[i] = 0x28
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.Retention))
+	data[i] = 0x30
+	i++
+	if m.Keep {
+		data[i] = 1
+	} else {
+		data[i] = 0
+	}
+	i++
+	data[i] = 0x38
+	i++
+	i = encodeVarintLocalConversationMetadata(data, i, uint64(m.MessageLifetime))
+	if m.Id != nil {
+		data[i] = 0x42
+		i++
+		i = encodeVarintLocalConversationMetadata(data, i, uint64(len(m.Id)))
+		i += copy(data[i:], m.Id)
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -327,6 +515,36 @@ func (this *ConversationMetadata) Equal(that interface{}) bool {
 	if this.Subject != that1.Subject {
 		return false
 	}
+	if this.DeliveryReceipts != nil && that1.DeliveryReceipts != nil {
+		if *this.DeliveryReceipts != *that1.DeliveryReceipts {
+			return false
+		}
+	} else if this.DeliveryReceipts != nil {
+		return false
+	} else if that1.DeliveryReceipts != nil {
+		return false
+	}
+	if this.ReadReceipts != nil && that1.ReadReceipts != nil {
+		if *this.ReadReceipts != *that1.ReadReceipts {
+			return false
+		}
+	} else if this.ReadReceipts != nil {
+		return false
+	} else if that1.ReadReceipts != nil {
+		return false
+	}
+	if this.Retention != that1.Retention {
+		return false
+	}
+	if this.Keep != that1.Keep {
+		return false
+	}
+	if this.MessageLifetime != that1.MessageLifetime {
+		return false
+	}
+	if !bytes.Equal(this.Id, that1.Id) {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -0,0 +1,739 @@
+// Code generated by protoc-gen-gogo.
+// source: LocalJournal.proto
+// DO NOT EDIT!
+
+package proto
+
+import proto1 "github.com/gogo/protobuf/proto"
+import math "math"
+
+// discarding unused import gogoproto "github.com/gogo/protobuf/gogoproto/gogo.pb"
+
+import io "io"
+import fmt "fmt"
+import github_com_gogo_protobuf_proto "github.com/gogo/protobuf/proto"
+
+import bytes "bytes"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto1.Marshal
+var _ = math.Inf
+
+type JournalEntry struct {
+	Name             string `protobuf:"bytes,1,opt" json:"Name"`
+	Retired          string `protobuf:"bytes,2,opt" json:"Retired"`
+	Payload          []byte `protobuf:"bytes,3,opt" json:"Payload,omitempty"`
+	Envelope         []byte `protobuf:"bytes,4,opt" json:"Envelope,omitempty"`
+	Ratchet          []byte `protobuf:"bytes,5,opt" json:"Ratchet,omitempty"`
+	MessageHash      []byte `protobuf:"bytes,6,opt" json:"MessageHash,omitempty"`
+	Prekey           []byte `protobuf:"bytes,7,opt" json:"Prekey,omitempty"`
+	Created          int64  `protobuf:"varint,8,opt" json:"Created"`
+	Attempts         int32  `protobuf:"varint,9,opt" json:"Attempts"`
+	NextAttempt      int64  `protobuf:"varint,10,opt" json:"NextAttempt"`
+	Message          string `protobuf:"bytes,11,opt" json:"Message"`
+	Chunk            int32  `protobuf:"varint,12,opt" json:"Chunk"`
+	Chunks           int32  `protobuf:"varint,13,opt" json:"Chunks"`
+	Clock            uint64 `protobuf:"varint,14,opt" json:"Clock"`
+	Sequence         uint64 `protobuf:"varint,15,opt" json:"Sequence"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *JournalEntry) Reset()         { *m = JournalEntry{} }
+func (m *JournalEntry) String() string { return proto1.CompactTextString(m) }
+func (*JournalEntry) ProtoMessage()    {}
+
+func init() {
+}
+func (m *JournalEntry) Unmarshal(data []byte) error {
+	l := len(data)
+	index := 0
+	for index < l {
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if index >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := data[index]
+			index++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(data[index:postIndex])
+			index = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Retired", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Retired = string(data[index:postIndex])
+			index = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Payload", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Payload = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Envelope", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Envelope = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ratchet", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ratchet = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MessageHash", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MessageHash = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Prekey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Prekey = append([]byte{}, data[index:postIndex]...)
+			index = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Created", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Created |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Attempts", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Attempts |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NextAttempt", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.NextAttempt |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Message", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + int(stringLen)
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Message = string(data[index:postIndex])
+			index = postIndex
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Chunk", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Chunk |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Chunks", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Chunks |= (int32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Clock", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Clock |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sequence", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Sequence |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			var sizeOfWire int
+			for {
+				sizeOfWire++
+				wire >>= 7
+				if wire == 0 {
+					break
+				}
+			}
+			index -= sizeOfWire
+			skippy, err := github_com_gogo_protobuf_proto.Skip(data[index:])
+			if err != nil {
+				return err
+			}
+			if (index + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, data[index:index+skippy]...)
+			index += skippy
+		}
+	}
+	return nil
+}
+func (m *JournalEntry) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Name)
+	n += 1 + l + sovLocalJournal(uint64(l))
+	l = len(m.Retired)
+	n += 1 + l + sovLocalJournal(uint64(l))
+	if m.Payload != nil {
+		l = len(m.Payload)
+		n += 1 + l + sovLocalJournal(uint64(l))
+	}
+	if m.Envelope != nil {
+		l = len(m.Envelope)
+		n += 1 + l + sovLocalJournal(uint64(l))
+	}
+	if m.Ratchet != nil {
+		l = len(m.Ratchet)
+		n += 1 + l + sovLocalJournal(uint64(l))
+	}
+	if m.MessageHash != nil {
+		l = len(m.MessageHash)
+		n += 1 + l + sovLocalJournal(uint64(l))
+	}
+	if m.Prekey != nil {
+		l = len(m.Prekey)
+		n += 1 + l + sovLocalJournal(uint64(l))
+	}
+	n += 1 + sovLocalJournal(uint64(m.Created))
+	n += 1 + sovLocalJournal(uint64(m.Attempts))
+	n += 1 + sovLocalJournal(uint64(m.NextAttempt))
+	l = len(m.Message)
+	n += 1 + l + sovLocalJournal(uint64(l))
+	n += 1 + sovLocalJournal(uint64(m.Chunk))
+	n += 1 + sovLocalJournal(uint64(m.Chunks))
+	n += 1 + sovLocalJournal(uint64(m.Clock))
+	n += 1 + sovLocalJournal(uint64(m.Sequence))
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func sovLocalJournal(x uint64) (n int) {
+	for {
+		n++
+		x >>= 7
+		if x == 0 {
+			break
+		}
+	}
+	return n
+}
+func sozLocalJournal(x uint64) (n int) {
+	return sovLocalJournal(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func NewPopulatedJournalEntry(r randyLocalJournal, easy bool) *JournalEntry {
+	this := &JournalEntry{}
+	this.Name = randStringLocalJournal(r)
+	this.Retired = randStringLocalJournal(r)
+	if r.Intn(10) != 0 {
+		v1 := r.Intn(100)
+		this.Payload = make([]byte, v1)
+		for i := 0; i < v1; i++ {
+			this.Payload[i] = byte(r.Intn(256))
+		}
+	}
+	if r.Intn(10) != 0 {
+		v2 := r.Intn(100)
+		this.Envelope = make([]byte, v2)
+		for i := 0; i < v2; i++ {
+			this.Envelope[i] = byte(r.Intn(256))
+		}
+	}
+	if r.Intn(10) != 0 {
+		v3 := r.Intn(100)
+		this.Ratchet = make([]byte, v3)
+		for i := 0; i < v3; i++ {
+			this.Ratchet[i] = byte(r.Intn(256))
+		}
+	}
+	if r.Intn(10) != 0 {
+		v4 := r.Intn(100)
+		this.MessageHash = make([]byte, v4)
+		for i := 0; i < v4; i++ {
+			this.MessageHash[i] = byte(r.Intn(256))
+		}
+	}
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(100)
+		this.Prekey = make([]byte, v5)
+		for i := 0; i < v5; i++ {
+			this.Prekey[i] = byte(r.Intn(256))
+		}
+	}
+	this.Created = r.Int63()
+	if r.Intn(2) == 0 {
+		this.Created *= -1
+	}
+	this.Attempts = r.Int31()
+	if r.Intn(2) == 0 {
+		this.Attempts *= -1
+	}
+	this.NextAttempt = r.Int63()
+	if r.Intn(2) == 0 {
+		this.NextAttempt *= -1
+	}
+	this.Message = randStringLocalJournal(r)
+	this.Chunk = r.Int31()
+	if r.Intn(2) == 0 {
+		this.Chunk *= -1
+	}
+	this.Chunks = r.Int31()
+	if r.Intn(2) == 0 {
+		this.Chunks *= -1
+	}
+	this.Clock = uint64(r.Uint32())
+	this.Sequence = uint64(r.Uint32())
+	if !easy && r.Intn(10) != 0 {
+		this.XXX_unrecognized = randUnrecognizedLocalJournal(r, 16)
+	}
+	return this
+}
+
+type randyLocalJournal interface {
+	Float32() float32
+	Float64() float64
+	Int63() int64
+	Int31() int32
+	Uint32() uint32
+	Intn(n int) int
+}
+
+func randUTF8RuneLocalJournal(r randyLocalJournal) rune {
+	return rune(r.Intn(126-43) + 43)
+}
+func randStringLocalJournal(r randyLocalJournal) string {
+	v6 := r.Intn(100)
+	tmps := make([]rune, v6)
+	for i := 0; i < v6; i++ {
+		tmps[i] = randUTF8RuneLocalJournal(r)
+	}
+	return string(tmps)
+}
+func randUnrecognizedLocalJournal(r randyLocalJournal, maxFieldNumber int) (data []byte) {
+	l := r.Intn(5)
+	for i := 0; i < l; i++ {
+		wire := r.Intn(4)
+		if wire == 3 {
+			wire = 5
+		}
+		fieldNumber := maxFieldNumber + r.Intn(100)
+		data = randFieldLocalJournal(data, r, fieldNumber, wire)
+	}
+	return data
+}
+func randFieldLocalJournal(data []byte, r randyLocalJournal, fieldNumber int, wire int) []byte {
+	key := uint32(fieldNumber)<<3 | uint32(wire)
+	switch wire {
+	case 0:
+		data = encodeVarintPopulateLocalJournal(data, uint64(key))
+		v7 := r.Int63()
+		if r.Intn(2) == 0 {
+			v7 *= -1
+		}
+		data = encodeVarintPopulateLocalJournal(data, uint64(v7))
+	case 1:
+		data = encodeVarintPopulateLocalJournal(data, uint64(key))
+		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+	case 2:
+		data = encodeVarintPopulateLocalJournal(data, uint64(key))
+		ll := r.Intn(100)
+		data = encodeVarintPopulateLocalJournal(data, uint64(ll))
+		for j := 0; j < ll; j++ {
+			data = append(data, byte(r.Intn(256)))
+		}
+	default:
+		data = encodeVarintPopulateLocalJournal(data, uint64(key))
+		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
+	}
+	return data
+}
+func encodeVarintPopulateLocalJournal(data []byte, v uint64) []byte {
+	for v >= 1<<7 {
+		data = append(data, uint8(uint64(v)&0x7f|0x80))
+		v >>= 7
+	}
+	data = append(data, uint8(v))
+	return data
+}
+func (m *JournalEntry) Marshal() (data []byte, err error) {
+	size := m.Size()
+	data = make([]byte, size)
+	n, err := m.MarshalTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+func (m *JournalEntry) MarshalTo(data []byte) (n int, err error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	data[i] = 0xa
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(len(m.Name)))
+	i += copy(data[i:], m.Name)
+	data[i] = 0x12
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(len(m.Retired)))
+	i += copy(data[i:], m.Retired)
+	if m.Payload != nil {
+		data[i] = 0x1a
+		i++
+		i = encodeVarintLocalJournal(data, i, uint64(len(m.Payload)))
+		i += copy(data[i:], m.Payload)
+	}
+	if m.Envelope != nil {
+		data[i] = 0x22
+		i++
+		i = encodeVarintLocalJournal(data, i, uint64(len(m.Envelope)))
+		i += copy(data[i:], m.Envelope)
+	}
+	if m.Ratchet != nil {
+		data[i] = 0x2a
+		i++
+		i = encodeVarintLocalJournal(data, i, uint64(len(m.Ratchet)))
+		i += copy(data[i:], m.Ratchet)
+	}
+	if m.MessageHash != nil {
+		data[i] = 0x32
+		i++
+		i = encodeVarintLocalJournal(data, i, uint64(len(m.MessageHash)))
+		i += copy(data[i:], m.MessageHash)
+	}
+	if m.Prekey != nil {
+		data[i] = 0x3a
+		i++
+		i = encodeVarintLocalJournal(data, i, uint64(len(m.Prekey)))
+		i += copy(data[i:], m.Prekey)
+	}
+	data[i] = 0x40
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Created))
+	data[i] = 0x48
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Attempts))
+	data[i] = 0x50
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.NextAttempt))
+	data[i] = 0x5a
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(len(m.Message)))
+	i += copy(data[i:], m.Message)
+	data[i] = 0x60
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Chunk))
+	data[i] = 0x68
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Chunks))
+	data[i] = 0x70
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Clock))
+	data[i] = 0x78
+	i++
+	i = encodeVarintLocalJournal(data, i, uint64(m.Sequence))
+	if m.XXX_unrecognized != nil {
+		i += copy(data[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func encodeFixed64LocalJournal(data []byte, offset int, v uint64) int {
+	data[offset] = uint8(v)
+	data[offset+1] = uint8(v >> 8)
+	data[offset+2] = uint8(v >> 16)
+	data[offset+3] = uint8(v >> 24)
+	data[offset+4] = uint8(v >> 32)
+	data[offset+5] = uint8(v >> 40)
+	data[offset+6] = uint8(v >> 48)
+	data[offset+7] = uint8(v >> 56)
+	return offset + 8
+}
+func encodeFixed32LocalJournal(data []byte, offset int, v uint32) int {
+	data[offset] = uint8(v)
+	data[offset+1] = uint8(v >> 8)
+	data[offset+2] = uint8(v >> 16)
+	data[offset+3] = uint8(v >> 24)
+	return offset + 4
+}
+func encodeVarintLocalJournal(data []byte, offset int, v uint64) int {
+	for v >= 1<<7 {
+		data[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	data[offset] = uint8(v)
+	return offset + 1
+}
+func (this *JournalEntry) Equal(that interface{}) bool {
+	if that == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	}
+
+	that1, ok := that.(*JournalEntry)
+	if !ok {
+		return false
+	}
+	if that1 == nil {
+		if this == nil {
+			return true
+		}
+		return false
+	} else if this == nil {
+		return false
+	}
+	if this.Name != that1.Name {
+		return false
+	}
+	if this.Retired != that1.Retired {
+		return false
+	}
+	if !bytes.Equal(this.Payload, that1.Payload) {
+		return false
+	}
+	if !bytes.Equal(this.Envelope, that1.Envelope) {
+		return false
+	}
+	if !bytes.Equal(this.Ratchet, that1.Ratchet) {
+		return false
+	}
+	if !bytes.Equal(this.MessageHash, that1.MessageHash) {
+		return false
+	}
+	if !bytes.Equal(this.Prekey, that1.Prekey) {
+		return false
+	}
+	if this.Created != that1.Created {
+		return false
+	}
+	if this.Attempts != that1.Attempts {
+		return false
+	}
+	if this.NextAttempt != that1.NextAttempt {
+		return false
+	}
+	if this.Message != that1.Message {
+		return false
+	}
+	if this.Chunk != that1.Chunk {
+		return false
+	}
+	if this.Chunks != that1.Chunks {
+		return false
+	}
+	if this.Clock != that1.Clock {
+		return false
+	}
+	if this.Sequence != that1.Sequence {
+		return false
+	}
+	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
+		return false
+	}
+	return true
+}
@@ -22,6 +22,7 @@ var _ = math.Inf
 type Prekeys struct {
 	PrekeySecrets    []Byte32 `protobuf:"bytes,1,rep,customtype=Byte32" json:"PrekeySecrets"`
 	PrekeyPublics    []Byte32 `protobuf:"bytes,2,rep,customtype=Byte32" json:"PrekeyPublics"`
+	PrekeyExpiries   []int64  `protobuf:"varint,3,rep" json:"PrekeyExpiries"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -96,6 +97,23 @@ func (m *Prekeys) Unmarshal(data []byte) error {
 			m.PrekeyPublics = append(m.PrekeyPublics, Byte32{})
 			m.PrekeyPublics[len(m.PrekeyPublics)-1].Unmarshal(data[index:postIndex])
 			index = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PrekeyExpiries", wireType)
+			}
+			var v int64
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				v |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.PrekeyExpiries = append(m.PrekeyExpiries, v)
 		default:
 			var sizeOfWire int
 			for {
@@ -134,6 +152,11 @@ func (m *Prekeys) Size() (n int) {
 			n += 1 + l + sovPrekeys(uint64(l))
 		}
 	}
+	if len(m.PrekeyExpiries) > 0 {
+		for _, e := range m.PrekeyExpiries {
+			n += 1 + sovPrekeys(uint64(e))
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -171,8 +194,18 @@ func NewPopulatedPrekeys(r randyPrekeys, easy bool) *Prekeys {
 			this.PrekeyPublics[i] = *v4
 		}
 	}
+	if r.Intn(10) != 0 {
+		v5 := r.Intn(100)
+		this.PrekeyExpiries = make([]int64, v5)
+		for i := 0; i < v5; i++ {
+			this.PrekeyExpiries[i] = r.Int63()
+			if r.Intn(2) == 0 {
+				this.PrekeyExpiries[i] *= -1
+			}
+		}
+	}
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedPrekeys(r, 3)
+		this.XXX_unrecognized = randUnrecognizedPrekeys(r, 4)
 	}
 	return this
 }
@@ -190,9 +223,9 @@ func randUTF8RunePrekeys(r randyPrekeys) rune {
 	return rune(r.Intn(126-43) + 43)
 }
 func randStringPrekeys(r randyPrekeys) string {
-	v5 := r.Intn(100)
-	tmps := make([]rune, v5)
-	for i := 0; i < v5; i++ {
+	v6 := r.Intn(100)
+	tmps := make([]rune, v6)
+	for i := 0; i < v6; i++ {
 		tmps[i] = randUTF8RunePrekeys(r)
 	}
 	return string(tmps)
@@ -214,11 +247,11 @@ func randFieldPrekeys(data []byte, r randyPrekeys, fieldNumber int, wire int) []
 	switch wire {
 	case 0:
 		data = encodeVarintPopulatePrekeys(data, uint64(key))
-		v6 := r.Int63()
+		v7 := r.Int63()
 		if r.Intn(2) == 0 {
-			v6 *= -1
+			v7 *= -1
 		}
-		data = encodeVarintPopulatePrekeys(data, uint64(v6))
+		data = encodeVarintPopulatePrekeys(data, uint64(v7))
 	case 1:
 		data = encodeVarintPopulatePrekeys(data, uint64(key))
 		data = append(data, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256)))
@@ -282,6 +315,13 @@ func (m *Prekeys) MarshalTo(data []byte) (n int, err error) {
 			i += n
 		}
 	}
+	if len(m.PrekeyExpiries) > 0 {
+		for _, num := range m.PrekeyExpiries {
+			data[i] = 0x18
+			i++
+			i = encodeVarintPrekeys(data, i, uint64(num))
+		}
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -351,6 +391,14 @@ func (this *Prekeys) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if len(this.PrekeyExpiries) != len(that1.PrekeyExpiries) {
+		return false
+	}
+	for i := range this.PrekeyExpiries {
+		if this.PrekeyExpiries[i] != that1.PrekeyExpiries[i] {
+			return false
+		}
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -1,8 +1,27 @@
 package proto
 
+import (
+	"encoding/binary"
+	"time"
+)
+
 const MAX_MESSAGE_SIZE = 16 * 1024
 const SERVER_MESSAGE_SIZE = MAX_MESSAGE_SIZE + 100
 
+// A signed prekey is the 32-byte public key, the Unix time in seconds after
+// which it must not be used (8 bytes, big endian) and an ed25519 signature of
+// both by the key signing key of its owner.
+const SIGNED_PREKEY_SIZE = 32 + 8 + 64
+
+// SignedPrekeyExpiry returns the expiry time in signedKey. Keys that are not
+// in the format described above do not have one.
+func SignedPrekeyExpiry(signedKey []byte) (expiry time.Time, ok bool) {
+	if len(signedKey) != SIGNED_PREKEY_SIZE {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(signedKey[32:40])), 0), true
+}
+
 func ToProtoByte32List(list [][32]byte) []Byte32 {
 	newList := make([]Byte32, 0)
 	for _, element := range list {
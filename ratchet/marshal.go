@@ -1,6 +1,8 @@
 package ratchet
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/andres-erbsen/chatterbox/proto"
@@ -8,6 +10,18 @@ import (
 	protobuf "github.com/gogo/protobuf/proto"
 )
 
+// StateVersion is the version of the format that ratchets are marshaled in.
+// When the format changes, increment it and append a migration from the
+// previous version to migrations.
+const StateVersion = 1
+
+// migrations[v] converts a state of version v to version v+1
+var migrations = []func(*RatchetState) error{
+	// States from before versioning have the same fields, but the handshake
+	// key is not known. It is left unset.
+	func(*RatchetState) error { return nil },
+}
+
 func (r *Ratchet) Proto() protobuf.Message              { return NewRatchetStateFromFace(r) }
 func (r *Ratchet) GetRootKey() *proto.Byte32            { return (*proto.Byte32)(&r.rootKey) }
 func (r *Ratchet) GetOurRatchetPrivate() *proto.Byte32  { return (*proto.Byte32)(&r.ourRatchetPrivate) }
@@ -25,6 +39,16 @@ func (r *Ratchet) GetRecvChainKey() *proto.Byte32       { return (*proto.Byte32)
 func (r *Ratchet) GetSendCount() uint32                 { return r.sendCount }
 func (r *Ratchet) GetRecvCount() uint32                 { return r.recvCount }
 func (r *Ratchet) GetPrevSendCount() uint32             { return r.prevSendCount }
+func (r *Ratchet) GetVersion() uint32                   { return StateVersion }
+
+// GetHandshakeKey returns nil if the handshake key is not known, as is the case
+// for ratchets stored by older versions
+func (r *Ratchet) GetHandshakeKey() *proto.Byte32 {
+	if isZeroKey(&r.handshakeKey) {
+		return nil
+	}
+	return (*proto.Byte32)(&r.handshakeKey)
+}
 
 func newByte32(bs *[32]byte) *proto.Byte32 {
 	ret := new(proto.Byte32)
@@ -56,9 +80,51 @@ func (r *Ratchet) MarshalTo(out []byte) (int, error) { return NewRatchetStateFro
 
 func (r *Ratchet) Unmarshal(data []byte) error {
 	rs := new(RatchetState)
-	err := rs.Unmarshal(data)
+	if err := rs.Unmarshal(data); err != nil {
+		return err
+	}
+	if err := migrate(rs); err != nil {
+		return err
+	}
+	if err := checkComplete(rs); err != nil {
+		return err
+	}
 	r.FillFromFace(rs)
-	return err
+	return nil
+}
+
+// migrate upgrades rs to StateVersion
+func migrate(rs *RatchetState) error {
+	if rs.Version > StateVersion {
+		return fmt.Errorf("ratchet: state version %d is newer than the supported version %d", rs.Version, StateVersion)
+	}
+	for rs.Version < StateVersion {
+		if err := migrations[rs.Version](rs); err != nil {
+			return fmt.Errorf("ratchet: migrating state from version %d: %s", rs.Version, err)
+		}
+		rs.Version++
+	}
+	return nil
+}
+
+// checkComplete returns an error if a key that FillFromFace needs is missing
+// from rs, which is the case for truncated or otherwise corrupt states
+func checkComplete(rs *RatchetState) error {
+	keys := []*proto.Byte32{rs.RootKey, rs.OurRatchetPrivate, rs.TheirRatchetPublic,
+		rs.SendHeaderKey, rs.RecvHeaderKey, rs.NextSendHeaderKey, rs.NextRecvHeaderKey,
+		rs.SendChainKey, rs.RecvChainKey, rs.PrevAuthPrivate, rs.OurAuthPrivate, rs.TheirAuthPublic}
+	for _, saved := range rs.SavedKeys {
+		keys = append(keys, saved.HeaderKey)
+		for _, messageKey := range saved.MessageKeys {
+			keys = append(keys, messageKey.Key, messageKey.AuthPrivate)
+		}
+	}
+	for _, key := range keys {
+		if key == nil {
+			return errors.New("ratchet: state is missing a required field")
+		}
+	}
+	return nil
 }
 
 func (r *Ratchet) FillFromFace(that RatchetStateFace) *Ratchet {
@@ -78,6 +144,10 @@ func (r *Ratchet) FillFromFace(that RatchetStateFace) *Ratchet {
 	r.ourAuthPrivate = *that.GetOurAuthPrivate()
 	r.prevAuthPrivate = *that.GetPrevAuthPrivate()
 	r.theirAuthPublic = *that.GetTheirAuthPublic()
+	r.handshakeKey = [32]byte{}
+	if handshakeKey := that.GetHandshakeKey(); handshakeKey != nil {
+		r.handshakeKey = *handshakeKey
+	}
 	r.saved = make(map[[32]byte]map[uint32]savedKey)
 	for _, saved := range that.GetSavedKeys() {
 		messageKeys := make(map[uint32]savedKey)
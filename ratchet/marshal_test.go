@@ -34,3 +34,45 @@ func TestRatchetFaceRoundTrip(t *testing.T) {
 		t.Fatalf("%#v !Face Equal %#v", msg, msgRoundTrip)
 	}
 }
+
+func TestMigrations(t *testing.T) {
+	if len(migrations) != StateVersion {
+		t.Fatalf("%d migrations for state version %d", len(migrations), StateVersion)
+	}
+	a, _ := pairedRatchet()
+	rs := proto.NewRatchetStateFromFace(a)
+	rs.Version = 0
+	rs.HandshakeKey = nil
+	bs, err := rs.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := new(Ratchet)
+	if err := migrated.Unmarshal(bs); err != nil {
+		t.Fatal(err)
+	}
+	if migrated.rootKey != a.rootKey || migrated.GetHandshakeKey() != nil {
+		t.Error("unversioned state was not read correctly")
+	}
+
+	rs.Version = StateVersion + 1
+	if bs, err = rs.Marshal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(Ratchet).Unmarshal(bs); err == nil {
+		t.Error("state from a newer version was accepted")
+	}
+}
+
+func TestUnmarshalCorrupt(t *testing.T) {
+	a, _ := pairedRatchet()
+	bs, err := a.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, corrupt := range [][]byte{nil, bs[:len(bs)/2], bs[len(bs)/2:]} {
+		if err := new(Ratchet).Unmarshal(corrupt); err == nil {
+			t.Errorf("corrupt state %x was accepted", corrupt)
+		}
+	}
+}
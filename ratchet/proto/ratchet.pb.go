@@ -58,10 +58,13 @@ type RatchetState struct {
 	// they are kept around longer. Public-key authenticators between the
 	// sender's long-term key and the receiver's current auth key can be used
 	// to authenticate messages.
-	PrevAuthPrivate  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,14,req,name=prev_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"prev_auth_private,omitempty"`
-	OurAuthPrivate   *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,15,req,name=our_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"our_auth_private,omitempty"`
-	TheirAuthPublic  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,16,req,name=their_auth_public,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"their_auth_public,omitempty"`
-	SavedKeys        []RatchetState_SavedKeys                          `protobuf:"bytes,17,rep,name=saved_keys" json:"saved_keys"`
+	PrevAuthPrivate *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,14,req,name=prev_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"prev_auth_private,omitempty"`
+	OurAuthPrivate  *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,15,req,name=our_auth_private,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"our_auth_private,omitempty"`
+	TheirAuthPublic *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,16,req,name=their_auth_public,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"their_auth_public,omitempty"`
+	SavedKeys       []RatchetState_SavedKeys                          `protobuf:"bytes,17,rep,name=saved_keys" json:"saved_keys"`
+	// Public key of the prekey that the session was established with
+	HandshakeKey     *github_com_andres_erbsen_chatterbox_proto.Byte32 `protobuf:"bytes,18,opt,name=handshake_key,customtype=github.com/andres-erbsen/chatterbox/proto.Byte32" json:"handshake_key,omitempty"`
+	Version          uint32                                            `protobuf:"varint,19,opt,name=version" json:"version"`
 	XXX_unrecognized []byte                                            `json:"-"`
 }
 
@@ -497,6 +500,46 @@ func (m *RatchetState) Unmarshal(data []byte) error {
 			m.SavedKeys = append(m.SavedKeys, RatchetState_SavedKeys{})
 			m.SavedKeys[len(m.SavedKeys)-1].Unmarshal(data[index:postIndex])
 			index = postIndex
+		case 18:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field HandshakeKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			postIndex := index + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.HandshakeKey = &github_com_andres_erbsen_chatterbox_proto.Byte32{}
+			if err := m.HandshakeKey.Unmarshal(data[index:postIndex]); err != nil {
+				return err
+			}
+			index = postIndex
+		case 19:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			for shift := uint(0); ; shift += 7 {
+				if index >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[index]
+				index++
+				m.Version |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			var sizeOfWire int
 			for {
@@ -793,6 +836,11 @@ func (m *RatchetState) Size() (n int) {
 			n += 2 + l + sovRatchet(uint64(l))
 		}
 	}
+	if m.HandshakeKey != nil {
+		l = m.HandshakeKey.Size()
+		n += 2 + l + sovRatchet(uint64(l))
+	}
+	n += 2 + sovRatchet(uint64(m.Version))
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -876,8 +924,12 @@ func NewPopulatedRatchetState(r randyRatchet, easy bool) *RatchetState {
 			this.SavedKeys[i] = *v2
 		}
 	}
+	if r.Intn(10) != 0 {
+		this.HandshakeKey = github_com_andres_erbsen_chatterbox_proto.NewPopulatedByte32(r)
+	}
+	this.Version = r.Uint32()
 	if !easy && r.Intn(10) != 0 {
-		this.XXX_unrecognized = randUnrecognizedRatchet(r, 18)
+		this.XXX_unrecognized = randUnrecognizedRatchet(r, 20)
 	}
 	return this
 }
@@ -1148,6 +1200,23 @@ func (m *RatchetState) MarshalTo(data []byte) (n int, err error) {
 			i += n
 		}
 	}
+	if m.HandshakeKey != nil {
+		data[i] = 0x92
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintRatchet(data, i, uint64(m.HandshakeKey.Size()))
+		n13, err := m.HandshakeKey.MarshalTo(data[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n13
+	}
+	data[i] = 0x98
+	i++
+	data[i] = 0x1
+	i++
+	i = encodeVarintRatchet(data, i, uint64(m.Version))
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
 	}
@@ -1173,11 +1242,11 @@ func (m *RatchetState_SavedKeys) MarshalTo(data []byte) (n int, err error) {
 		data[i] = 0xa
 		i++
 		i = encodeVarintRatchet(data, i, uint64(m.HeaderKey.Size()))
-		n13, err := m.HeaderKey.MarshalTo(data[i:])
+		n14, err := m.HeaderKey.MarshalTo(data[i:])
 		if err != nil {
 			return 0, err
 		}
-		i += n13
+		i += n14
 	}
 	if len(m.MessageKeys) > 0 {
 		for _, msg := range m.MessageKeys {
@@ -1219,11 +1288,11 @@ func (m *RatchetState_SavedKeys_MessageKey) MarshalTo(data []byte) (n int, err e
 		data[i] = 0x12
 		i++
 		i = encodeVarintRatchet(data, i, uint64(m.Key.Size()))
-		n14, err := m.Key.MarshalTo(data[i:])
+		n15, err := m.Key.MarshalTo(data[i:])
 		if err != nil {
 			return 0, err
 		}
-		i += n14
+		i += n15
 	}
 	data[i] = 0x18
 	i++
@@ -1232,11 +1301,11 @@ func (m *RatchetState_SavedKeys_MessageKey) MarshalTo(data []byte) (n int, err e
 		data[i] = 0x22
 		i++
 		i = encodeVarintRatchet(data, i, uint64(m.AuthPrivate.Size()))
-		n15, err := m.AuthPrivate.MarshalTo(data[i:])
+		n16, err := m.AuthPrivate.MarshalTo(data[i:])
 		if err != nil {
 			return 0, err
 		}
-		i += n15
+		i += n16
 	}
 	if m.XXX_unrecognized != nil {
 		i += copy(data[i:], m.XXX_unrecognized)
@@ -1291,6 +1360,8 @@ type RatchetStateFace interface {
 	GetOurAuthPrivate() *github_com_andres_erbsen_chatterbox_proto.Byte32
 	GetTheirAuthPublic() *github_com_andres_erbsen_chatterbox_proto.Byte32
 	GetSavedKeys() []RatchetState_SavedKeys
+	GetHandshakeKey() *github_com_andres_erbsen_chatterbox_proto.Byte32
+	GetVersion() uint32
 }
 
 func (this *RatchetState) Proto() github_com_gogo_protobuf_proto.Message {
@@ -1369,6 +1440,14 @@ func (this *RatchetState) GetSavedKeys() []RatchetState_SavedKeys {
 	return this.SavedKeys
 }
 
+func (this *RatchetState) GetHandshakeKey() *github_com_andres_erbsen_chatterbox_proto.Byte32 {
+	return this.HandshakeKey
+}
+
+func (this *RatchetState) GetVersion() uint32 {
+	return this.Version
+}
+
 func NewRatchetStateFromFace(that RatchetStateFace) *RatchetState {
 	this := &RatchetState{}
 	this.RootKey = that.GetRootKey()
@@ -1388,6 +1467,8 @@ func NewRatchetStateFromFace(that RatchetStateFace) *RatchetState {
 	this.OurAuthPrivate = that.GetOurAuthPrivate()
 	this.TheirAuthPublic = that.GetTheirAuthPublic()
 	this.SavedKeys = that.GetSavedKeys()
+	this.HandshakeKey = that.GetHandshakeKey()
+	this.Version = that.GetVersion()
 	return this
 }
 
@@ -1585,6 +1666,16 @@ func (this *RatchetState) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if that1.HandshakeKey == nil {
+		if this.HandshakeKey != nil {
+			return false
+		}
+	} else if !this.HandshakeKey.Equal(*that1.HandshakeKey) {
+		return false
+	}
+	if this.Version != that1.Version {
+		return false
+	}
 	if !bytes.Equal(this.XXX_unrecognized, that1.XXX_unrecognized) {
 		return false
 	}
@@ -46,12 +46,23 @@ type Ratchet struct {
 
 	// ourAuthPrivate is updated together with ourRatchetPrivate, but not flushed
 	ourAuthPrivate, prevAuthPrivate, theirAuthPublic [32]byte
+	// handshakeKey is the public key of the prekey that the session was
+	// established with. Both parties agree on it, so applications can use it
+	// to choose between two sessions.
+	handshakeKey [32]byte
 
 	FillAuth  func(tag, data []byte, theirAuthPublic *[32]byte)
 	CheckAuth func(tag, data, msg []byte, ourAuthPrivate *[32]byte) error
 
 	Rand io.Reader
 	Now  func() time.Time
+
+	// MaxMissingMessages is the largest number of messages that may be lost
+	// or delayed in a row; zero means DefaultMaxMissingMessages.
+	MaxMissingMessages uint32
+	// SavedKeyLifetime is how long ExpireSavedKeys keeps the keys of messages
+	// that have not arrived yet; zero means DefaultSavedKeyLifetime.
+	SavedKeyLifetime time.Duration
 }
 
 // savedKey contains a message key and timestamp for a message which has not
@@ -115,9 +126,25 @@ const (
 	// nonceInHeaderOffset is the offset of the message nonce in the
 	// header's plaintext.
 	nonceInHeaderOffset = 4 + 4 + 32 + 32
-	// maxMissingMessages is the maximum number of missing messages that
-	// we'll keep track of.
-	maxMissingMessages = 8
+	// DefaultMaxMissingMessages is the maximum number of missing messages
+	// that we'll keep track of unless MaxMissingMessages is set.
+	DefaultMaxMissingMessages = 8
+	// DefaultSavedKeyLifetime is used unless SavedKeyLifetime is set.
+	DefaultSavedKeyLifetime = 7 * 24 * time.Hour
+)
+
+// ErrDuplicate is returned by Decrypt for messages that have already been
+// decrypted or whose keys have expired. It does not mean that anything is wrong
+// with the ratchet.
+var ErrDuplicate = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+
+// ErrCannotDecrypt, ErrCorrupt and ErrReorderingLimit are returned by Decrypt
+// for messages that do not fit the state of the ratchet: either the message
+// has been tampered with or the sender's ratchet is out of sync with ours.
+var (
+	ErrCannotDecrypt   = errors.New("ratchet: cannot decrypt")
+	ErrCorrupt         = errors.New("ratchet: corrupt message")
+	ErrReorderingLimit = errors.New("ratchet: message exceeds reordering limit")
 )
 
 func (r *Ratchet) EncryptFirst(out, msg []byte, theirRatchetPublic *[32]byte) []byte {
@@ -126,6 +153,7 @@ func (r *Ratchet) EncryptFirst(out, msg []byte, theirRatchetPublic *[32]byte) []
 	r.randBytes(r.ourRatchetPrivate[:])
 	copy(r.theirRatchetPublic[:], theirRatchetPublic[:])
 	copy(r.theirAuthPublic[:], theirRatchetPublic[:])
+	copy(r.handshakeKey[:], theirRatchetPublic[:])
 
 	var sharedKey [32]byte
 	curve25519.ScalarMult(&sharedKey, &r.ourRatchetPrivate, &r.theirRatchetPublic)
@@ -153,6 +181,7 @@ func (r *Ratchet) DecryptFirst(ciphertext []byte, ourRatchetPrivate *[32]byte) (
 	}
 	copy(r.ourRatchetPrivate[:], ourRatchetPrivate[:])
 	copy(r.ourAuthPrivate[:], ourRatchetPrivate[:])
+	curve25519.ScalarBaseMult(&r.handshakeKey, ourRatchetPrivate)
 
 	tag := ciphertext[:authSize]
 	var sharedKey [32]byte
@@ -257,7 +286,7 @@ func (r *Ratchet) trySavedKeysAndCheckAuth(authTag, authBody, ciphertext []byte)
 		copy(nonce[:], header[nonceInHeaderOffset:])
 		msg, ok := secretbox.Open(nil, sealedMessage, &nonce, &msgKey.key)
 		if !ok {
-			return nil, errors.New("ratchet: corrupt message")
+			return nil, ErrCorrupt
 		}
 		if err := r.CheckAuth(authTag, authBody, msg, &msgKey.authPriv); err != nil {
 			return nil, err
@@ -283,13 +312,17 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *[32]byte, messageNum, receiv
 		// This is a message from the past, but we didn't have a saved
 		// key for it, which means that it's a duplicate message or we
 		// expired the save key.
-		err = errors.New("ratchet: duplicate message or message delayed longer than tolerance")
+		err = ErrDuplicate
 		return
 	}
 
 	missingMessages := messageNum - receivedCount
+	maxMissingMessages := r.MaxMissingMessages
+	if maxMissingMessages == 0 {
+		maxMissingMessages = DefaultMaxMissingMessages
+	}
 	if missingMessages > maxMissingMessages {
-		err = errors.New("ratchet: message exceeds reordering limit")
+		err = ErrReorderingLimit
 		return
 	}
 
@@ -298,11 +331,7 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *[32]byte, messageNum, receiv
 	var now time.Time
 	if missingMessages > 0 {
 		messageKeys = make(map[uint32]savedKey)
-		if r.Now == nil {
-			now = time.Now()
-		} else {
-			now = r.Now()
-		}
+		now = r.now()
 	}
 
 	copy(provisionalChainKey[:], recvChainKey[:])
@@ -377,7 +406,7 @@ func (r *Ratchet) decryptAndCheckAuth(authTag, authBody, ciphertext []byte) ([]b
 		copy(nonce[:], header[nonceInHeaderOffset:])
 		msg, ok := secretbox.Open(nil, sealedMessage, &nonce, &messageKey)
 		if !ok {
-			return nil, errors.New("ratchet: corrupt message")
+			return nil, ErrCorrupt
 		}
 		if err := r.CheckAuth(authTag, authBody, msg, &r.prevAuthPrivate); err != nil {
 			return nil, err
@@ -391,7 +420,7 @@ func (r *Ratchet) decryptAndCheckAuth(authTag, authBody, ciphertext []byte) ([]b
 
 	header, ok = secretbox.Open(nil, sealedHeader, &nonce, &r.nextRecvHeaderKey)
 	if !ok {
-		return nil, errors.New("ratchet: cannot decrypt")
+		return nil, ErrCannotDecrypt
 	}
 	if len(header) != headerSize {
 		return nil, errors.New("ratchet: incorrect header size")
@@ -435,7 +464,7 @@ func (r *Ratchet) decryptAndCheckAuth(authTag, authBody, ciphertext []byte) ([]b
 	copy(nonce[:], header[nonceInHeaderOffset:])
 	msg, ok = secretbox.Open(nil, sealedMessage, &nonce, &messageKey)
 	if !ok {
-		return nil, errors.New("ratchet: corrupt message")
+		return nil, ErrCorrupt
 	}
 	if err := r.CheckAuth(authTag, authBody, msg, &r.ourAuthPrivate); err != nil {
 		return nil, err
@@ -461,6 +490,44 @@ func (r *Ratchet) decryptAndCheckAuth(authTag, authBody, ciphertext []byte) ([]b
 	return msg, nil
 }
 
+// ReceiveHeaderKeys returns the header keys that messages to r may have been
+// sealed with: the current and the next receive header key, and the header
+// keys of messages that are still missing.
+func (r *Ratchet) ReceiveHeaderKeys() [][32]byte {
+	var keys [][32]byte
+	if !isZeroKey(&r.recvHeaderKey) {
+		keys = append(keys, r.recvHeaderKey)
+	}
+	if !isZeroKey(&r.nextRecvHeaderKey) {
+		keys = append(keys, r.nextRecvHeaderKey)
+	}
+	for headerKey := range r.saved {
+		if headerKey != r.recvHeaderKey && headerKey != r.nextRecvHeaderKey {
+			keys = append(keys, headerKey)
+		}
+	}
+	return keys
+}
+
+// HeaderKeyMatches returns true if the header of ciphertext, as output by
+// Encrypt, was sealed with headerKey. It does not check the message itself.
+func HeaderKeyMatches(ciphertext []byte, headerKey *[32]byte) bool {
+	if len(ciphertext) < authSize+sealedHeaderSize {
+		return false
+	}
+	sealedHeader := ciphertext[authSize:][:sealedHeaderSize]
+	var nonce [24]byte
+	copy(nonce[:], sealedHeader)
+	_, ok := secretbox.Open(nil, sealedHeader[len(nonce):], &nonce, headerKey)
+	return ok
+}
+
+// Received returns true if a message has been decrypted using r, which proves
+// that the other party has the session too.
+func (r *Ratchet) Received() bool {
+	return r.recvCount > 0
+}
+
 func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	if len(ciphertext) < authSize+sealedHeaderSize {
 		return nil, errors.New("ciphertext too short")
@@ -468,10 +535,30 @@ func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	return r.decryptAndCheckAuth(ciphertext[:authSize], ciphertext[authSize:], ciphertext[authSize:])
 }
 
-func (r *Ratchet) FlushSavedKeys(now time.Time, lifetime time.Duration) {
+func (r *Ratchet) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// ExpireSavedKeys deletes the keys for missing messages that have been
+// missing for longer than SavedKeyLifetime and returns how many there were.
+func (r *Ratchet) ExpireSavedKeys() int {
+	lifetime := r.SavedKeyLifetime
+	if lifetime == 0 {
+		lifetime = DefaultSavedKeyLifetime
+	}
+	return r.FlushSavedKeys(r.now(), lifetime)
+}
+
+// FlushSavedKeys deletes the keys for messages that have been missing for
+// longer than lifetime at time now and returns how many there were.
+func (r *Ratchet) FlushSavedKeys(now time.Time, lifetime time.Duration) (flushed int) {
 	for headerKey, messageKeys := range r.saved {
 		for messageNum, savedKey := range messageKeys {
 			if now.Sub(savedKey.timestamp) > lifetime {
+				flushed++
 				for i := range savedKey.key {
 					savedKey.key[i] = 0
 				}
@@ -485,4 +572,5 @@ func (r *Ratchet) FlushSavedKeys(now time.Time, lifetime time.Duration) {
 			delete(r.saved, headerKey) // safe: http://golang.org/doc/effective_go.html#for
 		}
 	}
+	return flushed
 }
@@ -6,6 +6,7 @@ package ratchet
 import (
 	"bytes"
 	"crypto/rand"
+	mathrand "math/rand"
 	"testing"
 	"time"
 
@@ -78,7 +79,8 @@ func reinitRatchet(t *testing.T, r *Ratchet) *Ratchet {
 	if err != nil {
 		t.Fatalf("Failed to marshal: %s", err)
 	}
-	newR := &Ratchet{Now: r.Now, Rand: r.Rand, FillAuth: r.FillAuth, CheckAuth: r.CheckAuth}
+	newR := &Ratchet{Now: r.Now, Rand: r.Rand, FillAuth: r.FillAuth, CheckAuth: r.CheckAuth,
+		MaxMissingMessages: r.MaxMissingMessages, SavedKeyLifetime: r.SavedKeyLifetime}
 	if err := newR.Unmarshal(data); err != nil {
 		t.Fatalf("Failed to unmarshal: %s", err)
 	}
@@ -227,3 +229,152 @@ func TestOverhead(t *testing.T) {
 		t.Errorf("expected subsequent message overhead %d, got %d", Overhead, len(encrypted))
 	}
 }
+
+func TestLargeReorder(t *testing.T) {
+	a, b := pairedRatchet()
+	b.MaxMissingMessages = 300
+	var msgs, encrypted [][]byte
+	for i := 0; i < 250; i++ {
+		msg := []byte{byte(i), byte(i >> 8)}
+		msgs = append(msgs, msg)
+		encrypted = append(encrypted, a.Encrypt(nil, msg))
+	}
+	for i, j := range mathrand.New(mathrand.NewSource(1)).Perm(len(msgs)) {
+		result, err := b.Decrypt(encrypted[j])
+		if err != nil {
+			t.Fatalf("#%d: message %d: %s", i, j, err)
+		}
+		if !bytes.Equal(result, msgs[j]) {
+			t.Fatalf("#%d: bad message: got %x, not %x", i, result, msgs[j])
+		}
+		if i%50 == 0 {
+			b = reinitRatchet(t, b)
+		}
+	}
+}
+
+func TestReorderLimit(t *testing.T) {
+	for _, limit := range []uint32{0, 20} {
+		a, b := pairedRatchet()
+		b.MaxMissingMessages = limit
+		if limit == 0 {
+			limit = DefaultMaxMissingMessages
+		}
+		for i := uint32(0); i < limit+1; i++ {
+			a.Encrypt(nil, nil)
+		}
+		if _, err := b.Decrypt(a.Encrypt(nil, nil)); err == nil {
+			t.Errorf("limit %d: message after %d missing ones was accepted", limit, limit+1)
+		}
+
+		a, b = pairedRatchet()
+		b.MaxMissingMessages = limit
+		for i := uint32(0); i < limit; i++ {
+			a.Encrypt(nil, nil)
+		}
+		if _, err := b.Decrypt(a.Encrypt(nil, nil)); err != nil {
+			t.Errorf("limit %d: %s", limit, err)
+		}
+	}
+}
+
+func TestExpireSavedKeys(t *testing.T) {
+	a, b := pairedRatchet()
+	now := time.Unix(1e9, 0)
+	b.Now = func() time.Time { return now }
+	b.SavedKeyLifetime = time.Hour
+
+	delayed := a.Encrypt(nil, []byte("delayed"))
+	if _, err := b.Decrypt(a.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.ExpireSavedKeys(); n != 0 {
+		t.Errorf("expired %d keys before their lifetime was over", n)
+	}
+	now = now.Add(2 * time.Hour)
+	if n := b.ExpireSavedKeys(); n != 1 {
+		t.Errorf("expired %d keys, expected 1", n)
+	}
+	if _, err := b.Decrypt(delayed); err == nil {
+		t.Error("message was decrypted after its key expired")
+	}
+}
+
+func TestReceiveHeaderKeys(t *testing.T) {
+	a, b := pairedRatchet()
+	matches := func(r *Ratchet, msg []byte) bool {
+		for _, key := range r.ReceiveHeaderKeys() {
+			if HeaderKeyMatches(msg, &key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	delayed := a.Encrypt(nil, nil)
+	msg := a.Encrypt(nil, nil)
+	if !matches(b, msg) || !matches(b, delayed) {
+		t.Fatal("header key of message from a not returned by b")
+	}
+	if matches(a, msg) {
+		t.Error("a recognizes its own message")
+	}
+	if _, err := b.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Decrypt(b.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	next := a.Encrypt(nil, nil)
+	if !matches(b, next) {
+		t.Error("header key of message after a ratchet step not returned")
+	}
+	if _, err := b.Decrypt(next); err != nil {
+		t.Fatal(err)
+	}
+	if !matches(b, delayed) {
+		t.Error("header key of delayed message not returned")
+	}
+	b.FlushSavedKeys(nowFunc().Add(time.Hour), time.Minute)
+	if matches(b, delayed) {
+		t.Error("header key of flushed message returned")
+	}
+}
+
+func TestHandshakeKey(t *testing.T) {
+	a, b := pairedRatchet()
+	if a.GetHandshakeKey() == nil || *a.GetHandshakeKey() != *b.GetHandshakeKey() {
+		t.Fatalf("handshake keys %v and %v differ", a.GetHandshakeKey(), b.GetHandshakeKey())
+	}
+	if !a.Received() || b.Received() {
+		t.Errorf("a received: %v, b received: %v", a.Received(), b.Received())
+	}
+	if _, err := b.Decrypt(a.Encrypt(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Received() {
+		t.Error("b has not received")
+	}
+	bs, err := b.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2 := new(Ratchet)
+	if err := b2.Unmarshal(bs); err != nil {
+		t.Fatal(err)
+	}
+	if *b2.GetHandshakeKey() != *b.GetHandshakeKey() || !b2.Received() {
+		t.Error("handshake state lost in serialization")
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	a, b := pairedRatchet()
+	msg := a.Encrypt(nil, nil)
+	if _, err := b.Decrypt(msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Decrypt(msg); err != ErrDuplicate {
+		t.Errorf("decrypting a message twice gave %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"net"
 	"sync"
+	"time"
 )
 
 var wO_sync = &opt.WriteOptions{Sync: true}
@@ -152,7 +153,12 @@ func (server *Server) handleClient(connection net.Conn) error {
 		case err := <-disconnected:
 			return err
 		case cmd := <-commands:
-			if cmd.CreateAccount != nil && *cmd.CreateAccount {
+			if cmd.Cover != nil && *cmd.Cover {
+				// cover traffic: a frame that went unanswered would tell an
+				// observer that it was a dummy, so it gets a reply padded to
+				// the same size as every other
+				response.Cover = protobuf.Bool(true)
+			} else if cmd.CreateAccount != nil && *cmd.CreateAccount {
 				err = server.newUser(uid)
 			} else if cmd.DeliverEnvelope != nil {
 				err = server.newMessage((*[32]byte)(cmd.DeliverEnvelope.User),
@@ -214,10 +220,21 @@ func (server *Server) handleClient(connection net.Conn) error {
 }
 
 func (server *Server) getNumKeys(user *[32]byte) (*int64, error) { //TODO: Batch read of some kind?
+	batch := new(leveldb.Batch)
+	numRecords, err := server.purgeExpiredKeys(user, time.Now(), batch)
+	if err != nil {
+		return nil, err
+	}
+	return &numRecords, server.database.Write(batch, wO_sync)
+}
+
+// purgeExpiredKeys adds the deletion of the keys of user that have expired at
+// now to batch and returns the number of keys that have not
+func (server *Server) purgeExpiredKeys(user *[32]byte, now time.Time, batch *leveldb.Batch) (int64, error) {
 	prefix := append([]byte{'k'}, (*user)[:]...)
 	snapshot, err := server.database.GetSnapshot()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer snapshot.Release()
 	keyRange := util.BytesPrefix(prefix)
@@ -225,9 +242,21 @@ func (server *Server) getNumKeys(user *[32]byte) (*int64, error) { //TODO: Batch
 	defer iter.Release()
 	var numRecords int64
 	for iter.Next() {
-		numRecords = numRecords + 1
+		if expired(iter.Value(), now) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		} else {
+			numRecords = numRecords + 1
+		}
 	}
-	return &numRecords, iter.Error()
+	return numRecords, iter.Error()
+}
+
+// expired returns true for signed prekeys that must no longer be handed out.
+// Keys that are not signed prekeys, like the ones old clients uploaded, never
+// expire on their own and are treated as expired.
+func expired(signedKey []byte, now time.Time) bool {
+	expiry, ok := proto.SignedPrekeyExpiry(signedKey)
+	return !ok || !now.Before(expiry)
 }
 
 func (server *Server) deleteKey(uid *[32]byte, key []byte) error {
@@ -248,17 +277,29 @@ func (server *Server) getKey(user *[32]byte) ([]byte, error) {
 	keyRange := util.BytesPrefix(prefix)
 	iter := snapshot.NewIterator(keyRange, nil)
 	defer iter.Release()
-	if iter.First() == false {
-		return nil, errors.New("No keys left in database")
+	now := time.Now()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		server.deleteKey(user, iter.Value())
+		if !expired(iter.Value(), now) {
+			return append([]byte{}, iter.Value()...), iter.Error()
+		}
 	}
-	err = iter.Error()
-	server.deleteKey(user, iter.Value())
-	return append([]byte{}, iter.Value()...), err
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("No keys left in database")
 }
 
 func (server *Server) newKeys(uid *[32]byte, keyList [][]byte) error {
 	batch := new(leveldb.Batch)
+	now := time.Now()
+	if _, err := server.purgeExpiredKeys(uid, now, batch); err != nil {
+		return err
+	}
 	for _, key := range keyList {
+		if expired(key, now) {
+			continue
+		}
 		keyHash := sha256.Sum256(key)
 		dbKey := append(append([]byte{'k'}, uid[:]...), keyHash[:]...)
 		batch.Put(dbKey, key)
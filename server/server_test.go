@@ -5,6 +5,7 @@ import (
 	"code.google.com/p/go.crypto/nacl/box"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"github.com/andres-erbsen/chatterbox/proto"
 	"github.com/andres-erbsen/chatterbox/transport"
@@ -360,16 +361,10 @@ func TestGetNumberOfKeys(t *testing.T) {
 
 	createAccount(conn, inBuf, outBuf, t)
 
-	pk1, _, err := box.GenerateKey(rand.Reader)
-	handleError(err, t)
-
-	pk2, _, err := box.GenerateKey(rand.Reader)
-	handleError(err, t)
-
 	// NOTE: the keys are note signed here, but they will be in real use
 	keyList := make([][]byte, 0, 64) //TODO: Make this a reasonable size
-	keyList = append(keyList, pk1[:])
-	keyList = append(keyList, pk2[:])
+	keyList = append(keyList, signedKey(t, time.Now().Add(time.Hour)))
+	keyList = append(keyList, signedKey(t, time.Now().Add(time.Hour)))
 
 	uploadKeys(conn, inBuf, outBuf, t, keyList)
 	newKey1 := getKey(conn, inBuf, outBuf, t, pkp)
@@ -410,15 +405,9 @@ func TestKeyUploadDownload(t *testing.T) {
 
 	createAccount(conn, inBuf, outBuf, t)
 
-	pk1, _, err := box.GenerateKey(rand.Reader)
-	handleError(err, t)
-
-	pk2, _, err := box.GenerateKey(rand.Reader)
-	handleError(err, t)
-
 	keyList := make([][]byte, 0, 64) //TODO: Make this a reasonable size
-	keyList = append(keyList, pk1[:])
-	keyList = append(keyList, pk2[:])
+	keyList = append(keyList, signedKey(t, time.Now().Add(time.Hour)))
+	keyList = append(keyList, signedKey(t, time.Now().Add(time.Hour)))
 
 	uploadKeys(conn, inBuf, outBuf, t, keyList)
 	numKeys := getNumKeys(conn, inBuf, outBuf, t, pkp)
@@ -429,6 +418,56 @@ func TestKeyUploadDownload(t *testing.T) {
 	server.StopServer()
 }
 
+// signedKey returns a key in the signed prekey format that expires at expiry.
+// The server does not check the signature.
+func signedKey(t *testing.T, expiry time.Time) []byte {
+	key := make([]byte, proto.SIGNED_PREKEY_SIZE)
+	_, err := rand.Read(key)
+	handleError(err, t)
+	binary.BigEndian.PutUint64(key[32:40], uint64(expiry.Unix()))
+	return key
+}
+
+func TestExpiredKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testdb")
+	handleError(err, t)
+
+	defer os.RemoveAll(dir)
+	db, err := leveldb.OpenFile(dir, nil)
+	handleError(err, t)
+
+	defer db.Close()
+
+	server, conn, inBuf, outBuf, pkp := setUpServerTest(db, t)
+	defer conn.Close()
+
+	createAccount(conn, inBuf, outBuf, t)
+
+	fresh := signedKey(t, time.Now().Add(time.Hour))
+	uploadKeys(conn, inBuf, outBuf, t, [][]byte{fresh, signedKey(t, time.Now().Add(-time.Hour))})
+	if numKeys := getNumKeys(conn, inBuf, outBuf, t, pkp); numKeys != 1 {
+		t.Errorf("%d keys stored, expected the expired key to be rejected", numKeys)
+	}
+
+	// a key that expired after it was uploaded
+	handleError(server.newKeys(pkp, [][]byte{signedKey(t, time.Now().Add(time.Hour))}), t)
+	stale := signedKey(t, time.Now().Add(-time.Hour))
+	keyHash := sha256.Sum256(stale)
+	handleError(db.Put(append(append([]byte{'k'}, pkp[:]...), keyHash[:]...), stale, nil), t)
+	if numKeys := getNumKeys(conn, inBuf, outBuf, t, pkp); numKeys != 2 {
+		t.Errorf("%d keys counted, expected 2", numKeys)
+	}
+	for i := 0; i < 2; i++ {
+		if key := getKey(conn, inBuf, outBuf, t, pkp); bytes.Equal(key, stale) || key == nil {
+			t.Errorf("got key %x", key)
+		}
+	}
+	if numKeys := getNumKeys(conn, inBuf, outBuf, t, pkp); numKeys != 0 {
+		t.Errorf("%d keys left, expected 0", numKeys)
+	}
+	server.StopServer()
+}
+
 func enablePush(conn *transport.Conn, inBuf []byte, outBuf []byte, t *testing.T) {
 	true_ := true
 	command := &proto.ClientToServer{
@@ -496,3 +535,46 @@ func TestPushNotifications(t *testing.T) {
 
 	server.StopServer()
 }
+
+func TestCoverTrafficAnswered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testdb")
+	handleError(err, t)
+
+	defer os.RemoveAll(dir)
+	db, err := leveldb.OpenFile(dir, nil)
+	handleError(err, t)
+
+	defer db.Close()
+
+	server, conn, inBuf, outBuf, pkp := setUpServerTest(db, t)
+	defer conn.Close()
+
+	createAccount(conn, inBuf, outBuf, t)
+
+	cover := &proto.ClientToServer{
+		Cover: protobuf.Bool(true),
+	}
+	writeProtobuf(conn, outBuf, cover, t)
+	writeProtobuf(conn, outBuf, cover, t)
+
+	// every cover frame gets a reply that looks like any other
+	for i := 0; i < 2; i++ {
+		conn.SetDeadline(time.Now().Add(time.Second))
+		num, err := conn.ReadFrame(inBuf)
+		handleError(err, t)
+		if num != proto.SERVER_MESSAGE_SIZE {
+			t.Errorf("cover reply has %d bytes, expected %d", num, proto.SERVER_MESSAGE_SIZE)
+		}
+		response := new(proto.ServerToClient)
+		handleError(response.Unmarshal(proto.Unpad(inBuf[:num])), t)
+		if response.Cover == nil || !*response.Cover {
+			t.Errorf("expected a cover reply, got %v", response)
+		}
+	}
+
+	if numKeys := getNumKeys(conn, inBuf, outBuf, t, pkp); numKeys != 0 {
+		t.Errorf("expected 0 keys, got %d", numKeys)
+	}
+
+	server.StopServer()
+}
@@ -22,6 +22,7 @@ import (
 type Conn struct {
 	unencrypted           net.Conn
 	readNonce, writeNonce uint64
+	framesRead            uint64
 	key                   [32]byte
 	readBuf, writeBuf     []byte
 	maxFrameSize          int
@@ -173,9 +174,13 @@ func (c *Conn) ReadFrame(b []byte) (int, error) {
 	if &b[0] != &b2[0] {
 		panic("ReadFrame buffer space accounting failed")
 	}
+	c.framesRead++
 	return int(size - box.Overhead), nil
 }
 
+// FramesRead returns the number of frames that have been read successfully
+func (c *Conn) FramesRead() uint64 { return c.framesRead }
+
 func (c *Conn) Close() error {
 	for i := range c.key {
 		c.key[i] = 0